@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Acknowledgement states of reminders which require a reply
+const (
+	ACK_PENDING = "pending"
+	ACK_ACKED   = "acked"
+)
+
+const (
+	DEFAULT_NAG_MINUTES = 15
+	MAX_NAG_MINUTES     = 12 * 60
+	DEFAULT_MAX_NAGS    = 3
+	MAX_NAGS            = 10
+	DEFAULT_SNOOZE      = 10 * time.Minute
+	MAX_SNOOZE          = 24 * time.Hour
+)
+
+// Key of the sorted set of IDs of reminders sent to number which are
+// waiting for a reply, scored by when they were last sent
+func ackPendingKey(number string) string {
+	return "ack_pending:" + number
+}
+
+// Gets the stored fields for a message which must be acknowledged, from
+// "ack", "nag_minutes" and "max_nags". Writes an error and returns false if
+// they're invalid.
+func messageAck(w http.ResponseWriter, data map[string]string) ([]interface{}, bool) {
+	if data["ack"] != "true" {
+		return nil, true
+	}
+	if ch := data["channel"]; ch != "" && ch != CHANNEL_SMS && ch != CHANNEL_VOICE {
+		WriteJSONError(w, "Only SMS and voice reminders can require a reply.", http.StatusBadRequest)
+		return nil, false
+	}
+	nagMinutes, maxNags := DEFAULT_NAG_MINUTES, DEFAULT_MAX_NAGS
+	if s := data["nag_minutes"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MAX_NAG_MINUTES {
+			WriteJSONError(w, fmt.Sprintf("Nag interval must be between 1 and %d minutes.", MAX_NAG_MINUTES), http.StatusBadRequest)
+			return nil, false
+		}
+		nagMinutes = n
+	}
+	if s := data["max_nags"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > MAX_NAGS {
+			WriteJSONError(w, fmt.Sprintf("Reminders can be re-sent at most %d times.", MAX_NAGS), http.StatusBadRequest)
+			return nil, false
+		}
+		maxNags = n
+	}
+	return []interface{}{"ack", ACK_PENDING, "nag_minutes", nagMinutes, "max_nags", maxNags}, true
+}
+
+// Records that a reminder needing a reply was sent, and schedules it to be
+// sent again after its nag interval until it's been re-sent MaxNags times
+func awaitAck(ctx context.Context, c redis.Conn, msg *Message, now time.Time) error {
+	sends, err := redis.Int(c.Do("HINCRBY", msg.ID, "sends", 1))
+	if err != nil {
+		return err
+	}
+	next := now.Add(time.Duration(msg.NagMinutes) * time.Minute)
+	c.Send("MULTI")
+	c.Send("ZADD", ackPendingKey(msg.To), now.Unix(), msg.ID)
+	c.Send("EXPIRE", ackPendingKey(msg.To), int(MESSAGE_RETENTION.Seconds()))
+	c.Send("HDEL", msg.ID, "last_error")
+	c.Send("HMSET", msg.ID, "status", STATUS_SENT, "sent_at", now.Unix())
+	if sends == 1 && len(msg.Escalation) > 0 {
+		queueEscalationStart(c, msg, now)
+	}
+	if sends <= msg.MaxNags {
+		c.Send("ZADD", "messages", next.Unix(), msg.ID)
+		c.Send("HSET", msg.ID, "time", next.Unix())
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	if sends > msg.MaxNags {
+		// keep the content in case it's snoozed
+		finishMessage(ctx, c, msg, STATUS_SENT, now, true)
+	}
+	return nil
+}
+
+// Gets the reminder sent to number most recently which is waiting for a
+// reply, or nil if there isn't one
+func pendingAck(c redis.Conn, number string) (*Message, error) {
+	ids, err := redis.Strings(c.Do("ZRANGE", ackPendingKey(number), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		msg, err := getMessage(c, ids[i])
+		if err == nil && msg.Ack == ACK_PENDING {
+			return msg, nil
+		}
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		// expired or acknowledged
+		c.Do("ZREM", ackPendingKey(number), ids[i])
+	}
+	return nil, nil
+}
+
+// Acknowledges the latest reminder waiting for a reply from number, which
+// stops it being re-sent or escalated. number is its recipient or a contact
+// it was escalated to. Returns it, or nil if there wasn't one.
+func AcknowledgeReminder(ctx context.Context, number string, now time.Time) (*Message, error) {
+	c := GetConn()
+	defer c.Close()
+	msg, err := pendingAck(c, number)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	c.Send("MULTI")
+	c.Send("ZREM", ackPendingKey(number), msg.ID)
+	c.Send("HMSET", msg.ID, "ack", ACK_ACKED, "acked_at", now.Unix(), "acked_by", number)
+	if len(msg.Escalation) > 0 {
+		c.Send("ZREM", ESCALATIONS_KEY, msg.ID)
+		step := -1
+		for i, s := range msg.Escalation[:msg.EscalationStep] {
+			if s.Contact == number {
+				step = i
+			}
+		}
+		queueEscalationEvent(c, msg.ID, EscalationEvent{Step: step, Number: number, Action: ESCALATION_ACKED, At: now.Unix()})
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	// sent_at stays when it was last sent
+	finishMessage(ctx, c, msg, STATUS_SENT, time.Unix(msg.SentAt, 0), false)
+	LoggerFrom(ctx).Info("reminder acknowledged", Fields{"message_id": msg.ID})
+	return msg, nil
+}
+
+// Sends the latest reminder waiting for a reply from number again after d,
+// returns it or nil if there wasn't one
+func SnoozeReminder(ctx context.Context, number string, d time.Duration, now time.Time) (*Message, error) {
+	c := GetConn()
+	defer c.Close()
+	msg, err := pendingAck(c, number)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	until := now.Add(d).Unix()
+	c.Send("MULTI")
+	c.Send("ZADD", "messages", until, msg.ID)
+	c.Send("SADD", userMessagesKey(msg.To), msg.ID)
+	if msg.Owner != "" {
+		c.Send("SADD", ownerMessagesKey(msg.Owner), msg.ID)
+	}
+	// the message may have been finished after its last nag
+	c.Send("PERSIST", msg.ID)
+	c.Send("HMSET", msg.ID, "time", until, "snoozed_until", until)
+	if _, err := c.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	msg.SnoozedUntil = until
+	LoggerFrom(ctx).Info("reminder snoozed", Fields{"message_id": msg.ID, "until": until})
+	return msg, nil
+}
+
+// SMS replies to reminders: "OK" acknowledges, "SNOOZE <minutes>" snoozes
+func replyOK(ctx context.Context, from, args string) (string, error) {
+	msg, err := AcknowledgeReminder(ctx, from, CLOCK.Now())
+	if err != nil || msg == nil {
+		return "", err
+	}
+	return "Thanks, your reminder has been acknowledged.", nil
+}
+
+func replySnooze(ctx context.Context, from, args string) (string, error) {
+	d := DEFAULT_SNOOZE
+	if args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 || time.Duration(n)*time.Minute > MAX_SNOOZE {
+			return fmt.Sprintf("Reply SNOOZE and a number of minutes up to %d, e.g. SNOOZE 15.", int(MAX_SNOOZE.Minutes())), nil
+		}
+		d = time.Duration(n) * time.Minute
+	}
+	msg, err := SnoozeReminder(ctx, from, d, CLOCK.Now())
+	if err != nil || msg == nil {
+		return "", err
+	}
+	at := time.Unix(msg.SnoozedUntil, 0).In(UserLocation(from))
+	return fmt.Sprintf("OK, I'll remind you again at %s.", at.Format("3:04 PM")), nil
+}
+
+// Gets a message the user scheduled, including its delivery and
+// acknowledgement state and any escalation's audit trail, {"number",
+// "password", "id"}
+func messageStatus(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	msg, err := userMessage(data["number"], data["id"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No message with that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get message", Fields{"message_id": data["id"], "error": err})
+		WriteJSONError(w, ERR_S+"getting the message.", http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{"message": msg}
+	if len(msg.Escalation) > 0 {
+		events, err := GetEscalationLog(msg.ID)
+		if err != nil {
+			LoggerFrom(r.Context()).Error("could not get escalation log", Fields{"message_id": msg.ID, "error": err})
+			WriteJSONError(w, ERR_S+"getting the message.", http.StatusInternalServerError)
+			return
+		}
+		res["escalation_log"] = events
+	}
+	WriteJSON(w, res, http.StatusOK)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcknowledgeReminder(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	sent := func() int { return len(app.Twilio.Messages()) - 1 }
+
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	code, res := app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": "Take your pills", "ack": "true", "nag_minutes": "10", "max_nags": "2"})
+	if code != http.StatusOK {
+		t.Fatalf("schedule: got status %d, %v", code, res)
+	}
+	id := res["id"].(string)
+
+	if _, reply := app.ReceiveSMS(number, "OK"); reply != "" {
+		t.Errorf("acknowledged a reminder before it was sent: %q", reply)
+	}
+	app.Dispatch()
+	app.Advance(10 * time.Minute)
+	app.Dispatch()
+	if n := sent(); n != 2 {
+		t.Fatalf("expected the reminder to be re-sent once, sent %d", n)
+	}
+
+	_, reply := app.ReceiveSMS(number, "snooze 30")
+	if !strings.Contains(reply, "12:40 PM") {
+		t.Errorf("unexpected snooze reply %q", reply)
+	}
+	app.Advance(10 * time.Minute)
+	app.Dispatch()
+	if n := sent(); n != 2 {
+		t.Errorf("snoozed reminder re-sent after %d messages", n)
+	}
+	app.Advance(20 * time.Minute)
+	app.Dispatch()
+	if n := sent(); n != 3 {
+		t.Errorf("snoozed reminder not re-sent, sent %d", n)
+	}
+
+	if _, reply := app.ReceiveSMS(number, "ok"); !strings.Contains(reply, "acknowledged") {
+		t.Errorf("unexpected ack reply %q", reply)
+	}
+	app.Advance(time.Hour)
+	app.Dispatch()
+	if n := sent(); n != 3 {
+		t.Errorf("acknowledged reminder re-sent, sent %d", n)
+	}
+
+	_, res = app.PostJSON("/message_status", map[string]string{"number": number, "password": password, "id": id})
+	msg, _ := res["message"].(map[string]interface{})
+	if msg["ack"] != ACK_ACKED || msg["acked_at"] != float64(app.Clock.Now().Add(-time.Hour).Unix()) || msg["sends"] != float64(3) {
+		t.Errorf("unexpected acknowledgement state %v", msg)
+	}
+	if code, _ := app.PostJSON("/message_status", map[string]string{"number": number, "password": password, "id": "nope"}); code != http.StatusNotFound {
+		t.Errorf("status of unknown message: got status %d", code)
+	}
+}
+
+func TestReminderNagLimit(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	_, res := app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": "Take your pills", "ack": "true", "nag_minutes": "5", "max_nags": "1"})
+	for i := 0; i < 4; i++ {
+		app.Dispatch()
+		app.Advance(5 * time.Minute)
+	}
+	if n := len(app.Twilio.Messages()) - 1; n != 2 {
+		t.Errorf("expected the reminder and one nag, sent %d", n)
+	}
+	msg, err := GetMessage(res["id"].(string))
+	if err != nil || msg.Scheduled || msg.Ack != ACK_PENDING {
+		t.Fatalf("unexpected state after last nag: %+v, %v", msg, err)
+	}
+
+	// it can still be snoozed after nagging stops
+	app.ReceiveSMS(number, "SNOOZE 15")
+	app.Advance(15 * time.Minute)
+	app.Dispatch()
+	if n := len(app.Twilio.Messages()) - 1; n != 3 {
+		t.Errorf("snoozed reminder not re-sent, sent %d", n)
+	}
+
+	for _, bad := range []map[string]string{{"nag_minutes": "0"}, {"max_nags": "11"}, {"channel": "email"}} {
+		data := map[string]string{"to": number, "password": password, "time": at, "body": "x", "ack": "true"}
+		for k, v := range bad {
+			data[k] = v
+		}
+		if code, _ := app.PostJSON("/schedule", data); code != http.StatusBadRequest {
+			t.Errorf("%v: got status %d", bad, code)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/nu7hatch/gouuid"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// What an API key can be used for
+const (
+	SCOPE_MESSAGES_WRITE = "messages:write"
+	SCOPE_MESSAGES_READ  = "messages:read"
+)
+
+var API_SCOPES = []string{SCOPE_MESSAGES_WRITE, SCOPE_MESSAGES_READ}
+
+const (
+	MAX_API_KEYS     = 20
+	MAX_KEY_NAME_LEN = 50
+	// Start of every key, so leaked keys are easy to recognise
+	API_KEY_PREFIX = "trk_"
+
+	API_KEYS_ERR_S = ERR_S + "updating API keys."
+)
+
+var ErrTooManyAPIKeys = errors.New("too many API keys")
+
+// A key a user made for scripts to call the API as them with
+// `Authorization: Bearer <key>`, without their password. Only a hash of
+// the key is stored, it's shown once when made.
+type APIKey struct {
+	ID        string   `json:"id"`
+	Number    string   `json:"number"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt int64    `json:"created_at"`
+	LastUsed  int64    `json:"last_used,omitempty"`
+}
+
+// Hash of an API key's details, keyed by the SHA-256 of the key. Keys are
+// random, so a fast hash is enough.
+func apiKeyKey(hash string) string { return "api_key:" + hash }
+
+// Hash of the hashes of a user's API keys by ID
+func apiKeysKey(number string) string { return "api_keys:" + number }
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Parses a comma separated list of scopes, at least one
+func parseScopes(list string) ([]string, error) {
+	scopes := make([]string, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !stringIn(s, API_SCOPES) {
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+		if !stringIn(s, scopes) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("no scopes")
+	}
+	return scopes, nil
+}
+
+// Makes an API key for number, returning its details and the key itself
+func CreateAPIKey(number, name string, scopes []string) (*APIKey, string, error) {
+	c := GetConn()
+	defer c.Close()
+	n, err := redis.Int(c.Do("HLEN", apiKeysKey(number)))
+	if err != nil {
+		return nil, "", err
+	}
+	if n >= MAX_API_KEYS {
+		return nil, "", ErrTooManyAPIKeys
+	}
+
+	uid, _ := uuid.NewV4()
+	key := &APIKey{ID: uid.String(), Number: number, Name: name, Scopes: scopes, CreatedAt: CLOCK.Now().Unix()}
+	secret := API_KEY_PREFIX + randomHex(24)
+	hash := hashAPIKey(secret)
+	c.Send("MULTI")
+	c.Send("HMSET", apiKeyKey(hash), "id", key.ID, "number", number, "name", name, "scopes", strings.Join(scopes, ","), "created_at", key.CreatedAt)
+	c.Send("HSET", apiKeysKey(number), key.ID, hash)
+	_, err = c.Do("EXEC")
+	return key, secret, err
+}
+
+func getAPIKey(c redis.Conn, hash string) (*APIKey, error) {
+	values, err := redis.Strings(c.Do("HGETALL", apiKeyKey(hash)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrNotFound
+	}
+	key := &APIKey{}
+	for i := 0; i+1 < len(values); i += 2 {
+		v := values[i+1]
+		switch values[i] {
+		case "id":
+			key.ID = v
+		case "number":
+			key.Number = v
+		case "name":
+			key.Name = v
+		case "scopes":
+			key.Scopes = strings.Split(v, ",")
+		case "created_at":
+			key.CreatedAt, _ = strconv.ParseInt(v, 10, 64)
+		case "last_used":
+			key.LastUsed, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return key, nil
+}
+
+// List number's API keys, oldest first then by name
+func ListAPIKeys(number string) ([]*APIKey, error) {
+	c := GetConn()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("HGETALL", apiKeysKey(number)))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*APIKey, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		key, err := getAPIKey(c, values[i+1])
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt != keys[j].CreatedAt {
+			return keys[i].CreatedAt < keys[j].CreatedAt
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	return keys, nil
+}
+
+// Revokes one of number's API keys, or returns ErrNotFound
+func RevokeAPIKey(number, id string) error {
+	c := GetConn()
+	defer c.Close()
+	hash, err := redis.String(c.Do("HGET", apiKeysKey(number), id))
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	c.Send("MULTI")
+	c.Send("DEL", apiKeyKey(hash))
+	c.Send("HDEL", apiKeysKey(number), id)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Revokes all of number's API keys
+func revokeAPIKeys(c redis.Conn, number string) error {
+	values, err := redis.Strings(c.Do("HGETALL", apiKeysKey(number)))
+	if err != nil {
+		return err
+	}
+	c.Send("MULTI")
+	for i := 0; i+1 < len(values); i += 2 {
+		c.Send("DEL", apiKeyKey(values[i+1]))
+	}
+	c.Send("DEL", apiKeysKey(number))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+type apiKeyCtxKey struct{}
+
+// The API key a request was authenticated with, if any
+func APIKeyFrom(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(apiKeyCtxKey{}).(*APIKey)
+	return key, ok
+}
+
+// The key in a request's `Authorization: Bearer` header, or ""
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Lets requests to fn authenticate with an API key with scope instead of a
+// password. The key is checked here and its number by authenticate.
+func APIKeyMiddleware(scope string, fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := bearerToken(r)
+		if secret == "" {
+			fn(w, r)
+			return
+		}
+		c := GetConn()
+		defer c.Close()
+		hash := hashAPIKey(secret)
+		// so last_used isn't written to a key revoked after it's read here,
+		// which would leave a hash with nothing else in it
+		if _, err := c.Do("WATCH", apiKeyKey(hash)); err != nil {
+			LoggerFrom(r.Context()).Error("could not get API key", Fields{"error": err})
+			WriteJSONError(w, ERR_S+"checking the API key.", http.StatusInternalServerError)
+			return
+		}
+		key, err := getAPIKey(c, hash)
+		if err == ErrNotFound {
+			WriteJSONError(w, "API key is not valid.", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			LoggerFrom(r.Context()).Error("could not get API key", Fields{"error": err})
+			WriteJSONError(w, ERR_S+"checking the API key.", http.StatusInternalServerError)
+			return
+		}
+		if !stringIn(scope, key.Scopes) {
+			c.Do("UNWATCH")
+			WriteJSONError(w, "API key doesn't have the "+scope+" scope.", http.StatusForbidden)
+			return
+		}
+		key.LastUsed = CLOCK.Now().Unix()
+		c.Send("MULTI")
+		c.Send("HSET", apiKeyKey(hash), "last_used", key.LastUsed)
+		// a nil reply means the key changed, either revoked or used by
+		// another request which recorded it instead
+		if _, err := c.Do("EXEC"); err != nil {
+			LoggerFrom(r.Context()).Warn("could not record API key use", Fields{"api_key_id": key.ID, "error": err})
+		}
+		log := LoggerFrom(r.Context()).With(Fields{"api_key_id": key.ID})
+		ctx := context.WithValue(WithLogger(r.Context(), log), apiKeyCtxKey{}, key)
+		fn(w, r.WithContext(ctx))
+	}
+}
+
+// Makes an API key, {"number", "password", "name", "scopes"} where scopes
+// is a comma separated list. The key is only ever returned here.
+func createAPIKey(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	name := strings.TrimSpace(data["name"])
+	if name == "" || utf8.RuneCountInString(name) > MAX_KEY_NAME_LEN {
+		WriteJSONError(w, fmt.Sprintf("API key names must be 1 to %d characters.", MAX_KEY_NAME_LEN), http.StatusBadRequest)
+		return
+	}
+	scopes, err := parseScopes(data["scopes"])
+	if err != nil {
+		WriteJSONError(w, "Scopes must be some of "+strings.Join(API_SCOPES, ", ")+".", http.StatusBadRequest)
+		return
+	}
+	key, secret, err := CreateAPIKey(data["number"], name, scopes)
+	if err == ErrTooManyAPIKeys {
+		WriteJSONError(w, fmt.Sprintf("You can't have more than %d API keys.", MAX_API_KEYS), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not create API key", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, API_KEYS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	LoggerFrom(r.Context()).Info("API key created", Fields{"api_key_id": key.ID, "scopes": key.Scopes})
+	WriteJSON(w, map[string]interface{}{"api_key": key, "key": secret}, http.StatusOK)
+}
+
+// Lists API keys, {"number", "password"}
+func listAPIKeys(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	keys, err := ListAPIKeys(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list API keys", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, API_KEYS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"api_keys": keys}, http.StatusOK)
+}
+
+// Revokes an API key, {"number", "password", "id"}
+func revokeAPIKey(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := RevokeAPIKey(data["number"], data["id"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No API key with that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not revoke API key", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, API_KEYS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	LoggerFrom(r.Context()).Info("API key revoked", Fields{"api_key_id": data["id"]})
+}
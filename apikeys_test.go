@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	auth := map[string]string{"number": number, "password": password}
+	post := func(path, key string, data map[string]string) (int, map[string]interface{}) {
+		b, _ := json.Marshal(data)
+		req, _ := http.NewRequest("POST", app.Server.URL+path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return app.decode(res)
+	}
+	create := func(name, scopes string) (int, string) {
+		code, res := app.PostJSON("/api_keys/create", map[string]string{"number": number, "password": password, "name": name, "scopes": scopes})
+		key, _ := res["key"].(string)
+		return code, key
+	}
+
+	if code, _ := create("ci", "messages:delete"); code != http.StatusBadRequest {
+		t.Errorf("unknown scope: got status %d", code)
+	}
+	_, writer := create("ci", "messages:write")
+	app.Advance(time.Minute)
+	_, reader := create("dashboard", "messages:read")
+	if !strings.HasPrefix(writer, API_KEY_PREFIX) || reader == writer {
+		t.Fatalf("unexpected keys %q, %q", writer, reader)
+	}
+
+	at := strconv.FormatInt(app.Clock.Now().Unix()+3600, 10)
+	code, res := post("/schedule", writer, map[string]string{"to": number, "time": at, "body": "Deploy finished"})
+	if code != http.StatusOK {
+		t.Fatalf("schedule with API key: got status %d, %v", code, res)
+	}
+	status := map[string]string{"number": number, "id": res["id"].(string)}
+	if code, _ := post("/message_status", writer, status); code != http.StatusForbidden {
+		t.Errorf("key without scope: got status %d", code)
+	}
+	if code, res := post("/message_status", reader, status); code != http.StatusOK {
+		t.Errorf("message status with API key: got status %d, %v", code, res)
+	}
+	if code, _ := post("/schedule", writer, map[string]string{"to": "5551230001", "time": at, "body": "Hi"}); code != http.StatusForbidden {
+		t.Errorf("key for another number: got status %d", code)
+	}
+	if code, _ := post("/templates/list", writer, map[string]string{"number": number}); code != http.StatusForbidden {
+		t.Errorf("key on an endpoint without scopes: got status %d", code)
+	}
+
+	_, res = app.PostJSON("/api_keys/list", auth)
+	keys := res["api_keys"].([]interface{})
+	ci := keys[0].(map[string]interface{})
+	if len(keys) != 2 || ci["name"] != "ci" || ci["last_used"] != float64(app.Clock.Now().Unix()) || keys[1].(map[string]interface{})["last_used"] != float64(app.Clock.Now().Unix()) {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	if b, _ := json.Marshal(res); bytes.Contains(b, []byte(writer)) {
+		t.Error("listed a key")
+	}
+
+	if code, _ := app.PostJSON("/api_keys/revoke", map[string]string{"number": number, "password": password, "id": ci["id"].(string)}); code != http.StatusOK {
+		t.Errorf("revoke: got status %d", code)
+	}
+	if code, _ := post("/schedule", writer, map[string]string{"to": number, "time": at, "body": "Deploy finished"}); code != http.StatusUnauthorized {
+		t.Errorf("revoked key: got status %d", code)
+	}
+}
+
+// Connection which deletes each API key it reads, as if revoked meanwhile
+type revokingConn struct {
+	redis.Conn
+	db *MemoryRedis
+}
+
+func (c revokingConn) Do(name string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(name, args...)
+	if name == "HGETALL" && strings.HasPrefix(args[0].(string), "api_key:") {
+		other := c.db.Conn()
+		defer other.Close()
+		other.Do("DEL", args[0])
+	}
+	return reply, err
+}
+
+func TestAPIKeyRevokedDuringRequest(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	_, secret, err := CreateAPIKey(number, "ci", []string{"messages:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	GetConn = func() redis.Conn { return revokingConn{app.DB.Conn(), app.DB} }
+	req, _ := http.NewRequest("POST", app.Server.URL+"/message_status", strings.NewReader(`{"number": "5558675309", "id": "x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+secret)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	GetConn = app.DB.Conn
+
+	conn := app.DB.Conn()
+	defer conn.Close()
+	if exists, _ := redis.Bool(conn.Do("EXISTS", apiKeyKey(hashAPIKey(secret)))); exists {
+		t.Error("recording its use brought back a revoked key")
+	}
+}
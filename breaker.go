@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open, provider appears to be down")
+
+type breakerState int
+
+const (
+	BREAKER_CLOSED breakerState = iota
+	BREAKER_OPEN
+	BREAKER_HALF_OPEN
+)
+
+var BREAKER_STATE_NAMES = map[breakerState]string{BREAKER_CLOSED: "closed", BREAKER_OPEN: "open", BREAKER_HALF_OPEN: "half-open"}
+
+// Stops calls to a failing dependency after Threshold consecutive failures.
+// Once Cooldown has passed a single trial call is let through; if it succeeds
+// the breaker closes again, otherwise it stays open for another Cooldown.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Returns ErrCircuitOpen if calls should not be made right now
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BREAKER_OPEN:
+		if CLOCK.Now().Sub(b.openedAt) < b.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BREAKER_HALF_OPEN
+		return nil
+	case BREAKER_HALF_OPEN:
+		// a trial call is already in flight
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Records the outcome of a call let through by Allow
+func (b *CircuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = BREAKER_CLOSED
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BREAKER_HALF_OPEN || b.failures >= b.Threshold {
+		b.state = BREAKER_OPEN
+		b.openedAt = CLOCK.Now()
+	}
+}
+
+// Gives back a call let through by Allow without recording an outcome, for
+// calls abandoned by the caller that say nothing about the provider's health
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BREAKER_HALF_OPEN {
+		// the cooldown has already passed, so the next call becomes the trial
+		b.state = BREAKER_OPEN
+	}
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BREAKER_STATE_NAMES[b.state]
+}
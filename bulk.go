@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/nu7hatch/gouuid"
+	"github.com/scascketta/textremind/sms"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on a bulk upload
+const (
+	MAX_BULK_SIZE = 1 << 20
+	MAX_BULK_ROWS = 1000
+)
+
+var ErrInvalidBulk = errors.New("must be a CSV file with a header row, or a JSON array of objects")
+
+// A message to schedule from a bulk upload. Time is a Unix timestamp or
+// RFC 3339, as in a spreadsheet export.
+type BulkRow struct {
+	To   string `json:"to"`
+	Time string `json:"time"`
+	Body string `json:"body"`
+}
+
+// Why a row of a bulk upload can't be scheduled. Row counts from 1 for the
+// first message, not counting a CSV header.
+type BulkRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// A row checked by validateBulk, ready to be stored
+type bulkMessage struct {
+	To     string
+	Time   int64
+	Fields []interface{}
+}
+
+// Parses an uploaded CSV file with "to", "time" and "body" columns, or a
+// JSON array of BulkRows
+func ParseBulk(r io.Reader) ([]BulkRow, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, MAX_BULK_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MAX_BULK_SIZE {
+		return nil, fmt.Errorf("must be at most %d MB", MAX_BULK_SIZE>>20)
+	}
+	b = bytes.TrimPrefix(bytes.TrimSpace(b), []byte("\xef\xbb\xbf"))
+	if len(b) > 0 && b[0] == '[' {
+		return parseBulkJSON(b)
+	}
+	return parseBulkCSV(b)
+}
+
+func parseBulkJSON(b []byte) ([]BulkRow, error) {
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, ErrInvalidBulk
+	}
+	rows := make([]BulkRow, len(raw))
+	for i, obj := range raw {
+		// times may be numbers or strings
+		get := func(key string) string {
+			switch v := obj[key].(type) {
+			case string:
+				return v
+			case float64:
+				return strconv.FormatFloat(v, 'f', -1, 64)
+			}
+			return ""
+		}
+		rows[i] = BulkRow{To: get("to"), Time: get("time"), Body: get("body")}
+	}
+	return rows, nil
+}
+
+func parseBulkCSV(b []byte) ([]BulkRow, error) {
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%v, %v", ErrInvalidBulk, err)
+	}
+	if len(records) == 0 {
+		return nil, ErrInvalidBulk
+	}
+	columns := map[string]int{"to": -1, "time": -1, "body": -1}
+	for i, name := range records[0] {
+		if _, ok := columns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+	}
+	for _, name := range []string{"to", "time", "body"} {
+		if columns[name] < 0 {
+			return nil, fmt.Errorf("has no %q column", name)
+		}
+	}
+	rows := make([]BulkRow, 0, len(records)-1)
+	for _, record := range records[1:] {
+		rows = append(rows, BulkRow{
+			To:   record[columns["to"]],
+			Time: strings.TrimSpace(record[columns["time"]]),
+			Body: record[columns["body"]],
+		})
+	}
+	return rows, nil
+}
+
+func parseBulkTime(v string) (int64, error) {
+	if at, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return at, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, errors.New("must be a Unix timestamp or RFC 3339")
+	}
+	return t.Unix(), nil
+}
+
+// Checks every row owner uploaded, returning the messages to store or an
+// error for each invalid row. Rows may be to owner or their confirmed contacts.
+func validateBulk(c redis.Conn, owner string, rows []BulkRow) ([]bulkMessage, []BulkRowError, error) {
+	msgs := make([]bulkMessage, 0, len(rows))
+	errs := make([]BulkRowError, 0)
+	for i, row := range rows {
+		fail := func(msg string) { errs = append(errs, BulkRowError{Row: i + 1, Error: msg}) }
+		to := NormalizeNumber(row.To)
+		if len(to) != 10 {
+			fail("Recipient's number is not valid.")
+			continue
+		}
+		confirmed, err := isConfirmedContact(c, owner, to)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !confirmed {
+			fail("Recipient is not a confirmed contact.")
+			continue
+		}
+		at, err := parseBulkTime(row.Time)
+		if err != nil {
+			fail("Time " + err.Error() + ".")
+			continue
+		}
+		body := row.Body
+		if TRANSLITERATE {
+			body = sms.Transliterate(body)
+		}
+		if strings.TrimSpace(body) == "" {
+			fail("Message has no body.")
+			continue
+		}
+		if _, err := checkSegments(body, MAX_SEGMENTS); err != nil {
+			fail(err.Error())
+			continue
+		}
+		fields := []interface{}{"body", body}
+		if to != owner {
+			fields = append(fields, "owner", owner)
+		}
+		msgs = append(msgs, bulkMessage{To: to, Time: at, Fields: fields})
+	}
+	return msgs, errs, nil
+}
+
+// Stores msgs in one transaction, so either all are scheduled or none are.
+// Returns their IDs in order.
+func scheduleBulk(ctx context.Context, c redis.Conn, msgs []bulkMessage) ([]string, error) {
+	ids := make([]string, len(msgs))
+	c.Send("MULTI")
+	for i, msg := range msgs {
+		uid, _ := uuid.NewV4()
+		ids[i] = uid.String()
+		queueMessage(c, ids[i], msg.To, strconv.FormatInt(msg.Time, 10), msg.Fields...)
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	LoggerFrom(ctx).Info("bulk messages scheduled", Fields{"messages": len(ids)})
+	emitMessageEvents(ctx, c, EVENT_SCHEDULED, ids...)
+	return ids, nil
+}
+
+// Schedules messages from an uploaded CSV or JSON file, as a multipart form
+// with "number", "password" and "file". Nothing is scheduled unless every
+// row is valid, and with "dry_run" set to "true" the rows are only checked.
+func scheduleBulkUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteJSONError(w, "Messages must be uploaded with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_BULK_SIZE+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		WriteJSONError(w, fmt.Sprintf("Messages must be uploaded as a form and be at most %d MB.", MAX_BULK_SIZE>>20), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	owner := r.FormValue("number")
+	if !authenticate(w, r, owner, r.FormValue("password")) {
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		WriteJSONError(w, "No messages were uploaded.", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	rows, err := ParseBulk(f)
+	if err != nil {
+		WriteJSONError(w, "Messages could not be read, the file "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	if len(rows) == 0 || len(rows) > MAX_BULK_ROWS {
+		WriteJSONError(w, fmt.Sprintf("Uploads must have between 1 and %d messages.", MAX_BULK_ROWS), http.StatusBadRequest)
+		return
+	}
+
+	c := GetConn()
+	defer c.Close()
+	msgs, errs, err := validateBulk(c, owner, rows)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not check bulk messages", Fields{"number": owner, "error": err})
+		WriteJSONError(w, SCHEDULE_MSG_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	dryRun := r.FormValue("dry_run") == "true"
+	if len(errs) > 0 {
+		WriteJSON(w, map[string]interface{}{"message": fmt.Sprintf("%d of %d messages are not valid, none were scheduled.", len(errs), len(rows)), "errors": errs, "dry_run": dryRun}, http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		WriteJSON(w, map[string]interface{}{"messages": len(msgs), "dry_run": true}, http.StatusOK)
+		return
+	}
+	ids, err := scheduleBulk(r.Context(), c, msgs)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not schedule bulk messages", Fields{"number": owner, "error": err})
+		WriteJSONError(w, SCHEDULE_MSG_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"messages": len(ids), "ids": ids, "dry_run": false}, http.StatusOK)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleBulk(t *testing.T) {
+	app := NewTestApp(t)
+	owner, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	alice, bob := "5551230001", "5551230002"
+	for _, number := range []string{alice, bob} {
+		app.PostJSON("/contacts/add", map[string]string{"number": owner, "password": password, "contact": number})
+	}
+	app.ReceiveSMS("+1"+alice, "YES")
+	fields := map[string]string{"number": owner, "password": password}
+	inAnHour := app.Clock.Now().Add(time.Hour)
+	at := strconv.FormatInt(inAnHour.Unix(), 10)
+	scheduled := func() int {
+		msgs, _ := ListMessages(0)
+		return len(msgs)
+	}
+
+	csv := "Time,To,Body\n" +
+		at + "," + owner + ",Stand up\n" +
+		inAnHour.Format(time.RFC3339) + ",+1 (555) 123-0001,\"Stand up, Alice\"\n" +
+		at + "," + bob + ",Stand up Bob\n" +
+		"tomorrow," + alice + ",Stand up again\n" +
+		at + "," + alice + ",\n"
+	code, res := postFile(t, app, "/schedule/bulk", fields, []byte(csv))
+	if code != http.StatusBadRequest {
+		t.Fatalf("invalid rows: got status %d, %v", code, res)
+	}
+	rows := make([]string, 0)
+	for _, e := range res["errors"].([]interface{}) {
+		rows = append(rows, strconv.Itoa(int(e.(map[string]interface{})["row"].(float64))))
+	}
+	if strings.Join(rows, ",") != "3,4,5" || scheduled() != 0 {
+		t.Errorf("unexpected errors %v with %d messages scheduled", res["errors"], scheduled())
+	}
+
+	csv = strings.Join(strings.Split(csv, "\n")[:3], "\n")
+	fields["dry_run"] = "true"
+	if code, res := postFile(t, app, "/schedule/bulk", fields, []byte(csv)); code != http.StatusOK || res["messages"] != float64(2) || scheduled() != 0 {
+		t.Errorf("dry run: got status %d, %v", code, res)
+	}
+	delete(fields, "dry_run")
+	if code, res := postFile(t, app, "/schedule/bulk", fields, []byte(csv)); code != http.StatusOK || len(res["ids"].([]interface{})) != 2 {
+		t.Fatalf("upload: got status %d, %v", code, res)
+	}
+
+	array := `[{"to": "` + alice + `", "time": ` + at + `, "body": "From JSON"}]`
+	if code, res := postFile(t, app, "/schedule/bulk", fields, []byte(array)); code != http.StatusOK || scheduled() != 3 {
+		t.Errorf("JSON upload: got status %d, %v", code, res)
+	}
+	if code, _ := postFile(t, app, "/schedule/bulk", fields, []byte("to,body\n"+alice+",hi\n")); code != http.StatusBadRequest {
+		t.Errorf("CSV without a time column: got status %d", code)
+	}
+
+	// messages to contacts stop if they opt out
+	app.ReceiveSMS("+1"+alice, "STOP")
+	app.Advance(time.Hour)
+	app.Dispatch()
+	sent := make([]string, 0)
+	for _, m := range app.Twilio.Messages() {
+		if strings.HasPrefix(m.Body, "Stand up") || m.Body == "From JSON" {
+			sent = append(sent, NormalizeNumber(m.To)+" "+m.Body)
+		}
+	}
+	if strings.Join(sent, "; ") != owner+" Stand up" {
+		t.Errorf("unexpected messages sent %v", sent)
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/nu7hatch/gouuid"
+	"github.com/scascketta/textremind/ics"
+	"github.com/scascketta/textremind/sms"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MAX_CALENDARS = 10
+	// Reminders are only scheduled this far ahead, later ones are added by
+	// re-syncing
+	CALENDAR_HORIZON = 60 * 24 * time.Hour
+	// Limit on the reminders scheduled for one calendar
+	MAX_CALENDAR_REMINDERS = 500
+	MAX_SUMMARY_LEN        = 100
+	CALENDAR_TIMEOUT       = 10 * time.Second
+	// Subscribed calendars fetched at once by the dispatcher
+	CALENDAR_WORKERS = 4
+
+	// Sorted set of subscribed calendar IDs, scored by when they're next synced
+	CALENDAR_SYNC_KEY = "calendar_sync"
+
+	CALENDAR_ERR_S = ERR_S + "importing the calendar."
+)
+
+var (
+	// How often subscribed calendars are fetched again
+	CALENDAR_SYNC_INTERVAL = time.Duration(envInt("TEXTREMIND_CALENDAR_SYNC_MINUTES", 60)) * time.Minute
+
+	CALENDAR_CLIENT = newPublicClient(CALENDAR_TIMEOUT)
+
+	ErrTooManyCalendars  = errors.New("too many calendars")
+	TOO_MANY_CALENDARS_S = fmt.Sprintf("You can't have more than %d calendars.", MAX_CALENDARS)
+)
+
+// An imported iCalendar file, or a subscription to one at URL which is
+// re-synced every CALENDAR_SYNC_INTERVAL
+type Calendar struct {
+	ID        string `json:"id"`
+	Owner     string `json:"owner"`
+	Name      string `json:"name"`
+	URL       string `json:"url,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	SyncedAt  int64  `json:"synced_at,omitempty"`
+	// Scheduled reminders as of the last sync
+	Reminders int `json:"reminders"`
+	// Why the last sync of a subscription failed
+	LastError string `json:"last_error,omitempty"`
+}
+
+// What changed when a calendar was synced
+type CalendarSync struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Cancelled int `json:"cancelled"`
+	Unchanged int `json:"unchanged"`
+	// Events which couldn't be imported
+	Skipped []SkippedEvent `json:"skipped"`
+}
+
+type SkippedEvent struct {
+	UID     string `json:"uid"`
+	Summary string `json:"summary"`
+	Reason  string `json:"reason"`
+}
+
+// A reminder scheduled for an event's alarm
+type calendarReminder struct {
+	MessageID string `json:"id"`
+	Time      int64  `json:"time"`
+	Body      string `json:"body"`
+}
+
+func calendarKey(id string) string { return "calendar:" + id }
+
+// Set of the IDs of a user's calendars
+func calendarsKey(owner string) string { return "calendars:" + owner }
+
+// Hash of the reminders scheduled for a calendar, keyed by event UID,
+// occurrence and alarm, see calendarReminder
+func calendarRemindersKey(id string) string { return "calendar_reminders:" + id }
+
+func getCalendar(c redis.Conn, id string) (*Calendar, error) {
+	b, err := redis.Bytes(c.Do("GET", calendarKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	cal := &Calendar{}
+	return cal, json.Unmarshal(b, cal)
+}
+
+func putCalendar(c redis.Conn, cal *Calendar) error {
+	b, err := json.Marshal(cal)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("SET", calendarKey(cal.ID), b)
+	return err
+}
+
+// Get one of owner's calendars, or ErrNotFound
+func GetCalendar(owner, id string) (*Calendar, error) {
+	c := GetConn()
+	defer c.Close()
+	return getOwnedCalendar(c, owner, id)
+}
+
+func getOwnedCalendar(c redis.Conn, owner, id string) (*Calendar, error) {
+	owned, err := redis.Bool(c.Do("SISMEMBER", calendarsKey(owner), id))
+	if err != nil {
+		return nil, err
+	}
+	if !owned {
+		return nil, ErrNotFound
+	}
+	return getCalendar(c, id)
+}
+
+// Creates a calendar for owner, imported from a file called name or
+// subscribed to at calURL
+func NewCalendar(owner, name, calURL string) (*Calendar, error) {
+	c := GetConn()
+	defer c.Close()
+	n, err := redis.Int(c.Do("SCARD", calendarsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	if n >= MAX_CALENDARS {
+		return nil, ErrTooManyCalendars
+	}
+	uid, _ := uuid.NewV4()
+	cal := &Calendar{ID: uid.String(), Owner: owner, Name: name, URL: calURL, CreatedAt: CLOCK.Now().Unix()}
+	if err := putCalendar(c, cal); err != nil {
+		return nil, err
+	}
+	_, err = c.Do("SADD", calendarsKey(owner), cal.ID)
+	return cal, err
+}
+
+// List owner's calendars, oldest first
+func ListCalendars(owner string) ([]*Calendar, error) {
+	c := GetConn()
+	defer c.Close()
+	ids, err := redis.Strings(c.Do("SMEMBERS", calendarsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	cals := make([]*Calendar, 0, len(ids))
+	for _, id := range ids {
+		cal, err := getCalendar(c, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cals = append(cals, cal)
+	}
+	sort.Slice(cals, func(i, j int) bool { return cals[i].CreatedAt < cals[j].CreatedAt })
+	return cals, nil
+}
+
+// Deletes all of owner's calendars, leaving their reminders to the caller
+func deleteCalendars(c redis.Conn, owner string) error {
+	ids, err := redis.Strings(c.Do("SMEMBERS", calendarsKey(owner)))
+	if err != nil {
+		return err
+	}
+	c.Send("MULTI")
+	for _, id := range ids {
+		c.Send("DEL", calendarKey(id), calendarRemindersKey(id))
+		c.Send("ZREM", CALENDAR_SYNC_KEY, id)
+	}
+	c.Send("DEL", calendarsKey(owner))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Deletes one of owner's calendars and cancels its scheduled reminders
+func DeleteCalendar(owner, id string) error {
+	c := GetConn()
+	defer c.Close()
+	if _, err := getOwnedCalendar(c, owner, id); err != nil {
+		return err
+	}
+	reminders, err := calendarReminders(c, id)
+	if err != nil {
+		return err
+	}
+	for _, r := range reminders {
+		if err := CancelMessage(r.MessageID); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	c.Send("MULTI")
+	c.Send("DEL", calendarKey(id), calendarRemindersKey(id))
+	c.Send("SREM", calendarsKey(owner), id)
+	c.Send("ZREM", CALENDAR_SYNC_KEY, id)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+func calendarReminders(c redis.Conn, id string) (map[string]calendarReminder, error) {
+	values, err := redis.Strings(c.Do("HGETALL", calendarRemindersKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	reminders := make(map[string]calendarReminder, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		var r calendarReminder
+		if err := json.Unmarshal([]byte(values[i+1]), &r); err != nil {
+			return nil, err
+		}
+		reminders[values[i]] = r
+	}
+	return reminders, nil
+}
+
+// The text of a reminder for an event starting at start
+func eventReminderBody(e *ics.Event, start time.Time, loc *time.Location) string {
+	summary := strings.TrimSpace(e.Summary)
+	if summary == "" {
+		summary = "Event"
+	}
+	if utf8.RuneCountInString(summary) > MAX_SUMMARY_LEN {
+		summary = string([]rune(summary)[:MAX_SUMMARY_LEN-1]) + "…"
+	}
+	var body string
+	if e.AllDay {
+		body = fmt.Sprintf("%s on %s", summary, start.Format("Mon Jan 2"))
+	} else {
+		body = fmt.Sprintf("%s at %s", summary, start.In(loc).Format("3:04 PM Mon Jan 2"))
+	}
+	if TRANSLITERATE {
+		body = sms.Transliterate(body)
+	}
+	return body
+}
+
+// Reminders wanted for events as of now, keyed like calendarRemindersKey
+func eventReminders(events []*ics.Event, now time.Time, loc *time.Location, sync *CalendarSync) map[string]calendarReminder {
+	skip := func(e *ics.Event, reason string) {
+		sync.Skipped = append(sync.Skipped, SkippedEvent{UID: e.UID, Summary: e.Summary, Reason: reason})
+	}
+	// occurrences replaced by another event are excluded from their series
+	overridden := make(map[string][]time.Time)
+	for _, e := range events {
+		if !e.RecurrenceID.IsZero() {
+			overridden[e.UID] = append(overridden[e.UID], e.RecurrenceID)
+		}
+	}
+
+	wanted := make(map[string]calendarReminder)
+	for _, e := range events {
+		switch {
+		case e.Err != nil:
+			skip(e, e.Err.Error())
+			continue
+		case e.Cancelled:
+			continue
+		}
+		uid := e.UID
+		if uid == "" {
+			uid = e.Summary + "@" + strconv.FormatInt(e.Start.Unix(), 10)
+		}
+		if e.RecurrenceID.IsZero() {
+			e.ExDates = append(e.ExDates, overridden[e.UID]...)
+		}
+		alarms := e.Alarms
+		if len(alarms) == 0 {
+			alarms = []ics.Alarm{{}}
+		}
+		// occurrences starting up to a day ago may have alarms after their start
+		starts, err := e.Occurrences(now.Add(-24*time.Hour), now.Add(CALENDAR_HORIZON), MAX_CALENDAR_REMINDERS)
+		if err != nil {
+			skip(e, err.Error())
+			continue
+		}
+		for _, start := range starts {
+			for i, alarm := range alarms {
+				at := start.Add(alarm.Offset)
+				if !alarm.At.IsZero() {
+					at = alarm.At
+				}
+				if !at.After(now) {
+					continue
+				}
+				if len(wanted) >= MAX_CALENDAR_REMINDERS {
+					skip(e, fmt.Sprintf("calendars can't have more than %d upcoming reminders", MAX_CALENDAR_REMINDERS))
+					return wanted
+				}
+				key := fmt.Sprintf("%s|%d|%d", uid, start.Unix(), i)
+				wanted[key] = calendarReminder{Time: at.Unix(), Body: eventReminderBody(e, start, loc)}
+			}
+		}
+	}
+	return wanted
+}
+
+// Schedules reminders for a calendar's events, updating or cancelling those
+// from the last sync which have changed. The changes are made in one
+// transaction, so a failed sync leaves the last one's reminders in place.
+func SyncCalendar(ctx context.Context, cal *Calendar, events []*ics.Event, now time.Time) (*CalendarSync, error) {
+	sync := &CalendarSync{Skipped: make([]SkippedEvent, 0)}
+	wanted := eventReminders(events, now, UserLocation(cal.Owner), sync)
+
+	c := GetConn()
+	defer c.Close()
+	existing, err := calendarReminders(c, cal.ID)
+	if err != nil {
+		return nil, err
+	}
+	removed, cancels := make([]interface{}, 0), make([]*Message, 0)
+	for key, old := range existing {
+		r, ok := wanted[key]
+		if ok && r.Time == old.Time && r.Body == old.Body {
+			sync.Unchanged++
+			delete(wanted, key)
+			continue
+		}
+		msg, err := getMessage(c, old.MessageID)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		// reminders already sent are forgotten rather than cancelled
+		if err == nil && msg.Scheduled {
+			cancels = append(cancels, msg)
+			if !ok {
+				sync.Cancelled++
+			}
+		}
+		if ok {
+			sync.Updated++
+		}
+		removed = append(removed, key)
+	}
+
+	c.Send("MULTI")
+	for _, msg := range cancels {
+		queueCancel(c, msg)
+	}
+	if len(removed) > 0 {
+		c.Send("HDEL", append([]interface{}{calendarRemindersKey(cal.ID)}, removed...)...)
+	}
+	ids := make([]string, 0, len(wanted))
+	for key, r := range wanted {
+		uid, _ := uuid.NewV4()
+		r.MessageID = uid.String()
+		queueMessage(c, r.MessageID, cal.Owner, strconv.FormatInt(r.Time, 10), "body", r.Body, "calendar", cal.ID)
+		ids = append(ids, r.MessageID)
+		if _, ok := existing[key]; !ok {
+			sync.Created++
+		}
+		b, _ := json.Marshal(r)
+		c.Send("HSET", calendarRemindersKey(cal.ID), key, b)
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	for _, msg := range cancels {
+		if err := cancelled(c, msg); err != nil {
+			LoggerFrom(ctx).Error("could not finish cancelling calendar reminder", Fields{"message_id": msg.ID, "error": err})
+		}
+	}
+	emitMessageEvents(ctx, c, EVENT_SCHEDULED, ids...)
+
+	cal.SyncedAt, cal.LastError = now.Unix(), ""
+	cal.Reminders = sync.Created + sync.Updated + sync.Unchanged
+	LoggerFrom(ctx).Info("calendar synced", Fields{"calendar_id": cal.ID, "created": sync.Created, "updated": sync.Updated, "cancelled": sync.Cancelled, "skipped": len(sync.Skipped)})
+	return sync, putCalendar(c, cal)
+}
+
+// Fetches a subscribed calendar, accepting webcal:// URLs as calendar apps do
+func fetchCalendar(ctx context.Context, calURL string) (io.ReadCloser, error) {
+	if strings.HasPrefix(calURL, "webcal://") {
+		calURL = "https://" + strings.TrimPrefix(calURL, "webcal://")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", calURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "TextRemind-Calendar")
+	res, err := CALENDAR_CLIENT.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("calendar server responded with statuscode %d", res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+// Fetches and syncs a subscribed calendar, recording any error on it
+func syncSubscription(ctx context.Context, cal *Calendar, now time.Time) (*CalendarSync, error) {
+	body, err := fetchCalendar(ctx, cal.URL)
+	var events []*ics.Event
+	if err == nil {
+		events, err = ics.Parse(body, UserLocation(cal.Owner))
+		body.Close()
+	}
+	if err != nil {
+		cal.LastError = err.Error()
+		c := GetConn()
+		defer c.Close()
+		putCalendar(c, cal)
+		return nil, err
+	}
+	return SyncCalendar(ctx, cal, events, now)
+}
+
+// Re-syncs subscribed calendars which are due, CALENDAR_WORKERS at a time
+func syncDueCalendars(ctx context.Context, c redis.Conn, now time.Time) error {
+	ids, err := redis.Strings(c.Do("ZRANGEBYSCORE", CALENDAR_SYNC_KEY, "-inf", now.Unix()))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := c.Do("ZADD", CALENDAR_SYNC_KEY, now.Add(CALENDAR_SYNC_INTERVAL).Unix(), id); err != nil {
+			return err
+		}
+	}
+	forEachConcurrently(ids, CALENDAR_WORKERS, func(c redis.Conn, id string) {
+		log := LoggerFrom(ctx).With(Fields{"calendar_id": id})
+		cal, err := getCalendar(c, id)
+		if err == ErrNotFound {
+			c.Do("ZREM", CALENDAR_SYNC_KEY, id)
+			return
+		}
+		if err != nil {
+			log.Error("could not get calendar", Fields{"error": err})
+			return
+		}
+		exists, err := userExists(c, cal.Owner)
+		if err != nil {
+			log.Error("could not check calendar owner", Fields{"error": err})
+			return
+		}
+		if !exists {
+			log.Info("removing calendar of deleted user")
+			c.Do("ZREM", CALENDAR_SYNC_KEY, id)
+			return
+		}
+		if _, err := syncSubscription(WithLogger(ctx, log), cal, now); err != nil {
+			log.Warn("could not sync calendar", Fields{"error": err})
+		}
+	})
+	return nil
+}
+
+// Imports reminders from an uploaded .ics file, as a multipart form with
+// "number", "password" and "file". If "id" is one of the user's calendars
+// it's replaced, updating or cancelling reminders for changed events.
+func importCalendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteJSONError(w, "Calendars must be uploaded with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, ics.MAX_SIZE+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		WriteJSONError(w, fmt.Sprintf("Calendars must be uploaded as a form and be at most %d MB.", ics.MAX_SIZE>>20), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	owner := r.FormValue("number")
+	if !authenticate(w, r, owner, r.FormValue("password")) {
+		return
+	}
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		WriteJSONError(w, "No calendar was uploaded.", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	events, err := ics.Parse(f, UserLocation(owner))
+	if err != nil {
+		WriteJSONError(w, "Calendar could not be read: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	var cal *Calendar
+	if id := r.FormValue("id"); id != "" {
+		cal, err = GetCalendar(owner, id)
+		if err == ErrNotFound {
+			WriteJSONError(w, "No calendar with that ID.", http.StatusNotFound)
+			return
+		}
+		if err == nil && cal.URL != "" {
+			WriteJSONError(w, "Subscribed calendars are synced from their URL.", http.StatusBadRequest)
+			return
+		}
+	} else {
+		cal, err = NewCalendar(owner, header.Filename, "")
+		if err == ErrTooManyCalendars {
+			WriteJSONError(w, TOO_MANY_CALENDARS_S, http.StatusBadRequest)
+			return
+		}
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get calendar", Fields{"number": owner, "error": err})
+		WriteJSONError(w, CALENDAR_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	writeCalendarSync(w, r, cal, events)
+}
+
+func writeCalendarSync(w http.ResponseWriter, r *http.Request, cal *Calendar, events []*ics.Event) {
+	sync, err := SyncCalendar(r.Context(), cal, events, CLOCK.Now())
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not sync calendar", Fields{"calendar_id": cal.ID, "error": err})
+		WriteJSONError(w, CALENDAR_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"calendar": cal, "sync": sync}, http.StatusOK)
+}
+
+// Subscribes to a calendar at an http(s) or webcal URL, {"number",
+// "password", "url"}. It's synced now and every CALENDAR_SYNC_INTERVAL.
+func subscribeCalendar(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	owner := data["number"]
+	if !authenticate(w, r, owner, data["password"]) {
+		return
+	}
+	u, err := url.Parse(data["url"])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "webcal") || u.Host == "" {
+		WriteJSONError(w, "Calendar URL must be http, https or webcal.", http.StatusBadRequest)
+		return
+	}
+	if isPrivateHost(u.Hostname()) {
+		WriteJSONError(w, "Calendar URL must be on the public internet.", http.StatusBadRequest)
+		return
+	}
+	body, err := fetchCalendar(r.Context(), data["url"])
+	var events []*ics.Event
+	if err == nil {
+		events, err = ics.Parse(body, UserLocation(owner))
+		body.Close()
+	}
+	if err != nil {
+		WriteJSONError(w, "Calendar could not be fetched: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	cal, err := NewCalendar(owner, u.Host+u.Path, data["url"])
+	if err == ErrTooManyCalendars {
+		WriteJSONError(w, TOO_MANY_CALENDARS_S, http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		c := GetConn()
+		_, err = c.Do("ZADD", CALENDAR_SYNC_KEY, CLOCK.Now().Add(CALENDAR_SYNC_INTERVAL).Unix(), cal.ID)
+		c.Close()
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not create calendar", Fields{"number": owner, "error": err})
+		WriteJSONError(w, CALENDAR_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	writeCalendarSync(w, r, cal, events)
+}
+
+// Lists calendars, {"number", "password"}
+func listCalendars(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	cals, err := ListCalendars(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list calendars", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, CALENDAR_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"calendars": cals}, http.StatusOK)
+}
+
+// Deletes a calendar and cancels its reminders, {"number", "password", "id"}
+func deleteCalendar(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := DeleteCalendar(data["number"], data["id"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No calendar with that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not delete calendar", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, CALENDAR_ERR_S, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/scascketta/textremind/ics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A calendar with the dentist at dentistTime and gym sessions counted by gym
+func gymCalendar(dentistTime string, gym int) string {
+	return fmt.Sprintf(`BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:dentist
+SUMMARY:Dentist
+DTSTART:%s
+BEGIN:VALARM
+TRIGGER:-PT1H
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:gym
+SUMMARY:Gym
+DTSTART:20150102T070000Z
+RRULE:FREQ=WEEKLY;COUNT=%d
+END:VEVENT
+BEGIN:VEVENT
+UID:last-year
+SUMMARY:Party
+DTSTART:20141231T200000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:last-weekday
+SUMMARY:Payday
+DTSTART:20150130T090000Z
+RRULE:FREQ=MONTHLY;BYSETPOS=-1;BYDAY=MO,TU,WE,TH,FR
+END:VEVENT
+END:VCALENDAR
+`, dentistTime, gym)
+}
+
+// Pads a calendar to one byte more than ics.MAX_SIZE
+func oversizeCalendar(body string) string {
+	pad := "X-PADDING:" + strings.Repeat("x", ics.MAX_SIZE+1-len(body)-len("X-PADDING:\n")) + "\n"
+	return strings.Replace(body, "BEGIN:VCALENDAR\n", "BEGIN:VCALENDAR\n"+pad, 1)
+}
+
+// Scheduled messages for a calendar, formatted "15:04 Jan 2 body"
+func calendarMessages(t *testing.T, id string) []string {
+	msgs, err := ListMessages(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := make([]string, 0)
+	for _, msg := range msgs {
+		if msg.Calendar == id {
+			s = append(s, time.Unix(msg.Time, 0).UTC().Format("15:04 Jan 2 ")+msg.Body)
+		}
+	}
+	return s
+}
+
+func TestImportCalendar(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	fields := map[string]string{"number": number, "password": password}
+
+	code, res := postFile(t, app, "/calendars/import", fields, []byte(gymCalendar("20150105T150000Z", 3)))
+	if code != http.StatusOK {
+		t.Fatalf("import: got status %d, %v", code, res)
+	}
+	sync := res["sync"].(map[string]interface{})
+	skipped := sync["skipped"].([]interface{})
+	if sync["created"] != float64(4) || len(skipped) != 1 || skipped[0].(map[string]interface{})["uid"] != "last-weekday" {
+		t.Errorf("unexpected sync %v", sync)
+	}
+	id := res["calendar"].(map[string]interface{})["id"].(string)
+	expected := []string{"07:00 Jan 2 Gym at 7:00 AM Fri Jan 2", "14:00 Jan 5 Dentist at 3:00 PM Mon Jan 5", "07:00 Jan 9 Gym at 7:00 AM Fri Jan 9", "07:00 Jan 16 Gym at 7:00 AM Fri Jan 16"}
+	if got := calendarMessages(t, id); strings.Join(got, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("unexpected reminders %v", got)
+	}
+
+	// re-importing replaces the calendar's reminders
+	fields["id"] = id
+	_, res = postFile(t, app, "/calendars/import", fields, []byte(gymCalendar("20150105T150000Z", 1)))
+	if sync := res["sync"].(map[string]interface{}); sync["cancelled"] != float64(2) || sync["unchanged"] != float64(2) {
+		t.Errorf("unexpected re-import sync %v", sync)
+	}
+
+	if code, _ := postFile(t, app, "/calendars/import", fields, []byte("not a calendar")); code != http.StatusBadRequest {
+		t.Errorf("invalid calendar: got status %d", code)
+	}
+	fields["id"] = "nope"
+	if code, _ := postFile(t, app, "/calendars/import", fields, []byte(gymCalendar("20150105T150000Z", 1))); code != http.StatusNotFound {
+		t.Errorf("unknown calendar: got status %d", code)
+	}
+}
+
+func TestSubscribeCalendar(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+
+	var mu sync.Mutex
+	ics := gymCalendar("20150105T150000Z", 3)
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(ics))
+	}))
+	defer feed.Close()
+
+	auth := map[string]string{"number": number, "password": password}
+	if code, _ := app.PostJSON("/calendars/subscribe", map[string]string{"number": number, "password": password, "url": "ftp://example.com/cal.ics"}); code != http.StatusBadRequest {
+		t.Errorf("ftp calendar: got status %d", code)
+	}
+	code, res := app.PostJSON("/calendars/subscribe", map[string]string{"number": number, "password": password, "url": feed.URL + "/cal.ics"})
+	if code != http.StatusOK {
+		t.Fatalf("subscribe: got status %d, %v", code, res)
+	}
+	id := res["calendar"].(map[string]interface{})["id"].(string)
+
+	mu.Lock()
+	ics = gymCalendar("20150105T160000Z", 2)
+	mu.Unlock()
+	app.Advance(CALENDAR_SYNC_INTERVAL - time.Minute)
+	app.Dispatch()
+	if got := calendarMessages(t, id); len(got) != 4 || got[1] != "14:00 Jan 5 Dentist at 3:00 PM Mon Jan 5" {
+		t.Fatalf("calendar synced early: %v", got)
+	}
+	app.Advance(time.Minute)
+	app.Dispatch()
+	expected := []string{"07:00 Jan 2 Gym at 7:00 AM Fri Jan 2", "15:00 Jan 5 Dentist at 4:00 PM Mon Jan 5", "07:00 Jan 9 Gym at 7:00 AM Fri Jan 9"}
+	if got := calendarMessages(t, id); strings.Join(got, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("unexpected reminders after sync %v", got)
+	}
+	_, res = app.PostJSON("/calendars/list", auth)
+	cals := res["calendars"].([]interface{})
+	if cal := cals[0].(map[string]interface{}); len(cals) != 1 || cal["reminders"] != float64(3) || cal["synced_at"] != float64(app.Clock.Now().Unix()) {
+		t.Errorf("unexpected calendars %v", cals)
+	}
+
+	// a feed too large to read, or cut off, leaves the reminders alone
+	for _, body := range []string{oversizeCalendar(gymCalendar("20150105T170000Z", 1)), strings.SplitAfter(ics, "END:VEVENT\n")[0]} {
+		mu.Lock()
+		ics = body
+		mu.Unlock()
+		app.Advance(CALENDAR_SYNC_INTERVAL)
+		app.Dispatch()
+		if got := calendarMessages(t, id); strings.Join(got, "; ") != strings.Join(expected, "; ") {
+			t.Errorf("reminders changed by a bad feed: %v", got)
+		}
+		_, res = app.PostJSON("/calendars/list", auth)
+		if cal := res["calendars"].([]interface{})[0].(map[string]interface{}); cal["last_error"] == nil {
+			t.Errorf("bad feed not recorded: %v", cal)
+		}
+	}
+
+	if code, _ := app.PostJSON("/calendars/delete", map[string]string{"number": number, "password": password, "id": id}); code != http.StatusOK {
+		t.Errorf("delete: got status %d", code)
+	}
+	if got := calendarMessages(t, id); len(got) != 0 {
+		t.Errorf("reminders not cancelled with their calendar: %v", got)
+	}
+	if _, res := app.PostJSON("/calendars/list", auth); len(res["calendars"].([]interface{})) != 0 {
+		t.Errorf("calendar not deleted: %v", res)
+	}
+}
+
+// Connection whose transactions fail once *allowed have run
+type failingExecConn struct {
+	redis.Conn
+	allowed *int
+}
+
+func (c failingExecConn) Do(name string, args ...interface{}) (interface{}, error) {
+	if name == "EXEC" {
+		if *c.allowed <= 0 {
+			return nil, errors.New("connection lost")
+		}
+		*c.allowed--
+	}
+	return c.Conn.Do(name, args...)
+}
+
+func TestSyncCalendarAllOrNothing(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	cal, err := NewCalendar(number, "gym", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := func(body string) error {
+		events, err := ics.Parse(bytes.NewReader([]byte(body)), time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = SyncCalendar(context.Background(), cal, events, app.Clock.Now())
+		return err
+	}
+	if err := sync(gymCalendar("20150105T150000Z", 3)); err != nil {
+		t.Fatal(err)
+	}
+	before := strings.Join(calendarMessages(t, cal.ID), "; ")
+
+	// a sync which fails partway leaves the reminders as they were, or as
+	// the new feed wants if the failure came after they were changed
+	for allowed := 0; allowed < 3; allowed++ {
+		n := allowed
+		GetConn = func() redis.Conn { return failingExecConn{app.DB.Conn(), &n} }
+		sync(gymCalendar("20150105T160000Z", 1))
+		GetConn = app.DB.Conn
+		got := strings.Join(calendarMessages(t, cal.ID), "; ")
+		if got != before && got != "07:00 Jan 2 Gym at 7:00 AM Fri Jan 2; 15:00 Jan 5 Dentist at 4:00 PM Mon Jan 5" {
+			t.Fatalf("calendar half synced after %d transactions: %s", allowed, got)
+		}
+		if got != before {
+			break
+		}
+	}
+}
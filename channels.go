@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Ways a message can be delivered. SMS and voice go to the user's verified
+// number, email and webhooks to a destination verified with AddDestination.
+const (
+	CHANNEL_SMS     = "sms"
+	CHANNEL_VOICE   = "voice"
+	CHANNEL_EMAIL   = "email"
+	CHANNEL_WEBHOOK = "webhook"
+)
+
+const (
+	MAX_DESTINATIONS = 20
+	// Wrong codes allowed before an email verification code is discarded
+	MAX_CODE_ATTEMPTS = 5
+	// Longest message body on channels other than SMS
+	MAX_CHANNEL_BODY = 1600
+
+	DESTINATIONS_ERR_S = ERR_S + "updating delivery destinations."
+)
+
+var (
+	ErrInvalidDestination  = errors.New("invalid destination")
+	ErrTooManyDestinations = errors.New("too many destinations")
+	ErrChallengeFailed     = errors.New("webhook did not echo the verification challenge")
+	// A message's destination was removed or is no longer verified
+	ErrDestinationGone = errors.New("destination no longer verified")
+)
+
+// An email address or webhook URL a user can have messages delivered to
+type Destination struct {
+	Channel  string `json:"channel"`
+	Address  string `json:"address"`
+	Verified bool   `json:"verified"`
+	// Webhooks are signed with this, see webhook.Sign
+	Secret string `json:"secret,omitempty"`
+
+	// Pending email verification, never sent to clients
+	Code         string `json:"code,omitempty"`
+	CodeSent     int64  `json:"code_sent,omitempty"`
+	CodeExpires  int64  `json:"code_expires,omitempty"`
+	CodeAttempts int    `json:"code_attempts,omitempty"`
+}
+
+// Hash of a user's destinations by "<channel>:<address>"
+func destinationsKey(owner string) string { return "destinations:" + owner }
+
+func destinationField(channel, address string) string { return channel + ":" + address }
+
+// Validates an address for channel, returning it in canonical form
+func normalizeAddress(channel, address string) (string, error) {
+	switch channel {
+	case CHANNEL_EMAIL:
+		a, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", ErrInvalidDestination
+		}
+		return a.Address, nil
+	case CHANNEL_WEBHOOK:
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || isPrivateHost(u.Hostname()) {
+			return "", ErrInvalidDestination
+		}
+		return u.String(), nil
+	}
+	return "", ErrInvalidDestination
+}
+
+func getDestination(c redis.Conn, owner, channel, address string) (*Destination, error) {
+	b, err := redis.Bytes(c.Do("HGET", destinationsKey(owner), destinationField(channel, address)))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &Destination{}
+	return d, json.Unmarshal(b, d)
+}
+
+func putDestination(c redis.Conn, owner string, d *Destination) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", destinationsKey(owner), destinationField(d.Channel, d.Address), b)
+	return err
+}
+
+// Adds a destination for owner and starts verifying it: email addresses are
+// sent a code to confirm with VerifyDestination, webhooks are sent a
+// challenge they must echo in their response. Verified destinations are
+// returned unchanged.
+func AddDestination(ctx context.Context, owner, channel, address string) (*Destination, error) {
+	address, err := normalizeAddress(channel, address)
+	if err != nil {
+		return nil, err
+	}
+	if channel == CHANNEL_EMAIL && SMTP_ADDR == "" {
+		return nil, ErrEmailDisabled
+	}
+
+	c := GetConn()
+	defer c.Close()
+	d, err := getDestination(c, owner, channel, address)
+	if err == ErrNotFound {
+		n, err := redis.Int(c.Do("HLEN", destinationsKey(owner)))
+		if err != nil {
+			return nil, err
+		}
+		if n >= MAX_DESTINATIONS {
+			return nil, ErrTooManyDestinations
+		}
+		d = &Destination{Channel: channel, Address: address}
+	} else if err != nil {
+		return nil, err
+	}
+	if d.Verified {
+		return d, nil
+	}
+
+	now := CLOCK.Now()
+	switch channel {
+	case CHANNEL_EMAIL:
+		if now.Before(time.Unix(d.CodeSent, 0).Add(VERIFY_RESEND_INTERVAL)) {
+			return nil, ErrVerifyTooSoon
+		}
+		d.Code, d.CodeSent, d.CodeExpires, d.CodeAttempts = randomCode(), now.Unix(), now.Add(VERIFY_CODE_TTL).Unix(), 0
+		if err := putDestination(c, owner, d); err != nil {
+			return nil, err
+		}
+		body := fmt.Sprintf("Your TextRemind verification code is %s. Enter it to receive reminders at this address.", d.Code)
+		if err := SendEmail(ctx, address, "Confirm your email for TextRemind", body); err != nil {
+			return nil, err
+		}
+	case CHANNEL_WEBHOOK:
+		if d.Secret == "" {
+			d.Secret = randomHex(32)
+		}
+		challenge := randomHex(16)
+		res, err := PostWebhook(ctx, address, d.Secret, map[string]string{"type": "verification", "challenge": challenge})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrChallengeFailed, err)
+		}
+		if !bytes.Contains(res, []byte(challenge)) {
+			return nil, ErrChallengeFailed
+		}
+		d.Verified = true
+		if err := putDestination(c, owner, d); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Checks the code sent to an email destination, verifying it if it matches.
+// Returns ErrNotFound if the destination hasn't been added.
+func VerifyDestination(owner, channel, address, code string) (bool, error) {
+	c := GetConn()
+	defer c.Close()
+	if a, err := normalizeAddress(channel, address); err == nil {
+		address = a
+	}
+	d, err := getDestination(c, owner, channel, address)
+	if err != nil {
+		return false, err
+	}
+	if d.Verified {
+		return true, nil
+	}
+	if d.Code == "" || !CLOCK.Now().Before(time.Unix(d.CodeExpires, 0)) {
+		return false, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(d.Code)) != 1 {
+		d.CodeAttempts++
+		if d.CodeAttempts >= MAX_CODE_ATTEMPTS {
+			d.Code = ""
+		}
+		return false, putDestination(c, owner, d)
+	}
+	d.Verified = true
+	d.Code, d.CodeExpires, d.CodeAttempts = "", 0, 0
+	return true, putDestination(c, owner, d)
+}
+
+// List owner's destinations, without verification codes
+func ListDestinations(owner string) ([]*Destination, error) {
+	c := GetConn()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("HGETALL", destinationsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	ds := make([]*Destination, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		d := &Destination{}
+		if err := json.Unmarshal([]byte(values[i+1]), d); err != nil {
+			return nil, err
+		}
+		d.Code, d.CodeSent, d.CodeExpires, d.CodeAttempts = "", 0, 0, 0
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		return destinationField(ds[i].Channel, ds[i].Address) < destinationField(ds[j].Channel, ds[j].Address)
+	})
+	return ds, nil
+}
+
+// Remove a destination, or ErrNotFound. Messages already scheduled to it are skipped.
+func RemoveDestination(owner, channel, address string) error {
+	c := GetConn()
+	defer c.Close()
+	if a, err := normalizeAddress(channel, address); err == nil {
+		address = a
+	}
+	n, err := redis.Int(c.Do("HDEL", destinationsKey(owner), destinationField(channel, address)))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Gets one of owner's destinations if it's verified, otherwise ErrDestinationGone
+func verifiedDestination(c redis.Conn, owner, channel, address string) (*Destination, error) {
+	d, err := getDestination(c, owner, channel, address)
+	if err == ErrNotFound || (err == nil && !d.Verified) {
+		return nil, ErrDestinationGone
+	}
+	return d, err
+}
+
+// Delivers a due message's rendered body on its channel
+func deliver(ctx context.Context, c redis.Conn, msg *Message, body string) error {
+	switch msg.Channel {
+	case "", CHANNEL_SMS:
+		urls, err := mediaURLs(c, msg.Media)
+		if err != nil {
+			return err
+		}
+		return sendTwilioMessage(ctx, HTTP_CLIENT, msg.To, body, statusCallbackURL(msg.ID), urls)
+	case CHANNEL_VOICE:
+		return MakeTwilioCall(ctx, HTTP_CLIENT, msg.To, body)
+	case CHANNEL_EMAIL:
+		d, err := verifiedDestination(c, msg.To, msg.Channel, msg.Destination)
+		if err != nil {
+			return err
+		}
+		return SendEmail(ctx, d.Address, "Reminder from TextRemind", body)
+	case CHANNEL_WEBHOOK:
+		d, err := verifiedDestination(c, msg.To, msg.Channel, msg.Destination)
+		if err != nil {
+			return err
+		}
+		_, err = PostWebhook(ctx, d.Address, d.Secret, map[string]interface{}{
+			"type":   "reminder",
+			"id":     msg.ID,
+			"number": msg.To,
+			"body":   body,
+			"time":   msg.Time,
+		})
+		return err
+	}
+	return fmt.Errorf("unknown channel %q", msg.Channel)
+}
+
+// Gets the stored fields for the channel of a message to owner from
+// "channel" and, for email and webhooks, "destination". Writes an error and
+// returns false if the destination isn't verified.
+func messageChannel(w http.ResponseWriter, r *http.Request, owner string, data map[string]string) ([]interface{}, bool) {
+	channel := data["channel"]
+	switch channel {
+	case "", CHANNEL_SMS:
+		return nil, true
+	case CHANNEL_VOICE:
+		return []interface{}{"channel", channel}, true
+	case CHANNEL_EMAIL, CHANNEL_WEBHOOK:
+		address, ok := checkDestination(w, r, owner, channel, data["destination"])
+		if !ok {
+			return nil, false
+		}
+		return []interface{}{"channel", channel, "destination", address}, true
+	}
+	WriteJSONError(w, "Channel must be one of sms, voice, email or webhook.", http.StatusBadRequest)
+	return nil, false
+}
+
+// Checks address is one of owner's verified destinations for channel,
+// returning it in canonical form. Writes an error and returns false if not.
+func checkDestination(w http.ResponseWriter, r *http.Request, owner, channel, address string) (string, bool) {
+	address, err := normalizeAddress(channel, address)
+	if err != nil {
+		WriteJSONError(w, "Destination is not a valid "+channel+" address.", http.StatusBadRequest)
+		return "", false
+	}
+	c := GetConn()
+	defer c.Close()
+	_, err = verifiedDestination(c, owner, channel, address)
+	if err == ErrDestinationGone {
+		WriteJSONError(w, "Destination hasn't been verified.", http.StatusBadRequest)
+		return "", false
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get destination", Fields{"number": owner, "error": err})
+		WriteJSONError(w, ERR_S+"checking the destination.", http.StatusInternalServerError)
+		return "", false
+	}
+	return address, true
+}
+
+// Checks the body of a message on a channel other than SMS isn't too long
+func checkChannelBody(body string) error {
+	if n := len([]rune(body)); n > MAX_CHANNEL_BODY {
+		return fmt.Errorf("Messages can't be longer than %d characters.", MAX_CHANNEL_BODY)
+	}
+	return nil
+}
+
+// Adds an email or webhook destination and starts verifying it,
+// {"number", "password", "channel", "address"}
+func addDestination(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	d, err := AddDestination(r.Context(), data["number"], data["channel"], data["address"])
+	switch {
+	case err == ErrInvalidDestination:
+		WriteJSONError(w, "Destinations must be an email address or a public http(s) URL for a webhook.", http.StatusBadRequest)
+	case err == ErrEmailDisabled:
+		WriteJSONError(w, "Email delivery isn't available.", http.StatusBadRequest)
+	case err == ErrVerifyTooSoon:
+		WriteJSONError(w, "A code was sent to that address recently, please wait before asking for another.", http.StatusTooManyRequests)
+	case errors.Is(err, ErrChallengeFailed):
+		WriteJSONError(w, "Webhook didn't respond to the verification challenge: "+err.Error()+".", http.StatusBadRequest)
+	case err == ErrTooManyDestinations:
+		WriteJSONError(w, fmt.Sprintf("You can't have more than %d destinations.", MAX_DESTINATIONS), http.StatusBadRequest)
+	case err != nil:
+		LoggerFrom(r.Context()).Error("could not add destination", Fields{"number": data["number"], "channel": data["channel"], "error": err})
+		WriteJSONError(w, DESTINATIONS_ERR_S, http.StatusInternalServerError)
+	default:
+		d.Code, d.CodeSent, d.CodeExpires, d.CodeAttempts = "", 0, 0, 0
+		WriteJSON(w, map[string]interface{}{"destination": d}, http.StatusOK)
+	}
+}
+
+// Checks a code emailed to a destination, {"number", "password", "channel", "address", "code"}
+func verifyDestination(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	valid, err := VerifyDestination(data["number"], data["channel"], data["address"], data["code"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No destination with that address.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not verify destination", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, DESTINATIONS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"valid": valid}, http.StatusOK)
+}
+
+// Lists destinations, {"number", "password"}
+func listDestinations(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	ds, err := ListDestinations(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list destinations", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, DESTINATIONS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"destinations": ds}, http.StatusOK)
+}
+
+// Removes a destination, {"number", "password", "channel", "address"}
+func removeDestination(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := RemoveDestination(data["number"], data["channel"], data["address"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No destination with that address.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not remove destination", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, DESTINATIONS_ERR_S, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/scascketta/textremind/webhook"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmailChannel(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	auth := func(data map[string]string) map[string]string {
+		data["number"], data["password"] = number, password
+		return data
+	}
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	schedule := map[string]string{"to": number, "password": password, "time": at, "body": "Renew passport", "channel": "email", "destination": "Me <me@example.com>"}
+
+	if code, _ := app.PostJSON("/schedule", schedule); code != http.StatusBadRequest {
+		t.Errorf("schedule to unverified email: got status %d", code)
+	}
+	if code, res := app.PostJSON("/destinations/add", auth(map[string]string{"channel": "email", "address": "me@example.com"})); code != http.StatusOK {
+		t.Fatalf("add email: got status %d, %v", code, res)
+	}
+	emails := app.SMTP.Emails()
+	if len(emails) != 1 || emails[0].To[0] != "me@example.com" {
+		t.Fatalf("expected a verification email, got %+v", emails)
+	}
+	code := regexp.MustCompile(`\d{6}`).FindString(emails[0].Body)
+
+	verify := auth(map[string]string{"channel": "email", "address": "me@example.com", "code": "000000x"})
+	if _, res := app.PostJSON("/destinations/verify", verify); res["valid"] != false {
+		t.Errorf("wrong code accepted: %v", res)
+	}
+	verify["code"] = code
+	if _, res := app.PostJSON("/destinations/verify", verify); res["valid"] != true {
+		t.Fatalf("code %s not accepted: %v", code, res)
+	}
+
+	if code, res := app.PostJSON("/schedule", schedule); code != http.StatusOK {
+		t.Fatalf("schedule email: got status %d, %v", code, res)
+	}
+	app.Advance(time.Hour)
+	app.Dispatch()
+	emails = app.SMTP.Emails()
+	if last := emails[len(emails)-1]; last.To[0] != "me@example.com" || strings.TrimSpace(last.Body) != "Renew passport" {
+		t.Errorf("expected reminder email, got %+v", last)
+	}
+	if n := len(app.Twilio.Messages()); n != 1 {
+		t.Errorf("email reminder also sent by SMS: %d messages", n)
+	}
+
+	// removing the destination skips messages already scheduled to it
+	app.PostJSON("/schedule", schedule)
+	app.PostJSON("/destinations/remove", auth(map[string]string{"channel": "email", "address": "me@example.com"}))
+	app.Advance(time.Hour)
+	app.Dispatch()
+	if n := len(app.SMTP.Emails()); n != 2 {
+		t.Errorf("expected no email to removed destination, got %d emails", n)
+	}
+	conn := app.DB.Conn()
+	defer conn.Close()
+	keys, _ := redis.Strings(conn.Do("KEYS", "*"))
+	skipped := false
+	for _, k := range keys {
+		if msg, err := GetMessage(k); err == nil && msg.Status == STATUS_SKIPPED {
+			skipped = true
+		}
+	}
+	if !skipped {
+		t.Error("message to removed destination not marked skipped")
+	}
+}
+
+func TestVoiceChannel(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	schedule := map[string]string{"to": number, "password": password, "time": at, "body": "Take <meds> & water", "channel": "voice"}
+	if code, res := app.PostJSON("/schedule", schedule); code != http.StatusOK {
+		t.Fatalf("schedule call: got status %d, %v", code, res)
+	}
+	app.Advance(time.Hour)
+	app.Dispatch()
+	calls := app.Twilio.Calls()
+	if len(calls) != 1 || calls[0].To != number {
+		t.Fatalf("expected a call to %s, got %+v", number, calls)
+	}
+	if want := "<Response><Say>Take &lt;meds&gt; &amp; water</Say></Response>"; calls[0].Twiml != want {
+		t.Errorf("got TwiML %q, want %q", calls[0].Twiml, want)
+	}
+}
+
+func TestWebhookChannel(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+
+	var mu sync.Mutex
+	var secret string
+	received := make([]map[string]interface{}, 0)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		data := make(map[string]interface{})
+		json.Unmarshal(body, &data)
+		if data["type"] == "verification" {
+			w.Write([]byte(data["challenge"].(string)))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := webhook.Verify(r, secret, body, app.Clock.Now(), time.Minute); err != nil {
+			t.Errorf("webhook has invalid signature: %v", err)
+		}
+		received = append(received, data)
+	}))
+	defer hook.Close()
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer silent.Close()
+
+	add := map[string]string{"number": number, "password": password, "channel": "webhook", "address": silent.URL}
+	if code, _ := app.PostJSON("/destinations/add", add); code != http.StatusBadRequest {
+		t.Errorf("webhook which ignored the challenge added: got status %d", code)
+	}
+	add["address"] = hook.URL + "/reminders"
+	code, res := app.PostJSON("/destinations/add", add)
+	d, _ := res["destination"].(map[string]interface{})
+	if code != http.StatusOK || d["verified"] != true {
+		t.Fatalf("add webhook: got status %d, %v", code, res)
+	}
+	mu.Lock()
+	secret = d["secret"].(string)
+	mu.Unlock()
+
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	schedule := map[string]string{"to": number, "password": password, "time": at, "body": "Deploy freeze", "channel": "webhook", "destination": hook.URL + "/reminders"}
+	if code, res := app.PostJSON("/schedule", schedule); code != http.StatusOK {
+		t.Fatalf("schedule webhook: got status %d, %v", code, res)
+	}
+	app.Advance(time.Hour)
+	app.Dispatch()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0]["body"] != "Deploy freeze" || received[0]["type"] != "reminder" {
+		t.Errorf("expected one reminder webhook, got %v", received)
+	}
+}
+
+func TestPermanentDeliveryErrors(t *testing.T) {
+	app := NewTestApp(t)
+	ctx := context.Background()
+	email, hook := &Message{Channel: CHANNEL_EMAIL}, &Message{Channel: CHANNEL_WEBHOOK}
+
+	app.SMTP.Reject("gone@example.com")
+	if err := SendEmail(ctx, "gone@example.com", "Hi", "hi"); !failedPermanently(email, err) {
+		t.Errorf("unknown mailbox not permanent: %v", err)
+	}
+
+	status := http.StatusGone
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(status) }))
+	defer server.Close()
+	if _, err := PostWebhook(ctx, server.URL, "secret", nil); !failedPermanently(hook, err) {
+		t.Errorf("410 from webhook not permanent: %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	_, err := PostWebhook(ctx, server.URL, "secret", nil)
+	if failedPermanently(hook, err) {
+		t.Errorf("503 from webhook permanent on the first attempt: %v", err)
+	}
+	hook.Attempts = MAX_DELIVERY_ATTEMPTS - 1
+	if !failedPermanently(hook, err) {
+		t.Errorf("webhook still retried after %d attempts", MAX_DELIVERY_ATTEMPTS)
+	}
+	text := &Message{Attempts: MAX_DELIVERY_ATTEMPTS - 1}
+	if !failedPermanently(text, &TwilioError{StatusCode: http.StatusServiceUnavailable}) {
+		t.Errorf("SMS still retried after %d attempts", MAX_DELIVERY_ATTEMPTS)
+	}
+
+	// retrying can't render a template or bring back media
+	text.Attempts = 0
+	c := GetConn()
+	defer c.Close()
+	if _, err := messageBody(c, &Message{To: "5558675309", Template: "{{.missing}}"}, app.Clock.Now()); !failedPermanently(text, err) {
+		t.Errorf("template render error not permanent: %v", err)
+	}
+	if _, err := mediaURLs(c, []string{"gone"}); !failedPermanently(text, err) {
+		t.Errorf("missing media not permanent: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const USAGE = `Usage: textremind <command> [arguments]
+
+Commands:
+  serve [-mode all|api|worker]    run the HTTP API and/or dispatcher (default)
+  dispatch                        run only the message dispatcher, same as serve -mode worker
+  users list                      list users
+  users show <number>             show a user
+  users lock <number>             stop a user scheduling messages or verifying
+  users unlock <number>           undo users lock
+  users delete <number>           delete a user and their scheduled messages
+  messages list [-due]            list scheduled messages
+  messages cancel <id>            unschedule and delete a message
+  messages requeue <id> [time]    reschedule a message, for now by default
+  send-test <number> [body]       send a SMS through the provider
+  migrate [-dry-run]              apply pending storage migrations
+  fake-twilio [flags]             run a fake Twilio server for development
+
+Configuration is read from the same environment variables as the server.
+In worker mode health checks and metrics are served on TEXTREMIND_WORKER_ADDR
+(default :9091), which all mode also does if it is set.
+`
+
+// Error with a message for the user, exits with status 2
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// Runs the command named by args[0], returns the exit status
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	cmd := "serve"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		mode := fs.String("mode", envOr("TEXTREMIND_MODE", MODE_ALL), "what to run: all, api or worker")
+		if err = fs.Parse(args); err != nil {
+			err = usageError(err.Error())
+		} else {
+			serve(*mode)
+		}
+	case "dispatch":
+		serve(MODE_WORKER)
+	case "users":
+		err = usersCommand(args, stdout)
+	case "messages":
+		err = messagesCommand(args, stdout)
+	case "send-test":
+		err = sendTestCommand(args, stdout)
+	case "migrate":
+		err = migrateCommand(args, stdout)
+	case "fake-twilio":
+		runFakeTwilio(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, USAGE)
+	default:
+		err = usageError(fmt.Sprintf("unknown command %q", cmd))
+	}
+
+	if _, ok := err.(usageError); ok {
+		fmt.Fprintf(stderr, "textremind: %s\n\n%s", err, USAGE)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "textremind: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Returns the single argument of a subcommand or a usageError
+func oneArg(cmd string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", usageError(cmd + " takes exactly one argument")
+	}
+	return args[0], nil
+}
+
+func usersCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return usageError("users needs a subcommand")
+	}
+	sub, args := args[0], args[1:]
+
+	switch sub {
+	case "list":
+		users, err := ListUsers()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NUMBER\tSTATUS\tLOCKED\tSCHEDULED")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%d\n", u.Number, userStatus(u), u.Locked, u.ScheduledMessages)
+		}
+		return tw.Flush()
+	case "show":
+		number, err := oneArg("users show", args)
+		if err != nil {
+			return err
+		}
+		u, err := GetUser(number)
+		if err != nil {
+			return fmt.Errorf("user %s: %s", number, err)
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "Number:\t%s\n", u.Number)
+		fmt.Fprintf(tw, "Status:\t%s\n", userStatus(u))
+		fmt.Fprintf(tw, "Password set:\t%t\n", u.PasswordSet)
+		fmt.Fprintf(tw, "Locked:\t%t\n", u.Locked)
+		fmt.Fprintf(tw, "Scheduled messages:\t%d\n", u.ScheduledMessages)
+		return tw.Flush()
+	case "lock", "unlock":
+		number, err := oneArg("users "+sub, args)
+		if err != nil {
+			return err
+		}
+		if err := SetUserLocked(number, sub == "lock"); err != nil {
+			return fmt.Errorf("user %s: %s", number, err)
+		}
+		fmt.Fprintf(out, "%sed %s\n", sub, number)
+		return nil
+	case "delete":
+		number, err := oneArg("users delete", args)
+		if err != nil {
+			return err
+		}
+		if err := DeleteUser(number); err != nil {
+			return fmt.Errorf("user %s: %s", number, err)
+		}
+		fmt.Fprintf(out, "deleted %s\n", number)
+		return nil
+	}
+	return usageError(fmt.Sprintf("unknown users subcommand %q", sub))
+}
+
+func userStatus(u *User) string {
+	switch {
+	case u.Verified:
+		return "verified"
+	case u.OnlyNumberVerified:
+		return "awaiting password"
+	}
+	return "unverified"
+}
+
+func messagesCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return usageError("messages needs a subcommand")
+	}
+	sub, args := args[0], args[1:]
+
+	switch sub {
+	case "list":
+		fs := flag.NewFlagSet("messages list", flag.ContinueOnError)
+		fs.SetOutput(out)
+		due := fs.Bool("due", false, "only list messages which are due")
+		if err := fs.Parse(args); err != nil {
+			return usageError(err.Error())
+		}
+		before := int64(0)
+		if *due {
+			before = CLOCK.Now().Unix() + 1
+		}
+		msgs, err := ListMessages(before)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTIME\tTO\tBODY")
+		for _, m := range msgs {
+			body := m.Body
+			if m.Template != "" {
+				body = "template: " + m.Template
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.ID, time.Unix(m.Time, 0).UTC().Format(time.RFC3339), m.To, truncate(body, 40))
+		}
+		return tw.Flush()
+	case "cancel":
+		id, err := oneArg("messages cancel", args)
+		if err != nil {
+			return err
+		}
+		if err := CancelMessage(id); err != nil {
+			return fmt.Errorf("message %s: %s", id, err)
+		}
+		fmt.Fprintf(out, "cancelled %s\n", id)
+		return nil
+	case "requeue":
+		if len(args) < 1 || len(args) > 2 {
+			return usageError("messages requeue takes a message ID and optional unix time")
+		}
+		at := CLOCK.Now().Unix()
+		if len(args) == 2 {
+			var err error
+			if at, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return usageError(fmt.Sprintf("invalid unix time %q", args[1]))
+			}
+		}
+		if err := RequeueMessage(args[0], at); err != nil {
+			return fmt.Errorf("message %s: %s", args[0], err)
+		}
+		fmt.Fprintf(out, "requeued %s for %s\n", args[0], time.Unix(at, 0).UTC().Format(time.RFC3339))
+		return nil
+	}
+	return usageError(fmt.Sprintf("unknown messages subcommand %q", sub))
+}
+
+func sendTestCommand(args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return usageError("send-test needs a number")
+	}
+	body := "This is a test message from TextRemind."
+	if len(args) > 1 {
+		body = strings.Join(args[1:], " ")
+	}
+	checkRequiredEnvVars(requiredTwilioEnvVars())
+	if err := SendTwilioMessage(context.Background(), HTTP_CLIENT, args[0], body); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "sent test message to %s\n", args[0])
+	return nil
+}
+
+// Twilio settings send-test needs, unless using a fake Twilio server
+func requiredTwilioEnvVars() []string {
+	required := make([]string, 0)
+	for _, ev := range requiredEnvVars(false) {
+		if stringIn(ev, TWILIO_ENV_VARS) {
+			required = append(required, ev)
+		}
+	}
+	return required
+}
+
+func migrateCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "list pending migrations without applying them")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+
+	pending, err := PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(out, "storage is up to date")
+		return nil
+	}
+	if *dryRun {
+		for _, m := range pending {
+			fmt.Fprintf(out, "pending %d: %s\n", m.Version, m.Description)
+		}
+		return nil
+	}
+	return Migrate(func(m migration) {
+		fmt.Fprintf(out, "applied %d: %s\n", m.Version, m.Description)
+	})
+}
+
+// Shortens s to at most n runes, marking where it was cut
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
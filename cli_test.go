@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs a CLI command, failing the test if its exit status isn't want
+func runCLI(t *testing.T, want int, args ...string) string {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if got := runCommand(args, stdout, stderr); got != want {
+		t.Fatalf("textremind %s: exit status %d, want %d\nstdout: %s\nstderr: %s", strings.Join(args, " "), got, want, stdout, stderr)
+	}
+	return stdout.String()
+}
+
+func TestCLIUsers(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	if err := ScheduleMessage(context.Background(), "hi", number, at); err != nil {
+		t.Fatal(err)
+	}
+
+	out := runCLI(t, 0, "users", "list")
+	if !strings.Contains(out, number) || !strings.Contains(out, "verified") {
+		t.Errorf("users list missing user: %s", out)
+	}
+	out = runCLI(t, 0, "users", "show", number)
+	if !strings.Contains(out, "Scheduled messages:  1") {
+		t.Errorf("users show missing scheduled message count: %s", out)
+	}
+
+	runCLI(t, 0, "users", "lock", number)
+	code, _ := app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "body": "hi", "time": at})
+	if code != 403 {
+		t.Errorf("locked user scheduled a message: got status %d", code)
+	}
+	runCLI(t, 0, "users", "unlock", number)
+
+	runCLI(t, 0, "users", "delete", number)
+	runCLI(t, 1, "users", "show", number)
+	if msgs, _ := ListMessages(0); len(msgs) != 0 {
+		t.Errorf("deleted user's messages still scheduled: %v", msgs)
+	}
+}
+
+func TestCLIMessages(t *testing.T) {
+	app := NewTestApp(t)
+	later := app.Clock.Now().Add(time.Hour).Unix()
+	if err := ScheduleMessage(context.Background(), "hi", "5558675309", strconv.FormatInt(later, 10)); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := ListMessages(0)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	id := msgs[0].ID
+
+	if out := runCLI(t, 0, "messages", "list", "-due"); strings.Contains(out, id) {
+		t.Errorf("message listed as due before its time: %s", out)
+	}
+	runCLI(t, 0, "messages", "requeue", id)
+	if out := runCLI(t, 0, "messages", "list", "-due"); !strings.Contains(out, id) {
+		t.Errorf("requeued message not due: %s", out)
+	}
+	app.Dispatch()
+	if len(app.Twilio.Messages()) != 1 {
+		t.Error("requeued message not dispatched")
+	}
+
+	runCLI(t, 1, "messages", "cancel", id)
+	runCLI(t, 2, "messages", "frobnicate")
+}
+
+func TestCLIRequeueFailedMessage(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	app.Twilio.SetConfig(FakeConfig{FailNumbers: map[string]int{number: TWILIO_ERR_INVALID_NUMBER}})
+	now := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	if err := ScheduleMessage(context.Background(), "hi", number, now); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := ListMessages(0)
+	id := msgs[0].ID
+	app.Dispatch()
+	if msg, _ := GetMessage(id); msg == nil || msg.Status != STATUS_FAILED {
+		t.Fatalf("message did not fail permanently: %+v", msg)
+	}
+
+	// its body was removed when it failed, so there's nothing to send
+	runCLI(t, 1, "messages", "requeue", id)
+	if msgs, _ := ListMessages(0); len(msgs) != 0 {
+		t.Errorf("failed message without content requeued: %+v", msgs)
+	}
+
+	// messages which may fall back keep their content
+	c := GetConn()
+	defer c.Close()
+	c.Do("HSET", id, "body", "hi")
+	runCLI(t, 0, "messages", "requeue", id)
+	if ttl, _ := redis.Int(c.Do("TTL", id)); ttl != -1 {
+		t.Errorf("requeued message still expires in %ds", ttl)
+	}
+	if msg, _ := GetMessage(id); msg == nil || msg.Attempts != 0 || msg.LastError != "" {
+		t.Errorf("requeued message kept its failure: %+v", msg)
+	}
+	app.Twilio.SetConfig(FakeConfig{})
+	app.Dispatch()
+	if msgs := app.Twilio.Messages(); len(msgs) != 1 || msgs[0].Body != "hi" {
+		t.Errorf("requeued message not sent: %+v", msgs)
+	}
+}
+
+func TestCLIMigrate(t *testing.T) {
+	NewTestApp(t)
+	c := GetConn()
+	c.Do("ZADD", "messages", 1, "legacy")
+	c.Do("HSET", "legacy", "to", "5558675309")
+	c.Close()
+
+	if out := runCLI(t, 0, "migrate", "-dry-run"); !strings.Contains(out, "pending 1") {
+		t.Errorf("migration not pending: %s", out)
+	}
+	runCLI(t, 0, "migrate")
+	if u, err := GetUser("5558675309"); err != nil || u.ScheduledMessages != 1 {
+		t.Errorf("legacy message not indexed: %+v, %v", u, err)
+	}
+	if out := runCLI(t, 0, "migrate"); !strings.Contains(out, "up to date") {
+		t.Errorf("migration applied twice: %s", out)
+	}
+}
+
+func TestDeleteUserRemovesEverything(t *testing.T) {
+	app := NewTestApp(t)
+	owner, password, contact := "5558675309", "correct horse battery", "5551230001"
+	verifyNumber(t, app, owner, password)
+	auth := func(data map[string]string) map[string]string {
+		data["number"], data["password"] = owner, password
+		return data
+	}
+	app.PostJSON("/contacts/add", auth(map[string]string{"contact": contact, "name": "alice"}))
+	app.ReceiveSMS("+1"+contact, "YES")
+	app.PostJSON("/groups/save", auth(map[string]string{"name": "team", "members": contact}))
+	app.PostJSON("/templates/save", auth(map[string]string{"name": "standup", "body": "Standup"}))
+	app.PostJSON("/escalations/save", auth(map[string]string{"name": "boss", "steps": contact + ":5"}))
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	if code, res := app.PostJSON("/schedule", auth(map[string]string{"group": "team", "body": "hi", "time": at})); code != 200 {
+		t.Fatalf("schedule group message: got status %d, %v", code, res)
+	}
+	cal, err := NewCalendar(owner, "work", "https://example.com/work.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := GetConn()
+	defer c.Close()
+	c.Do("ZADD", CALENDAR_SYNC_KEY, 0, cal.ID)
+	c.Do("HSET", subscriptionsKey(owner), "sub", `{"id":"sub","url":"https://example.com/hook"}`)
+	c.Do("HSET", destinationsKey(owner), "email:a@example.com", `{"channel":"email","address":"a@example.com"}`)
+
+	runCLI(t, 0, "users", "delete", owner)
+	keys, _ := redis.Strings(c.Do("KEYS", "*"))
+	for _, key := range keys {
+		// invitation limits expire on their own
+		if strings.Contains(key, owner) && !strings.HasPrefix(key, "invite") {
+			t.Errorf("deleted user's key %q remains", key)
+		}
+	}
+	for _, key := range []string{"messages", CALENDAR_SYNC_KEY, userMessagesKey(contact), contactOfKey(contact)} {
+		if n, _ := redis.Int(c.Do("ZCARD", key)); n != 0 {
+			t.Errorf("%s has %d entries after deleting user", key, n)
+		}
+		if n, _ := redis.Int(c.Do("SCARD", key)); n != 0 {
+			t.Errorf("%s has %d entries after deleting user", key, n)
+		}
+	}
+}
+
+func TestDispatchSkipsDeletedOwners(t *testing.T) {
+	app := NewTestApp(t)
+	owner, contact := "5558675309", "5551230001"
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	if _, err := scheduleMessage(context.Background(), contact, at, "owner", owner, "body", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	c := GetConn()
+	defer c.Close()
+	putCalendar(c, &Calendar{ID: "cal", Owner: owner, URL: "https://example.com/work.ics"})
+	c.Do("ZADD", CALENDAR_SYNC_KEY, 0, "cal")
+
+	app.Dispatch()
+	if n := len(app.Twilio.Messages()); n != 0 {
+		t.Errorf("sent %d messages for a deleted user", n)
+	}
+	if _, err := redis.Int(c.Do("ZSCORE", CALENDAR_SYNC_KEY, "cal")); err != redis.ErrNil {
+		t.Errorf("deleted user's calendar still syncing: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Package client is a Go client for the TextRemind API.
+//
+//	c := client.New("https://textremind.example.com", "5558675309")
+//	c.APIKey = os.Getenv("TEXTREMIND_API_KEY")
+//	res, err := c.Schedule(ctx, client.ScheduleRequest{Time: at, Body: "Call mum"})
+//	if errors.Is(err, client.ErrBadRequest) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/scascketta/textremind/sms"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most of an error response which is read
+const MAX_ERROR_BODY = 64 << 10
+
+// Errors an *Error matches with errors.Is, by status code
+var (
+	ErrBadRequest      = errors.New("bad request")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrForbidden       = errors.New("forbidden")
+	ErrNotFound        = errors.New("not found")
+	ErrConflict        = errors.New("conflict")
+	ErrUnprocessable   = errors.New("unprocessable")
+	ErrTooManyRequests = errors.New("too many requests")
+	ErrServer          = errors.New("server error")
+)
+
+var STATUS_ERRORS = map[int]error{
+	http.StatusBadRequest:          ErrBadRequest,
+	http.StatusUnauthorized:        ErrUnauthorized,
+	http.StatusForbidden:           ErrForbidden,
+	http.StatusNotFound:            ErrNotFound,
+	http.StatusConflict:            ErrConflict,
+	http.StatusUnprocessableEntity: ErrUnprocessable,
+	http.StatusTooManyRequests:     ErrTooManyRequests,
+}
+
+// An error response from the API. Message is the server's explanation, which
+// can be shown to users.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("textremind: %d %s", e.StatusCode, e.Message)
+}
+
+// Matches the Err value for the status code, so callers can use errors.Is
+func (e *Error) Is(target error) bool {
+	if e.StatusCode >= 500 {
+		return target == ErrServer
+	}
+	return STATUS_ERRORS[e.StatusCode] == target
+}
+
+// A client for one user's number. Requests are authenticated with APIKey if
+// it's set, otherwise Password.
+type Client struct {
+	BaseURL string
+	// http.DefaultClient if nil
+	HTTPClient *http.Client
+	Number     string
+	Password   string
+	APIKey     string
+}
+
+// Makes a client for number on the server at baseURL, set Password or APIKey
+// before making requests
+func New(baseURL, number string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), Number: number}
+}
+
+// A scheduled message, as returned by the API
+type Message struct {
+	ID       string            `json:"id"`
+	To       string            `json:"to"`
+	Body     string            `json:"body"`
+	Template string            `json:"template,omitempty"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	Media    []string          `json:"media,omitempty"`
+	// Unix time it's due
+	Time        int64  `json:"time"`
+	Channel     string `json:"channel,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Urgent      bool   `json:"urgent,omitempty"`
+	Ack         string `json:"ack,omitempty"`
+	Scheduled   bool   `json:"scheduled"`
+	Status      string `json:"status"`
+	Delivery    string `json:"delivery,omitempty"`
+	SentAt      int64  `json:"sent_at,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// A message to schedule for the client's number. Either Body or Template is
+// set, Vars fill in the template.
+type ScheduleRequest struct {
+	Time     time.Time
+	Body     string
+	Template string
+	Vars     map[string]string
+	// IDs of uploaded images
+	Media []string
+	// "sms" if empty, or "voice", "email" or "webhook"
+	Channel     string
+	Destination string
+	Urgent      bool
+	// Keep re-sending until the reminder is acknowledged
+	Ack bool
+	// Lowers the server's limit on SMS segments if set
+	MaxSegments int
+	// Retries with the same key get the first response rather than
+	// scheduling the message again
+	IdempotencyKey string
+}
+
+// The response to scheduling a message
+type ScheduleResult struct {
+	ID string `json:"id"`
+	// How an SMS will be sent, see sms.Analyze
+	SMS *sms.Info `json:"sms,omitempty"`
+	// Set if the message falls in quiet hours and will be sent later
+	Warning       string `json:"warning,omitempty"`
+	DeferredUntil int64  `json:"deferred_until,omitempty"`
+	// Whether this is the stored response to an earlier request with the
+	// same IdempotencyKey
+	Replayed bool `json:"-"`
+}
+
+// The credentials for a request, as the server expects them
+func (c *Client) auth(data map[string]string, numberField string) map[string]string {
+	data[numberField] = c.Number
+	if c.APIKey == "" {
+		data["password"] = c.Password
+	}
+	return data
+}
+
+// POSTs data as JSON to path and decodes the response into res, if it's
+// not nil
+func (c *Client) post(ctx context.Context, path string, data map[string]string, header http.Header, res interface{}) (*http.Response, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, res)
+}
+
+// GETs path with query and decodes the response into res
+func (c *Client) get(ctx context.Context, path string, query url.Values, res interface{}) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req, res)
+}
+
+func (c *Client) do(req *http.Request, res interface{}) (*http.Response, error) {
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_ERROR_BODY))
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var body struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &body) == nil && body.Message != "" {
+			apiErr.Message = body.Message
+		} else {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return resp, apiErr
+	}
+	if res == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return resp, fmt.Errorf("textremind: could not decode response: %v", err)
+	}
+	return resp, nil
+}
+
+// Schedules a message to the client's number
+func (c *Client) Schedule(ctx context.Context, req ScheduleRequest) (*ScheduleResult, error) {
+	data := c.auth(map[string]string{
+		"time":        strconv.FormatInt(req.Time.Unix(), 10),
+		"body":        req.Body,
+		"template":    req.Template,
+		"media":       strings.Join(req.Media, ","),
+		"channel":     req.Channel,
+		"destination": req.Destination,
+	}, "to")
+	for k, v := range req.Vars {
+		data["var."+k] = v
+	}
+	if req.Urgent {
+		data["urgent"] = "true"
+	}
+	if req.Ack {
+		data["ack"] = "true"
+	}
+	if req.MaxSegments > 0 {
+		data["max_segments"] = strconv.Itoa(req.MaxSegments)
+	}
+	header := make(http.Header)
+	if req.IdempotencyKey != "" {
+		header.Set("Idempotency-Key", req.IdempotencyKey)
+	}
+	res := &ScheduleResult{}
+	resp, err := c.post(ctx, "/schedule", data, header, res)
+	if err != nil {
+		return nil, err
+	}
+	res.Replayed = resp.Header.Get("Idempotent-Replayed") == "true"
+	return res, nil
+}
+
+// Lists the messages scheduled to the client's number and by it for its
+// contacts, soonest first
+func (c *Client) ListMessages(ctx context.Context) ([]*Message, error) {
+	var res struct {
+		Messages []*Message `json:"messages"`
+	}
+	if _, err := c.post(ctx, "/messages/list", c.auth(map[string]string{}, "number"), nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Messages, nil
+}
+
+// Gets a message, which must be to the client's number or sent by it to a
+// contact
+func (c *Client) GetMessage(ctx context.Context, id string) (*Message, error) {
+	var res struct {
+		Message *Message `json:"message"`
+	}
+	if _, err := c.post(ctx, "/message_status", c.auth(map[string]string{"id": id}, "number"), nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Message, nil
+}
+
+// Cancels a scheduled message. Messages already sent, or not the client's,
+// are ErrNotFound.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	_, err := c.post(ctx, "/messages/cancel", c.auth(map[string]string{"id": id}, "number"), nil, nil)
+	return err
+}
+
+// Texts a verification code to the client's number. Codes can be requested
+// once a minute, sooner is ErrTooManyRequests.
+func (c *Client) SendVerification(ctx context.Context) error {
+	_, err := c.post(ctx, "/send_verification", map[string]string{"number": c.Number}, nil, nil)
+	return err
+}
+
+// Checks the code texted by SendVerification, which lets the number set a
+// password with SetPassword
+func (c *Client) Verify(ctx context.Context, code string) (bool, error) {
+	var res struct {
+		Valid bool `json:"valid"`
+	}
+	_, err := c.get(ctx, "/check_verification", url.Values{"number": {c.Number}, "code": {code}}, &res)
+	return res.Valid, err
+}
+
+// Sets the number's password once it's been verified, and uses it for
+// later requests
+func (c *Client) SetPassword(ctx context.Context, password string) error {
+	if _, err := c.post(ctx, "/set_password", map[string]string{"number": c.Number, "password": password}, nil, nil); err != nil {
+		return err
+	}
+	c.Password = password
+	return nil
+}
+
+// Whether the number has been verified and has a password
+func (c *Client) IsVerified(ctx context.Context) (bool, error) {
+	var res struct {
+		Verified bool `json:"verified"`
+	}
+	_, err := c.get(ctx, "/check", url.Values{"number": {c.Number}}, &res)
+	return res.Verified, err
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	for code, want := range STATUS_ERRORS {
+		err := fmt.Errorf("scheduling: %w", &Error{StatusCode: code, Message: "Nope."})
+		if !errors.Is(err, want) || errors.Is(err, ErrServer) {
+			t.Errorf("%d doesn't match %v", code, want)
+		}
+	}
+	if err := (&Error{StatusCode: http.StatusServiceUnavailable}); !errors.Is(err, ErrServer) || errors.Is(err, ErrBadRequest) {
+		t.Errorf("503 doesn't match only ErrServer")
+	}
+	if errors.Is(&Error{StatusCode: http.StatusTeapot}, ErrBadRequest) {
+		t.Error("418 matches ErrBadRequest")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/scascketta/textremind/client"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	ctx := context.Background()
+	c := client.New(app.Server.URL+"/", number)
+
+	if err := c.SendVerification(ctx); err != nil {
+		t.Fatalf("SendVerification: %v", err)
+	}
+	if err := c.SendVerification(ctx); !errors.Is(err, client.ErrTooManyRequests) {
+		t.Errorf("expected ErrTooManyRequests, got %v", err)
+	}
+	msgs := app.Twilio.Messages()
+	if valid, err := c.Verify(ctx, "000000x"); valid || err != nil {
+		t.Errorf("wrong code verified: %v, %v", valid, err)
+	}
+	if valid, err := c.Verify(ctx, CODE_RE.FindString(msgs[len(msgs)-1].Body)); !valid || err != nil {
+		t.Fatalf("Verify: %v, %v", valid, err)
+	}
+	if err := c.SetPassword(ctx, password); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+	if verified, err := c.IsVerified(ctx); !verified || err != nil {
+		t.Errorf("IsVerified: %v, %v", verified, err)
+	}
+
+	at := app.Clock.Now().Add(time.Hour)
+	req := client.ScheduleRequest{Time: at, Body: "Call mum", IdempotencyKey: "call-mum"}
+	first, err := c.Schedule(ctx, req)
+	if err != nil || first.ID == "" || first.SMS == nil || first.SMS.Segments != 1 {
+		t.Fatalf("Schedule: %+v, %v", first, err)
+	}
+	if again, err := c.Schedule(ctx, req); err != nil || again.ID != first.ID || !again.Replayed {
+		t.Errorf("retry was not replayed: %+v, %v", again, err)
+	}
+	second, err := c.Schedule(ctx, client.ScheduleRequest{Time: at.Add(time.Hour), Body: "Feed the dog"})
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	if _, err := c.Schedule(ctx, client.ScheduleRequest{Time: at, Template: "missing"}); !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("expected ErrBadRequest for a missing template, got %v", err)
+	}
+
+	listed, err := c.ListMessages(ctx)
+	if err != nil || len(listed) != 2 || listed[0].ID != first.ID || listed[1].Body != "Feed the dog" || listed[0].Time != at.Unix() {
+		t.Fatalf("ListMessages: %+v, %v", listed, err)
+	}
+	if err := c.Cancel(ctx, second.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	err = c.Cancel(ctx, second.ID)
+	var apiErr *client.Error
+	if !errors.Is(err, client.ErrNotFound) || !errors.As(err, &apiErr) || apiErr.Message != "No scheduled message with that ID." {
+		t.Errorf("expected ErrNotFound cancelling twice, got %v", err)
+	}
+	if msg, err := c.GetMessage(ctx, first.ID); err != nil || msg.Body != "Call mum" || !msg.Scheduled {
+		t.Errorf("GetMessage: %+v, %v", msg, err)
+	}
+
+	// other users can't see or cancel the message
+	other := client.New(app.Server.URL, "5551234567")
+	verifyNumber(t, app, other.Number, "hunter22")
+	other.Password = "hunter22"
+	if err := other.Cancel(ctx, first.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound cancelling another user's message, got %v", err)
+	}
+	if listed, err := other.ListMessages(ctx); err != nil || len(listed) != 0 {
+		t.Errorf("other user's messages: %+v, %v", listed, err)
+	}
+	other.Password = "wrong"
+	if _, err := other.ListMessages(ctx); !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("expected ErrBadRequest for a wrong password, got %v", err)
+	}
+
+	_, res := app.PostJSON("/api_keys/create", map[string]string{"number": number, "password": password, "name": "dashboard", "scopes": "messages:read"})
+	keyed := client.New(app.Server.URL, number)
+	keyed.APIKey, _ = res["key"].(string)
+	if listed, err := keyed.ListMessages(ctx); err != nil || len(listed) != 1 {
+		t.Errorf("ListMessages with an API key: %+v, %v", listed, err)
+	}
+	if err := keyed.Cancel(ctx, first.ID); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("expected ErrForbidden cancelling with a read only key, got %v", err)
+	}
+	keyed.APIKey = "trk_revoked"
+	if _, err := keyed.ListMessages(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("expected ErrUnauthorized for an invalid key, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.ListMessages(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream down", http.StatusBadGateway)
+	}))
+	defer down.Close()
+	_, err = client.New(down.URL, number).ListMessages(ctx)
+	if !errors.Is(err, client.ErrServer) || !errors.As(err, &apiErr) || apiErr.Message != "Bad Gateway" {
+		t.Errorf("expected ErrServer, got %v", err)
+	}
+}
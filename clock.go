@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of the current time and of timers. Code that schedules or expires
+// things uses CLOCK rather than the time package so tests can control time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+var CLOCK Clock = RealClock{}
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// Clock which only moves when Advance is called
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	// signalled whenever a timer is created, for BlockUntil
+	changed *sync.Cond
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	f := &FakeClock{now: now}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.timers = append(f.timers, fakeTimer{at: f.now.Add(d), c: c})
+	f.changed.Broadcast()
+	return c
+}
+
+// Moves the clock forward by d, firing any timers which come due
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.at.After(f.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- f.now
+		}
+	}
+	f.timers = pending
+}
+
+// Blocks until at least n timers are waiting to fire, so a test knows a
+// goroutine is waiting on the clock before advancing it
+func (f *FakeClock) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.changed.Wait()
+	}
+}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/nu7hatch/gouuid"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Contact statuses. Only confirmed contacts receive group messages.
+const (
+	CONTACT_PENDING   = "pending"
+	CONTACT_CONFIRMED = "confirmed"
+	CONTACT_DECLINED  = "declined"
+)
+
+const (
+	MAX_CONTACTS = 200
+	MAX_GROUPS   = 50
+	// Minimum time between invitations to the same contact
+	INVITE_RESEND_INTERVAL = 24 * time.Hour
+	// Most invitations a user can send in INVITE_WINDOW
+	MAX_INVITES   = 20
+	INVITE_WINDOW = 24 * time.Hour
+
+	CONTACTS_ERR_S = ERR_S + "updating contacts."
+)
+
+// Someone a user can send messages to once they've opted in by SMS
+type Contact struct {
+	Number      string `json:"number"`
+	Name        string `json:"name"`
+	Status      string `json:"status"`
+	InvitedAt   int64  `json:"invited_at"`
+	RespondedAt int64  `json:"responded_at,omitempty"`
+}
+
+var ErrTooManyInvites = errors.New("too many invitations sent recently")
+
+// A message scheduled for a group, delivered as one message per member
+type Broadcast struct {
+	ID         string     `json:"id"`
+	Group      string     `json:"group"`
+	Time       int64      `json:"time"`
+	Recipients []*Message `json:"recipients"`
+}
+
+// Hash of a user's contacts by number
+func contactsKey(owner string) string { return "contacts:" + owner }
+
+// Time owner last invited number, kept after the contact is removed so
+// removing and adding them again doesn't send another invitation
+func invitedKey(owner, number string) string { return "invited:" + owner + ":" + number }
+
+// Count of invitations owner has sent in the current INVITE_WINDOW
+func invitesSentKey(owner string) string { return "invites_sent:" + owner }
+
+// Set of users who have number as a contact
+func contactOfKey(number string) string { return "contact_of:" + number }
+
+// Hash of a user's groups by name, each a JSON list of numbers
+func groupsKey(owner string) string { return "groups:" + owner }
+
+func broadcastKey(id string) string { return "broadcast:" + id }
+
+// Set of the IDs of a broadcast's messages
+func broadcastMessagesKey(id string) string { return "broadcast_messages:" + id }
+
+// Reduces a phone number to the 10 digits used as keys, so numbers entered
+// by users match the E.164 numbers in Twilio webhooks
+func NormalizeNumber(number string) string {
+	digits := make([]rune, 0, len(number))
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) == 11 && digits[0] == '1' {
+		digits = digits[1:]
+	}
+	return string(digits)
+}
+
+func getContact(c redis.Conn, owner, number string) (*Contact, error) {
+	b, err := redis.Bytes(c.Do("HGET", contactsKey(owner), number))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	contact := &Contact{}
+	return contact, json.Unmarshal(b, contact)
+}
+
+func putContact(c redis.Conn, owner string, contact *Contact) error {
+	b, err := json.Marshal(contact)
+	if err != nil {
+		return err
+	}
+	c.Send("MULTI")
+	c.Send("HSET", contactsKey(owner), contact.Number, b)
+	c.Send("SADD", contactOfKey(contact.Number), owner)
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Adds or renames a contact. Returns whether they should be sent an
+// invitation: they aren't confirmed and owner last invited them more than
+// INVITE_RESEND_INTERVAL ago, even if they were removed since. Returns
+// ErrTooManyInvites if owner has sent MAX_INVITES in INVITE_WINDOW.
+func AddContact(owner, number, name string) (*Contact, bool, error) {
+	c := GetConn()
+	defer c.Close()
+
+	now := CLOCK.Now()
+	contact, err := getContact(c, owner, number)
+	switch {
+	case err == ErrNotFound:
+		n, err := redis.Int(c.Do("HLEN", contactsKey(owner)))
+		if err != nil {
+			return nil, false, err
+		}
+		if n >= MAX_CONTACTS {
+			return nil, false, fmt.Errorf("too many contacts")
+		}
+		contact = &Contact{Number: number, Status: CONTACT_PENDING}
+	case err != nil:
+		return nil, false, err
+	}
+
+	invite := false
+	if contact.Status != CONTACT_CONFIRMED {
+		if invite, err = claimInvite(c, owner, number, now); err != nil {
+			return nil, false, err
+		}
+	}
+	contact.Name = name
+	if invite {
+		contact.Status = CONTACT_PENDING
+		contact.InvitedAt = now.Unix()
+		contact.RespondedAt = 0
+	} else if contact.InvitedAt == 0 {
+		// added again after being removed
+		contact.InvitedAt, _ = redis.Int64(c.Do("GET", invitedKey(owner, number)))
+	}
+	return contact, invite, putContact(c, owner, contact)
+}
+
+// Records that owner is inviting number at now. Returns false if they were
+// invited in the last INVITE_RESEND_INTERVAL, or ErrTooManyInvites.
+func claimInvite(c redis.Conn, owner, number string, now time.Time) (bool, error) {
+	ok, err := redis.String(c.Do("SET", invitedKey(owner, number), now.Unix(), "EX", int(INVITE_RESEND_INTERVAL.Seconds()), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil || ok != "OK" {
+		return false, err
+	}
+
+	sent, err := redis.Int(c.Do("INCR", invitesSentKey(owner)))
+	if err != nil {
+		return false, err
+	}
+	if sent == 1 {
+		c.Do("EXPIRE", invitesSentKey(owner), int(INVITE_WINDOW.Seconds()))
+	}
+	if sent > MAX_INVITES {
+		c.Do("DEL", invitedKey(owner, number))
+		return false, ErrTooManyInvites
+	}
+	return true, nil
+}
+
+// Undoes claimInvite for an invitation which couldn't be sent, so owner can
+// try again and it doesn't count towards MAX_INVITES
+func ReleaseInvite(owner, number string) error {
+	c := GetConn()
+	defer c.Close()
+	if _, err := c.Do("DEL", invitedKey(owner, number)); err != nil {
+		return err
+	}
+	sent, err := redis.Int(c.Do("DECR", invitesSentKey(owner)))
+	if err == nil && sent <= 0 {
+		// the window ended since, don't leave a count without an expiry
+		_, err = c.Do("DEL", invitesSentKey(owner))
+	}
+	return err
+}
+
+// List a user's contacts sorted by name
+func ListContacts(owner string) ([]*Contact, error) {
+	c := GetConn()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("HGETALL", contactsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	contacts := make([]*Contact, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		contact := &Contact{}
+		if err := json.Unmarshal([]byte(values[i+1]), contact); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Name < contacts[j].Name })
+	return contacts, nil
+}
+
+// Remove a contact, or ErrNotFound. They stay in groups but aren't sent anything.
+func RemoveContact(owner, number string) error {
+	c := GetConn()
+	defer c.Close()
+	c.Send("MULTI")
+	c.Send("HDEL", contactsKey(owner), number)
+	c.Send("SREM", contactOfKey(number), owner)
+	replies, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if n, _ := redis.Int(replies[0], nil); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Deletes all of owner's contacts and groups
+func deleteContacts(c redis.Conn, owner string) error {
+	values, err := redis.Strings(c.Do("HGETALL", contactsKey(owner)))
+	if err != nil {
+		return err
+	}
+	c.Send("MULTI")
+	for i := 0; i+1 < len(values); i += 2 {
+		c.Send("SREM", contactOfKey(values[i]), owner)
+	}
+	c.Send("DEL", contactsKey(owner), groupsKey(owner))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Whether owner may send to number: number is owner or a confirmed contact
+func isConfirmedContact(c redis.Conn, owner, number string) (bool, error) {
+	if owner == number {
+		return true, nil
+	}
+	contact, err := getContact(c, owner, number)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return contact.Status == CONTACT_CONFIRMED, nil
+}
+
+// Owners with a pending invitation to number, most recently invited first
+func PendingInvites(number string) ([]string, error) {
+	c := GetConn()
+	defer c.Close()
+
+	owners, err := redis.Strings(c.Do("SMEMBERS", contactOfKey(number)))
+	if err != nil {
+		return nil, err
+	}
+	invitedAt := make(map[string]int64)
+	pending := make([]string, 0)
+	for _, owner := range owners {
+		contact, err := getContact(c, owner, number)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if contact.Status == CONTACT_PENDING {
+			pending = append(pending, owner)
+			invitedAt[owner] = contact.InvitedAt
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if invitedAt[pending[i]] != invitedAt[pending[j]] {
+			return invitedAt[pending[i]] > invitedAt[pending[j]]
+		}
+		return pending[i] < pending[j]
+	})
+	return pending, nil
+}
+
+// Records number's response to invitations, only owner's if it isn't empty.
+// If onlyPending, only pending invitations are updated. Returns the owners
+// whose contact changed.
+func RespondToInvites(number, owner, status string, onlyPending bool) ([]string, error) {
+	c := GetConn()
+	defer c.Close()
+
+	owners := []string{owner}
+	if owner == "" {
+		var err error
+		if owners, err = redis.Strings(c.Do("SMEMBERS", contactOfKey(number))); err != nil {
+			return nil, err
+		}
+	}
+	changed := make([]string, 0)
+	for _, owner := range owners {
+		contact, err := getContact(c, owner, number)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if contact.Status == status || (onlyPending && contact.Status != CONTACT_PENDING) {
+			continue
+		}
+		contact.Status = status
+		contact.RespondedAt = CLOCK.Now().Unix()
+		if err := putContact(c, owner, contact); err != nil {
+			return nil, err
+		}
+		changed = append(changed, owner)
+	}
+	return changed, nil
+}
+
+// Creates or replaces a group of owner's contacts. Members must be contacts,
+// or owner's own number.
+func SaveGroup(owner, name string, members []string) error {
+	c := GetConn()
+	defer c.Close()
+
+	for _, m := range members {
+		if m == owner {
+			continue
+		}
+		if _, err := getContact(c, owner, m); err == ErrNotFound {
+			return fmt.Errorf("%s is not a contact", m)
+		} else if err != nil {
+			return err
+		}
+	}
+	exists, err := redis.Bool(c.Do("HEXISTS", groupsKey(owner), name))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		n, err := redis.Int(c.Do("HLEN", groupsKey(owner)))
+		if err != nil {
+			return err
+		}
+		if n >= MAX_GROUPS {
+			return fmt.Errorf("too many groups")
+		}
+	}
+	b, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", groupsKey(owner), name, b)
+	return err
+}
+
+// Get the members of one of owner's groups, or ErrNotFound
+func GetGroup(owner, name string) ([]string, error) {
+	c := GetConn()
+	defer c.Close()
+	b, err := redis.Bytes(c.Do("HGET", groupsKey(owner), name))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0)
+	return members, json.Unmarshal(b, &members)
+}
+
+// List owner's groups, by name
+func ListGroups(owner string) (map[string][]string, error) {
+	c := GetConn()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("HGETALL", groupsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		members := make([]string, 0)
+		if err := json.Unmarshal([]byte(values[i+1]), &members); err != nil {
+			return nil, err
+		}
+		groups[values[i]] = members
+	}
+	return groups, nil
+}
+
+func DeleteGroup(owner, name string) error {
+	c := GetConn()
+	defer c.Close()
+	n, err := redis.Int(c.Do("HDEL", groupsKey(owner), name))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Schedules a message with content fields to each confirmed member of
+// owner's group. Returns the broadcast's ID and the members skipped
+// because they haven't confirmed.
+func ScheduleBroadcast(ctx context.Context, owner, group, at string, fields ...interface{}) (string, []string, error) {
+	members, err := GetGroup(owner, group)
+	if err != nil {
+		return "", nil, err
+	}
+	when, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c := GetConn()
+	defer c.Close()
+	recipients, skipped := make([]string, 0), make([]string, 0)
+	for _, m := range members {
+		confirmed, err := isConfirmedContact(c, owner, m)
+		if err != nil {
+			return "", nil, err
+		}
+		if confirmed {
+			recipients = append(recipients, m)
+		} else {
+			skipped = append(skipped, m)
+		}
+	}
+
+	uid, _ := uuid.NewV4()
+	bid := uid.String()
+	// keep the broadcast as long as its messages' statuses, messages in the
+	// past are sent right away
+	wait := time.Unix(when, 0).Sub(CLOCK.Now())
+	if wait < 0 {
+		wait = 0
+	}
+	ttl := int((wait + MESSAGE_RETENTION).Seconds())
+
+	c.Send("MULTI")
+	c.Send("HMSET", broadcastKey(bid), "owner", owner, "group", group, "time", at)
+	c.Send("EXPIRE", broadcastKey(bid), ttl)
+	ids := make([]string, len(recipients))
+	for i, to := range recipients {
+		mid, _ := uuid.NewV4()
+		ids[i] = mid.String()
+		queueMessage(c, ids[i], to, at, append([]interface{}{"owner", owner, "broadcast", bid}, fields...)...)
+		c.Send("SADD", broadcastMessagesKey(bid), ids[i])
+	}
+	c.Send("EXPIRE", broadcastMessagesKey(bid), ttl)
+	if _, err := c.Do("EXEC"); err != nil {
+		return "", nil, err
+	}
+	LoggerFrom(ctx).Info("group message scheduled", Fields{"broadcast_id": bid, "recipients": len(recipients), "skipped": len(skipped), "time": at})
+	emitMessageEvents(ctx, c, EVENT_SCHEDULED, ids...)
+	return bid, skipped, nil
+}
+
+// Get one of owner's broadcasts with the status of each recipient's message
+func GetBroadcast(owner, id string) (*Broadcast, error) {
+	c := GetConn()
+	defer c.Close()
+
+	values, err := redis.Strings(c.Do("HGETALL", broadcastKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	for i := 0; i+1 < len(values); i += 2 {
+		info[values[i]] = values[i+1]
+	}
+	if info["owner"] != owner {
+		return nil, ErrNotFound
+	}
+	ids, err := redis.Strings(c.Do("SMEMBERS", broadcastMessagesKey(id)))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broadcast{ID: id, Group: info["group"], Recipients: make([]*Message, 0, len(ids))}
+	b.Time, _ = strconv.ParseInt(info["time"], 10, 64)
+	for _, mid := range ids {
+		msg, err := getMessage(c, mid)
+		if err == ErrNotFound {
+			// cancelled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// recipients see the message, the sender only needs its status
+		msg.Body, msg.Template, msg.Vars = "", "", nil
+		b.Recipients = append(b.Recipients, msg)
+	}
+	sort.Slice(b.Recipients, func(i, j int) bool { return b.Recipients[i].To < b.Recipients[j].To })
+	return b, nil
+}
+
+// Schedules a message to a group, {"number", "password", "group", "time"}
+// plus "body" or a template as for schedule, which authenticates the owner
+func scheduleGroup(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	owner := data["number"]
+	if data["channel"] != "" && data["channel"] != CHANNEL_SMS {
+		WriteJSONError(w, "Group messages can only be sent by SMS.", http.StatusBadRequest)
+		return
+	}
+	if data["ack"] == "true" || data["escalation"] != "" {
+		WriteJSONError(w, "Group messages can't require a reply.", http.StatusBadRequest)
+		return
+	}
+	content, info, ok := messageContent(w, r, owner, data)
+	if !ok {
+		return
+	}
+	id, skipped, err := ScheduleBroadcast(r.Context(), owner, data["group"], data["time"], content...)
+	if err == ErrNotFound {
+		WriteJSONError(w, "No group with that name.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not schedule group message", Fields{"number": owner, "error": err})
+		WriteJSONError(w, SCHEDULE_MSG_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{"id": id, "skipped": skipped, "sms": info}
+	b, err := GetBroadcast(owner, id)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get group message", Fields{"number": owner, "error": err})
+	} else {
+		recipients := make([]string, len(b.Recipients))
+		for i, msg := range b.Recipients {
+			recipients[i] = msg.To
+		}
+		addQuietHoursWarning(r, res, owner, recipients, data)
+	}
+	WriteJSON(w, res, http.StatusOK)
+}
+
+// Gets delivery status of a group message, {"number", "password", "id"}
+func groupMessageStatus(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	b, err := GetBroadcast(data["number"], data["id"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No group message with that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get group message", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, ERR_S+"getting the group message.", http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"message": b}, http.StatusOK)
+}
+
+// Adds a contact and texts them an invitation, {"number", "password", "contact", "name"}
+func addContact(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	owner := data["number"]
+	if !authenticate(w, r, owner, data["password"]) {
+		return
+	}
+	number := NormalizeNumber(data["contact"])
+	if len(number) != 10 {
+		WriteJSONError(w, "Contact's number is not valid.", http.StatusBadRequest)
+		return
+	}
+	if number == owner {
+		WriteJSONError(w, "You don't need to add yourself as a contact.", http.StatusBadRequest)
+		return
+	}
+
+	contact, invite, err := AddContact(owner, number, data["name"])
+	if err == ErrTooManyInvites {
+		WriteJSONError(w, fmt.Sprintf("You can't send more than %d invitations a day.", MAX_INVITES), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not add contact", Fields{"number": owner, "error": err})
+		WriteJSONError(w, CONTACTS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	if invite {
+		body := fmt.Sprintf("%s wants to send you reminders with TextRemind. Reply YES %s to accept or NO %s to decline.", owner, owner, owner)
+		if err := SendTwilioMessage(r.Context(), HTTP_CLIENT, number, body); err != nil {
+			LoggerFrom(r.Context()).Error("could not send contact invitation", Fields{"to": number, "error": err})
+			if err := ReleaseInvite(owner, number); err != nil {
+				LoggerFrom(r.Context()).Error("could not release contact invitation", Fields{"to": number, "error": err})
+			}
+			WriteJSONError(w, ERR_S+"inviting the contact.", http.StatusInternalServerError)
+			return
+		}
+	}
+	WriteJSON(w, map[string]interface{}{"contact": contact, "invited": invite}, http.StatusOK)
+}
+
+// Lists contacts and groups, {"number", "password"}
+func listContacts(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	contacts, err := ListContacts(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list contacts", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, CONTACTS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	groups, err := ListGroups(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list groups", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, CONTACTS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"contacts": contacts, "groups": groups}, http.StatusOK)
+}
+
+// Removes a contact, {"number", "password", "contact"}
+func removeContact(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := RemoveContact(data["number"], NormalizeNumber(data["contact"]))
+	if err == ErrNotFound {
+		WriteJSONError(w, "No contact with that number.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not remove contact", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, CONTACTS_ERR_S, http.StatusInternalServerError)
+	}
+}
+
+// Creates or replaces a group, {"number", "password", "name", "members"}
+// where members is a comma separated list of contacts' numbers
+func saveGroup(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	if data["name"] == "" {
+		WriteJSONError(w, "Groups need a name.", http.StatusBadRequest)
+		return
+	}
+	members := make([]string, 0)
+	for _, m := range strings.Split(data["members"], ",") {
+		if m = NormalizeNumber(m); m != "" && !stringIn(m, members) {
+			members = append(members, m)
+		}
+	}
+	if err := SaveGroup(data["number"], data["name"], members); err != nil {
+		WriteJSONError(w, "Group could not be saved: "+err.Error()+".", http.StatusBadRequest)
+	}
+}
+
+// Deletes a group, {"number", "password", "name"}
+func deleteGroup(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := DeleteGroup(data["number"], data["name"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No group with that name.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not delete group", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, CONTACTS_ERR_S, http.StatusInternalServerError)
+	}
+}
+
+// SMS replies to invitations. With more than one pending, YES must name the
+// inviter so accepting one user's invitation doesn't opt in to others'.
+func replyYes(ctx context.Context, from, args string) (string, error) {
+	pending, err := PendingInvites(from)
+	if err != nil || len(pending) == 0 {
+		return "", err
+	}
+	owner := NormalizeNumber(args)
+	if owner == "" {
+		if len(pending) > 1 {
+			return fmt.Sprintf("You have invitations from %s. Reply YES and a number to accept one, e.g. YES %s.", strings.Join(pending, ", "), pending[0]), nil
+		}
+		owner = pending[0]
+	}
+	if !stringIn(owner, pending) {
+		return fmt.Sprintf("You don't have an invitation from %s. You have invitations from %s.", owner, strings.Join(pending, ", ")), nil
+	}
+	if _, err := RespondToInvites(from, owner, CONTACT_CONFIRMED, true); err != nil {
+		return "", err
+	}
+	reply := fmt.Sprintf("Thanks, you'll now receive reminders from %s.", owner)
+	if others := otherOwners(pending, owner); len(others) > 0 {
+		reply += fmt.Sprintf(" You still have invitations from %s.", strings.Join(others, ", "))
+	}
+	return reply, nil
+}
+
+// NO declines the named inviter's invitation, or every pending one
+func replyNo(ctx context.Context, from, args string) (string, error) {
+	owner := NormalizeNumber(args)
+	owners, err := RespondToInvites(from, owner, CONTACT_DECLINED, true)
+	if err != nil || len(owners) == 0 {
+		return "", err
+	}
+	if owner == "" {
+		return "OK, you won't receive reminders from them.", nil
+	}
+	return fmt.Sprintf("OK, you won't receive reminders from %s.", owner), nil
+}
+
+// owners without owner
+func otherOwners(owners []string, owner string) []string {
+	others := make([]string, 0, len(owners))
+	for _, o := range owners {
+		if o != owner {
+			others = append(others, o)
+		}
+	}
+	return others
+}
+
+// Twilio replies to STOP itself, we only need to stop sending
+func replyStop(ctx context.Context, from, args string) (string, error) {
+	_, err := RespondToInvites(from, "", CONTACT_DECLINED, false)
+	return "", err
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeNumber(t *testing.T) {
+	for in, want := range map[string]string{
+		"(555) 123-4567":  "5551234567",
+		"+1 555 123 4567": "5551234567",
+		"5551234567":      "5551234567",
+		"+445551234567":   "445551234567",
+	} {
+		if got := NormalizeNumber(in); got != want {
+			t.Errorf("NormalizeNumber(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGroupMessage(t *testing.T) {
+	app := NewTestApp(t)
+	owner, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	auth := func(data map[string]string) map[string]string {
+		data["number"], data["password"] = owner, password
+		return data
+	}
+
+	contacts := map[string]string{"alice": "5551230001", "bob": "5551230002", "carol": "5551230003"}
+	for name, number := range contacts {
+		code, res := app.PostJSON("/contacts/add", auth(map[string]string{"contact": "+1" + number, "name": name}))
+		if code != http.StatusOK || res["invited"] != true {
+			t.Fatalf("add contact %s: got status %d, %v", name, code, res)
+		}
+	}
+	invites := 0
+	for _, m := range app.Twilio.Messages() {
+		if strings.Contains(m.Body, "Reply YES") {
+			invites++
+		}
+	}
+	if invites != 3 {
+		t.Errorf("expected 3 invitations, got %d", invites)
+	}
+	// adding again only renames
+	if _, res := app.PostJSON("/contacts/add", auth(map[string]string{"contact": contacts["bob"], "name": "Bob"})); res["invited"] != false {
+		t.Errorf("contact re-invited immediately: %v", res)
+	}
+
+	// replies must be signed by Twilio
+	res, _ := http.PostForm(app.Server.URL+"/sms/inbound", map[string][]string{"From": {"+1" + contacts["alice"]}, "Body": {"YES"}})
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("unsigned inbound SMS: got status %d", res.StatusCode)
+	}
+	for _, name := range []string{"alice", "carol"} {
+		code, reply := app.ReceiveSMS("+1"+contacts[name], " yes ")
+		if code != http.StatusOK || !strings.Contains(reply, owner) {
+			t.Errorf("%s confirming: got status %d, reply %q", name, code, reply)
+		}
+	}
+
+	if code, _ := app.PostJSON("/groups/save", auth(map[string]string{"name": "team", "members": "5550000000"})); code != http.StatusBadRequest {
+		t.Errorf("group with a stranger saved: got status %d", code)
+	}
+	members := strings.Join([]string{owner, contacts["alice"], contacts["bob"], contacts["carol"]}, ",")
+	if code, _ := app.PostJSON("/groups/save", auth(map[string]string{"name": "team", "members": members})); code != http.StatusOK {
+		t.Fatalf("save group: got status %d", code)
+	}
+
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	code, res2 := app.PostJSON("/schedule", auth(map[string]string{"group": "team", "body": "Standup!", "time": at}))
+	if code != http.StatusOK {
+		t.Fatalf("schedule group message: got status %d, %v", code, res2)
+	}
+	if skipped, _ := res2["skipped"].([]interface{}); len(skipped) != 1 || skipped[0] != contacts["bob"] {
+		t.Errorf("expected unconfirmed bob to be skipped, got %v", res2["skipped"])
+	}
+	id, _ := res2["id"].(string)
+
+	// carol opts out before it's sent
+	app.ReceiveSMS("+1"+contacts["carol"], "STOP")
+	app.Twilio.Reset()
+	app.Advance(time.Hour)
+	app.Dispatch()
+
+	sent := make(map[string]string)
+	for _, m := range app.Twilio.Messages() {
+		sent[m.To] = m.Body
+	}
+	if len(sent) != 2 || sent[owner] != "Standup!" || sent[contacts["alice"]] != "Standup!" {
+		t.Errorf("expected messages to owner and alice only, got %v", sent)
+	}
+
+	_, res2 = app.PostJSON("/group_message_status", auth(map[string]string{"id": id}))
+	msg, _ := res2["message"].(map[string]interface{})
+	recipients, _ := msg["recipients"].([]interface{})
+	statuses := make(map[string]interface{})
+	for _, r := range recipients {
+		r := r.(map[string]interface{})
+		statuses[r["to"].(string)] = r["status"]
+		if r["body"] != "" {
+			t.Errorf("status includes message content: %v", r)
+		}
+	}
+	want := map[string]interface{}{owner: STATUS_SENT, contacts["alice"]: STATUS_SENT, contacts["carol"]: STATUS_SKIPPED}
+	if len(statuses) != len(want) {
+		t.Errorf("got statuses %v, want %v", statuses, want)
+	}
+	for to, status := range want {
+		if statuses[to] != status {
+			t.Errorf("message to %s: got status %v, want %v", to, statuses[to], status)
+		}
+	}
+
+	if code, _ := app.PostJSON("/group_message_status", map[string]string{"number": contacts["alice"], "password": password, "id": id}); code == http.StatusOK {
+		t.Error("another user got the group message status")
+	}
+}
+
+func TestContactInvitationLimits(t *testing.T) {
+	app := NewTestApp(t)
+	owner, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	auth := func(data map[string]string) map[string]string {
+		data["number"], data["password"] = owner, password
+		return data
+	}
+
+	app.PostJSON("/contacts/add", auth(map[string]string{"contact": "5551230000", "name": "alice"}))
+	app.PostJSON("/contacts/remove", auth(map[string]string{"contact": "5551230000"}))
+	_, res := app.PostJSON("/contacts/add", auth(map[string]string{"contact": "5551230000", "name": "alice"}))
+	if res["invited"] != false {
+		t.Errorf("contact re-invited after being removed: %v", res)
+	}
+	app.Advance(INVITE_RESEND_INTERVAL)
+	if _, res = app.PostJSON("/contacts/add", auth(map[string]string{"contact": "5551230000", "name": "alice"})); res["invited"] != true {
+		t.Errorf("contact not re-invited after INVITE_RESEND_INTERVAL: %v", res)
+	}
+
+	for i := 1; i < MAX_INVITES; i++ {
+		number := fmt.Sprintf("55512300%02d", i)
+		if code, _ := app.PostJSON("/contacts/add", auth(map[string]string{"contact": number, "name": number})); code != http.StatusOK {
+			t.Fatalf("add contact %d: got status %d", i, code)
+		}
+	}
+	if code, _ := app.PostJSON("/contacts/add", auth(map[string]string{"contact": "5551239999", "name": "zed"})); code != http.StatusTooManyRequests {
+		t.Errorf("invitation over the limit: got status %d", code)
+	}
+	app.Advance(INVITE_WINDOW)
+	if _, res = app.PostJSON("/contacts/add", auth(map[string]string{"contact": "5551239999", "name": "zed"})); res["invited"] != true {
+		t.Errorf("contact not invited after INVITE_WINDOW: %v", res)
+	}
+}
+
+func TestFailedInvitationReleased(t *testing.T) {
+	app := NewTestApp(t)
+	owner, contact, password := "5558675309", "5551230001", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	data := map[string]string{"number": owner, "password": password, "contact": contact, "name": "alice"}
+
+	app.Twilio.SetConfig(FakeConfig{FailNumbers: map[string]int{contact: TWILIO_ERR_INVALID_NUMBER}})
+	if code, _ := app.PostJSON("/contacts/add", data); code != http.StatusInternalServerError {
+		t.Fatalf("invitation which couldn't be sent: got status %d", code)
+	}
+	c := GetConn()
+	defer c.Close()
+	if sent, _ := redis.Int(c.Do("GET", invitesSentKey(owner))); sent != 0 {
+		t.Errorf("failed invitation counted towards the limit: %d sent", sent)
+	}
+
+	app.Twilio.SetConfig(FakeConfig{})
+	if _, res := app.PostJSON("/contacts/add", data); res["invited"] != true {
+		t.Errorf("contact not invited again after a failed invitation: %v", res)
+	}
+}
+
+func TestYesNamesInviter(t *testing.T) {
+	app := NewTestApp(t)
+	friend, stranger, contact := "5558675309", "5558675300", "5551230001"
+	for _, owner := range []string{friend, stranger} {
+		if _, invite, err := AddContact(owner, contact, "alice"); err != nil || !invite {
+			t.Fatalf("add contact for %s: %v, %v", owner, invite, err)
+		}
+		app.Advance(time.Minute)
+	}
+
+	// a bare YES could be meant for either
+	if _, reply := app.ReceiveSMS("+1"+contact, "YES"); !strings.Contains(reply, friend) || !strings.Contains(reply, stranger) {
+		t.Errorf("YES with two invitations: reply %q", reply)
+	}
+	if pending, _ := PendingInvites(contact); len(pending) != 2 {
+		t.Fatalf("bare YES accepted an invitation, pending %v", pending)
+	}
+
+	_, reply := app.ReceiveSMS("+1"+contact, "yes +1 "+friend)
+	if !strings.Contains(reply, "now receive reminders from "+friend) || !strings.Contains(reply, "still have invitations from "+stranger) {
+		t.Errorf("YES %s: reply %q", friend, reply)
+	}
+	c := GetConn()
+	defer c.Close()
+	for owner, want := range map[string]bool{friend: true, stranger: false} {
+		if ok, _ := isConfirmedContact(c, owner, contact); ok != want {
+			t.Errorf("confirmed contact of %s: %v, want %v", owner, ok, want)
+		}
+	}
+
+	// NO can name the inviter too
+	app.ReceiveSMS("+1"+contact, "NO "+stranger)
+	if pending, _ := PendingInvites(contact); len(pending) != 0 {
+		t.Errorf("invitation not declined, pending %v", pending)
+	}
+}
+
+func TestBroadcastInPastIsKept(t *testing.T) {
+	NewTestApp(t)
+	owner := "5558675309"
+	if err := SaveGroup(owner, "me", []string{owner}); err != nil {
+		t.Fatal(err)
+	}
+	at := strconv.FormatInt(CLOCK.Now().Add(-30*24*time.Hour).Unix(), 10)
+	id, _, err := ScheduleBroadcast(context.Background(), owner, "me", at, "body", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := GetConn()
+	defer c.Close()
+	if ttl, _ := redis.Int(c.Do("TTL", broadcastKey(id))); ttl < int(MESSAGE_RETENTION.Seconds()) {
+		t.Errorf("broadcast in the past kept for %ds", ttl)
+	}
+}
+
+func TestListMessagesToContacts(t *testing.T) {
+	app := NewTestApp(t)
+	owner, contact, password := "5558675309", "5551230001", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	verifyNumber(t, app, contact, password)
+	auth := func(number string, data map[string]string) map[string]string {
+		data["number"], data["password"] = number, password
+		return data
+	}
+	app.PostJSON("/contacts/add", auth(owner, map[string]string{"contact": contact, "name": "alice"}))
+	app.ReceiveSMS("+1"+contact, "YES")
+	app.PostJSON("/groups/save", auth(owner, map[string]string{"name": "team", "members": contact}))
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	if code, res := app.PostJSON("/schedule", auth(owner, map[string]string{"group": "team", "body": "Standup!", "time": at})); code != http.StatusOK {
+		t.Fatalf("schedule group message: got status %d, %v", code, res)
+	}
+	app.PostJSON("/schedule", auth(contact, map[string]string{"to": contact, "body": "mine", "time": at}))
+
+	for number, want := range map[string]string{owner: "Standup!", contact: "mine"} {
+		_, res := app.PostJSON("/messages/list", auth(number, map[string]string{}))
+		msgs, _ := res["messages"].([]interface{})
+		if len(msgs) != 1 || msgs[0].(map[string]interface{})["body"] != want {
+			t.Errorf("%s listed %v, want only %q", number, msgs, want)
+		}
+	}
+}
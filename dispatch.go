@@ -1,53 +1,319 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"strconv"
+	uuid "github.com/nu7hatch/gouuid"
+	"github.com/scascketta/textremind/sms"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Attempts at sending a message before it fails, an hour of retries each
+// minute
+const MAX_DELIVERY_ATTEMPTS = 60
+
+// Work the dispatcher starts each minute after sending messages, in its own
+// goroutine so slow calendar or webhook servers don't hold up messages
+type dispatchJob struct {
+	Name string
+	Run  func(ctx context.Context, c redis.Conn, now time.Time) error
+
+	// 1 while a run is in progress, a run isn't started until the last ends
+	running int32
+}
+
+var DISPATCH_JOBS = []*dispatchJob{
+	{Name: "sync calendars", Run: syncDueCalendars},
+	{Name: "deliver events", Run: deliverEvents},
+}
+
+// Runs j in a new goroutine unless it's still running from the last minute
+func (j *dispatchJob) start(wg *sync.WaitGroup, now time.Time) {
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		logger.Warn("dispatch job still running, skipping it this minute", Fields{"job": j.Name})
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer atomic.StoreInt32(&j.running, 0)
+		j.runNow(now)
+	}()
+}
+
+// Runs j in this goroutine with its own connection, logging any error
+func (j *dispatchJob) runNow(now time.Time) {
+	did, _ := uuid.NewV4()
+	log := logger.With(Fields{"dispatch_id": did.String(), "job": j.Name})
+	c := GetConn()
+	defer c.Close()
+	if err := j.Run(WithLogger(context.Background(), log), c, now); err != nil {
+		log.Error("dispatch job failed", Fields{"error": err})
+	}
+}
+
+// Calls fn with each of ids from at most workers goroutines, each with its
+// own connection, and waits for them to finish
+func forEachConcurrently(ids []string, workers int, fn func(c redis.Conn, id string)) {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := GetConn()
+			defer c.Close()
+			for id := range work {
+				fn(c, id)
+			}
+		}()
+	}
+	for _, id := range ids {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+}
+
 // Dispatches scheduled messages at the start of every minute
 func DispatchMessages() {
+	dispatchLoop(nil)
+}
+
+// Dispatches scheduled messages at the start of every minute, then starts
+// DISPATCH_JOBS, until stop is closed
+func dispatchLoop(stop <-chan struct{}) {
 	c := GetConn()
 	defer c.Close()
+	jobs := &sync.WaitGroup{}
+	defer jobs.Wait()
 
-	dbglogger.Printf("Message dispatch goroutine running...")
-	ticker := nextMinuteTicker()
+	logger.Info("message dispatch goroutine running")
+	markDispatchStarted()
 	for {
-		<-ticker.C
-		// FIXME: cleaner way to do Time to unix_time string
-		now := strconv.Itoa(int(time.Now().Unix()))
+		select {
+		case <-CLOCK.After(untilNextMinute(CLOCK.Now())):
+		case <-stop:
+			return
+		}
+		now := CLOCK.Now()
+		if err := dispatchDue(c, now); err == nil {
+			markDispatchLoop()
+		}
+		for _, j := range DISPATCH_JOBS {
+			j.start(jobs, now)
+		}
+	}
+}
+
+// Sends messages due at or before now, escalates and falls back for
+// messages not acknowledged or delivered in time, then removes media no
+// longer needed. Returns an error if the due messages couldn't be fetched,
+// failures to send are only logged.
+func dispatchDue(c redis.Conn, now time.Time) error {
+	// each pass gets its own ID so its log entries can be correlated
+	did, _ := uuid.NewV4()
+	log := logger.With(Fields{"dispatch_id": did.String()})
+
+	// get messages that must be dispatched now
+	uids, err := redis.Strings(c.Do("ZRANGEBYSCORE", "messages", 0, now.Unix()))
+	if err != nil {
+		log.Error("could not get due messages", Fields{"error": err})
+		return err
+	}
 
-		// get messages that must be dispatched now
-		uids, err := redis.Strings(c.Do("ZRANGEBYSCORE", "messages", 0, now))
+	for _, uid := range uids {
+		mlog := log.With(Fields{"message_id": uid})
+		ctx := WithLogger(context.Background(), mlog)
+		msg, err := getMessage(c, uid)
 		if err != nil {
-			errlogger.Println(err)
+			mlog.Error("could not get message", Fields{"error": err})
+			continue
 		}
+		dispatchMessage(ctx, c, msg, now)
+	}
 
-		for _, uid := range uids {
-			body, _ := redis.String(c.Do("HGET", uid, "body"))
-			to, _ := redis.String(c.Do("HGET", uid, "to"))
-			err := SendTwilioMessage(HTTP_CLIENT, to, body)
-			if err != nil {
-				errlogger.Println(err)
-				continue
+	if err := checkEscalations(WithLogger(context.Background(), log), c, now); err != nil {
+		log.Error("could not check escalations", Fields{"error": err})
+	}
+	if err := checkDeliveryTimeouts(WithLogger(context.Background(), log), c, now); err != nil {
+		log.Error("could not check delivery timeouts", Fields{"error": err})
+	}
+	if err := cleanupMedia(c, now); err != nil {
+		log.Error("could not clean up media", Fields{"error": err})
+	}
+	return nil
+}
+
+// Sends a due message and records the outcome
+func dispatchMessage(ctx context.Context, c redis.Conn, msg *Message, now time.Time) {
+	log := LoggerFrom(ctx)
+
+	if msg.Owner != "" {
+		exists, err := userExists(c, msg.Owner)
+		if err != nil {
+			log.Error("could not check message owner", Fields{"error": err})
+			return
+		}
+		if !exists {
+			log.Info("skipping message from deleted user", Fields{"owner": msg.Owner})
+			finishMessage(ctx, c, msg, STATUS_SKIPPED, now, false)
+			return
+		}
+		confirmed, err := isConfirmedContact(c, msg.Owner, msg.To)
+		if err != nil {
+			log.Error("could not check contact is confirmed", Fields{"error": err})
+			return
+		}
+		if !confirmed {
+			log.Info("skipping message to unconfirmed contact", Fields{"to": msg.To})
+			finishMessage(ctx, c, msg, STATUS_SKIPPED, now, false)
+			return
+		}
+	}
+
+	until, err := quietUntil(c, msg, now)
+	if err != nil {
+		log.Error("could not check quiet hours", Fields{"error": err})
+	}
+	if !until.IsZero() {
+		log.Info("deferring message until quiet hours end", Fields{"until": until.Unix()})
+		if err := deferMessage(c, msg, until); err != nil {
+			log.Error("could not defer message", Fields{"error": err})
+		}
+		return
+	}
+
+	body, err := messageBody(c, msg, now)
+	if err == nil {
+		err = deliver(ctx, c, msg, body)
+	}
+	if err == ErrDestinationGone {
+		log.Info("skipping message to removed destination", Fields{"channel": msg.Channel})
+		finishMessage(ctx, c, msg, STATUS_SKIPPED, now, false)
+		return
+	}
+	rule, rerr := fallbackRule(c, msg)
+	if rerr != nil {
+		log.Error("could not get fallback rule", Fields{"error": rerr})
+	}
+	if err != nil {
+		atomic.AddInt64(&messagesFailed, 1)
+		permanent := failedPermanently(msg, err)
+		log.Error("could not send message", Fields{"to": msg.To, "error": err, "permanent": permanent})
+		status := STATUS_RETRYING
+		if permanent {
+			status = STATUS_FAILED
+		}
+		c.Send("MULTI")
+		c.Send("HMSET", msg.ID, "status", status, "last_error", err.Error())
+		c.Send("HINCRBY", msg.ID, "attempts", 1)
+		if _, err := c.Do("EXEC"); err != nil {
+			log.Error("could not record failed message", Fields{"error": err})
+		}
+		if permanent {
+			finishMessage(ctx, c, msg, STATUS_FAILED, now, rule != nil)
+			msg.Status, msg.LastError, msg.Scheduled = STATUS_FAILED, err.Error(), false
+			if err := emitEvent(c, EVENT_FAILED, msg, now); err != nil {
+				log.Error("could not queue event", Fields{"event": EVENT_FAILED, "error": err})
 			}
-			c.Send("MULTI")
-			c.Send("ZREM", "messages", uid)
-			c.Send("HDEL", uid, "body")
-			c.Send("HDEL", uid, "to")
-			_, err = c.Do("EXEC")
-			if err != nil {
-				errlogger.Println(err)
+			if rule != nil {
+				runFallback(ctx, c, msg, rule, FALLBACK_FAILED, now)
 			}
 		}
-		ticker = nextMinuteTicker()
+		return
+	}
+	atomic.AddInt64(&messagesSent, 1)
+	sent := *msg
+	sent.Status, sent.SentAt, sent.Scheduled = STATUS_SENT, now.Unix(), false
+	if err := emitEvent(c, EVENT_SENT, &sent, now); err != nil {
+		log.Error("could not queue event", Fields{"event": EVENT_SENT, "error": err})
+	}
+	if msg.Ack == ACK_PENDING {
+		// re-sending until it's acknowledged stands in for a fallback timeout
+		if err := awaitAck(ctx, c, msg, now); err != nil {
+			log.Error("could not wait for acknowledgement", Fields{"error": err})
+		}
+		return
+	}
+	awaiting := rule != nil && rule.TimeoutMinutes > 0 && statusCallbackURL(msg.ID) != ""
+	finishMessage(ctx, c, msg, STATUS_SENT, now, awaiting)
+	if awaiting {
+		if err := awaitDelivery(ctx, c, msg, rule, now); err != nil {
+			log.Error("could not wait for delivery", Fields{"error": err})
+		}
+	}
+}
+
+// Whether a failed send will never succeed, so shouldn't be retried: the
+// template can't be rendered, its media is gone or the provider refused it
+// for good. Bad credentials fail every message but are fixable, so are
+// retried. Every message is given up on after MAX_DELIVERY_ATTEMPTS.
+func failedPermanently(msg *Message, err error) bool {
+	// err is from this attempt, which msg.Attempts doesn't count yet
+	if msg.Attempts+1 >= MAX_DELIVERY_ATTEMPTS || errors.Is(err, ErrRenderFailed) || errors.Is(err, ErrMediaGone) {
+		return true
+	}
+	switch msg.Channel {
+	case CHANNEL_EMAIL, CHANNEL_WEBHOOK:
+		var werr *WebhookError
+		return IsPermanentEmailError(err) || (errors.As(err, &werr) && werr.Permanent())
+	}
+	return IsPermanentTwilioError(err) && !IsTwilioErrorCode(err, TWILIO_ERR_AUTH)
+}
+
+// Unschedules a message, keeping its status for MESSAGE_RETENTION. Its
+// content is removed unless keepContent, for messages which may fall back.
+func finishMessage(ctx context.Context, c redis.Conn, msg *Message, status string, now time.Time, keepContent bool) {
+	c.Send("MULTI")
+	c.Send("ZREM", "messages", msg.ID)
+	if !keepContent {
+		c.Send("HDEL", msg.ID, "body", "template", "vars")
+	}
+	if status != STATUS_FAILED {
+		c.Send("HDEL", msg.ID, "last_error")
+	}
+	c.Send("HDEL", msg.ID, "media")
+	c.Send("HMSET", msg.ID, "status", status, "sent_at", now.Unix())
+	c.Send("EXPIRE", msg.ID, int(MESSAGE_RETENTION.Seconds()))
+	c.Send("SREM", userMessagesKey(msg.To), msg.ID)
+	if msg.Owner != "" {
+		c.Send("SREM", ownerMessagesKey(msg.Owner), msg.ID)
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		LoggerFrom(ctx).Error("could not remove dispatched message", Fields{"error": err})
+		return
+	}
+	if err := releaseMedia(c, msg.Media, now); err != nil {
+		LoggerFrom(ctx).Error("could not release message media", Fields{"error": err})
+	}
+}
+
+// Gets the text to send for msg, rendering its template if it has one in
+// the recipient's time zone, or the sender's if the recipient has no account
+func messageBody(c redis.Conn, msg *Message, now time.Time) (string, error) {
+	if msg.Template == "" {
+		return msg.Body, nil
+	}
+	number, err := settingsUser(c, msg.To, msg.Owner)
+	if err != nil {
+		return "", err
+	}
+	body, err := RenderTemplate(msg.Template, msg.Vars, now, userLocation(c, number))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrRenderFailed, err)
+	}
+	if TRANSLITERATE {
+		body = sms.Transliterate(body)
 	}
+	return body, nil
 }
 
-// Get a *time.Ticker which ticks at start of the next minute from now
-func nextMinuteTicker() *time.Ticker {
-	now := time.Now()
-	nextTick := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute()+1, 0, 0, time.Local)
-	return time.NewTicker(nextTick.Sub(now))
+// Get the time from now until the start of the next minute
+func untilNextMinute(now time.Time) time.Duration {
+	return now.Truncate(time.Minute).Add(time.Minute).Sub(now)
 }
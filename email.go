@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"time"
+)
+
+var (
+	// host:port of the SMTP server email is sent through, email is disabled if unset
+	SMTP_ADDR     string = os.Getenv("TEXTREMIND_SMTP_ADDR")
+	SMTP_USER     string = os.Getenv("TEXTREMIND_SMTP_USER")
+	SMTP_PASSWORD string = os.Getenv("TEXTREMIND_SMTP_PASSWORD")
+	SMTP_FROM     string = envOr("TEXTREMIND_SMTP_FROM", "reminders@textremind.local")
+
+	ErrEmailDisabled = errors.New("email is not configured")
+)
+
+const SMTP_TIMEOUT = 10 * time.Second
+
+// SMTP replies to failed authentication, which are fixable so not permanent
+var SMTP_AUTH_CODES = []int{530, 534, 535}
+
+// Sends a plain text email through SMTP_ADDR, using STARTTLS if the server
+// supports it and authenticating if SMTP_USER is set
+func SendEmail(ctx context.Context, to, subject, body string) error {
+	if SMTP_ADDR == "" {
+		return ErrEmailDisabled
+	}
+	host, _, err := net.SplitHostPort(SMTP_ADDR)
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{Timeout: SMTP_TIMEOUT}
+	conn, err := dialer.DialContext(ctx, "tcp", SMTP_ADDR)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if SMTP_USER != "" {
+		if err := c.Auth(smtp.PlainAuth("", SMTP_USER, SMTP_PASSWORD, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(SMTP_FROM); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(emailMessage(to, subject, body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	LoggerFrom(ctx).Info("email sent", Fields{"body_length": len(body)})
+	return c.Quit()
+}
+
+// Whether err is a 5xx reply from the SMTP server, e.g. an unknown mailbox,
+// so sending again will fail too. Authentication failures aren't permanent.
+func IsPermanentEmailError(err error) bool {
+	var terr *textproto.Error
+	if !errors.As(err, &terr) || terr.Code < 500 || terr.Code > 599 {
+		return false
+	}
+	for _, code := range SMTP_AUTH_CODES {
+		if terr.Code == code {
+			return false
+		}
+	}
+	return true
+}
+
+// Formats an email with a UTF-8 quoted-printable body
+func emailMessage(to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", SMTP_FROM)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", CLOCK.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	qp.Write([]byte(body))
+	qp.Close()
+	return b.Bytes()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_ESCALATION_POLICIES = 20
+	MAX_ESCALATION_STEPS    = 5
+	MAX_ESCALATION_DELAY    = 24 * 60
+
+	// Sorted set of IDs of reminders with a pending escalation step, scored
+	// by when it's due
+	ESCALATIONS_KEY = "escalations"
+
+	ESCALATION_ERR_S = ERR_S + "updating escalation policies."
+)
+
+// What happened at a step of an escalation
+const (
+	ESCALATION_NOTIFIED = "notified"
+	ESCALATION_SKIPPED  = "skipped"
+	ESCALATION_FAILED   = "failed"
+	ESCALATION_ACKED    = "acknowledged"
+)
+
+var ErrInvalidEscalation = errors.New("escalation policy is not valid")
+
+// A step of an escalation policy: if a reminder still hasn't been
+// acknowledged DelayMinutes after the previous step, or after it was first
+// sent, it's sent to Contact
+type EscalationStep struct {
+	Contact      string `json:"contact"`
+	DelayMinutes int    `json:"delay_minutes"`
+}
+
+// An entry in a reminder's escalation audit trail
+type EscalationEvent struct {
+	// Index of the step, -1 for the reminder's recipient
+	Step   int    `json:"step"`
+	Number string `json:"number"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+	At     int64  `json:"at"`
+}
+
+// Hash of a user's escalation policies by name, each a JSON list of steps
+func escalationsKey(owner string) string { return "escalations:" + owner }
+
+// List of a reminder's escalation events, oldest first
+func escalationLogKey(id string) string { return "escalation_log:" + id }
+
+// Parses steps from a comma separated list of "number:delay_minutes"
+func ParseEscalationSteps(s string) ([]EscalationStep, error) {
+	steps := make([]EscalationStep, 0)
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%w, %q needs a delay", ErrInvalidEscalation, part)
+		}
+		delay, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+		if err != nil || delay < 1 || delay > MAX_ESCALATION_DELAY {
+			return nil, fmt.Errorf("%w, delays must be between 1 and %d minutes", ErrInvalidEscalation, MAX_ESCALATION_DELAY)
+		}
+		steps = append(steps, EscalationStep{Contact: NormalizeNumber(part[:i]), DelayMinutes: delay})
+	}
+	if len(steps) == 0 || len(steps) > MAX_ESCALATION_STEPS {
+		return nil, fmt.Errorf("%w, policies need between 1 and %d steps", ErrInvalidEscalation, MAX_ESCALATION_STEPS)
+	}
+	return steps, nil
+}
+
+// Creates or replaces one of owner's escalation policies. Each step must be
+// a confirmed contact.
+func SaveEscalation(owner, name string, steps []EscalationStep) error {
+	c := GetConn()
+	defer c.Close()
+
+	for _, step := range steps {
+		confirmed, err := isConfirmedContact(c, owner, step.Contact)
+		if err != nil {
+			return err
+		}
+		if !confirmed || step.Contact == owner {
+			return fmt.Errorf("%w, %s is not a confirmed contact", ErrInvalidEscalation, step.Contact)
+		}
+	}
+	exists, err := redis.Bool(c.Do("HEXISTS", escalationsKey(owner), name))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		n, err := redis.Int(c.Do("HLEN", escalationsKey(owner)))
+		if err != nil {
+			return err
+		}
+		if n >= MAX_ESCALATION_POLICIES {
+			return fmt.Errorf("%w, you can't have more than %d", ErrInvalidEscalation, MAX_ESCALATION_POLICIES)
+		}
+	}
+	b, err := json.Marshal(steps)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", escalationsKey(owner), name, b)
+	return err
+}
+
+// Get the steps of one of owner's escalation policies, or ErrNotFound
+func GetEscalation(owner, name string) ([]EscalationStep, error) {
+	c := GetConn()
+	defer c.Close()
+	b, err := redis.Bytes(c.Do("HGET", escalationsKey(owner), name))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]EscalationStep, 0)
+	return steps, json.Unmarshal(b, &steps)
+}
+
+// List owner's escalation policies, by name
+func ListEscalations(owner string) (map[string][]EscalationStep, error) {
+	c := GetConn()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("HGETALL", escalationsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string][]EscalationStep, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		steps := make([]EscalationStep, 0)
+		if err := json.Unmarshal([]byte(values[i+1]), &steps); err != nil {
+			return nil, err
+		}
+		policies[values[i]] = steps
+	}
+	return policies, nil
+}
+
+func DeleteEscalation(owner, name string) error {
+	c := GetConn()
+	defer c.Close()
+	n, err := redis.Int(c.Do("HDEL", escalationsKey(owner), name))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Gets a reminder's escalation audit trail
+func GetEscalationLog(id string) ([]EscalationEvent, error) {
+	c := GetConn()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("LRANGE", escalationLogKey(id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]EscalationEvent, 0, len(values))
+	for _, v := range values {
+		var e EscalationEvent
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// Sends the commands appending an event to a reminder's audit trail, to be
+// run in a transaction
+func queueEscalationEvent(c redis.Conn, id string, e EscalationEvent) {
+	b, _ := json.Marshal(e)
+	c.Send("RPUSH", escalationLogKey(id), b)
+	c.Send("EXPIRE", escalationLogKey(id), int(MESSAGE_RETENTION.Seconds()))
+}
+
+// Gets the stored fields for a reminder escalated with one of owner's
+// policies named by "escalation". Writes an error and returns false if
+// there's no such policy.
+func messageEscalation(w http.ResponseWriter, r *http.Request, owner string, data map[string]string) ([]interface{}, bool) {
+	if data["escalation"] == "" {
+		return nil, true
+	}
+	steps, err := GetEscalation(owner, data["escalation"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No escalation policy with that name.", http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get escalation policy", Fields{"number": owner, "error": err})
+		WriteJSONError(w, SCHEDULE_MSG_ERR_S, http.StatusInternalServerError)
+		return nil, false
+	}
+	// the policy may change before the reminder is sent, so it's copied
+	b, _ := json.Marshal(steps)
+	return []interface{}{"escalation", string(b)}, true
+}
+
+// Sends the commands starting a reminder's escalation when it's first sent,
+// to be run in a transaction
+func queueEscalationStart(c redis.Conn, msg *Message, now time.Time) {
+	due := now.Add(time.Duration(msg.Escalation[0].DelayMinutes) * time.Minute)
+	c.Send("ZADD", ESCALATIONS_KEY, due.Unix(), msg.ID)
+	c.Send("HSET", msg.ID, "escalation_step", 0)
+	queueEscalationEvent(c, msg.ID, EscalationEvent{Step: -1, Number: msg.To, Action: ESCALATION_NOTIFIED, At: now.Unix()})
+}
+
+// Runs the escalation steps due by now for reminders not yet acknowledged
+func checkEscalations(ctx context.Context, c redis.Conn, now time.Time) error {
+	ids, err := redis.Strings(c.Do("ZRANGEBYSCORE", ESCALATIONS_KEY, "-inf", now.Unix()))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// removing it claims the step, so concurrent dispatchers run it once
+		removed, err := redis.Int(c.Do("ZREM", ESCALATIONS_KEY, id))
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			continue
+		}
+		mctx := WithLogger(ctx, LoggerFrom(ctx).With(Fields{"message_id": id}))
+		msg, err := getMessage(c, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Ack == ACK_PENDING && msg.EscalationStep < len(msg.Escalation) {
+			escalate(mctx, c, msg, now)
+		}
+	}
+	return nil
+}
+
+// Sends a reminder to the contact at its current escalation step, then
+// schedules the next step
+func escalate(ctx context.Context, c redis.Conn, msg *Message, now time.Time) {
+	log := LoggerFrom(ctx)
+	i := msg.EscalationStep
+	step := msg.Escalation[i]
+	event := EscalationEvent{Step: i, Number: step.Contact, Action: ESCALATION_NOTIFIED, At: now.Unix()}
+
+	confirmed, err := isConfirmedContact(c, msg.To, step.Contact)
+	if err == nil && !confirmed {
+		event.Action = ESCALATION_SKIPPED
+	}
+	if err == nil && confirmed {
+		var body string
+		body, err = messageBody(c, msg, now)
+		if err == nil {
+			body = fmt.Sprintf("Unacknowledged reminder for %s: %s\nReply OK to acknowledge it.", msg.To, body)
+			err = SendTwilioMessage(ctx, HTTP_CLIENT, step.Contact, body)
+		}
+	}
+	if err != nil {
+		event.Action, event.Error = ESCALATION_FAILED, err.Error()
+		log.Error("could not escalate reminder", Fields{"step": i, "to": step.Contact, "error": err})
+	} else {
+		log.Info("escalated reminder", Fields{"step": i, "to": step.Contact, "action": event.Action})
+	}
+
+	c.Send("MULTI")
+	queueEscalationEvent(c, msg.ID, event)
+	if event.Action == ESCALATION_NOTIFIED {
+		// their reply acknowledges it, see pendingAck
+		c.Send("ZADD", ackPendingKey(step.Contact), now.Unix(), msg.ID)
+		c.Send("EXPIRE", ackPendingKey(step.Contact), int(MESSAGE_RETENTION.Seconds()))
+	}
+	c.Send("HSET", msg.ID, "escalation_step", i+1)
+	if i+1 < len(msg.Escalation) {
+		due := now.Add(time.Duration(msg.Escalation[i+1].DelayMinutes) * time.Minute)
+		c.Send("ZADD", ESCALATIONS_KEY, due.Unix(), msg.ID)
+	}
+	if _, err := c.Do("EXEC"); err != nil {
+		log.Error("could not record escalation", Fields{"error": err})
+	}
+}
+
+// Creates or replaces an escalation policy, {"number", "password", "name",
+// "steps"} with steps as a comma separated list of "contact:delay_minutes"
+func saveEscalation(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	if data["name"] == "" {
+		WriteJSONError(w, "Escalation policies need a name.", http.StatusBadRequest)
+		return
+	}
+	steps, err := ParseEscalationSteps(data["steps"])
+	if err == nil {
+		err = SaveEscalation(data["number"], data["name"], steps)
+	}
+	switch {
+	case errors.Is(err, ErrInvalidEscalation):
+		WriteJSONError(w, "The "+err.Error()+".", http.StatusBadRequest)
+	case err != nil:
+		LoggerFrom(r.Context()).Error("could not save escalation policy", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, ESCALATION_ERR_S, http.StatusInternalServerError)
+	default:
+		WriteJSON(w, map[string]interface{}{"steps": steps}, http.StatusOK)
+	}
+}
+
+// Lists escalation policies, {"number", "password"}
+func listEscalations(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	policies, err := ListEscalations(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list escalation policies", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, ESCALATION_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"escalations": policies}, http.StatusOK)
+}
+
+// Deletes an escalation policy, {"number", "password", "name"}. Reminders
+// already scheduled with it still escalate.
+func deleteEscalation(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := DeleteEscalation(data["number"], data["name"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No escalation policy with that name.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not delete escalation policy", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, ESCALATION_ERR_S, http.StatusInternalServerError)
+	}
+}
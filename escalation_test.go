@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscalation(t *testing.T) {
+	app := NewTestApp(t)
+	owner, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	auth := func(data map[string]string) map[string]string {
+		data["number"], data["password"] = owner, password
+		return data
+	}
+	alice, bob, carol := "5551230001", "5551230002", "5551230003"
+	for _, number := range []string{alice, bob, carol} {
+		app.PostJSON("/contacts/add", auth(map[string]string{"contact": number}))
+	}
+	app.ReceiveSMS("+1"+alice, "YES")
+	app.ReceiveSMS("+1"+bob, "YES")
+	escalated := func(to string) int {
+		n := 0
+		for _, m := range app.Twilio.Messages() {
+			if NormalizeNumber(m.To) == to && strings.HasPrefix(m.Body, "Unacknowledged reminder for "+owner+": Server on fire") {
+				n++
+			}
+		}
+		return n
+	}
+
+	if code, _ := app.PostJSON("/escalations/save", auth(map[string]string{"name": "oncall", "steps": alice + ":5," + carol + ":5"})); code != http.StatusBadRequest {
+		t.Errorf("escalation to unconfirmed contact: got status %d", code)
+	}
+	if code, _ := app.PostJSON("/escalations/save", auth(map[string]string{"name": "oncall", "steps": alice})); code != http.StatusBadRequest {
+		t.Errorf("escalation step without a delay: got status %d", code)
+	}
+	if code, res := app.PostJSON("/escalations/save", auth(map[string]string{"name": "oncall", "steps": "+1" + alice + ":5, " + bob + ":10"})); code != http.StatusOK {
+		t.Fatalf("save escalation: got status %d, %v", code, res)
+	}
+	_, res := app.PostJSON("/escalations/list", auth(map[string]string{}))
+	if policies, _ := res["escalations"].(map[string]interface{}); len(policies["oncall"].([]interface{})) != 2 {
+		t.Errorf("unexpected escalation policies %v", res)
+	}
+
+	schedule := map[string]string{"to": owner, "password": password, "time": strconv.FormatInt(app.Clock.Now().Unix(), 10), "body": "Server on fire", "escalation": "oncall", "max_nags": "0"}
+	_, res = app.PostJSON("/schedule", schedule)
+	first := res["id"].(string)
+	app.Dispatch()
+	app.Advance(4 * time.Minute)
+	app.Dispatch()
+	if escalated(alice) != 0 {
+		t.Fatal("escalated before the first step's delay")
+	}
+	app.Advance(time.Minute)
+	app.Dispatch()
+	if escalated(alice) != 1 || escalated(bob) != 0 {
+		t.Fatalf("expected escalation to alice only, got %d, %d", escalated(alice), escalated(bob))
+	}
+	app.Advance(10 * time.Minute)
+	app.Dispatch()
+	if escalated(bob) != 1 {
+		t.Fatal("not escalated to bob")
+	}
+	if _, reply := app.ReceiveSMS("+1"+bob, "OK"); !strings.Contains(reply, "acknowledged") {
+		t.Errorf("unexpected ack reply %q", reply)
+	}
+
+	_, res = app.PostJSON("/message_status", auth(map[string]string{"id": first}))
+	msg := res["message"].(map[string]interface{})
+	if msg["ack"] != ACK_ACKED || msg["acked_by"] != bob {
+		t.Errorf("expected bob to acknowledge, got %v", msg)
+	}
+	actions := make([]string, 0)
+	for _, e := range res["escalation_log"].([]interface{}) {
+		event := e.(map[string]interface{})
+		actions = append(actions, event["number"].(string)+" "+event["action"].(string))
+	}
+	expected := []string{owner + " notified", alice + " notified", bob + " notified", bob + " acknowledged"}
+	if strings.Join(actions, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("unexpected audit trail %v", actions)
+	}
+
+	// acknowledging stops the escalation
+	schedule["time"] = strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	app.PostJSON("/schedule", schedule)
+	app.Dispatch()
+	app.Advance(5 * time.Minute)
+	app.Dispatch()
+	app.ReceiveSMS("+1"+alice, "OK")
+	app.Advance(time.Hour)
+	app.Dispatch()
+	if escalated(alice) != 2 || escalated(bob) != 1 {
+		t.Errorf("escalation continued after acknowledgement: %d, %d", escalated(alice), escalated(bob))
+	}
+}
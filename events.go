@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/nu7hatch/gouuid"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reminder lifecycle events sent to webhook subscriptions
+const (
+	EVENT_SCHEDULED = "message.scheduled"
+	EVENT_SENT      = "message.sent"
+	EVENT_DELIVERED = "message.delivered"
+	EVENT_FAILED    = "message.failed"
+	EVENT_CANCELLED = "message.cancelled"
+)
+
+var EVENT_TYPES = []string{EVENT_SCHEDULED, EVENT_SENT, EVENT_DELIVERED, EVENT_FAILED, EVENT_CANCELLED}
+
+// Webhook delivery statuses
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_SUCCEEDED = "succeeded"
+	DELIVERY_FAILED    = "failed"
+)
+
+const (
+	MAX_SUBSCRIPTIONS = 10
+	// Attempts made to deliver an event, the first retry after
+	// EVENT_RETRY_BACKOFF and each later one after twice as long
+	MAX_EVENT_ATTEMPTS  = 6
+	EVENT_RETRY_BACKOFF = time.Minute
+	// Deliveries kept in each user's log
+	MAX_DELIVERY_LOG = 100
+	// Deliveries attempted at once by the dispatcher
+	EVENT_WORKERS = 8
+	// How long a claimed delivery is left to its dispatcher, after which
+	// it's attempted again in case that dispatcher stopped part way
+	EVENT_DELIVERY_LEASE = 5 * time.Minute
+
+	// Sorted set of webhook delivery IDs, scored by when they're next attempted
+	EVENT_DELIVERIES_KEY = "event_deliveries"
+
+	SUBSCRIPTIONS_ERR_S = ERR_S + "updating webhook subscriptions."
+)
+
+var ErrTooManySubscriptions = errors.New("too many webhook subscriptions")
+
+// A URL a user's lifecycle events are POSTed to, signed with Secret like
+// webhook destinations, see webhook.Sign. Events empty means all events.
+type Subscription struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// What's POSTed to a subscription. ID is the same for every attempt, so
+// receivers can ignore events they've already handled.
+type Event struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	CreatedAt int64    `json:"created_at"`
+	Message   *Message `json:"message"`
+}
+
+// An event being delivered to one subscription, kept for MESSAGE_RETENTION
+type Delivery struct {
+	ID           string          `json:"id"`
+	Subscription string          `json:"subscription"`
+	Owner        string          `json:"owner"`
+	Event        string          `json:"event"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	LastError    string          `json:"last_error,omitempty"`
+	CreatedAt    int64           `json:"created_at"`
+	NextAttempt  int64           `json:"next_attempt,omitempty"`
+	DeliveredAt  int64           `json:"delivered_at,omitempty"`
+}
+
+// Hash of a user's subscriptions by ID
+func subscriptionsKey(owner string) string { return "subscriptions:" + owner }
+
+func deliveryKey(id string) string { return "delivery:" + id }
+
+// List of a user's latest delivery IDs, newest first
+func deliveryLogKey(owner string) string { return "delivery_log:" + owner }
+
+func (s *Subscription) wants(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a comma separated list of event types, empty for all of them
+func parseEventTypes(list string) ([]string, error) {
+	events := make([]string, 0)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		known := false
+		for _, t := range EVENT_TYPES {
+			known = known || t == e
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// Subscribes owner's events to url, which must echo a verification
+// challenge like webhook destinations
+func Subscribe(ctx context.Context, owner, url string, events []string) (*Subscription, error) {
+	url, err := normalizeAddress(CHANNEL_WEBHOOK, url)
+	if err != nil {
+		return nil, err
+	}
+	c := GetConn()
+	defer c.Close()
+	n, err := redis.Int(c.Do("HLEN", subscriptionsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	if n >= MAX_SUBSCRIPTIONS {
+		return nil, ErrTooManySubscriptions
+	}
+
+	uid, _ := uuid.NewV4()
+	s := &Subscription{ID: uid.String(), URL: url, Events: events, Secret: randomHex(32), CreatedAt: CLOCK.Now().Unix()}
+	challenge := randomHex(16)
+	res, err := PostWebhook(ctx, url, s.Secret, map[string]string{"type": "verification", "challenge": challenge})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrChallengeFailed, err)
+	}
+	if !strings.Contains(string(res), challenge) {
+		return nil, ErrChallengeFailed
+	}
+	b, _ := json.Marshal(s)
+	_, err = c.Do("HSET", subscriptionsKey(owner), s.ID, b)
+	return s, err
+}
+
+func listSubscriptions(c redis.Conn, owner string) ([]*Subscription, error) {
+	values, err := redis.Strings(c.Do("HGETALL", subscriptionsKey(owner)))
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]*Subscription, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		s := &Subscription{}
+		if err := json.Unmarshal([]byte(values[i+1]), s); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt < subs[j].CreatedAt })
+	return subs, nil
+}
+
+// List owner's subscriptions, oldest first
+func ListSubscriptions(owner string) ([]*Subscription, error) {
+	c := GetConn()
+	defer c.Close()
+	return listSubscriptions(c, owner)
+}
+
+// Removes a subscription, or returns ErrNotFound. Pending deliveries to it
+// are dropped when they're next attempted.
+func Unsubscribe(owner, id string) error {
+	c := GetConn()
+	defer c.Close()
+	n, err := redis.Int(c.Do("HDEL", subscriptionsKey(owner), id))
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// Deletes all of owner's subscriptions and their deliveries
+func deleteSubscriptions(c redis.Conn, owner string) error {
+	ids, err := redis.Strings(c.Do("LRANGE", deliveryLogKey(owner), 0, -1))
+	if err != nil {
+		return err
+	}
+	c.Send("MULTI")
+	for _, id := range ids {
+		c.Send("ZREM", EVENT_DELIVERIES_KEY, id)
+		c.Send("DEL", deliveryKey(id))
+	}
+	c.Send("DEL", subscriptionsKey(owner), deliveryLogKey(owner))
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Queues event for delivery to the subscriptions of the user msg belongs
+// to: whoever scheduled it, which is the recipient unless it has an owner
+func emitEvent(c redis.Conn, event string, msg *Message, now time.Time) error {
+	owner := msg.To
+	if msg.Owner != "" {
+		owner = msg.Owner
+	}
+	subs, err := listSubscriptions(c, owner)
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+	for _, s := range subs {
+		if !s.wants(event) {
+			continue
+		}
+		uid, _ := uuid.NewV4()
+		payload, err := json.Marshal(Event{ID: uid.String(), Type: event, CreatedAt: now.Unix(), Message: msg})
+		if err != nil {
+			return err
+		}
+		d := &Delivery{ID: uid.String(), Subscription: s.ID, Owner: owner, Event: event, Payload: payload, Status: DELIVERY_PENDING, CreatedAt: now.Unix(), NextAttempt: now.Unix()}
+		c.Send("MULTI")
+		queuePutDelivery(c, d)
+		c.Send("ZADD", EVENT_DELIVERIES_KEY, d.NextAttempt, d.ID)
+		c.Send("LPUSH", deliveryLogKey(owner), d.ID)
+		c.Send("LTRIM", deliveryLogKey(owner), 0, MAX_DELIVERY_LOG-1)
+		if _, err := c.Do("EXEC"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queues event for the messages with ids, logging rather than returning
+// errors since the messages have already been stored
+func emitMessageEvents(ctx context.Context, c redis.Conn, event string, ids ...string) {
+	now := CLOCK.Now()
+	for _, id := range ids {
+		msg, err := getMessage(c, id)
+		if err == nil {
+			err = emitEvent(c, event, msg, now)
+		}
+		if err != nil {
+			LoggerFrom(ctx).Error("could not queue event", Fields{"event": event, "message_id": id, "error": err})
+		}
+	}
+}
+
+// Sends the commands storing d, to be run in a transaction
+func queuePutDelivery(c redis.Conn, d *Delivery) {
+	b, _ := json.Marshal(d)
+	c.Send("SET", deliveryKey(d.ID), b, "EX", int(MESSAGE_RETENTION.Seconds()))
+}
+
+func getDelivery(c redis.Conn, id string) (*Delivery, error) {
+	b, err := redis.Bytes(c.Do("GET", deliveryKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &Delivery{}
+	return d, json.Unmarshal(b, d)
+}
+
+// Attempts deliveries which are due, EVENT_WORKERS at a time, retrying
+// failures with backoff until MAX_EVENT_ATTEMPTS
+func deliverEvents(ctx context.Context, c redis.Conn, now time.Time) error {
+	ids, err := redis.Strings(c.Do("ZRANGEBYSCORE", EVENT_DELIVERIES_KEY, "-inf", now.Unix()))
+	if err != nil {
+		return err
+	}
+	claimed := make([]string, 0, len(ids))
+	lease := now.Add(EVENT_DELIVERY_LEASE).Unix()
+	for _, id := range ids {
+		// claim it by pushing it back until the lease is up, in case another
+		// dispatcher got to it first. It stays in the set until the attempt
+		// is recorded, so it's retried if this dispatcher stops before then.
+		n, err := redis.Int(c.Do("ZADD", EVENT_DELIVERIES_KEY, "XX", "GT", "CH", lease, id))
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			claimed = append(claimed, id)
+		}
+	}
+	forEachConcurrently(claimed, EVENT_WORKERS, func(c redis.Conn, id string) {
+		log := LoggerFrom(ctx).With(Fields{"delivery_id": id})
+		d, err := getDelivery(c, id)
+		if err == ErrNotFound {
+			c.Do("ZREM", EVENT_DELIVERIES_KEY, id)
+			return
+		}
+		if err != nil {
+			log.Error("could not get delivery", Fields{"error": err})
+			return
+		}
+		attemptDelivery(WithLogger(ctx, log), c, d, now)
+	})
+	return nil
+}
+
+// Records a delivery's outcome, rescheduling it or removing it from
+// EVENT_DELIVERIES_KEY in the same transaction
+func recordDelivery(c redis.Conn, d *Delivery) error {
+	c.Send("MULTI")
+	queuePutDelivery(c, d)
+	if d.NextAttempt > 0 {
+		c.Send("ZADD", EVENT_DELIVERIES_KEY, d.NextAttempt, d.ID)
+	} else {
+		c.Send("ZREM", EVENT_DELIVERIES_KEY, d.ID)
+	}
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// POSTs a delivery's event to its subscription and records the outcome
+func attemptDelivery(ctx context.Context, c redis.Conn, d *Delivery, now time.Time) {
+	log := LoggerFrom(ctx)
+	b, err := redis.Bytes(c.Do("HGET", subscriptionsKey(d.Owner), d.Subscription))
+	s := &Subscription{}
+	if err == nil {
+		err = json.Unmarshal(b, s)
+	}
+	if err == redis.ErrNil {
+		d.Status, d.LastError, d.NextAttempt = DELIVERY_FAILED, "subscription removed", 0
+		if err := recordDelivery(c, d); err != nil {
+			log.Error("could not record delivery", Fields{"error": err})
+		}
+		return
+	}
+	if err != nil {
+		log.Error("could not get subscription", Fields{"error": err})
+		return
+	}
+
+	d.Attempts++
+	_, err = PostWebhook(ctx, s.URL, s.Secret, d.Payload)
+	switch {
+	case err == nil:
+		d.Status, d.LastError, d.NextAttempt, d.DeliveredAt = DELIVERY_SUCCEEDED, "", 0, now.Unix()
+	case d.Attempts >= MAX_EVENT_ATTEMPTS:
+		d.Status, d.LastError, d.NextAttempt = DELIVERY_FAILED, err.Error(), 0
+	default:
+		d.LastError = err.Error()
+		d.NextAttempt = now.Add(EVENT_RETRY_BACKOFF << uint(d.Attempts-1)).Unix()
+	}
+	if err != nil {
+		log.Warn("could not deliver event", Fields{"event": d.Event, "attempts": d.Attempts, "error": err})
+	}
+	if err := recordDelivery(c, d); err != nil {
+		log.Error("could not record delivery", Fields{"error": err})
+	}
+}
+
+// Get owner's latest deliveries, newest first
+func DeliveryLog(owner string) ([]*Delivery, error) {
+	c := GetConn()
+	defer c.Close()
+	ids, err := redis.Strings(c.Do("LRANGE", deliveryLogKey(owner), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	log := make([]*Delivery, 0, len(ids))
+	for _, id := range ids {
+		d, err := getDelivery(c, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log = append(log, d)
+	}
+	return log, nil
+}
+
+// Sends one of owner's deliveries again with the dispatcher's next pass,
+// whether or not it succeeded, or returns ErrNotFound
+func ReplayDelivery(owner, id string) (*Delivery, error) {
+	c := GetConn()
+	defer c.Close()
+	d, err := getDelivery(c, id)
+	if err == nil && d.Owner != owner {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a replay gets a full set of retries
+	d.Status, d.Attempts, d.NextAttempt = DELIVERY_PENDING, 0, CLOCK.Now().Unix()
+	return d, recordDelivery(c, d)
+}
+
+// Subscribes to events, {"number", "password", "url", "events"} where events
+// is a comma separated list of event types, or empty for all of them
+func subscribeEvents(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	events, err := parseEventTypes(data["events"])
+	if err != nil {
+		WriteJSONError(w, fmt.Sprintf("Events must be some of %s, %s.", strings.Join(EVENT_TYPES, ", "), err), http.StatusBadRequest)
+		return
+	}
+	s, err := Subscribe(r.Context(), data["number"], data["url"], events)
+	switch {
+	case err == ErrInvalidDestination:
+		WriteJSONError(w, "Webhook URL must be http or https.", http.StatusBadRequest)
+	case err == ErrTooManySubscriptions:
+		WriteJSONError(w, fmt.Sprintf("You can't have more than %d webhook subscriptions.", MAX_SUBSCRIPTIONS), http.StatusBadRequest)
+	case errors.Is(err, ErrChallengeFailed):
+		WriteJSONError(w, "Webhook did not echo the verification challenge.", http.StatusBadRequest)
+	case err != nil:
+		LoggerFrom(r.Context()).Error("could not subscribe", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, SUBSCRIPTIONS_ERR_S, http.StatusInternalServerError)
+	default:
+		WriteJSON(w, map[string]interface{}{"subscription": s}, http.StatusOK)
+	}
+}
+
+// Lists webhook subscriptions, {"number", "password"}
+func listEventSubscriptions(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	subs, err := ListSubscriptions(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list subscriptions", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, SUBSCRIPTIONS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"subscriptions": subs}, http.StatusOK)
+}
+
+// Removes a webhook subscription, {"number", "password", "id"}
+func unsubscribeEvents(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := Unsubscribe(data["number"], data["id"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No webhook subscription with that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not unsubscribe", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, SUBSCRIPTIONS_ERR_S, http.StatusInternalServerError)
+	}
+}
+
+// Lists the latest webhook deliveries, {"number", "password"}
+func listDeliveries(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	log, err := DeliveryLog(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get delivery log", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, SUBSCRIPTIONS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"deliveries": log}, http.StatusOK)
+}
+
+// Sends a webhook delivery again, {"number", "password", "id"}
+func replayDelivery(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	d, err := ReplayDelivery(data["number"], data["id"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No webhook delivery with that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not replay delivery", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, SUBSCRIPTIONS_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"delivery": d}, http.StatusOK)
+}
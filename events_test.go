@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/scascketta/textremind/webhook"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycleWebhooks(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	auth := map[string]string{"number": number, "password": password}
+
+	var mu sync.Mutex
+	var secret string
+	failing := false
+	received := make([]Event, 0)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var event struct {
+			Event
+			Challenge string `json:"challenge"`
+		}
+		json.Unmarshal(body, &event)
+		if event.Challenge != "" {
+			w.Write([]byte(event.Challenge))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := webhook.Verify(r, secret, body, app.Clock.Now(), time.Minute); err != nil {
+			t.Errorf("event with invalid signature %s: %v", body, err)
+		}
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, event.Event)
+	}))
+	defer hook.Close()
+	// events due together may arrive in any order
+	types := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		s := make([]string, len(received))
+		for i, e := range received {
+			s[i] = e.Type
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+	event := func(typ string) *Event {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range received {
+			if e.Type == typ {
+				return &e
+			}
+		}
+		return nil
+	}
+
+	if code, _ := app.PostJSON("/webhooks/subscribe", map[string]string{"number": number, "password": password, "url": hook.URL, "events": "message.sent,message.exploded"}); code != http.StatusBadRequest {
+		t.Errorf("unknown event type: got status %d", code)
+	}
+	code, res := app.PostJSON("/webhooks/subscribe", map[string]string{"number": number, "password": password, "url": hook.URL, "events": "message.scheduled, message.sent, message.cancelled"})
+	if code != http.StatusOK {
+		t.Fatalf("subscribe: got status %d, %v", code, res)
+	}
+	mu.Lock()
+	secret = res["subscription"].(map[string]interface{})["secret"].(string)
+	mu.Unlock()
+
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	_, res = app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": "Feed the fish"})
+	id := res["id"].(string)
+	later := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	_, res = app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": later, "body": "Feed the cat"})
+	CancelMessage(res["id"].(string))
+	app.Dispatch()
+	if got := types(); got != "message.cancelled,message.scheduled,message.scheduled,message.sent" {
+		t.Fatalf("unexpected events %v", got)
+	}
+	if sent := event(EVENT_SENT); sent.Message.ID != id || sent.Message.Status != STATUS_SENT || sent.Message.Body != "Feed the fish" {
+		t.Errorf("unexpected sent event %+v", sent.Message)
+	}
+
+	// failed deliveries are retried with backoff, then given up on
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	nextWeek := strconv.FormatInt(app.Clock.Now().Add(7*24*time.Hour).Unix(), 10)
+	app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": nextWeek, "body": "Feed the dog"})
+	for i := 0; i < MAX_EVENT_ATTEMPTS+2; i++ {
+		app.Dispatch()
+		app.Advance(EVENT_RETRY_BACKOFF << uint(i))
+	}
+	_, res = app.PostJSON("/webhooks/deliveries", auth)
+	latest := res["deliveries"].([]interface{})[0].(map[string]interface{})
+	if latest["status"] != DELIVERY_FAILED || latest["attempts"] != float64(MAX_EVENT_ATTEMPTS) {
+		t.Errorf("unexpected failed delivery %v", latest)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if code, _ := app.PostJSON("/webhooks/replay", map[string]string{"number": number, "password": password, "id": latest["id"].(string)}); code != http.StatusOK {
+		t.Errorf("replay: got status %d", code)
+	}
+	app.Dispatch()
+	if got := types(); got != "message.cancelled,message.scheduled,message.scheduled,message.scheduled,message.sent" {
+		t.Errorf("replayed event not delivered: %v", got)
+	}
+	if code, _ := app.PostJSON("/webhooks/replay", map[string]string{"number": "5551230001", "password": password, "id": latest["id"].(string)}); code == http.StatusOK {
+		t.Error("replayed another user's delivery")
+	}
+}
+
+func TestEventDeliveryLease(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+
+	var mu sync.Mutex
+	received := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var challenge struct {
+			Challenge string `json:"challenge"`
+		}
+		if json.Unmarshal(body, &challenge); challenge.Challenge != "" {
+			w.Write([]byte(challenge.Challenge))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received++
+	}))
+	defer hook.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+	if code, res := app.PostJSON("/webhooks/subscribe", map[string]string{"number": number, "password": password, "url": hook.URL, "events": "message.scheduled"}); code != http.StatusOK {
+		t.Fatalf("subscribe: got status %d, %v", code, res)
+	}
+	later := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": later, "body": "Feed the cat"})
+
+	// the dispatcher stops after sending the event, before recording it
+	n := 0
+	GetConn = func() redis.Conn { return failingExecConn{app.DB.Conn(), &n} }
+	conn := app.DB.Conn()
+	defer conn.Close()
+	if err := deliverEvents(context.Background(), conn, app.Clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	GetConn = app.DB.Conn
+	if got := count(); got != 1 {
+		t.Fatalf("expected the event to be sent once, got %d", got)
+	}
+
+	// it's left to that dispatcher until the lease is up, then sent again
+	app.Advance(EVENT_DELIVERY_LEASE - time.Minute)
+	app.Dispatch()
+	if got := count(); got != 1 {
+		t.Fatalf("leased delivery sent again early, %d times", got)
+	}
+	app.Advance(time.Minute)
+	app.Dispatch()
+	if got := count(); got != 2 {
+		t.Fatalf("delivery not retried after its lease, sent %d times", got)
+	}
+	app.Advance(EVENT_DELIVERY_LEASE)
+	app.Dispatch()
+	if got := count(); got != 2 {
+		t.Errorf("recorded delivery sent again, %d times", got)
+	}
+	if n, _ := redis.Int(conn.Do("ZCARD", EVENT_DELIVERIES_KEY)); n != 0 {
+		t.Errorf("%d deliveries still queued", n)
+	}
+}
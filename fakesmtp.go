@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// An email received by FakeSMTP
+type FakeEmail struct {
+	From    string
+	To      []string
+	Subject string
+	// Decoded text of the message
+	Body string
+}
+
+// Stand-in SMTP server which records the email it's sent, for tests and
+// development. It accepts anything, except recipients passed to Reject, and
+// doesn't support TLS or AUTH.
+type FakeSMTP struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	emails   []FakeEmail
+	rejected map[string]bool
+}
+
+// Starts a FakeSMTP listening on addr, e.g. "127.0.0.1:0"
+func NewFakeSMTP(addr string) (*FakeSMTP, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeSMTP{listener: l, rejected: make(map[string]bool)}
+	go f.serve()
+	return f, nil
+}
+
+func (f *FakeSMTP) Addr() string { return f.listener.Addr().String() }
+
+func (f *FakeSMTP) Close() error { return f.listener.Close() }
+
+// Returns the emails received so far
+func (f *FakeSMTP) Emails() []FakeEmail {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeEmail(nil), f.emails...)
+}
+
+// Makes email to address fail as an unknown mailbox
+func (f *FakeSMTP) Reject(address string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejected[address] = true
+}
+
+func (f *FakeSMTP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.session(conn)
+	}
+}
+
+func (f *FakeSMTP) session(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake-smtp ready")
+	email := FakeEmail{}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 fake-smtp")
+		case "MAIL":
+			email = FakeEmail{From: smtpPath(line)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			to := smtpPath(line)
+			f.mu.Lock()
+			rejected := f.rejected[to]
+			f.mu.Unlock()
+			if rejected {
+				tp.PrintfLine("550 5.1.1 mailbox unavailable")
+				continue
+			}
+			email.To = append(email.To, to)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 end with <CRLF>.<CRLF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			email.Subject, email.Body = parseEmail(data)
+			f.mu.Lock()
+			f.emails = append(f.emails, email)
+			f.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// Gets the address from a MAIL FROM:<...> or RCPT TO:<...> command
+func smtpPath(line string) string {
+	start, end := strings.Index(line, "<"), strings.LastIndex(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func parseEmail(data []byte) (string, string) {
+	msg, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return "", string(data)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	body := msg.Body
+	if strings.EqualFold(msg.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+		body = quotedprintable.NewReader(body)
+	}
+	b, _ := ioutil.ReadAll(body)
+	return subject, string(b)
+}
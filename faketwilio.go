@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A message received by FakeTwilio
+type FakeMessage struct {
+	Sid            string    `json:"sid"`
+	AccountSid     string    `json:"account_sid"`
+	From           string    `json:"from"`
+	To             string    `json:"to"`
+	Body           string    `json:"body"`
+	MediaURLs      []string  `json:"media_urls,omitempty"`
+	Status         string    `json:"status"`
+	StatusCallback string    `json:"status_callback,omitempty"`
+	DateCreated    time.Time `json:"date_created"`
+}
+
+// A call received by FakeTwilio
+type FakeCall struct {
+	Sid         string    `json:"sid"`
+	AccountSid  string    `json:"account_sid"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Twiml       string    `json:"twiml"`
+	Status      string    `json:"status"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// Controls how FakeTwilio misbehaves
+type FakeConfig struct {
+	// Fraction of requests, 0 to 1, which fail with FailStatus/FailCode
+	FailRate   float64 `json:"fail_rate"`
+	FailStatus int     `json:"fail_status"`
+	FailCode   int     `json:"fail_code"`
+	// Added to every request to the Messages and Calls APIs
+	LatencyMs int `json:"latency_ms"`
+	// Recipients which always fail with the mapped Twilio error code, e.g. 21211
+	FailNumbers map[string]int `json:"fail_numbers"`
+	// Status reported to status callbacks after "sent", e.g. "delivered" or "undelivered"
+	FinalStatus string `json:"final_status"`
+	// Where inbound messages are delivered if a request doesn't specify one
+	InboundURL string `json:"inbound_url"`
+}
+
+// Stand-in for the Twilio Messages and Calls APIs used in development and
+// tests. Routes:
+//
+//	POST   /2010-04-01/Accounts/{sid}/Messages.json  send a message
+//	POST   /2010-04-01/Accounts/{sid}/Calls.json     make a call
+//	GET    /_fake/messages                           list received messages
+//	DELETE /_fake/messages                           forget received messages and calls
+//	GET    /_fake/calls                              list received calls
+//	GET    /_fake/config, POST /_fake/config         view or replace FakeConfig
+//	POST   /_fake/messages/{sid}/status              fire a status callback
+//	POST   /_fake/inbound                            deliver an inbound SMS webhook
+type FakeTwilio struct {
+	// Used to sign webhooks, as Twilio does with the account's auth token
+	AuthToken string
+	Client    *http.Client
+
+	mu       sync.Mutex
+	config   FakeConfig
+	messages []*FakeMessage
+	calls    []FakeCall
+}
+
+func NewFakeTwilio(authToken string, config FakeConfig) *FakeTwilio {
+	return &FakeTwilio{AuthToken: authToken, Client: &http.Client{Timeout: 10 * time.Second}, config: config}
+}
+
+// Returns copies of the messages received so far
+func (f *FakeTwilio) Messages() []FakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msgs := make([]FakeMessage, len(f.messages))
+	for i, m := range f.messages {
+		msgs[i] = *m
+	}
+	return msgs
+}
+
+// Returns the calls received so far
+func (f *FakeTwilio) Calls() []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeCall(nil), f.calls...)
+}
+
+func (f *FakeTwilio) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = nil
+	f.calls = nil
+}
+
+func (f *FakeTwilio) SetConfig(config FakeConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config = config
+}
+
+func (f *FakeTwilio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case strings.HasPrefix(path, "/2010-04-01/Accounts/") && strings.HasSuffix(path, "/Messages.json"):
+		if r.Method != "POST" {
+			WriteJSONError(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		sid := strings.TrimSuffix(strings.TrimPrefix(path, "/2010-04-01/Accounts/"), "/Messages.json")
+		f.createMessage(w, r, sid)
+	case strings.HasPrefix(path, "/2010-04-01/Accounts/") && strings.HasSuffix(path, "/Calls.json"):
+		if r.Method != "POST" {
+			WriteJSONError(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		sid := strings.TrimSuffix(strings.TrimPrefix(path, "/2010-04-01/Accounts/"), "/Calls.json")
+		f.createCall(w, r, sid)
+	case path == "/_fake/calls" && r.Method == "GET":
+		WriteJSON(w, map[string]interface{}{"calls": f.Calls()}, http.StatusOK)
+	case path == "/_fake/messages":
+		switch r.Method {
+		case "GET":
+			WriteJSON(w, map[string]interface{}{"messages": f.Messages()}, http.StatusOK)
+		case "DELETE":
+			f.Reset()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			WriteJSONError(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		}
+	case path == "/_fake/config":
+		f.handleConfig(w, r)
+	case strings.HasPrefix(path, "/_fake/messages/") && strings.HasSuffix(path, "/status") && r.Method == "POST":
+		sid := strings.TrimSuffix(strings.TrimPrefix(path, "/_fake/messages/"), "/status")
+		f.handleStatus(w, r, sid)
+	case path == "/_fake/inbound" && r.Method == "POST":
+		f.handleInbound(w, r)
+	default:
+		WriteJSONError(w, "Not found.", http.StatusNotFound)
+	}
+}
+
+// Parses a Messages or Calls API request, applying the configured latency
+// and failures. Writes an error and returns false if it should fail.
+func (f *FakeTwilio) accept(w http.ResponseWriter, r *http.Request) (FakeConfig, bool) {
+	if err := r.ParseForm(); err != nil {
+		writeTwilioError(w, http.StatusBadRequest, 21100, err.Error())
+		return FakeConfig{}, false
+	}
+	f.mu.Lock()
+	config := f.config
+	f.mu.Unlock()
+
+	if config.LatencyMs > 0 {
+		time.Sleep(time.Duration(config.LatencyMs) * time.Millisecond)
+	}
+	to := r.PostForm.Get("To")
+	if to == "" || r.PostForm.Get("From") == "" {
+		writeTwilioError(w, http.StatusBadRequest, 21604, "A 'To' and 'From' phone number is required.")
+		return config, false
+	}
+	if code, ok := config.FailNumbers[to]; ok {
+		writeTwilioError(w, http.StatusBadRequest, code, fmt.Sprintf("Simulated error %d for recipient.", code))
+		return config, false
+	}
+	if config.FailRate > 0 && mrand.Float64() < config.FailRate {
+		status := config.FailStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		writeTwilioError(w, status, config.FailCode, "Simulated failure.")
+		return config, false
+	}
+	return config, true
+}
+
+func (f *FakeTwilio) createCall(w http.ResponseWriter, r *http.Request, accountSid string) {
+	if _, ok := f.accept(w, r); !ok {
+		return
+	}
+	if r.PostForm.Get("Twiml") == "" && r.PostForm.Get("Url") == "" {
+		writeTwilioError(w, http.StatusBadRequest, 21205, "Either Url or Twiml is required.")
+		return
+	}
+	call := FakeCall{
+		Sid:         "CA" + randomHex(16),
+		AccountSid:  accountSid,
+		From:        r.PostForm.Get("From"),
+		To:          r.PostForm.Get("To"),
+		Twiml:       r.PostForm.Get("Twiml"),
+		Status:      "queued",
+		DateCreated: time.Now().UTC(),
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	WriteJSON(w, map[string]interface{}{
+		"sid":          call.Sid,
+		"account_sid":  call.AccountSid,
+		"from":         call.From,
+		"to":           call.To,
+		"status":       call.Status,
+		"date_created": call.DateCreated.Format(time.RFC1123Z),
+	}, http.StatusCreated)
+}
+
+func (f *FakeTwilio) createMessage(w http.ResponseWriter, r *http.Request, accountSid string) {
+	config, ok := f.accept(w, r)
+	if !ok {
+		return
+	}
+	to := r.PostForm.Get("To")
+
+	msg := &FakeMessage{
+		Sid:            "SM" + randomHex(16),
+		AccountSid:     accountSid,
+		From:           r.PostForm.Get("From"),
+		To:             to,
+		Body:           r.PostForm.Get("Body"),
+		MediaURLs:      r.PostForm["MediaUrl"],
+		Status:         "queued",
+		StatusCallback: r.PostForm.Get("StatusCallback"),
+		DateCreated:    time.Now().UTC(),
+	}
+	f.mu.Lock()
+	f.messages = append(f.messages, msg)
+	// status callbacks update msg concurrently, respond with what was created
+	created := *msg
+	f.mu.Unlock()
+
+	if msg.StatusCallback != "" {
+		final := config.FinalStatus
+		if final == "" {
+			final = "delivered"
+		}
+		go func() {
+			f.fireStatus(msg.Sid, "sent", "")
+			f.fireStatus(msg.Sid, final, "")
+		}()
+	}
+
+	WriteJSON(w, map[string]interface{}{
+		"sid":          created.Sid,
+		"account_sid":  created.AccountSid,
+		"from":         created.From,
+		"to":           created.To,
+		"body":         created.Body,
+		"status":       created.Status,
+		"num_media":    fmt.Sprint(len(created.MediaURLs)),
+		"date_created": created.DateCreated.Format(time.RFC1123Z),
+	}, http.StatusCreated)
+}
+
+func (f *FakeTwilio) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		config := FakeConfig{}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			WriteJSONError(w, DECODE_ERR_S, http.StatusBadRequest)
+			return
+		}
+		f.SetConfig(config)
+	}
+	f.mu.Lock()
+	config := f.config
+	f.mu.Unlock()
+	WriteJSON(w, map[string]interface{}{"config": config}, http.StatusOK)
+}
+
+// Fires a status callback for a message, body: {"status": "...", "error_code": "..."}
+func (f *FakeTwilio) handleStatus(w http.ResponseWriter, r *http.Request, sid string) {
+	data, err := decodeJSON(w, r)
+	if err != nil {
+		return
+	}
+	if err := f.fireStatus(sid, data["status"], data["error_code"]); err != nil {
+		WriteJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Updates a message's status and POSTs it to the message's StatusCallback
+func (f *FakeTwilio) fireStatus(sid, status, errorCode string) error {
+	f.mu.Lock()
+	var msg *FakeMessage
+	for _, m := range f.messages {
+		if m.Sid == sid {
+			msg = m
+		}
+	}
+	if msg == nil {
+		f.mu.Unlock()
+		return fmt.Errorf("no message with sid %s", sid)
+	}
+	msg.Status = status
+	m := *msg
+	f.mu.Unlock()
+
+	if m.StatusCallback == "" {
+		return nil
+	}
+	params := url.Values{}
+	params.Set("MessageSid", m.Sid)
+	params.Set("AccountSid", m.AccountSid)
+	params.Set("From", m.From)
+	params.Set("To", m.To)
+	params.Set("MessageStatus", status)
+	if errorCode != "" {
+		params.Set("ErrorCode", errorCode)
+	}
+	return f.postWebhook(m.StatusCallback, params)
+}
+
+// Delivers an inbound SMS webhook, body: {"from": "...", "to": "...", "body": "...", "url": "..."}
+func (f *FakeTwilio) handleInbound(w http.ResponseWriter, r *http.Request) {
+	data, err := decodeJSON(w, r)
+	if err != nil {
+		return
+	}
+	target := data["url"]
+	if target == "" {
+		f.mu.Lock()
+		target = f.config.InboundURL
+		f.mu.Unlock()
+	}
+	if target == "" {
+		WriteJSONError(w, "No inbound webhook URL configured.", http.StatusBadRequest)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("MessageSid", "SM"+randomHex(16))
+	params.Set("From", data["from"])
+	params.Set("To", data["to"])
+	params.Set("Body", data["body"])
+	if err := f.postWebhook(target, params); err != nil {
+		WriteJSONError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POSTs params to target signed like Twilio's webhooks
+func (f *FakeTwilio) postWebhook(target string, params url.Values) error {
+	req, err := http.NewRequest("POST", target, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", TwilioSignature(f.AuthToken, target, params))
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook %s responded with statuscode %d", target, res.StatusCode)
+	}
+	return nil
+}
+
+// Computes the X-Twilio-Signature header for a webhook POST of params to url.
+// See: https://www.twilio.com/docs/usage/security#validating-requests
+func TwilioSignature(authToken, url string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := url
+	for _, k := range keys {
+		for _, v := range params[k] {
+			s += k + v
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func writeTwilioError(w http.ResponseWriter, status, code int, msg string) {
+	WriteJSON(w, map[string]interface{}{
+		"status":    status,
+		"code":      code,
+		"message":   msg,
+		"more_info": fmt.Sprintf("https://www.twilio.com/docs/errors/%d", code),
+	}, status)
+}
+
+// Runs FakeTwilio as a standalone server, for `textremind fake-twilio`
+func runFakeTwilio(args []string) {
+	fs := flag.NewFlagSet("fake-twilio", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:4010", "address to listen on")
+	token := fs.String("auth-token", "fake-auth-token", "auth token used to sign webhooks")
+	config := FakeConfig{}
+	fs.Float64Var(&config.FailRate, "fail-rate", 0, "fraction of sends which fail")
+	fs.IntVar(&config.FailStatus, "fail-status", http.StatusInternalServerError, "HTTP status of simulated failures")
+	fs.IntVar(&config.FailCode, "fail-code", 0, "Twilio error code of simulated failures")
+	fs.IntVar(&config.LatencyMs, "latency-ms", 0, "latency added to every send")
+	fs.StringVar(&config.FinalStatus, "final-status", "delivered", "status reported to status callbacks")
+	fs.StringVar(&config.InboundURL, "inbound-url", "", "default URL for inbound SMS webhooks")
+	fs.Parse(args)
+
+	logger.Info("fake twilio server listening", Fields{"addr": *addr})
+	if err := http.ListenAndServe(*addr, NewFakeTwilio(*token, config)); err != nil {
+		logger.Fatal("problem starting fake twilio server", Fields{"error": err})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Returns a *Client sending to a FakeTwilio. Must close received server.
+func fakeTwilioClient(f *FakeTwilio) (*Client, *httptest.Server) {
+	server := httptest.NewServer(f)
+	return &Client{URL: server.URL + "/2010-04-01/Accounts/ACtest/Messages.json", HTTPClient: &http.Client{}}, server
+}
+
+func TestFakeTwilioRecordsMessages(t *testing.T) {
+	f := NewFakeTwilio("token", FakeConfig{})
+	c, server := fakeTwilioClient(f)
+	defer server.Close()
+
+	if err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := f.Messages()
+	if len(msgs) != 1 || msgs[0].To != "5558675309" || msgs[0].Body != "asdf" || msgs[0].AccountSid != "ACtest" {
+		t.Errorf("unexpected messages recorded: %+v", msgs)
+	}
+}
+
+func TestFakeTwilioFailNumbers(t *testing.T) {
+	f := NewFakeTwilio("token", FakeConfig{FailNumbers: map[string]int{"5550001111": TWILIO_ERR_UNSUBSCRIBED}})
+	c, server := fakeTwilioClient(f)
+	defer server.Close()
+
+	err := SendTwilioMessage(context.Background(), c, "5550001111", "asdf")
+	if !IsTwilioErrorCode(err, TWILIO_ERR_UNSUBSCRIBED) {
+		t.Errorf("expected unsubscribed error, got %v", err)
+	}
+	if len(f.Messages()) != 0 {
+		t.Error("failed message should not be recorded")
+	}
+}
+
+func TestFakeTwilioStatusCallback(t *testing.T) {
+	statuses := make(chan string, 2)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Header.Get("X-Twilio-Signature") != TwilioSignature("token", "http://"+r.Host+r.URL.Path, r.PostForm) {
+			t.Error("status callback signature doesn't match")
+		}
+		statuses <- r.PostForm.Get("MessageStatus")
+	}))
+	defer callback.Close()
+
+	f := NewFakeTwilio("token", FakeConfig{})
+	server := httptest.NewServer(f)
+	defer server.Close()
+	_, err := http.PostForm(server.URL+"/2010-04-01/Accounts/ACtest/Messages.json", map[string][]string{
+		"From": {"+15005550006"}, "To": {"5558675309"}, "Body": {"asdf"}, "StatusCallback": {callback.URL + "/status"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"sent", "delivered"} {
+		select {
+		case got := <-statuses:
+			if got != want {
+				t.Errorf("got status %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q status callback", want)
+		}
+	}
+}
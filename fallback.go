@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Why a message fell back
+const (
+	// Twilio rejected it, e.g. an invalid number
+	FALLBACK_FAILED = "failed"
+	// the carrier reported it undelivered
+	FALLBACK_UNDELIVERED = "undelivered"
+	// no delivery receipt arrived in time
+	FALLBACK_UNCONFIRMED = "unconfirmed"
+)
+
+const (
+	MAX_FALLBACK_TIMEOUT = 24 * 60
+	// Sorted set of IDs of sent messages waiting for a delivery receipt,
+	// scored by when they fall back
+	AWAITING_DELIVERY_KEY = "awaiting_delivery"
+
+	FALLBACK_ERR_S = ERR_S + "updating the fallback."
+)
+
+// A user's rule for delivering their SMS reminders another way when they
+// fail, or aren't confirmed delivered within TimeoutMinutes
+type FallbackRule struct {
+	Channel     string `json:"channel"`
+	Destination string `json:"destination,omitempty"`
+	// Zero to only fall back when Twilio rejects a message
+	TimeoutMinutes int `json:"timeout_minutes"`
+}
+
+// What happened when a message fell back
+type FallbackOutcome struct {
+	Channel string `json:"channel"`
+	Reason  string `json:"reason"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	At      int64  `json:"at"`
+}
+
+// URL Twilio reports a message's delivery status to, empty if the app's
+// public URL isn't configured
+func statusCallbackURL(id string) string {
+	if PUBLIC_URL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(PUBLIC_URL, "/") + "/sms/status?id=" + url.QueryEscape(id)
+}
+
+// Delivery statuses reported by Twilio which mean a message won't arrive
+func undelivered(status string) bool {
+	return status == "undelivered" || status == "failed"
+}
+
+// Get a user's fallback rule, or nil if they don't have one
+func GetFallback(owner string) (*FallbackRule, error) {
+	c := GetConn()
+	defer c.Close()
+	return getFallback(c, owner)
+}
+
+func getFallback(c redis.Conn, owner string) (*FallbackRule, error) {
+	b, err := redis.Bytes(c.Do("HGET", owner, "fallback"))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rule := &FallbackRule{}
+	return rule, json.Unmarshal(b, rule)
+}
+
+func SetFallback(owner string, rule *FallbackRule) error {
+	b, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	c := GetConn()
+	defer c.Close()
+	_, err = c.Do("HSET", owner, "fallback", b)
+	return err
+}
+
+func ClearFallback(owner string) error {
+	c := GetConn()
+	defer c.Close()
+	_, err := c.Do("HDEL", owner, "fallback")
+	return err
+}
+
+// Gets the fallback rule for msg. Only SMS users schedule for themselves
+// fall back, not messages to contacts.
+func fallbackRule(c redis.Conn, msg *Message) (*FallbackRule, error) {
+	if msg.Owner != "" || (msg.Channel != "" && msg.Channel != CHANNEL_SMS) {
+		return nil, nil
+	}
+	return getFallback(c, msg.To)
+}
+
+// Delivers msg on rule's channel, once, and records the outcome on msg
+func runFallback(ctx context.Context, c redis.Conn, msg *Message, rule *FallbackRule, reason string, now time.Time) {
+	log := LoggerFrom(ctx)
+	body, err := messageBody(c, msg, now)
+	if err == nil {
+		alt := *msg
+		alt.Channel, alt.Destination, alt.Media = rule.Channel, rule.Destination, nil
+		err = deliver(ctx, c, &alt, body)
+	}
+	outcome := FallbackOutcome{Channel: rule.Channel, Reason: reason, Status: STATUS_SENT, At: now.Unix()}
+	if err != nil {
+		outcome.Status, outcome.Error = STATUS_FAILED, err.Error()
+		log.Error("could not deliver fallback", Fields{"message_id": msg.ID, "channel": rule.Channel, "reason": reason, "error": err})
+	} else {
+		log.Info("delivered fallback", Fields{"message_id": msg.ID, "channel": rule.Channel, "reason": reason})
+	}
+
+	b, _ := json.Marshal(outcome)
+	c.Send("MULTI")
+	c.Send("HSET", msg.ID, "fallback", b)
+	c.Send("HDEL", msg.ID, "body", "template", "vars")
+	if _, err := c.Do("EXEC"); err != nil {
+		log.Error("could not record fallback", Fields{"message_id": msg.ID, "error": err})
+	}
+}
+
+// Waits for a delivery receipt for a message sent under rule, falling back
+// if there isn't one in time. Its content is kept until then.
+func awaitDelivery(ctx context.Context, c redis.Conn, msg *Message, rule *FallbackRule, now time.Time) error {
+	if _, err := c.Do("ZADD", AWAITING_DELIVERY_KEY, now.Add(time.Duration(rule.TimeoutMinutes)*time.Minute).Unix(), msg.ID); err != nil {
+		return err
+	}
+	// the receipt may have arrived before it was waited for
+	status, err := redis.String(c.Do("HGET", msg.ID, "delivery"))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status == "delivered" || undelivered(status) {
+		return resolveDelivery(ctx, c, msg.ID, FALLBACK_UNDELIVERED, now)
+	}
+	return nil
+}
+
+// Resolves a message which was waiting for a delivery receipt: it falls
+// back unless it was delivered. Does nothing if it wasn't waiting, so
+// concurrent status callbacks and dispatchers resolve it once.
+func resolveDelivery(ctx context.Context, c redis.Conn, id, reason string, now time.Time) error {
+	removed, err := redis.Int(c.Do("ZREM", AWAITING_DELIVERY_KEY, id))
+	if err != nil || removed == 0 {
+		return err
+	}
+	msg, err := getMessage(c, id)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if msg.Delivery == "delivered" {
+		_, err := c.Do("HDEL", id, "body", "template", "vars")
+		return err
+	}
+	if undelivered(msg.Delivery) {
+		reason = FALLBACK_UNDELIVERED
+	}
+	rule, err := fallbackRule(c, msg)
+	if err != nil {
+		return err
+	}
+	if rule == nil {
+		// removed since it was sent
+		_, err := c.Do("HDEL", id, "body", "template", "vars")
+		return err
+	}
+	runFallback(ctx, c, msg, rule, reason, now)
+	return nil
+}
+
+// Falls back for sent messages with no delivery receipt by now
+func checkDeliveryTimeouts(ctx context.Context, c redis.Conn, now time.Time) error {
+	ids, err := redis.Strings(c.Do("ZRANGEBYSCORE", AWAITING_DELIVERY_KEY, "-inf", now.Unix()))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		mctx := WithLogger(ctx, LoggerFrom(ctx).With(Fields{"message_id": id}))
+		if err := resolveDelivery(mctx, c, id, FALLBACK_UNCONFIRMED, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Twilio's status callback for sent messages, see statusCallbackURL
+func smsStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !validTwilioSignature(r) {
+		LoggerFrom(r.Context()).Warn("status callback with invalid signature")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	id, status := r.URL.Query().Get("id"), r.PostForm.Get("MessageStatus")
+	log := LoggerFrom(r.Context()).With(Fields{"message_id": id})
+
+	c := GetConn()
+	defer c.Close()
+	exists, err := redis.Bool(c.Do("EXISTS", id))
+	if err != nil {
+		log.Error("could not get message", Fields{"error": err})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		// expired, or already finished with
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, err := c.Do("HSET", id, "delivery", status); err != nil {
+		log.Error("could not record delivery status", Fields{"error": err})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Info("delivery status", Fields{"status": status, "error_code": r.PostForm.Get("ErrorCode")})
+	if status == "delivered" || undelivered(status) {
+		ctx := WithLogger(r.Context(), log)
+		event := EVENT_DELIVERED
+		if status != "delivered" {
+			event = EVENT_FAILED
+		}
+		emitMessageEvents(ctx, c, event, id)
+		if err := resolveDelivery(ctx, c, id, FALLBACK_UNDELIVERED, CLOCK.Now()); err != nil {
+			log.Error("could not resolve delivery", Fields{"error": err})
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sets the fallback rule, {"number", "password", "channel", "destination",
+// "timeout_minutes"}. Email and webhook destinations must be verified.
+func setFallback(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	owner := data["number"]
+	if !authenticate(w, r, owner, data["password"]) {
+		return
+	}
+	rule := &FallbackRule{Channel: data["channel"]}
+	if data["timeout_minutes"] != "" {
+		n, err := strconv.Atoi(data["timeout_minutes"])
+		if err != nil || n < 0 || n > MAX_FALLBACK_TIMEOUT {
+			WriteJSONError(w, "Timeout must be between 0 and 1440 minutes.", http.StatusBadRequest)
+			return
+		}
+		rule.TimeoutMinutes = n
+	}
+	if rule.TimeoutMinutes > 0 && PUBLIC_URL == "" {
+		WriteJSONError(w, "Delivery receipts aren't available, so messages can only fall back when sending fails.", http.StatusBadRequest)
+		return
+	}
+	switch rule.Channel {
+	case CHANNEL_VOICE:
+	case CHANNEL_EMAIL, CHANNEL_WEBHOOK:
+		address, ok := checkDestination(w, r, owner, rule.Channel, data["destination"])
+		if !ok {
+			return
+		}
+		rule.Destination = address
+	default:
+		WriteJSONError(w, "Fallback channel must be one of voice, email or webhook.", http.StatusBadRequest)
+		return
+	}
+	if err := SetFallback(owner, rule); err != nil {
+		LoggerFrom(r.Context()).Error("could not set fallback", Fields{"number": owner, "error": err})
+		WriteJSONError(w, FALLBACK_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"fallback": rule}, http.StatusOK)
+}
+
+// Gets the fallback rule, {"number", "password"}
+func getFallbackRule(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	rule, err := GetFallback(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get fallback", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, FALLBACK_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"fallback": rule}, http.StatusOK)
+}
+
+// Removes the fallback rule, {"number", "password"}
+func clearFallback(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	if err := ClearFallback(data["number"]); err != nil {
+		LoggerFrom(r.Context()).Error("could not clear fallback", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, FALLBACK_ERR_S, http.StatusInternalServerError)
+	}
+}
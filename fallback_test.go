@@ -0,0 +1,217 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a TestApp receiving status callbacks, for a user whose SMS
+// reminders fall back to a verified email address after timeout minutes
+func newFallbackApp(t *testing.T, number, password, timeout string) *TestApp {
+	app := NewTestApp(t)
+	oldPublicURL := PUBLIC_URL
+	PUBLIC_URL = app.Server.URL
+	t.Cleanup(func() { PUBLIC_URL = oldPublicURL })
+
+	verifyNumber(t, app, number, password)
+	auth := map[string]string{"number": number, "password": password, "channel": "email", "address": "me@example.com"}
+	app.PostJSON("/destinations/add", auth)
+	auth["code"] = regexp.MustCompile(`\d{6}`).FindString(app.SMTP.Emails()[0].Body)
+	if _, res := app.PostJSON("/destinations/verify", auth); res["valid"] != true {
+		t.Fatalf("could not verify email: %v", res)
+	}
+	rule := map[string]string{"number": number, "password": password, "channel": "email", "destination": "me@example.com", "timeout_minutes": timeout}
+	if code, res := app.PostJSON("/fallback/set", rule); code != http.StatusOK {
+		t.Fatalf("set fallback: got status %d, %v", code, res)
+	}
+	return app
+}
+
+// Schedules a reminder to number now and dispatches it, returns its ID
+func sendReminder(t *testing.T, app *TestApp, number, password string) string {
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	if code, res := app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": "Take out the bins"}); code != http.StatusOK {
+		t.Fatalf("schedule: got status %d, %v", code, res)
+	}
+	app.Dispatch()
+	conn := app.DB.Conn()
+	defer conn.Close()
+	ids, _ := redis.Strings(conn.Do("SMEMBERS", userMessagesKey(number)))
+	keys, _ := redis.Strings(conn.Do("KEYS", "*"))
+	for _, k := range append(ids, keys...) {
+		if msg, err := GetMessage(k); err == nil && msg.To == number && msg.SentAt > 0 {
+			return k
+		}
+	}
+	t.Fatal("no sent message found")
+	return ""
+}
+
+// Waits for a message's delivery status to be reported
+func waitForDelivery(t *testing.T, id, status string) *Message {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		msg, err := GetMessage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Delivery == status {
+			return msg
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery status %q not reported, got %+v", status, msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func fallbackEmails(app *TestApp) int {
+	n := 0
+	for _, e := range app.SMTP.Emails() {
+		if strings.TrimSpace(e.Body) == "Take out the bins" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFallbackWhenSendFails(t *testing.T) {
+	number, password := "5558675309", "correct horse battery"
+	app := newFallbackApp(t, number, password, "0")
+	app.Twilio.SetConfig(FakeConfig{FailNumbers: map[string]int{number: TWILIO_ERR_INVALID_NUMBER}})
+
+	id := sendReminder(t, app, number, password)
+	if n := fallbackEmails(app); n != 1 {
+		t.Fatalf("expected the reminder by email, got %d emails", n)
+	}
+	msg, _ := GetMessage(id)
+	if msg.Status != STATUS_FAILED || msg.Scheduled || msg.Body != "" {
+		t.Errorf("failed message not finished: %+v", msg)
+	}
+	if msg.Fallback == nil || msg.Fallback.Reason != FALLBACK_FAILED || msg.Fallback.Status != STATUS_SENT {
+		t.Errorf("unexpected fallback outcome %+v", msg.Fallback)
+	}
+
+	// not retried, so it doesn't fall back again
+	app.Advance(time.Hour)
+	app.Dispatch()
+	if n := fallbackEmails(app); n != 1 {
+		t.Errorf("fell back %d times", n)
+	}
+}
+
+func TestFallbackWhenSendKeepsFailing(t *testing.T) {
+	number, password := "5558675309", "correct horse battery"
+	app := newFallbackApp(t, number, password, "0")
+	app.Twilio.SetConfig(FakeConfig{FailRate: 1, FailStatus: http.StatusServiceUnavailable})
+
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	if code, res := app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": "Take out the bins"}); code != http.StatusOK {
+		t.Fatalf("schedule: got status %d, %v", code, res)
+	}
+	for i := 1; i < MAX_DELIVERY_ATTEMPTS; i++ {
+		app.Dispatch()
+		if n := fallbackEmails(app); n != 0 {
+			t.Fatalf("fell back after %d attempts", i)
+		}
+		app.Advance(time.Minute)
+	}
+	app.Dispatch()
+	if n := fallbackEmails(app); n != 1 {
+		t.Fatalf("expected the reminder by email after %d attempts, got %d emails", MAX_DELIVERY_ATTEMPTS, n)
+	}
+	if msgs, _ := ListMessages(0); len(msgs) != 0 {
+		t.Errorf("failed message still scheduled: %+v", msgs)
+	}
+}
+
+func TestFallbackWhenUndelivered(t *testing.T) {
+	number, password := "5558675309", "correct horse battery"
+	app := newFallbackApp(t, number, password, "10")
+	app.Twilio.SetConfig(FakeConfig{FinalStatus: "undelivered"})
+
+	id := sendReminder(t, app, number, password)
+	waitForDelivery(t, id, "undelivered")
+	msg, _ := GetMessage(id)
+	if msg.Fallback == nil || msg.Fallback.Reason != FALLBACK_UNDELIVERED {
+		t.Fatalf("unexpected fallback outcome %+v", msg.Fallback)
+	}
+	if n := fallbackEmails(app); n != 1 {
+		t.Errorf("expected the reminder by email, got %d emails", n)
+	}
+
+	app.Advance(10 * time.Minute)
+	app.Dispatch()
+	if n := fallbackEmails(app); n != 1 {
+		t.Errorf("fell back %d times", n)
+	}
+}
+
+func TestFallbackWhenUnconfirmed(t *testing.T) {
+	number, password := "5558675309", "correct horse battery"
+	app := newFallbackApp(t, number, password, "10")
+	app.Twilio.SetConfig(FakeConfig{FinalStatus: "sent"})
+
+	id := sendReminder(t, app, number, password)
+	waitForDelivery(t, id, "sent")
+	app.Advance(9 * time.Minute)
+	app.Dispatch()
+	if n := fallbackEmails(app); n != 0 {
+		t.Fatalf("fell back before the timeout")
+	}
+
+	app.Advance(time.Minute)
+	app.Dispatch()
+	msg, _ := GetMessage(id)
+	if msg.Fallback == nil || msg.Fallback.Reason != FALLBACK_UNCONFIRMED {
+		t.Fatalf("unexpected fallback outcome %+v", msg.Fallback)
+	}
+	if n := fallbackEmails(app); n != 1 {
+		t.Errorf("expected the reminder by email, got %d emails", n)
+	}
+}
+
+func TestNoFallbackWhenDelivered(t *testing.T) {
+	number, password := "5558675309", "correct horse battery"
+	app := newFallbackApp(t, number, password, "10")
+
+	id := sendReminder(t, app, number, password)
+	waitForDelivery(t, id, "delivered")
+	app.Advance(time.Hour)
+	app.Dispatch()
+	if n := fallbackEmails(app); n != 0 {
+		t.Errorf("delivered message fell back")
+	}
+	msg, _ := GetMessage(id)
+	if msg.Body != "" || msg.Fallback != nil {
+		t.Errorf("delivered message not finished: %+v", msg)
+	}
+}
+
+func TestSetFallbackValidation(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	rule := map[string]string{"number": number, "password": password, "channel": "email", "destination": "me@example.com"}
+
+	if code, _ := app.PostJSON("/fallback/set", rule); code != http.StatusBadRequest {
+		t.Errorf("fallback to unverified email: got status %d", code)
+	}
+	rule["channel"] = "sms"
+	if code, _ := app.PostJSON("/fallback/set", rule); code != http.StatusBadRequest {
+		t.Errorf("fallback to sms: got status %d", code)
+	}
+	rule["channel"], rule["timeout_minutes"] = "voice", "10"
+	if code, _ := app.PostJSON("/fallback/set", rule); code != http.StatusBadRequest {
+		t.Errorf("timeout without status callbacks: got status %d", code)
+	}
+	rule["timeout_minutes"] = ""
+	if code, res := app.PostJSON("/fallback/set", rule); code != http.StatusOK {
+		t.Errorf("fallback to voice: got status %d, %v", code, res)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Limit on the reminders in a feed, the soonest are kept
+	MAX_FEED_EVENTS = 1000
+	// Calendar apps are asked to refresh feeds this often
+	FEED_REFRESH_INTERVAL = "PT1H"
+
+	FEED_ERR_S = ERR_S + "getting your reminder feed."
+)
+
+// Key of the number whose feed is served at a token. The user's token is
+// kept in their hash as "feed_token".
+func feedKey(token string) string { return "feed:" + token }
+
+// Get the secret token for number's reminder feed, creating one if they
+// don't have one or reset is set, which stops the old one working
+func FeedToken(number string, reset bool) (string, error) {
+	c := GetConn()
+	defer c.Close()
+	old, err := redis.String(c.Do("HGET", number, "feed_token"))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if old != "" && !reset {
+		return old, nil
+	}
+	token := randomHex(16)
+	c.Send("MULTI")
+	if old != "" {
+		c.Send("DEL", feedKey(old))
+	}
+	c.Send("SET", feedKey(token), number)
+	c.Send("HSET", number, "feed_token", token)
+	_, err = c.Do("EXEC")
+	return token, err
+}
+
+// Stops number's reminder feed being served
+func RevokeFeed(number string) error {
+	c := GetConn()
+	defer c.Close()
+	return revokeFeed(c, number)
+}
+
+func revokeFeed(c redis.Conn, number string) error {
+	token, err := redis.String(c.Do("HGET", number, "feed_token"))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.Send("MULTI")
+	c.Send("DEL", feedKey(token))
+	c.Send("HDEL", number, "feed_token")
+	_, err = c.Do("EXEC")
+	return err
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// Writes a content line, folded at 75 octets without splitting characters
+func writeICSLine(w io.Writer, line string) {
+	limit := 75
+	for len(line) > limit {
+		i := limit
+		for line[i]&0xC0 == 0x80 {
+			i--
+		}
+		io.WriteString(w, line[:i]+"\r\n ")
+		line = line[i:]
+		// continuation lines start with a space, which counts
+		limit = 74
+	}
+	io.WriteString(w, line+"\r\n")
+}
+
+// Writes msgs as an iCalendar feed, each message an event at its delivery time
+func writeICSFeed(w io.Writer, c redis.Conn, number string, msgs []*Message, now time.Time) {
+	const stamp = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//TextRemind//Reminder feed//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:TextRemind reminders for " + number,
+		"REFRESH-INTERVAL;VALUE=DURATION:" + FEED_REFRESH_INTERVAL,
+		"X-PUBLISHED-TTL:" + FEED_REFRESH_INTERVAL,
+	}
+	for _, line := range lines {
+		writeICSLine(w, line)
+	}
+	for _, msg := range msgs {
+		at := time.Unix(msg.Time, 0)
+		body, err := messageBody(c, msg, at)
+		if err != nil {
+			body = "Reminder from template " + msg.Template
+		}
+		channel := msg.Channel
+		if channel == "" {
+			channel = CHANNEL_SMS
+		}
+		writeICSLine(w, "BEGIN:VEVENT")
+		writeICSLine(w, "UID:"+msg.ID+"@textremind")
+		writeICSLine(w, "DTSTAMP:"+now.UTC().Format(stamp))
+		writeICSLine(w, "DTSTART:"+at.UTC().Format(stamp))
+		writeICSLine(w, "SUMMARY:"+icsEscaper.Replace(body))
+		writeICSLine(w, "DESCRIPTION:"+icsEscaper.Replace(fmt.Sprintf("Reminder sent by %s", channel)))
+		writeICSLine(w, "TRANSP:TRANSPARENT")
+		writeICSLine(w, "END:VEVENT")
+	}
+	writeICSLine(w, "END:VCALENDAR")
+}
+
+// Serves a user's reminder feed at /feed/<token>.ics. The token is the only
+// credential, so calendar apps can subscribe without a password.
+func serveFeed(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/feed/"), ".ics")
+	if token == "" || strings.ContainsAny(token, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+	c := GetConn()
+	defer c.Close()
+	number, err := redis.String(c.Do("GET", feedKey(token)))
+	if err == redis.ErrNil {
+		http.NotFound(w, r)
+		return
+	}
+	var msgs []*Message
+	if err == nil {
+		msgs, err = scheduledMessages(c, number, false, MAX_FEED_EVENTS)
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get reminder feed", Fields{"error": err})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	writeICSFeed(w, c, number, msgs, CLOCK.Now())
+}
+
+// Gets the URL of the user's reminder feed, {"number", "password"}, with
+// "reset": "true" to replace the URL with a new one
+func feedURL(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	token, err := FeedToken(data["number"], data["reset"] == "true")
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get feed token", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, FEED_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"url": publicURL(r) + "/feed/" + token + ".ics"}, http.StatusOK)
+}
+
+// Stops the user's reminder feed being served, {"number", "password"}
+func revokeFeedURL(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	if err := RevokeFeed(data["number"]); err != nil {
+		LoggerFrom(r.Context()).Error("could not revoke feed", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, FEED_ERR_S, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/scascketta/textremind/ics"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReminderFeed(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	auth := map[string]string{"number": number, "password": password}
+	fetch := func(feed string) (int, string) {
+		res, err := http.Get(feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	now := app.Clock.Now()
+	long := "Pick up milk, eggs; bread from the shop on the corner\nand the dry cleaning before it closes at six"
+	for i, body := range []string{"Call mum", long} {
+		at := strconv.FormatInt(now.Add(time.Duration(i+1)*time.Hour).Unix(), 10)
+		if code, res := app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": body}); code != http.StatusOK {
+			t.Fatalf("schedule: got status %d, %v", code, res)
+		}
+	}
+
+	_, res := app.PostJSON("/feed/url", auth)
+	feed, _ := res["url"].(string)
+	if !strings.HasPrefix(feed, app.Server.URL+"/feed/") {
+		t.Fatalf("unexpected feed URL %v", res)
+	}
+	if _, res := app.PostJSON("/feed/url", auth); res["url"] != feed {
+		t.Errorf("feed URL changed without reset: %v", res)
+	}
+	code, body := fetch(feed)
+	if code != http.StatusOK || !strings.Contains(body, "\r\n ") {
+		t.Fatalf("unexpected feed %d %q", code, body)
+	}
+	events, err := ics.Parse(strings.NewReader(body), time.UTC)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("could not parse feed: %v, %v", events, err)
+	}
+	if events[0].Summary != "Call mum" || !events[0].Start.Equal(now.Add(time.Hour)) || events[1].Summary != long {
+		t.Errorf("unexpected events %+v, %+v", events[0], events[1])
+	}
+
+	// sent reminders leave the feed
+	app.Advance(time.Hour)
+	app.Dispatch()
+	if _, body := fetch(feed); strings.Contains(body, "Call mum") {
+		t.Error("sent reminder still in feed")
+	}
+
+	auth["reset"] = "true"
+	_, res = app.PostJSON("/feed/url", auth)
+	if code, _ := fetch(feed); code != http.StatusNotFound || res["url"] == feed {
+		t.Errorf("old feed URL works after reset: %d", code)
+	}
+	delete(auth, "reset")
+	app.PostJSON("/feed/revoke", auth)
+	if code, _ := fetch(res["url"].(string)); code != http.StatusNotFound {
+		t.Errorf("feed URL works after revoking: %d", code)
+	}
+}
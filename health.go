@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The dispatcher ticks every minute, so a few missed ticks means it's stuck
+const DISPATCH_STALE_AFTER = 3 * time.Minute
+
+var (
+	// Unix nanoseconds of when the dispatcher started, and when it last
+	// finished a loop. Zero if the dispatcher isn't running in this process.
+	dispatchStarted  int64
+	dispatchLastLoop int64
+)
+
+// Records that the dispatcher has started
+func markDispatchStarted() {
+	atomic.StoreInt64(&dispatchStarted, CLOCK.Now().UnixNano())
+}
+
+// Records that the dispatcher finished a loop
+func markDispatchLoop() {
+	atomic.StoreInt64(&dispatchLastLoop, CLOCK.Now().UnixNano())
+	atomic.AddInt64(&dispatchLoops, 1)
+}
+
+type checkResult map[string]interface{}
+
+// Checks that the dispatcher finished a loop recently
+func checkDispatcher() (checkResult, bool) {
+	started := atomic.LoadInt64(&dispatchStarted)
+	last := atomic.LoadInt64(&dispatchLastLoop)
+	if started == 0 {
+		return checkResult{"status": "skipped", "running": false}, true
+	}
+
+	res := checkResult{"running": true, "started_at": time.Unix(0, started).UTC().Format(time.RFC3339)}
+	since := time.Unix(0, started)
+	if last != 0 {
+		since = time.Unix(0, last)
+		res["last_loop_at"] = since.UTC().Format(time.RFC3339)
+	}
+	age := CLOCK.Now().Sub(since)
+	res["seconds_since_loop"] = int(age.Seconds())
+	if age > DISPATCH_STALE_AFTER {
+		res["status"] = "fail"
+		res["error"] = "dispatcher has not completed a loop recently"
+		return res, false
+	}
+	res["status"] = "ok"
+	return res, true
+}
+
+// Checks that redis is reachable
+func checkStorage() (checkResult, bool) {
+	start := time.Now()
+	c, err := DialRedis()
+	if err != nil {
+		return checkResult{"status": "fail", "error": err.Error()}, false
+	}
+	defer c.Close()
+	if _, err := redis.String(c.Do("PING")); err != nil {
+		return checkResult{"status": "fail", "error": err.Error()}, false
+	}
+	return checkResult{"status": "ok", "latency_ms": time.Since(start).Seconds() * 1000}, true
+}
+
+// Checks that the Twilio credentials are configured
+func checkProvider() (checkResult, bool) {
+	missing := make([]string, 0)
+	for name, v := range map[string]string{
+		"TWILIO_ACCOUNT_SID": TWILIO_ACCOUNT_SID,
+		"TWILIO_AUTH_TOKEN":  TWILIO_AUTH_TOKEN,
+		"TWILIO_NUMBER":      TWILIO_NUMBER,
+	} {
+		if v == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return checkResult{"status": "fail", "error": "provider is not configured", "missing": missing}, false
+	}
+	res := checkResult{"status": "ok", "provider": "twilio", "api_base": TWILIO_API_BASE}
+	if HTTP_CLIENT.Breaker != nil {
+		// an open circuit is reported but doesn't fail readiness, requests
+		// not needing the provider can still be served
+		res["circuit"] = HTTP_CLIENT.Breaker.State()
+	}
+	return res, true
+}
+
+// Runs checks, writes their results as JSON with 200 if all passed or 503 otherwise
+func writeChecks(w http.ResponseWriter, checks map[string]func() (checkResult, bool)) {
+	results := make(map[string]interface{}, len(checks))
+	healthy := true
+	for name, check := range checks {
+		res, ok := check()
+		results[name] = res
+		healthy = healthy && ok
+	}
+
+	status, code := "ok", http.StatusOK
+	if !healthy {
+		status, code = "fail", http.StatusServiceUnavailable
+	}
+	WriteJSON(w, map[string]interface{}{"status": status, "checks": results}, code)
+}
+
+// Liveness: the process is serving requests and the dispatcher isn't stuck
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, map[string]func() (checkResult, bool){
+		"dispatcher": checkDispatcher,
+	})
+}
+
+// Readiness: dependencies needed to serve requests are available
+func readyz(w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, map[string]func() (checkResult, bool){
+		"storage":    checkStorage,
+		"provider":   checkProvider,
+		"dispatcher": checkDispatcher,
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthzDispatcher(t *testing.T) {
+	defer atomic.StoreInt64(&dispatchStarted, 0)
+	defer atomic.StoreInt64(&dispatchLastLoop, 0)
+
+	cases := []struct {
+		lastLoop time.Duration
+		code     int
+	}{
+		{time.Minute, http.StatusOK},
+		{DISPATCH_STALE_AFTER + time.Minute, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		atomic.StoreInt64(&dispatchStarted, time.Now().Add(-time.Hour).UnixNano())
+		atomic.StoreInt64(&dispatchLastLoop, time.Now().Add(-tc.lastLoop).UnixNano())
+
+		w := httptest.NewRecorder()
+		healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != tc.code {
+			t.Errorf("last loop %s ago: got status %d, want %d", tc.lastLoop, w.Code, tc.code)
+		}
+		res := make(map[string]interface{})
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := res["checks"].(map[string]interface{})["dispatcher"]; !ok {
+			t.Errorf("dispatcher check missing from response: %v", res)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	app := NewTestApp(t)
+	sent := atomic.LoadInt64(&messagesSent)
+	if err := ScheduleMessage(context.Background(), "hi", "5558675309", strconv.FormatInt(app.Clock.Now().Unix(), 10)); err != nil {
+		t.Fatal(err)
+	}
+	app.Dispatch()
+
+	w := httptest.NewRecorder()
+	metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := fmt.Sprintf("textremind_messages_sent_total %d\n", sent+1)
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("metrics missing %q:\n%s", want, w.Body.String())
+	}
+}
@@ -0,0 +1,442 @@
+// Package ics parses the events, alarms and recurrence rules TextRemind
+// imports from iCalendar files.
+package ics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on what's read from a calendar
+const (
+	MAX_SIZE = 2 << 20
+	// Bound on the periods of a recurring event checked, in case a rule
+	// never reaches the import window
+	MAX_RRULE_ITERATIONS = 5000
+)
+
+var (
+	ErrInvalid = errors.New("not a valid iCalendar file")
+	// Rather than reading part of a calendar, and missing the events after
+	// the cutoff, calendars over MAX_SIZE aren't read
+	ErrTooLarge = fmt.Errorf("calendar is larger than %d MB", MAX_SIZE>>20)
+	// A rule with COUNT has too many occurrences before the window to count
+	ErrTooManyOccurrences = errors.New("recurrence rule has too many occurrences before the window")
+)
+
+// An event from an iCalendar file. Times without a zone, and all-day dates,
+// are in the importing user's time zone.
+type Event struct {
+	UID     string
+	Summary string
+	Start   time.Time
+	// Zero if the event has no end
+	End    time.Time
+	AllDay bool
+	RRule  *RRule
+	// Occurrences of a recurring event which don't happen
+	ExDates []time.Time
+	// Set on an event which replaces one occurrence of the recurring event
+	// with the same UID
+	RecurrenceID time.Time
+	Alarms       []Alarm
+	Cancelled    bool
+	// Why the event can't be imported, e.g. an unsupported recurrence rule
+	Err error
+}
+
+// When an event's alarm goes off: Offset from the start of each occurrence,
+// or at a fixed time if At is set
+type Alarm struct {
+	Offset time.Duration
+	At     time.Time
+}
+
+// The subset of RFC 5545 recurrence rules supported: FREQ, INTERVAL, COUNT,
+// UNTIL, and BYDAY of plain weekdays for weekly rules
+type RRule struct {
+	Freq     string
+	Interval int
+	Count    int
+	Until    time.Time
+	ByDay    []time.Weekday
+}
+
+// A content line, NAME;PARAM=VALUE:value
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Reads content lines, joining folded lines
+func readICSLines(r io.Reader) ([]string, error) {
+	b, err := io.ReadAll(io.LimitReader(r, MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MAX_SIZE {
+		return nil, ErrTooLarge
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64<<10), MAX_SIZE)
+	lines := make([]string, 0)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func parseICSProperty(line string) (icsProperty, bool) {
+	p := icsProperty{Params: map[string]string{}}
+	// the value starts at the first colon outside a quoted parameter
+	quoted, colon := false, -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return p, false
+	}
+	p.Value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	p.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if i := strings.Index(param, "="); i > 0 {
+			p.Params[strings.ToUpper(param[:i])] = strings.Trim(param[i+1:], `"`)
+		}
+	}
+	return p, true
+}
+
+var icsUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+// Parses the events in an iCalendar file, with floating times in loc.
+// Events which can't be imported have Err set rather than failing the file.
+func Parse(r io.Reader, loc *time.Location) ([]*Event, error) {
+	lines, err := readICSLines(r)
+	if err != nil {
+		return nil, err
+	}
+	// a calendar cut off part way, e.g. by a dropped connection, would
+	// look like its later events were deleted
+	if len(lines) == 0 || strings.ToUpper(lines[0]) != "BEGIN:VCALENDAR" || strings.ToUpper(strings.TrimSpace(lines[len(lines)-1])) != "END:VCALENDAR" {
+		return nil, ErrInvalid
+	}
+
+	events := make([]*Event, 0)
+	var event *Event
+	var alarm *Alarm
+	var duration time.Duration
+	for _, line := range lines {
+		p, ok := parseICSProperty(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case p.Name == "BEGIN" && strings.ToUpper(p.Value) == "VEVENT":
+			event, duration = &Event{}, 0
+		case p.Name == "END" && strings.ToUpper(p.Value) == "VEVENT" && event != nil:
+			if event.Start.IsZero() && event.Err == nil {
+				event.Err = errors.New("event has no start")
+			}
+			if event.End.IsZero() && duration > 0 {
+				event.End = event.Start.Add(duration)
+			}
+			events = append(events, event)
+			event = nil
+		case event == nil:
+			continue
+		case p.Name == "BEGIN" && strings.ToUpper(p.Value) == "VALARM":
+			alarm = &Alarm{}
+		case p.Name == "END" && strings.ToUpper(p.Value) == "VALARM" && alarm != nil:
+			event.Alarms = append(event.Alarms, *alarm)
+			alarm = nil
+		case alarm != nil:
+			if p.Name == "TRIGGER" {
+				if err := parseTrigger(p, alarm, loc); err != nil && event.Err == nil {
+					event.Err = err
+				}
+			}
+		default:
+			if err := event.setProperty(p, loc, &duration); err != nil && event.Err == nil {
+				event.Err = fmt.Errorf("%s: %v", p.Name, err)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (e *Event) setProperty(p icsProperty, loc *time.Location, duration *time.Duration) error {
+	var err error
+	switch p.Name {
+	case "UID":
+		e.UID = p.Value
+	case "SUMMARY":
+		e.Summary = icsUnescaper.Replace(p.Value)
+	case "STATUS":
+		e.Cancelled = strings.ToUpper(p.Value) == "CANCELLED"
+	case "DTSTART":
+		e.Start, e.AllDay, err = parseICSTime(p, loc)
+	case "DTEND":
+		e.End, _, err = parseICSTime(p, loc)
+	case "DURATION":
+		*duration, err = parseICSDuration(p.Value)
+	case "RECURRENCE-ID":
+		e.RecurrenceID, _, err = parseICSTime(p, loc)
+	case "RRULE":
+		e.RRule, err = parseRRule(p.Value, loc)
+	case "EXDATE":
+		for _, v := range strings.Split(p.Value, ",") {
+			p.Value = v
+			t, _, err := parseICSTime(p, loc)
+			if err != nil {
+				return err
+			}
+			e.ExDates = append(e.ExDates, t)
+		}
+	}
+	return err
+}
+
+// Parses a DATE or DATE-TIME value, in UTC, its TZID, or loc if floating.
+// Also returns whether it was a date.
+func parseICSTime(p icsProperty, loc *time.Location) (time.Time, bool, error) {
+	v := p.Value
+	if tzid := p.Params["TZID"]; tzid != "" {
+		// zones which aren't IANA names, e.g. from Outlook, are taken as the user's
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	if p.Params["VALUE"] == "DATE" || len(v) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", v, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(v, "Z") {
+		t, err := time.Parse("20060102T150405Z", v)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	return t, false, err
+}
+
+var icsDurationRE = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// Parses a DURATION value such as -PT15M or P1DT12H
+func parseICSDuration(v string) (time.Duration, error) {
+	m := icsDurationRE.FindStringSubmatch(strings.ToUpper(v))
+	if m == nil || v == "P" || strings.HasSuffix(v, "T") {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// Alarms relative to the end of an event aren't supported, they'd rarely
+// be useful for reminders
+func parseTrigger(p icsProperty, alarm *Alarm, loc *time.Location) error {
+	if p.Params["VALUE"] == "DATE-TIME" {
+		t, _, err := parseICSTime(p, loc)
+		alarm.At = t
+		return err
+	}
+	if p.Params["RELATED"] == "END" {
+		return errors.New("alarms relative to an event's end aren't supported")
+	}
+	d, err := parseICSDuration(p.Value)
+	alarm.Offset = d
+	return err
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func parseRRule(v string, loc *time.Location) (*RRule, error) {
+	rule := &RRule{Interval: 1}
+	for _, part := range strings.Split(v, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		var err error
+		switch key {
+		case "FREQ":
+			rule.Freq = value
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(value)
+			if err == nil && rule.Interval < 1 {
+				err = errors.New("interval must be positive")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(value)
+		case "UNTIL":
+			rule.Until, _, err = parseICSTime(icsProperty{Value: value, Params: map[string]string{}}, loc)
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				wd, ok := icsWeekdays[day]
+				if !ok {
+					return nil, fmt.Errorf("BYDAY=%s isn't supported", value)
+				}
+				rule.ByDay = append(rule.ByDay, wd)
+			}
+		case "WKST":
+		default:
+			return nil, fmt.Errorf("%s isn't supported", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	switch rule.Freq {
+	case "DAILY", "MONTHLY", "YEARLY":
+		if len(rule.ByDay) > 0 {
+			return nil, fmt.Errorf("BYDAY isn't supported for %s rules", rule.Freq)
+		}
+	case "WEEKLY":
+	default:
+		return nil, fmt.Errorf("FREQ=%s isn't supported", rule.Freq)
+	}
+	return rule, nil
+}
+
+// Start times of the event's occurrences from from until to, at most max,
+// excluding EXDATEs. Returns ErrTooManyOccurrences if they can't be found
+// within MAX_RRULE_ITERATIONS periods.
+func (e *Event) Occurrences(from, to time.Time, max int) ([]time.Time, error) {
+	if e.RRule == nil {
+		if !e.Start.Before(from) && e.Start.Before(to) {
+			return []time.Time{e.Start}, nil
+		}
+		return nil, nil
+	}
+	excluded := func(t time.Time) bool {
+		for _, ex := range e.ExDates {
+			if ex.Equal(t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	rule, start := e.RRule, e.Start
+	occurrences := make([]time.Time, 0)
+	// COUNT includes excluded occurrences, so they must be counted from the
+	// start; otherwise periods before from are skipped
+	count, first := 0, 0
+	if rule.Count == 0 {
+		first = rule.periodBefore(start, from)
+	}
+	for i := first; i < first+MAX_RRULE_ITERATIONS; i++ {
+		for _, t := range rule.period(start, i) {
+			if t.Before(start) {
+				continue
+			}
+			if !t.Before(to) || (!rule.Until.IsZero() && t.After(rule.Until)) || (rule.Count > 0 && count >= rule.Count) || len(occurrences) >= max {
+				return occurrences, nil
+			}
+			count++
+			if !excluded(t) && !t.Before(from) {
+				occurrences = append(occurrences, t)
+			}
+		}
+	}
+	return occurrences, ErrTooManyOccurrences
+}
+
+// Index of a period of the rule ending before t, so no occurrence at or
+// after t is in an earlier one. Lengths of days vary with DST, so it's one
+// period earlier than needed.
+func (rule *RRule) periodBefore(start, t time.Time) int {
+	if !t.After(start) {
+		return 0
+	}
+	days := int(t.Sub(start).Hours() / 24)
+	n := 0
+	switch rule.Freq {
+	case "DAILY":
+		n = days / rule.Interval
+	case "WEEKLY":
+		n = days / 7 / rule.Interval
+	case "MONTHLY":
+		n = ((t.Year()-start.Year())*12 + int(t.Month()-start.Month())) / rule.Interval
+	case "YEARLY":
+		n = (t.Year() - start.Year()) / rule.Interval
+	}
+	if n > 0 {
+		n--
+	}
+	return n
+}
+
+// Candidate start times in the i'th period of the rule, in order. Dates
+// which don't exist, like February 30th, are skipped as RFC 5545 requires.
+func (rule *RRule) period(start time.Time, i int) []time.Time {
+	y, m, d := start.Date()
+	h, min, s := start.Clock()
+	loc := start.Location()
+	n := i * rule.Interval
+	at := func(y int, m time.Month, d int) []time.Time {
+		t := time.Date(y, m, d, h, min, s, 0, loc)
+		if t.Day() != d {
+			return nil
+		}
+		return []time.Time{t}
+	}
+	switch rule.Freq {
+	case "DAILY":
+		return []time.Time{time.Date(y, m, d+n, h, min, s, 0, loc)}
+	case "WEEKLY":
+		if len(rule.ByDay) == 0 {
+			return []time.Time{time.Date(y, m, d+7*n, h, min, s, 0, loc)}
+		}
+		// weeks start on Monday
+		monday := d - (int(start.Weekday())+6)%7 + 7*n
+		times := make([]time.Time, 0, len(rule.ByDay))
+		for offset := 0; offset < 7; offset++ {
+			t := time.Date(y, m, monday+offset, h, min, s, 0, loc)
+			for _, wd := range rule.ByDay {
+				if t.Weekday() == wd {
+					times = append(times, t)
+				}
+			}
+		}
+		return times
+	case "MONTHLY":
+		first := time.Date(y, m+time.Month(n), 1, 0, 0, 0, 0, loc)
+		return at(first.Year(), first.Month(), d)
+	case "YEARLY":
+		return at(y+n, m, d)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package ics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testICS = `BEGIN:VCALENDAR
+VERSION:2.0
+BEGIN:VEVENT
+UID:standup@example.com
+SUMMARY:Team standup\, dai
+ ly sync
+DTSTART;TZID=America/Chicago:20150105T093000
+DURATION:PT15M
+RRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR;COUNT=6
+EXDATE;TZID=America/Chicago:20150107T093000
+BEGIN:VALARM
+TRIGGER:-PT15M
+ACTION:DISPLAY
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:holiday@example.com
+SUMMARY:Holiday
+DTSTART;VALUE=DATE:20150119
+END:VEVENT
+BEGIN:VEVENT
+UID:first-monday@example.com
+SUMMARY:First Monday
+DTSTART:20150105T090000Z
+RRULE:FREQ=MONTHLY;BYDAY=1MO
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestParse(t *testing.T) {
+	loc, _ := time.LoadLocation("America/New_York")
+	chicago, _ := time.LoadLocation("America/Chicago")
+	events, err := Parse(strings.NewReader(strings.Replace(testICS, "\n", "\r\n", -1)), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+
+	standup := events[0]
+	if standup.Summary != "Team standup, daily sync" || standup.Err != nil {
+		t.Errorf("unexpected summary %q, %v", standup.Summary, standup.Err)
+	}
+	if start := time.Date(2015, 1, 5, 9, 30, 0, 0, chicago); !standup.Start.Equal(start) || !standup.End.Equal(start.Add(15*time.Minute)) {
+		t.Errorf("unexpected time %v - %v", standup.Start, standup.End)
+	}
+	if len(standup.Alarms) != 1 || standup.Alarms[0].Offset != -15*time.Minute {
+		t.Errorf("unexpected alarms %v", standup.Alarms)
+	}
+	if rule := standup.RRule; rule == nil || rule.Freq != "WEEKLY" || rule.Count != 6 || len(rule.ByDay) != 3 || len(standup.ExDates) != 1 {
+		t.Errorf("unexpected recurrence %+v, %v", rule, standup.ExDates)
+	}
+
+	holiday := events[1]
+	if !holiday.AllDay || !holiday.Start.Equal(time.Date(2015, 1, 19, 0, 0, 0, 0, loc)) {
+		t.Errorf("unexpected all-day event %+v", holiday)
+	}
+	if events[2].Err == nil || !strings.Contains(events[2].Err.Error(), "BYDAY=1MO") {
+		t.Errorf("expected unsupported rule to be an error, got %v", events[2].Err)
+	}
+
+	if _, err := Parse(strings.NewReader("BEGIN:VCARD\nEND:VCARD\n"), loc); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestParseIncomplete(t *testing.T) {
+	// pads testICS out to size bytes
+	padded := func(size int) string {
+		pad := "X-PADDING:" + strings.Repeat("x", size-len(testICS)-len("X-PADDING:\n")) + "\n"
+		return strings.Replace(testICS, "VERSION:2.0\n", "VERSION:2.0\n"+pad, 1)
+	}
+	if events, err := Parse(strings.NewReader(padded(MAX_SIZE)), time.UTC); err != nil || len(events) != 3 {
+		t.Errorf("calendar of MAX_SIZE: got %d events, %v", len(events), err)
+	}
+	if _, err := Parse(strings.NewReader(padded(MAX_SIZE+1)), time.UTC); err != ErrTooLarge {
+		t.Errorf("calendar over MAX_SIZE: expected ErrTooLarge, got %v", err)
+	}
+	cut := testICS[:strings.Index(testICS, "BEGIN:VEVENT\nUID:first-monday")]
+	if _, err := Parse(strings.NewReader(cut), time.UTC); err != ErrInvalid {
+		t.Errorf("calendar without END:VCALENDAR: expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	chicago, _ := time.LoadLocation("America/Chicago")
+	from, to := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)
+	parse := func(ics string) *Event {
+		events, err := Parse(strings.NewReader("BEGIN:VCALENDAR\nBEGIN:VEVENT\n"+ics+"\nEND:VEVENT\nEND:VCALENDAR\n"), chicago)
+		if err != nil || len(events) != 1 || events[0].Err != nil {
+			t.Fatalf("could not parse %q: %v, %v", ics, err, events)
+		}
+		return events[0]
+	}
+	occurrences := func(e *Event, from, to time.Time, max int) []time.Time {
+		times, err := e.Occurrences(from, to, max)
+		if err != nil {
+			t.Fatalf("occurrences of %+v: %v", e, err)
+		}
+		return times
+	}
+	days := func(times []time.Time) string {
+		s := make([]string, len(times))
+		for i, t := range times {
+			s[i] = t.Format("Jan 2 15:04")
+		}
+		return strings.Join(s, ", ")
+	}
+
+	events, _ := Parse(strings.NewReader(testICS), chicago)
+	// the excluded occurrence still counts towards COUNT
+	if got := days(occurrences(events[0], from, to, 100)); got != "Jan 5 09:30, Jan 9 09:30, Jan 12 09:30, Jan 14 09:30, Jan 16 09:30" {
+		t.Errorf("weekly: got %s", got)
+	}
+	if got := days(occurrences(events[0], time.Date(2015, 1, 10, 0, 0, 0, 0, chicago), to, 2)); got != "Jan 12 09:30, Jan 14 09:30" {
+		t.Errorf("weekly from a later date: got %s", got)
+	}
+
+	monthly := parse("DTSTART:20150131T080000\nRRULE:FREQ=MONTHLY")
+	if got := days(occurrences(monthly, from, to, 100)); got != "Jan 31 08:00, Mar 31 08:00, May 31 08:00" {
+		t.Errorf("monthly: got %s", got)
+	}
+
+	// daily events keep their local time across a DST change
+	daily := parse("DTSTART:20150307T090000\nRRULE:FREQ=DAILY;UNTIL=20150309T235959")
+	got := occurrences(daily, from, to, 100)
+	if days(got) != "Mar 7 09:00, Mar 8 09:00, Mar 9 09:00" || got[1].Sub(got[0]) != 23*time.Hour {
+		t.Errorf("daily: got %v", got)
+	}
+
+	single := parse("DTSTART:20141231T090000")
+	if got := occurrences(single, from, to, 100); len(got) != 0 {
+		t.Errorf("past event: got %v", got)
+	}
+
+	// long running series skip ahead to the window
+	old := parse("DTSTART:19700101T070000\nRRULE:FREQ=DAILY;INTERVAL=2")
+	if got := days(occurrences(old, from, from.Add(96*time.Hour), 100)); got != "Jan 1 07:00, Jan 3 07:00" {
+		t.Errorf("old daily: got %s", got)
+	}
+	oldWeekly := parse("DTSTART:19000102T070000\nRRULE:FREQ=WEEKLY;BYDAY=MO,FR")
+	if got := days(occurrences(oldWeekly, from, from.Add(96*time.Hour), 100)); got != "Jan 2 07:00" {
+		t.Errorf("old weekly: got %s", got)
+	}
+	oldMonthly := parse("DTSTART:08000131T070000\nRRULE:FREQ=MONTHLY")
+	if got := days(occurrences(oldMonthly, from, to, 100)); got != "Jan 31 07:00, Mar 31 07:00, May 31 07:00" {
+		t.Errorf("old monthly: got %s", got)
+	}
+	counted := parse("DTSTART:19900101T070000\nRRULE:FREQ=DAILY;COUNT=100000")
+	if _, err := counted.Occurrences(from, to, 100); err != ErrTooManyOccurrences {
+		t.Errorf("old daily with COUNT: expected ErrTooManyOccurrences, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"regexp"
+)
+
+// How long a request's response is kept for replaying to retries
+const IDEMPOTENCY_TTL = 24 * 60 * 60
+
+var IDEMPOTENCY_KEY_RE = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// Request fields left out of fingerprints. They've been checked by the time
+// the key is claimed, and a fast hash of them kept beside the rest of the
+// request would let them be guessed offline.
+var CREDENTIAL_FIELDS = []string{"password"}
+
+// What's stored for an Idempotency-Key: a hash of the request it was first
+// used with, and its response once the request has succeeded
+type idempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Pending     bool   `json:"pending,omitempty"`
+	Code        int    `json:"code,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// Keys are per number, so users can't see each other's responses
+func idempotencyKey(number, key string) string {
+	return "idempotency:" + number + ":" + key
+}
+
+// Records the status code and body written by a handler
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Makes retries of a request with the same `Idempotency-Key` header get the
+// first response rather than running it again. Only successful responses are
+// kept, so failed requests can be retried with the same key. Reusing a key
+// with a different request is an error. Handlers must authenticate the user
+// before calling it, so others can't claim or probe their keys.
+func IdempotencyMiddleware(fn func(http.ResponseWriter, *http.Request, map[string]string)) func(http.ResponseWriter, *http.Request, map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, data map[string]string) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			fn(w, r, data)
+			return
+		}
+		if !IDEMPOTENCY_KEY_RE.MatchString(key) {
+			WriteJSONError(w, "Idempotency-Key must be at most 255 printable characters.", http.StatusBadRequest)
+			return
+		}
+		number := data["to"]
+		if data["group"] != "" {
+			number = data["number"]
+		}
+		fingerprint := requestFingerprint(data)
+		log := LoggerFrom(r.Context()).With(Fields{"idempotency_key": key})
+
+		c := GetConn()
+		defer c.Close()
+		stored := idempotencyKey(number, key)
+		pending, _ := json.Marshal(idempotentResponse{Fingerprint: fingerprint, Pending: true})
+		claimed, err := c.Do("SET", stored, pending, "NX", "EX", IDEMPOTENCY_TTL)
+		if err != nil {
+			log.Error("could not claim idempotency key", Fields{"error": err})
+			WriteJSONError(w, ERR_S+"handling your request.", http.StatusInternalServerError)
+			return
+		}
+		if claimed == nil {
+			replayResponse(w, r, c, stored, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, code: http.StatusOK}
+		fn(rec, r, data)
+		if rec.code < 200 || rec.code > 299 {
+			_, err = c.Do("DEL", stored)
+		} else {
+			b, _ := json.Marshal(idempotentResponse{Fingerprint: fingerprint, Code: rec.code, Body: rec.body.Bytes()})
+			_, err = c.Do("SET", stored, b, "EX", IDEMPOTENCY_TTL)
+		}
+		if err != nil {
+			log.Error("could not store idempotent response", Fields{"error": err})
+		}
+	}
+}
+
+// Hash of a request's fields without CREDENTIAL_FIELDS
+func requestFingerprint(data map[string]string) string {
+	fields := make(map[string]string, len(data))
+	for k, v := range data {
+		if !stringIn(k, CREDENTIAL_FIELDS) {
+			fields[k] = v
+		}
+	}
+	// maps are encoded with sorted keys, so equal requests hash the same
+	b, _ := json.Marshal(fields)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Writes the response stored for a key already used, if it was used for the
+// same request and has finished
+func replayResponse(w http.ResponseWriter, r *http.Request, c redis.Conn, stored, fingerprint string) {
+	b, err := redis.Bytes(c.Do("GET", stored))
+	var res idempotentResponse
+	if err == nil {
+		err = json.Unmarshal(b, &res)
+	}
+	switch {
+	case err == redis.ErrNil:
+		// expired or failed since it was claimed
+		WriteJSONError(w, "A request with this Idempotency-Key has just finished, please retry.", http.StatusConflict)
+	case err != nil:
+		LoggerFrom(r.Context()).Error("could not get idempotent response", Fields{"error": err})
+		WriteJSONError(w, ERR_S+"handling your request.", http.StatusInternalServerError)
+	case res.Fingerprint != fingerprint:
+		WriteJSONError(w, "This Idempotency-Key was used for a different request.", http.StatusUnprocessableEntity)
+	case res.Pending:
+		WriteJSONError(w, "A request with this Idempotency-Key is still being handled.", http.StatusConflict)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(res.Code)
+		w.Write(res.Body)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIdempotentSchedule(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	post := func(key string, data map[string]string) (int, map[string]interface{}, bool) {
+		b, _ := json.Marshal(data)
+		req, _ := http.NewRequest("POST", app.Server.URL+"/schedule", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed := res.Header.Get("Idempotent-Replayed") == "true"
+		code, body := app.decode(res)
+		return code, body, replayed
+	}
+	scheduled := func() int {
+		msgs, _ := ListMessages(0)
+		return len(msgs)
+	}
+
+	at := strconv.FormatInt(app.Clock.Now().Unix()+3600, 10)
+	data := map[string]string{"to": number, "password": "wrong", "time": at, "body": "Water the plants"}
+	if code, _, _ := post("retry-1", data); code != http.StatusBadRequest {
+		t.Fatalf("wrong password: got status %d", code)
+	}
+	// failures aren't kept, so the request can be fixed and retried
+	data["password"] = password
+	code, first, replayed := post("retry-1", data)
+	if code != http.StatusOK || replayed {
+		t.Fatalf("schedule: got status %d, %v", code, first)
+	}
+	code, second, replayed := post("retry-1", data)
+	if code != http.StatusOK || !replayed || second["id"] != first["id"] || scheduled() != 1 {
+		t.Errorf("retry not replayed: %d, %v, %v, %d scheduled", code, first, second, scheduled())
+	}
+
+	// others can't see whether a key has been used
+	probe := map[string]string{"to": number, "password": "wrong", "time": at, "body": "Water the plants"}
+	if code, res, replayed := post("retry-1", probe); code != http.StatusBadRequest || replayed || res["message"] != "Password doesn't match." {
+		t.Errorf("used key with wrong password: got status %d, %v", code, res)
+	}
+
+	data["body"] = "Water the cat"
+	if code, res, _ := post("retry-1", data); code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for a different request: got status %d, %v", code, res)
+	}
+	if code, res, _ := post("retry-2", data); code != http.StatusOK || res["id"] == first["id"] || scheduled() != 2 {
+		t.Errorf("new key: got status %d, %v", code, res)
+	}
+	if code, _, _ := post(strings.Repeat("k", 256), data); code != http.StatusBadRequest {
+		t.Errorf("invalid key: got status %d", code)
+	}
+}
+
+func TestFingerprintLeavesOutPassword(t *testing.T) {
+	data := map[string]string{"to": "5558675309", "password": "correct horse battery", "body": "Water the plants"}
+	fingerprint := requestFingerprint(data)
+	data["password"] = "another password"
+	if requestFingerprint(data) != fingerprint {
+		t.Error("fingerprint depends on the password")
+	}
+	data["body"] = "Water the cat"
+	if requestFingerprint(data) == fingerprint {
+		t.Error("fingerprint doesn't depend on the body")
+	}
+}
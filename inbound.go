@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Handles an SMS keyword sent to TWILIO_NUMBER. from is the sender's
+// normalized number and args the rest of the message. Returns the reply,
+// if any.
+type inboundCommand func(ctx context.Context, from, args string) (string, error)
+
+var (
+	// Base URL Twilio reaches us at, used to check webhook signatures when
+	// behind a proxy. Defaults to the scheme and host of the request.
+	PUBLIC_URL string = os.Getenv("TEXTREMIND_PUBLIC_URL")
+
+	INBOUND_COMMANDS = map[string]inboundCommand{
+		"YES":    replyYes,
+		"NO":     replyNo,
+		"STOP":   replyStop,
+		"OK":     replyOK,
+		"SNOOZE": replySnooze,
+	}
+)
+
+// The URL the app is reached at by Twilio, without a trailing slash
+func publicURL(r *http.Request) string {
+	if PUBLIC_URL != "" {
+		return strings.TrimSuffix(PUBLIC_URL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// Whether r was signed by Twilio with TWILIO_AUTH_TOKEN. r's form must be parsed.
+func validTwilioSignature(r *http.Request) bool {
+	expected := TwilioSignature(TWILIO_AUTH_TOKEN, publicURL(r)+r.URL.RequestURI(), r.PostForm)
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Twilio-Signature")))
+}
+
+// Twilio's webhook for SMS sent to TWILIO_NUMBER. Replies with TwiML.
+func inboundSMS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !validTwilioSignature(r) {
+		LoggerFrom(r.Context()).Warn("inbound SMS with invalid signature")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	from := NormalizeNumber(r.PostForm.Get("From"))
+	words := strings.Fields(r.PostForm.Get("Body"))
+	keyword, args := "", ""
+	if len(words) > 0 {
+		keyword = strings.ToUpper(words[0])
+		args = strings.Join(words[1:], " ")
+	}
+
+	reply := ""
+	if cmd, ok := INBOUND_COMMANDS[keyword]; ok {
+		var err error
+		reply, err = cmd(r.Context(), from, args)
+		if err != nil {
+			LoggerFrom(r.Context()).Error("could not handle inbound SMS", Fields{"from": from, "keyword": keyword, "error": err})
+			reply = "Sorry, something went wrong. Please try again later."
+		}
+	}
+	LoggerFrom(r.Context()).Info("inbound SMS", Fields{"from": from, "keyword": keyword, "replied": reply != ""})
+	writeTwiML(w, reply)
+}
+
+type twiML struct {
+	XMLName xml.Name `xml:"Response"`
+	Message string   `xml:"Message,omitempty"`
+}
+
+// Writes a TwiML response which replies with msg, or does nothing if it's empty
+func writeTwiML(w http.ResponseWriter, msg string) {
+	b, _ := xml.Marshal(twiML{Message: msg})
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
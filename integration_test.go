@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// SendTwilioMessage needs a From number, don't depend on the environment
+	if TWILIO_NUMBER == "" {
+		TWILIO_NUMBER = "+15005550006"
+	}
+	os.Exit(m.Run())
+}
+
+var CODE_RE = regexp.MustCompile(`\d{6}`)
+
+// Verifies number and sets its password through the API
+func verifyNumber(t *testing.T, app *TestApp, number, password string) {
+	if code, _ := app.PostJSON("/send_verification", map[string]string{"number": number}); code != http.StatusOK {
+		t.Fatalf("send_verification: got status %d", code)
+	}
+	msgs := app.Twilio.Messages()
+	if len(msgs) == 0 || msgs[len(msgs)-1].To != number {
+		t.Fatalf("verification code was not sent to %s: %+v", number, msgs)
+	}
+	vcode := CODE_RE.FindString(msgs[len(msgs)-1].Body)
+
+	_, res := app.Get("/check_verification", url.Values{"number": {number}, "code": {"000000x"}})
+	if res["valid"] != false {
+		t.Errorf("wrong verification code accepted: %v", res)
+	}
+	_, res = app.Get("/check_verification", url.Values{"number": {number}, "code": {vcode}})
+	if res["valid"] != true {
+		t.Fatalf("verification code %s not accepted: %v", vcode, res)
+	}
+
+	if code, _ := app.PostJSON("/set_password", map[string]string{"number": number, "password": password}); code != http.StatusOK {
+		t.Fatalf("set_password: got status %d", code)
+	}
+}
+
+func TestUserFlow(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+
+	_, res := app.Get("/check", url.Values{"number": {number}})
+	if res["verified"] != false {
+		t.Fatalf("number verified before verification: %v", res)
+	}
+	verifyNumber(t, app, number, password)
+	_, res = app.Get("/check", url.Values{"number": {number}})
+	if res["verified"] != true {
+		t.Fatalf("number not verified after verification: %v", res)
+	}
+
+	at := strconv.FormatInt(app.Clock.Now().Add(10*time.Minute).Unix(), 10)
+	code, _ := app.PostJSON("/schedule", map[string]string{"to": number, "password": "wrong password", "body": "hi", "time": at})
+	if code != http.StatusBadRequest {
+		t.Errorf("schedule with wrong password: got status %d", code)
+	}
+	code, _ = app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "body": "take out the trash", "time": at})
+	if code != http.StatusOK {
+		t.Fatalf("schedule: got status %d", code)
+	}
+
+	sent := len(app.Twilio.Messages())
+	app.Advance(5 * time.Minute)
+	app.Dispatch()
+	if len(app.Twilio.Messages()) != sent {
+		t.Fatal("message dispatched before its time")
+	}
+
+	app.Advance(5 * time.Minute)
+	app.Dispatch()
+	msgs := app.Twilio.Messages()
+	if len(msgs) != sent+1 || msgs[sent].To != number || msgs[sent].Body != "take out the trash" {
+		t.Fatalf("scheduled message not dispatched: %+v", msgs)
+	}
+
+	app.Advance(time.Minute)
+	app.Dispatch()
+	if len(app.Twilio.Messages()) != sent+1 {
+		t.Error("message dispatched more than once")
+	}
+}
+
+func TestSetPasswordUnverified(t *testing.T) {
+	app := NewTestApp(t)
+	code, _ := app.PostJSON("/set_password", map[string]string{"number": "5558675309", "password": "correct horse battery"})
+	if code != http.StatusBadRequest {
+		t.Errorf("set_password for unverified number: got status %d", code)
+	}
+}
+
+func TestDispatchRetriesFailedSend(t *testing.T) {
+	app := NewTestApp(t)
+	app.Twilio.SetConfig(FakeConfig{FailRate: 1, FailStatus: http.StatusServiceUnavailable})
+
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	if err := ScheduleMessage(context.Background(), "hi", "5558675309", at); err != nil {
+		t.Fatal(err)
+	}
+	app.Dispatch()
+	if len(app.Twilio.Messages()) != 0 {
+		t.Fatal("message recorded despite failure")
+	}
+
+	app.Twilio.SetConfig(FakeConfig{})
+	app.Advance(time.Minute)
+	app.Dispatch()
+	if len(app.Twilio.Messages()) != 1 {
+		t.Error("failed message was not retried on the next dispatch")
+	}
+}
+
+func TestVerificationCodeExpires(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	app.PostJSON("/send_verification", map[string]string{"number": number})
+	vcode := CODE_RE.FindString(app.Twilio.Messages()[0].Body)
+
+	app.Advance(VERIFY_CODE_TTL)
+	_, res := app.Get("/check_verification", url.Values{"number": {number}, "code": {vcode}})
+	if res["valid"] != false {
+		t.Errorf("expired verification code accepted: %v", res)
+	}
+}
+
+func TestVerificationCodeWithoutExpiry(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	// codes made before expiry was tracked only have a code field
+	c := GetConn()
+	c.Do("HSET", number, "code", "123456")
+	c.Close()
+
+	_, res := app.Get("/check_verification", url.Values{"number": {number}, "code": {"123456"}})
+	if res["valid"] != true {
+		t.Errorf("code without expiry rejected: %v", res)
+	}
+}
+
+func TestVerificationCodeUsedOnce(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	app.PostJSON("/send_verification", map[string]string{"number": number})
+	vcode := CODE_RE.FindString(app.Twilio.Messages()[0].Body)
+
+	if _, res := app.Get("/check_verification", url.Values{"number": {number}, "code": {vcode}}); res["valid"] != true {
+		t.Fatalf("verification code not accepted: %v", res)
+	}
+	if _, res := app.Get("/check_verification", url.Values{"number": {number}, "code": {vcode}}); res["valid"] != false {
+		t.Errorf("verification code accepted twice: %v", res)
+	}
+}
+
+func TestVerificationFailuresLimited(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	app.PostJSON("/send_verification", map[string]string{"number": number})
+	vcode := CODE_RE.FindString(app.Twilio.Messages()[0].Body)
+	wrong := "000000"
+	if vcode == wrong {
+		wrong = "111111"
+	}
+
+	for i := 0; i < MAX_VERIFY_FAILURES; i++ {
+		if _, res := app.Get("/check_verification", url.Values{"number": {number}, "code": {wrong}}); res["valid"] != false {
+			t.Fatalf("wrong verification code accepted: %v", res)
+		}
+	}
+	if code, _ := app.Get("/check_verification", url.Values{"number": {number}, "code": {vcode}}); code != http.StatusTooManyRequests {
+		t.Errorf("check after %d failures: got status %d", MAX_VERIFY_FAILURES, code)
+	}
+
+	app.Advance(VERIFY_FAILURE_WINDOW)
+	app.PostJSON("/send_verification", map[string]string{"number": number})
+	msgs := app.Twilio.Messages()
+	vcode = CODE_RE.FindString(msgs[len(msgs)-1].Body)
+	if _, res := app.Get("/check_verification", url.Values{"number": {number}, "code": {vcode}}); res["valid"] != true {
+		t.Errorf("verification code not accepted after the failure window: %v", res)
+	}
+}
+
+func TestVerificationResendLimited(t *testing.T) {
+	app := NewTestApp(t)
+	number := "5558675309"
+	app.PostJSON("/send_verification", map[string]string{"number": number})
+
+	app.Advance(VERIFY_RESEND_INTERVAL / 2)
+	if code, _ := app.PostJSON("/send_verification", map[string]string{"number": number}); code != http.StatusTooManyRequests {
+		t.Errorf("resend too soon: got status %d", code)
+	}
+	app.Advance(VERIFY_RESEND_INTERVAL / 2)
+	if code, _ := app.PostJSON("/send_verification", map[string]string{"number": number}); code != http.StatusOK {
+		t.Errorf("resend after interval: got status %d", code)
+	}
+	if n := len(app.Twilio.Messages()); n != 2 {
+		t.Errorf("expected 2 verification messages, got %d", n)
+	}
+}
+
+func TestDispatchLoopTicksEachMinute(t *testing.T) {
+	app := NewTestApp(t)
+	// start 30s into a minute, the loop should wait until the next one
+	app.Advance(30 * time.Second)
+	at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+	if err := ScheduleMessage(context.Background(), "hi", "5558675309", at); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		dispatchLoop(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	app.Clock.BlockUntil(1)
+	app.Advance(29 * time.Second)
+	if len(app.Twilio.Messages()) != 0 {
+		t.Fatal("message dispatched before the minute started")
+	}
+	app.Advance(time.Second)
+	app.Clock.BlockUntil(1)
+	if len(app.Twilio.Messages()) != 1 {
+		t.Error("message not dispatched at the start of the minute")
+	}
+}
+
+func TestForEachConcurrently(t *testing.T) {
+	NewTestApp(t)
+	ids := []string{"a", "b", "c", "d", "e", "f", "g"}
+	var mu sync.Mutex
+	running, most, seen := 0, 0, make(map[string]bool)
+	forEachConcurrently(ids, 3, func(c redis.Conn, id string) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		seen[id] = true
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if len(seen) != len(ids) {
+		t.Errorf("expected %d ids handled, got %v", len(ids), seen)
+	}
+	if most < 2 || most > 3 {
+		t.Errorf("expected at most 3 ids handled at once, and more than 1, got %d", most)
+	}
+}
+
+func TestDispatchJobSkippedWhileRunning(t *testing.T) {
+	NewTestApp(t)
+	release, runs := make(chan struct{}), int32(0)
+	j := &dispatchJob{Name: "slow", Run: func(ctx context.Context, c redis.Conn, now time.Time) error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	}}
+	var wg sync.WaitGroup
+	j.start(&wg, CLOCK.Now())
+	j.start(&wg, CLOCK.Now())
+	close(release)
+	wg.Wait()
+	j.start(&wg, CLOCK.Now())
+	wg.Wait()
+	if runs != 2 {
+		t.Errorf("expected 2 runs, got %d", runs)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var LEVEL_NAMES = map[Level]string{DEBUG: "debug", INFO: "info", WARN: "warn", ERROR: "error"}
+
+// Field keys whose values are never written to the log as-is
+var (
+	SECRET_KEYS = map[string]bool{"password": true, "code": true, "body": true, "token": true, "auth_token": true}
+	PHONE_KEYS  = map[string]bool{"to": true, "from": true, "number": true, "phone": true}
+	// Phone-number-looking runs of digits in free text (log messages, errors)
+	PHONE_RE = regexp.MustCompile(`\+?\d{10,15}`)
+)
+
+type Fields map[string]interface{}
+
+// Leveled logger writing one JSON object per line. Fields attached with
+// With are included in every entry, and sensitive values are masked.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	fields Fields
+}
+
+func NewLogger(out io.Writer, level Level) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level, fields: Fields{}}
+}
+
+// Returns a copy of l which adds fields to every entry
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{mu: l.mu, out: l.out, level: l.level, fields: merged}
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) { l.log(DEBUG, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Fields)  { l.log(INFO, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Fields)  { l.log(WARN, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Fields) { l.log(ERROR, msg, fields) }
+
+// Logs at ERROR level then exits
+func (l *Logger) Fatal(msg string, fields ...Fields) {
+	l.log(ERROR, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, extra []Fields) {
+	if level < l.level {
+		return
+	}
+	entry := make(map[string]interface{}, len(l.fields)+4)
+	for k, v := range l.fields {
+		entry[k] = Redact(k, v)
+	}
+	for _, fields := range extra {
+		for k, v := range fields {
+			entry[k] = Redact(k, v)
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = LEVEL_NAMES[level]
+	entry["msg"] = ScrubText(msg)
+	if _, file, line, ok := runtime.Caller(2); ok {
+		entry["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": "could not encode log entry", "error": err.Error()})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(b, '\n'))
+}
+
+// Masks the value of a log field based on its key. Errors and other
+// free text have phone numbers masked.
+func Redact(key string, v interface{}) interface{} {
+	k := strings.ToLower(key)
+	switch {
+	case SECRET_KEYS[k]:
+		return "[REDACTED]"
+	case PHONE_KEYS[k]:
+		return MaskPhone(fmt.Sprint(v))
+	}
+	switch v := v.(type) {
+	case error:
+		return ScrubText(v.Error())
+	case string:
+		return ScrubText(v)
+	}
+	return v
+}
+
+// Masks all but the last four digits of a phone number
+func MaskPhone(number string) string {
+	if len(number) <= 4 {
+		return strings.Repeat("*", len(number))
+	}
+	return strings.Repeat("*", len(number)-4) + number[len(number)-4:]
+}
+
+// Masks anything which looks like a phone number in s
+func ScrubText(s string) string {
+	return PHONE_RE.ReplaceAllStringFunc(s, MaskPhone)
+}
+
+// Parses a level name such as "debug", defaulting to INFO
+func ParseLevel(name string) Level {
+	for level, n := range LEVEL_NAMES {
+		if strings.EqualFold(n, name) {
+			return level
+		}
+	}
+	return INFO
+}
+
+type loggerKey struct{}
+
+// Returns a copy of ctx carrying l
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Returns the logger carried by ctx, or the global logger
+func LoggerFrom(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return logger
+}
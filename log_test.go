@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(buf, DEBUG).With(Fields{"request_id": "abc"})
+	l.Info("sent to +15558675309", Fields{
+		"to":       "5558675309",
+		"password": "hunter2hunter2",
+		"code":     "123456",
+		"body":     "pick up milk",
+		"error":    errors.New("bad number 5558675309"),
+	})
+
+	out := buf.String()
+	for _, secret := range []string{"5558675309", "hunter2", "123456", "milk"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output contains %q: %s", secret, out)
+		}
+	}
+
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["request_id"] != "abc" || entry["level"] != "info" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+	if entry["to"] != "******5309" {
+		t.Errorf("phone number not masked as expected: %v", entry["to"])
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(buf, ParseLevel("warn"))
+	l.Info("hidden")
+	l.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("level filtering failed: %s", buf.String())
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/scascketta/textremind/sms"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Twilio's limit for images it will deliver to every carrier
+	MAX_MEDIA_SIZE = 5 << 20
+	// Twilio's limit on attachments per message
+	MAX_MEDIA_PER_MESSAGE = 10
+	// MMS aren't split into segments but bodies are limited
+	MAX_MMS_BODY = 1600
+	// Uploads which aren't attached to a message are removed after this
+	MEDIA_UNUSED_TTL = 24 * time.Hour
+	// Limit on a user's uploads which aren't attached to a message, so
+	// storage can't be filled before they're removed
+	MAX_UNATTACHED_MEDIA = 50
+	// Media is kept this long after its last message is sent, since Twilio
+	// fetches it after accepting the message
+	MEDIA_GRACE = time.Hour
+
+	MEDIA_ERR_S = ERR_S + "uploading the image."
+)
+
+var (
+	// Where uploaded media is stored. In worker mode the dispatcher removes
+	// files, so the API and worker processes must share it.
+	MEDIA_DIR string = envOr("TEXTREMIND_MEDIA_DIR", "media")
+
+	// Types which can be attached, by the extension they're stored with
+	MEDIA_TYPES = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif"}
+
+	ErrMediaTooLarge = errors.New("media too large")
+	ErrMediaType     = errors.New("unsupported media type")
+	ErrTooManyMedia  = errors.New("too many unattached uploads")
+	ErrMediaGone     = errors.New("media no longer exists")
+)
+
+// An uploaded file. ID is random and unguessable, since URL is public so
+// Twilio can fetch it.
+type Media struct {
+	ID    string `json:"id"`
+	Owner string `json:"-"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	URL   string `json:"url"`
+}
+
+func mediaKey(id string) string { return "media:" + id }
+
+// Set of IDs of a user's uploads which may not be attached, see
+// countUnattachedMedia
+func unattachedMediaKey(owner string) string { return "unattached_media:" + owner }
+
+// Sorted set of media IDs to remove, scored by when
+const MEDIA_CLEANUP_KEY = "media_cleanup"
+
+func mediaPath(id, contentType string) string {
+	return filepath.Join(MEDIA_DIR, id+MEDIA_TYPES[contentType])
+}
+
+// Stores an image uploaded by owner, served under baseURL. The type is
+// detected from the content rather than trusted from the client.
+func SaveMedia(owner, baseURL string, src io.Reader) (*Media, error) {
+	c := GetConn()
+	defer c.Close()
+	m := &Media{ID: randomHex(16), Owner: owner}
+	m.URL = baseURL + "/media/" + m.ID
+	if err := reserveMedia(c, m); err != nil {
+		return nil, err
+	}
+	saved := false
+	defer func() {
+		if !saved {
+			discardMedia(c, m)
+		}
+	}()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	m.Type = http.DetectContentType(head)
+	if _, ok := MEDIA_TYPES[m.Type]; !ok {
+		return nil, ErrMediaType
+	}
+
+	if err := os.MkdirAll(MEDIA_DIR, 0o755); err != nil {
+		return nil, err
+	}
+	path := mediaPath(m.ID, m.Type)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// read one byte past the limit to tell if it's over
+	m.Size, err = io.Copy(f, io.LimitReader(io.MultiReader(bytes.NewReader(head), src), MAX_MEDIA_SIZE+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && m.Size > MAX_MEDIA_SIZE {
+		err = ErrMediaTooLarge
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	if _, err := c.Do("HMSET", mediaKey(m.ID), "type", m.Type, "size", m.Size, "url", m.URL); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	saved = true
+	return m, nil
+}
+
+// Takes one of owner's MAX_UNATTACHED_MEDIA slots for m before it's uploaded,
+// so concurrent uploads can't all get under the limit. Returns
+// ErrTooManyMedia if there are none left. Reservations are removed with
+// unused uploads if the upload never finishes.
+func reserveMedia(c redis.Conn, m *Media) error {
+	c.Send("MULTI")
+	c.Send("HMSET", mediaKey(m.ID), "owner", m.Owner, "refs", 0)
+	c.Send("ZADD", MEDIA_CLEANUP_KEY, CLOCK.Now().Add(MEDIA_UNUSED_TTL).Unix(), m.ID)
+	c.Send("SADD", unattachedMediaKey(m.Owner), m.ID)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	unattached, err := countUnattachedMedia(c, m.Owner)
+	if err == nil && unattached > MAX_UNATTACHED_MEDIA {
+		err = ErrTooManyMedia
+	}
+	if err != nil {
+		discardMedia(c, m)
+	}
+	return err
+}
+
+// Removes the reservation of an upload which didn't finish
+func discardMedia(c redis.Conn, m *Media) {
+	c.Send("MULTI")
+	c.Send("DEL", mediaKey(m.ID))
+	c.Send("ZREM", MEDIA_CLEANUP_KEY, m.ID)
+	c.Send("SREM", unattachedMediaKey(m.Owner), m.ID)
+	if _, err := c.Do("EXEC"); err != nil {
+		logger.Error("could not discard media reservation", Fields{"media_id": m.ID, "error": err})
+	}
+}
+
+// Counts owner's uploads which aren't attached to a message, forgetting
+// those which have been attached or removed since they were uploaded
+func countUnattachedMedia(c redis.Conn, owner string) (int, error) {
+	ids, err := redis.Strings(c.Do("SMEMBERS", unattachedMediaKey(owner)))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		refs, err := redis.Int(c.Do("HGET", mediaKey(id), "refs"))
+		if err != nil && err != redis.ErrNil {
+			return 0, err
+		}
+		if err == nil && refs == 0 {
+			n++
+			continue
+		}
+		if _, err := c.Do("SREM", unattachedMediaKey(owner), id); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Get uploaded media, or ErrNotFound
+func GetMedia(id string) (*Media, error) {
+	c := GetConn()
+	defer c.Close()
+	return getMedia(c, id)
+}
+
+func getMedia(c redis.Conn, id string) (*Media, error) {
+	values, err := redis.Strings(c.Do("HGETALL", mediaKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrNotFound
+	}
+	m := &Media{ID: id}
+	for i := 0; i+1 < len(values); i += 2 {
+		switch values[i] {
+		case "owner":
+			m.Owner = values[i+1]
+		case "type":
+			m.Type = values[i+1]
+		case "size":
+			m.Size, _ = strconv.ParseInt(values[i+1], 10, 64)
+		case "url":
+			m.URL = values[i+1]
+		}
+	}
+	return m, nil
+}
+
+// Sends the commands attaching media to a message, so it's kept until the
+// message is sent. To be run in a transaction.
+func attachMedia(c redis.Conn, ids []string) {
+	for _, id := range ids {
+		c.Send("HINCRBY", mediaKey(id), "refs", 1)
+		c.Send("ZREM", MEDIA_CLEANUP_KEY, id)
+	}
+}
+
+// Detaches media from a sent or cancelled message, scheduling it for
+// removal once nothing else uses it
+func releaseMedia(c redis.Conn, ids []string, now time.Time) error {
+	for _, id := range ids {
+		refs, err := redis.Int(c.Do("HINCRBY", mediaKey(id), "refs", -1))
+		if err != nil {
+			return err
+		}
+		if refs <= 0 {
+			if _, err := c.Do("ZADD", MEDIA_CLEANUP_KEY, now.Add(MEDIA_GRACE).Unix(), id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Removes media which is due for cleanup and unused
+func cleanupMedia(c redis.Conn, now time.Time) error {
+	ids, err := redis.Strings(c.Do("ZRANGEBYSCORE", MEDIA_CLEANUP_KEY, "-inf", now.Unix()))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		m, err := getMedia(c, id)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if m != nil {
+			refs, _ := redis.Int(c.Do("HGET", mediaKey(id), "refs"))
+			if refs > 0 {
+				// attached again since
+				c.Do("ZREM", MEDIA_CLEANUP_KEY, id)
+				continue
+			}
+			if err := os.Remove(mediaPath(id, m.Type)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		c.Send("MULTI")
+		c.Send("DEL", mediaKey(id))
+		c.Send("ZREM", MEDIA_CLEANUP_KEY, id)
+		if _, err := c.Do("EXEC"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks the body of a MMS isn't too long
+func checkMMS(body string) (sms.Info, error) {
+	info := sms.Analyze(body)
+	info.MMS, info.Segments = true, 1
+	if n := utf8.RuneCountInString(body); n > MAX_MMS_BODY {
+		return info, fmt.Errorf("Messages with images can't be longer than %d characters.", MAX_MMS_BODY)
+	}
+	return info, nil
+}
+
+// Gets the URLs of a message's media for Twilio
+func mediaURLs(c redis.Conn, ids []string) ([]string, error) {
+	urls := make([]string, 0, len(ids))
+	for _, id := range ids {
+		m, err := getMedia(c, id)
+		if err == ErrNotFound {
+			return nil, fmt.Errorf("%w: %s", ErrMediaGone, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, m.URL)
+	}
+	return urls, nil
+}
+
+// Checks media IDs in a comma separated list were uploaded by owner
+func parseMediaIDs(owner, list string) ([]string, error) {
+	ids := make([]string, 0)
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		m, err := GetMedia(id)
+		if err == ErrNotFound || (err == nil && m.Owner != owner) {
+			return nil, fmt.Errorf("no image with ID %s", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > MAX_MEDIA_PER_MESSAGE {
+		return nil, fmt.Errorf("messages can't have more than %d images", MAX_MEDIA_PER_MESSAGE)
+	}
+	return ids, nil
+}
+
+// Uploads an image, as a multipart form with "number", "password" and "file"
+func uploadMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteJSONError(w, "Images must be uploaded with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_MEDIA_SIZE+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		WriteJSONError(w, fmt.Sprintf("Images must be uploaded as a form and be at most %d MB.", MAX_MEDIA_SIZE>>20), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	owner := r.FormValue("number")
+	if !authenticate(w, r, owner, r.FormValue("password")) {
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		WriteJSONError(w, "No image was uploaded.", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	m, err := SaveMedia(owner, publicURL(r), f)
+	switch {
+	case err == ErrMediaType:
+		WriteJSONError(w, "Images must be JPEG, PNG or GIF.", http.StatusUnsupportedMediaType)
+	case err == ErrMediaTooLarge:
+		WriteJSONError(w, fmt.Sprintf("Images must be at most %d MB.", MAX_MEDIA_SIZE>>20), http.StatusRequestEntityTooLarge)
+	case err == ErrTooManyMedia:
+		WriteJSONError(w, fmt.Sprintf("You can't have more than %d images which aren't attached to a message.", MAX_UNATTACHED_MEDIA), http.StatusBadRequest)
+	case err != nil:
+		LoggerFrom(r.Context()).Error("could not save media", Fields{"number": owner, "error": err})
+		WriteJSONError(w, MEDIA_ERR_S, http.StatusInternalServerError)
+	default:
+		LoggerFrom(r.Context()).Info("media uploaded", Fields{"media_id": m.ID, "size": m.Size})
+		WriteJSON(w, map[string]interface{}{"media": m}, http.StatusOK)
+	}
+}
+
+// Serves uploaded media at /media/<id>, for Twilio to fetch
+func serveMedia(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/media/")
+	if id == "" || strings.ContainsAny(id, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+	m, err := GetMedia(id)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get media", Fields{"error": err})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", m.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, mediaPath(m.ID, m.Type))
+}
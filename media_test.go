@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Uploads content to /media/upload as number
+func uploadFile(t *testing.T, app *TestApp, number, password string, content []byte) (int, map[string]interface{}) {
+	return postFile(t, app, "/media/upload", map[string]string{"number": number, "password": password}, content)
+}
+
+// POSTs a multipart form with fields and content as "file"
+func postFile(t *testing.T, app *TestApp, path string, fields map[string]string, content []byte) (int, map[string]interface{}) {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		form.WriteField(k, v)
+	}
+	part, _ := form.CreateFormFile("file", "upload")
+	part.Write(content)
+	form.Close()
+
+	res, err := http.Post(app.Server.URL+path, form.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data := make(map[string]interface{})
+	json.NewDecoder(res.Body).Decode(&data)
+	return res.StatusCode, data
+}
+
+func TestMMS(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+
+	if code, _ := uploadFile(t, app, number, password, []byte("<html>not an image</html>")); code != http.StatusUnsupportedMediaType {
+		t.Errorf("upload HTML: got status %d", code)
+	}
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4)))
+	if code, _ := uploadFile(t, app, number, password, append(img.Bytes(), make([]byte, MAX_MEDIA_SIZE)...)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload oversized image: got status %d", code)
+	}
+	code, res := uploadFile(t, app, number, password, img.Bytes())
+	media, _ := res["media"].(map[string]interface{})
+	if code != http.StatusOK || media["type"] != "image/png" {
+		t.Fatalf("upload PNG: got status %d, %v", code, res)
+	}
+	id, mediaURL := media["id"].(string), media["url"].(string)
+	_, res = uploadFile(t, app, number, password, img.Bytes())
+	unused := res["media"].(map[string]interface{})["id"].(string)
+
+	get, err := http.Get(mediaURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get.Body.Close()
+	if get.StatusCode != http.StatusOK || get.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("fetch media: got status %d, type %s", get.StatusCode, get.Header.Get("Content-Type"))
+	}
+
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	schedule := map[string]string{"to": number, "password": password, "time": at, "body": "Parking spot", "media": "0123456789abcdef"}
+	if code, _ := app.PostJSON("/schedule", schedule); code != http.StatusBadRequest {
+		t.Errorf("schedule with unknown media: got status %d", code)
+	}
+	schedule["media"] = id
+	code, res = app.PostJSON("/schedule", schedule)
+	if sms, _ := res["sms"].(map[string]interface{}); code != http.StatusOK || sms["mms"] != true {
+		t.Fatalf("schedule MMS: got status %d, %v", code, res)
+	}
+
+	app.Advance(time.Hour)
+	app.Dispatch()
+	msgs := app.Twilio.Messages()
+	last := msgs[len(msgs)-1]
+	if last.Body != "Parking spot" || len(last.MediaURLs) != 1 || last.MediaURLs[0] != mediaURL {
+		t.Errorf("expected MMS with %s, got %+v", mediaURL, last)
+	}
+
+	files := func() int {
+		matches, _ := filepath.Glob(filepath.Join(MEDIA_DIR, "*"))
+		return len(matches)
+	}
+	if n := files(); n != 2 {
+		t.Errorf("media removed before Twilio could fetch it: %d files left", n)
+	}
+	app.Advance(MEDIA_GRACE)
+	app.Dispatch()
+	if _, err := os.Stat(mediaPath(id, "image/png")); !os.IsNotExist(err) {
+		t.Errorf("sent media not removed: %v", err)
+	}
+	if get, _ := http.Get(mediaURL); get.StatusCode != http.StatusNotFound {
+		t.Errorf("fetch removed media: got status %d", get.StatusCode)
+	}
+	if files() != 1 {
+		t.Error("unused upload removed early")
+	}
+
+	app.Advance(MEDIA_UNUSED_TTL)
+	app.Dispatch()
+	if _, err := GetMedia(unused); err != ErrNotFound || files() != 0 {
+		t.Errorf("unused upload not removed: %v, %d files", err, files())
+	}
+}
+
+func TestUnattachedMediaLimit(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	var first string
+	for i := 0; i < MAX_UNATTACHED_MEDIA; i++ {
+		code, res := uploadFile(t, app, number, password, img.Bytes())
+		if code != http.StatusOK {
+			t.Fatalf("upload %d: got status %d, %v", i, code, res)
+		}
+		if first == "" {
+			first = res["media"].(map[string]interface{})["id"].(string)
+		}
+	}
+	if code, res := uploadFile(t, app, number, password, img.Bytes()); code != http.StatusBadRequest {
+		t.Errorf("upload over the limit: got status %d, %v", code, res)
+	}
+
+	// attaching one makes room for another
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	schedule := map[string]string{"to": number, "password": password, "time": at, "body": "Parking spot", "media": first}
+	if code, res := app.PostJSON("/schedule", schedule); code != http.StatusOK {
+		t.Fatalf("schedule with media: got status %d, %v", code, res)
+	}
+	if code, res := uploadFile(t, app, number, password, img.Bytes()); code != http.StatusOK {
+		t.Errorf("upload after attaching: got status %d, %v", code, res)
+	}
+
+	// as does their removal
+	app.Advance(MEDIA_UNUSED_TTL)
+	app.Dispatch()
+	if code, res := uploadFile(t, app, number, password, img.Bytes()); code != http.StatusOK {
+		t.Errorf("upload after removal: got status %d, %v", code, res)
+	}
+}
+
+// Reader which signals started on its first Read and waits for release
+// before returning r's content
+type gatedReader struct {
+	r       *bytes.Reader
+	started chan<- bool
+	release <-chan bool
+	once    sync.Once
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	g.once.Do(func() {
+		g.started <- true
+		<-g.release
+	})
+	return g.r.Read(p)
+}
+
+func TestUnattachedMediaLimitConcurrent(t *testing.T) {
+	NewTestApp(t)
+	number := "5558675309"
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	// every upload is in progress at once
+	uploads := MAX_UNATTACHED_MEDIA + 5
+	started, done, release := make(chan bool), make(chan error), make(chan bool)
+	for i := 0; i < uploads; i++ {
+		go func() {
+			_, err := SaveMedia(number, "http://localhost", &gatedReader{r: bytes.NewReader(img.Bytes()), started: started, release: release})
+			done <- err
+		}()
+	}
+	var saved, refused int
+	for waiting := uploads; waiting > 0; waiting-- {
+		select {
+		case <-started:
+		case err := <-done:
+			if err != ErrTooManyMedia {
+				t.Fatalf("expected ErrTooManyMedia, got %v", err)
+			}
+			refused++
+		}
+	}
+	close(release)
+	for i := refused; i < uploads; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		saved++
+	}
+	if saved != MAX_UNATTACHED_MEDIA {
+		t.Errorf("%d concurrent uploads saved, limit is %d", saved, MAX_UNATTACHED_MEDIA)
+	}
+	c := GetConn()
+	defer c.Close()
+	if n, _ := countUnattachedMedia(c, number); n != saved {
+		t.Errorf("%d unattached uploads recorded, %d saved", n, saved)
+	}
+}
@@ -0,0 +1,970 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errWrongType = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errSyntax    = redis.Error("ERR syntax error")
+	errNotInt    = redis.Error("ERR value is not an integer or out of range")
+)
+
+type memValue struct {
+	str     string
+	hash    map[string]string
+	set     map[string]bool
+	zset    map[string]float64
+	list    []string
+	expires time.Time
+}
+
+// In-memory stand-in for the subset of redis used by TextRemind, for tests
+// and local development without a redis server. Conns share one keyspace.
+type MemoryRedis struct {
+	// Used for key expiry, defaults to CLOCK.Now
+	Now func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*memValue
+}
+
+func NewMemoryRedis() *MemoryRedis {
+	return &MemoryRedis{Now: func() time.Time { return CLOCK.Now() }, keys: make(map[string]*memValue)}
+}
+
+// Returns a new connection to m, usable as GetConn
+func (m *MemoryRedis) Conn() redis.Conn {
+	return &memConn{db: m}
+}
+
+type memCommand struct {
+	name string
+	args []interface{}
+}
+
+type memConn struct {
+	db      *MemoryRedis
+	multi   bool
+	queued  []memCommand
+	pending []interface{}
+	closed  bool
+	// Watched keys and their values when watched, EXEC is aborted if any
+	// have changed since
+	watched map[string]string
+}
+
+func (c *memConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *memConn) Err() error {
+	if c.closed {
+		return errors.New("redigo: closed")
+	}
+	return nil
+}
+
+func (c *memConn) Flush() error { return c.Err() }
+
+// Runs a command, or queues it inside MULTI. Replies are read with Receive,
+// or returned all at once by the next Do, as with a real connection.
+func (c *memConn) Send(name string, args ...interface{}) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	reply, err := c.run(name, args)
+	if err != nil {
+		c.pending = append(c.pending, err)
+	} else {
+		c.pending = append(c.pending, reply)
+	}
+	return nil
+}
+
+func (c *memConn) Receive() (interface{}, error) {
+	if len(c.pending) == 0 {
+		return nil, errors.New("redigo: no pending replies")
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *memConn) Do(name string, args ...interface{}) (interface{}, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	c.pending = nil
+	if name == "" {
+		return nil, nil
+	}
+	reply, err := c.run(name, args)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *memConn) run(name string, args []interface{}) (interface{}, error) {
+	name = strings.ToUpper(name)
+	switch name {
+	case "MULTI":
+		c.multi = true
+		c.queued = nil
+		return "OK", nil
+	case "DISCARD":
+		c.multi = false
+		c.queued = nil
+		c.watched = nil
+		return "OK", nil
+	case "WATCH":
+		if c.multi {
+			return nil, redis.Error("ERR WATCH inside MULTI is not allowed")
+		}
+		c.db.mu.Lock()
+		defer c.db.mu.Unlock()
+		if c.watched == nil {
+			c.watched = map[string]string{}
+		}
+		for _, key := range memArgs(args) {
+			c.watched[key] = c.db.fingerprint(key)
+		}
+		return "OK", nil
+	case "UNWATCH":
+		c.watched = nil
+		return "OK", nil
+	case "EXEC":
+		if !c.multi {
+			return nil, redis.Error("ERR EXEC without MULTI")
+		}
+		c.multi = false
+		queued, watched := c.queued, c.watched
+		c.queued, c.watched = nil, nil
+		c.db.mu.Lock()
+		defer c.db.mu.Unlock()
+		for key, fp := range watched {
+			if c.db.fingerprint(key) != fp {
+				return nil, nil
+			}
+		}
+		replies := make([]interface{}, len(queued))
+		for i, cmd := range queued {
+			reply, err := c.db.exec(cmd.name, cmd.args)
+			if err != nil {
+				replies[i] = err
+			} else {
+				replies[i] = reply
+			}
+		}
+		return replies, nil
+	}
+	if c.multi {
+		c.queued = append(c.queued, memCommand{name, args})
+		return "QUEUED", nil
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return c.db.exec(name, args)
+}
+
+// Converts a command argument to a string the way redigo does
+func memArg(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	case float64:
+		return strconv.FormatFloat(arg, 'g', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(arg)
+}
+
+func memArgs(args []interface{}) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = memArg(arg)
+	}
+	return strs
+}
+
+func bulk(s string) interface{} { return []byte(s) }
+
+func bulks(strs []string) []interface{} {
+	replies := make([]interface{}, len(strs))
+	for i, s := range strs {
+		replies[i] = bulk(s)
+	}
+	return replies
+}
+
+// Returns the live value at key, or nil
+func (m *MemoryRedis) get(key string) *memValue {
+	v, ok := m.keys[key]
+	if !ok {
+		return nil
+	}
+	if !v.expires.IsZero() && !m.Now().Before(v.expires) {
+		delete(m.keys, key)
+		return nil
+	}
+	return v
+}
+
+// Describes the live value at key, to tell whether a watched key changed
+func (m *MemoryRedis) fingerprint(key string) string {
+	v := m.get(key)
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%+v", *v)
+}
+
+// Returns the value at key, creating it with create if missing. Returns
+// errWrongType if the existing value isn't of the kind check accepts.
+func (m *MemoryRedis) getOrCreate(key string, check func(*memValue) bool, create func() *memValue) (*memValue, error) {
+	v := m.get(key)
+	if v == nil {
+		v = create()
+		m.keys[key] = v
+		return v, nil
+	}
+	if !check(v) {
+		return nil, errWrongType
+	}
+	return v, nil
+}
+
+func isString(v *memValue) bool { return !isHash(v) && !isSet(v) && !isZset(v) && !isList(v) }
+func isHash(v *memValue) bool   { return v.hash != nil }
+func isSet(v *memValue) bool    { return v.set != nil }
+func isZset(v *memValue) bool   { return v.zset != nil }
+func isList(v *memValue) bool   { return v.list != nil }
+
+// Deletes key if it's a now-empty collection, as redis does
+func (m *MemoryRedis) gc(key string) {
+	v := m.keys[key]
+	if v != nil && ((v.hash != nil && len(v.hash) == 0) || (v.set != nil && len(v.set) == 0) ||
+		(v.zset != nil && len(v.zset) == 0) || (v.list != nil && len(v.list) == 0)) {
+		delete(m.keys, key)
+	}
+}
+
+func (m *MemoryRedis) exec(name string, rawArgs []interface{}) (interface{}, error) {
+	args := memArgs(rawArgs)
+	arity := func(n int) error {
+		if len(args) < n {
+			return redis.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		}
+		return nil
+	}
+
+	switch name {
+	case "PING":
+		return "PONG", nil
+
+	case "FLUSHDB", "FLUSHALL":
+		m.keys = make(map[string]*memValue)
+		return "OK", nil
+
+	case "GET":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return nil, nil
+		}
+		if !isString(v) {
+			return nil, errWrongType
+		}
+		return bulk(v.str), nil
+
+	case "SET":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := &memValue{str: args[1]}
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if m.get(args[0]) != nil {
+					return nil, nil
+				}
+			case "XX":
+				if m.get(args[0]) == nil {
+					return nil, nil
+				}
+			case "EX", "PX":
+				if i+1 >= len(args) {
+					return nil, errSyntax
+				}
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					return nil, errNotInt
+				}
+				unit := time.Second
+				if strings.ToUpper(args[i]) == "PX" {
+					unit = time.Millisecond
+				}
+				v.expires = m.Now().Add(time.Duration(n) * unit)
+				i++
+			default:
+				return nil, errSyntax
+			}
+		}
+		m.keys[args[0]] = v
+		return "OK", nil
+
+	case "INCR", "INCRBY", "DECR":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		by := int64(1)
+		if name == "DECR" {
+			by = -1
+		}
+		if name == "INCRBY" {
+			if err := arity(2); err != nil {
+				return nil, err
+			}
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return nil, errNotInt
+			}
+			by = n
+		}
+		v, err := m.getOrCreate(args[0], isString, func() *memValue { return &memValue{str: "0"} })
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(v.str, 10, 64)
+		if err != nil {
+			return nil, errNotInt
+		}
+		n += by
+		v.str = strconv.FormatInt(n, 10)
+		return n, nil
+
+	case "DEL":
+		var n int64
+		for _, key := range args {
+			if m.get(key) != nil {
+				delete(m.keys, key)
+				n++
+			}
+		}
+		return n, nil
+
+	case "EXISTS":
+		var n int64
+		for _, key := range args {
+			if m.get(key) != nil {
+				n++
+			}
+		}
+		return n, nil
+
+	case "EXPIRE":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		secs, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, errNotInt
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		v.expires = m.Now().Add(time.Duration(secs) * time.Second)
+		return int64(1), nil
+
+	case "PERSIST":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil || v.expires.IsZero() {
+			return int64(0), nil
+		}
+		v.expires = time.Time{}
+		return int64(1), nil
+
+	case "TTL":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(-2), nil
+		}
+		if v.expires.IsZero() {
+			return int64(-1), nil
+		}
+		return int64(math.Ceil(v.expires.Sub(m.Now()).Seconds())), nil
+
+	case "KEYS":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0)
+		for key := range m.keys {
+			if ok, _ := path.Match(args[0], key); ok && m.get(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return bulks(keys), nil
+
+	case "TYPE":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		switch {
+		case v == nil:
+			return "none", nil
+		case isHash(v):
+			return "hash", nil
+		case isSet(v):
+			return "set", nil
+		case isZset(v):
+			return "zset", nil
+		case isList(v):
+			return "list", nil
+		}
+		return "string", nil
+
+	case "HSET", "HMSET":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		if len(args)%2 != 1 {
+			return nil, errSyntax
+		}
+		v, err := m.getOrCreate(args[0], isHash, func() *memValue { return &memValue{hash: map[string]string{}} })
+		if err != nil {
+			return nil, err
+		}
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := v.hash[args[i]]; !ok {
+				added++
+			}
+			v.hash[args[i]] = args[i+1]
+		}
+		if name == "HMSET" {
+			return "OK", nil
+		}
+		return added, nil
+
+	case "HSETNX":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		v, err := m.getOrCreate(args[0], isHash, func() *memValue { return &memValue{hash: map[string]string{}} })
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := v.hash[args[1]]; ok {
+			return int64(0), nil
+		}
+		v.hash[args[1]] = args[2]
+		return int64(1), nil
+
+	case "HGET":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return nil, nil
+		}
+		if !isHash(v) {
+			return nil, errWrongType
+		}
+		f, ok := v.hash[args[1]]
+		if !ok {
+			return nil, nil
+		}
+		return bulk(f), nil
+
+	case "HEXISTS":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isHash(v) {
+			return nil, errWrongType
+		}
+		if _, ok := v.hash[args[1]]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+
+	case "HDEL":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isHash(v) {
+			return nil, errWrongType
+		}
+		var n int64
+		for _, f := range args[1:] {
+			if _, ok := v.hash[f]; ok {
+				delete(v.hash, f)
+				n++
+			}
+		}
+		m.gc(args[0])
+		return n, nil
+
+	case "HGETALL":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return []interface{}{}, nil
+		}
+		if !isHash(v) {
+			return nil, errWrongType
+		}
+		fields := make([]string, 0, len(v.hash))
+		for f := range v.hash {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		replies := make([]interface{}, 0, 2*len(fields))
+		for _, f := range fields {
+			replies = append(replies, bulk(f), bulk(v.hash[f]))
+		}
+		return replies, nil
+
+	case "HLEN":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isHash(v) {
+			return nil, errWrongType
+		}
+		return int64(len(v.hash)), nil
+
+	case "HINCRBY":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, errNotInt
+		}
+		v, err := m.getOrCreate(args[0], isHash, func() *memValue { return &memValue{hash: map[string]string{}} })
+		if err != nil {
+			return nil, err
+		}
+		n := int64(0)
+		if f, ok := v.hash[args[1]]; ok {
+			if n, err = strconv.ParseInt(f, 10, 64); err != nil {
+				return nil, errNotInt
+			}
+		}
+		n += by
+		v.hash[args[1]] = strconv.FormatInt(n, 10)
+		return n, nil
+
+	case "SADD":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v, err := m.getOrCreate(args[0], isSet, func() *memValue { return &memValue{set: map[string]bool{}} })
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for _, member := range args[1:] {
+			if !v.set[member] {
+				v.set[member] = true
+				n++
+			}
+		}
+		return n, nil
+
+	case "SREM":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isSet(v) {
+			return nil, errWrongType
+		}
+		var n int64
+		for _, member := range args[1:] {
+			if v.set[member] {
+				delete(v.set, member)
+				n++
+			}
+		}
+		m.gc(args[0])
+		return n, nil
+
+	case "SISMEMBER":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isSet(v) {
+			return nil, errWrongType
+		}
+		if v.set[args[1]] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+
+	case "SMEMBERS":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return []interface{}{}, nil
+		}
+		if !isSet(v) {
+			return nil, errWrongType
+		}
+		members := make([]string, 0, len(v.set))
+		for member := range v.set {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return bulks(members), nil
+
+	case "SCARD":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isSet(v) {
+			return nil, errWrongType
+		}
+		return int64(len(v.set)), nil
+
+	case "ZADD":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		key, flags := args[0], map[string]bool{}
+		for len(args) > 1 {
+			f := strings.ToUpper(args[1])
+			if f != "NX" && f != "XX" && f != "GT" && f != "LT" && f != "CH" {
+				break
+			}
+			flags[f] = true
+			args = args[1:]
+		}
+		if len(args) < 3 || len(args)%2 != 1 {
+			return nil, errSyntax
+		}
+		v, err := m.getOrCreate(key, isZset, func() *memValue { return &memValue{zset: map[string]float64{}} })
+		if err != nil {
+			return nil, err
+		}
+		var added, changed int64
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return nil, redis.Error("ERR value is not a valid float")
+			}
+			old, ok := v.zset[args[i+1]]
+			if ok && (flags["NX"] || flags["GT"] && score <= old || flags["LT"] && score >= old) || !ok && flags["XX"] {
+				continue
+			}
+			if !ok {
+				added++
+			} else if score != old {
+				changed++
+			}
+			v.zset[args[i+1]] = score
+		}
+		if len(v.zset) == 0 {
+			delete(m.keys, key)
+		}
+		if flags["CH"] {
+			return added + changed, nil
+		}
+		return added, nil
+
+	case "ZREM":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isZset(v) {
+			return nil, errWrongType
+		}
+		var n int64
+		for _, member := range args[1:] {
+			if _, ok := v.zset[member]; ok {
+				delete(v.zset, member)
+				n++
+			}
+		}
+		m.gc(args[0])
+		return n, nil
+
+	case "ZSCORE":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return nil, nil
+		}
+		if !isZset(v) {
+			return nil, errWrongType
+		}
+		score, ok := v.zset[args[1]]
+		if !ok {
+			return nil, nil
+		}
+		return bulk(strconv.FormatFloat(score, 'f', -1, 64)), nil
+
+	case "ZCARD":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isZset(v) {
+			return nil, errWrongType
+		}
+		return int64(len(v.zset)), nil
+
+	case "ZRANGE", "ZRANGEBYSCORE":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v != nil && !isZset(v) {
+			return nil, errWrongType
+		}
+		members := make([]string, 0)
+		if v != nil {
+			for member := range v.zset {
+				members = append(members, member)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			si, sj := v.zset[members[i]], v.zset[members[j]]
+			if si != sj {
+				return si < sj
+			}
+			return members[i] < members[j]
+		})
+
+		withScores := false
+		offset, count := 0, -1
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "WITHSCORES":
+				withScores = true
+			case "LIMIT":
+				if name != "ZRANGEBYSCORE" || i+2 >= len(args) {
+					return nil, errSyntax
+				}
+				var err1, err2 error
+				offset, err1 = strconv.Atoi(args[i+1])
+				count, err2 = strconv.Atoi(args[i+2])
+				if err1 != nil || err2 != nil {
+					return nil, errNotInt
+				}
+				i += 2
+			default:
+				return nil, errSyntax
+			}
+		}
+
+		var selected []string
+		if name == "ZRANGE" {
+			start, err1 := strconv.Atoi(args[1])
+			stop, err2 := strconv.Atoi(args[2])
+			if err1 != nil || err2 != nil {
+				return nil, errNotInt
+			}
+			selected = memSlice(members, start, stop)
+		} else {
+			min, minEx, err1 := parseScoreBound(args[1])
+			max, maxEx, err2 := parseScoreBound(args[2])
+			if err1 != nil || err2 != nil {
+				return nil, redis.Error("ERR min or max is not a float")
+			}
+			for _, member := range members {
+				s := v.zset[member]
+				if (s > min || (!minEx && s == min)) && (s < max || (!maxEx && s == max)) {
+					selected = append(selected, member)
+				}
+			}
+			if offset > len(selected) {
+				offset = len(selected)
+			}
+			selected = selected[offset:]
+			if count >= 0 && count < len(selected) {
+				selected = selected[:count]
+			}
+		}
+
+		replies := make([]interface{}, 0, len(selected))
+		for _, member := range selected {
+			replies = append(replies, bulk(member))
+			if withScores {
+				replies = append(replies, bulk(strconv.FormatFloat(v.zset[member], 'f', -1, 64)))
+			}
+		}
+		return replies, nil
+
+	case "RPUSH", "LPUSH":
+		if err := arity(2); err != nil {
+			return nil, err
+		}
+		v, err := m.getOrCreate(args[0], isList, func() *memValue { return &memValue{list: []string{}} })
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range args[1:] {
+			if name == "RPUSH" {
+				v.list = append(v.list, item)
+			} else {
+				v.list = append([]string{item}, v.list...)
+			}
+		}
+		return int64(len(v.list)), nil
+
+	case "LRANGE":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return nil, errNotInt
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return []interface{}{}, nil
+		}
+		if !isList(v) {
+			return nil, errWrongType
+		}
+		return bulks(memSlice(v.list, start, stop)), nil
+
+	case "LTRIM":
+		if err := arity(3); err != nil {
+			return nil, err
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return nil, errNotInt
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return "OK", nil
+		}
+		if !isList(v) {
+			return nil, errWrongType
+		}
+		v.list = append([]string{}, memSlice(v.list, start, stop)...)
+		m.gc(args[0])
+		return "OK", nil
+
+	case "LLEN":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		v := m.get(args[0])
+		if v == nil {
+			return int64(0), nil
+		}
+		if !isList(v) {
+			return nil, errWrongType
+		}
+		return int64(len(v.list)), nil
+	}
+	return nil, redis.Error(fmt.Sprintf("ERR unknown command '%s'", name))
+}
+
+// Slices items by redis-style inclusive, possibly negative, indexes
+func memSlice(items []string, start, stop int) []string {
+	n := len(items)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return []string{}
+	}
+	return items[start : stop+1]
+}
+
+// Parses a ZRANGEBYSCORE bound such as "5", "(5", "-inf" or "+inf"
+func parseScoreBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, exclusive, err
+}
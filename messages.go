@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"sort"
+)
+
+// Limit on the messages listed, the soonest are kept
+const MAX_LISTED_MESSAGES = 1000
+
+// Scheduled messages number may see in delivery order, at most max: those
+// to number which they scheduled themselves and, if sent, those number
+// scheduled for their contacts
+func scheduledMessages(c redis.Conn, number string, sent bool, max int) ([]*Message, error) {
+	keys := []string{userMessagesKey(number)}
+	if sent {
+		keys = append(keys, ownerMessagesKey(number))
+	}
+	seen := make(map[string]bool)
+	msgs := make([]*Message, 0)
+	for _, key := range keys {
+		ids, err := redis.Strings(c.Do("SMEMBERS", key))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			msg, err := getMessage(c, id)
+			if err == ErrNotFound || (err == nil && !msg.Scheduled) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			// someone else's message to number as their contact
+			if msg.Owner != "" && msg.Owner != number {
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Time < msgs[j].Time })
+	if len(msgs) > max {
+		msgs = msgs[:max]
+	}
+	return msgs, nil
+}
+
+// Get a message number may see: one they sent to a contact, or one to
+// themselves. Others are ErrNotFound, so IDs can't be probed.
+func userMessage(number, id string) (*Message, error) {
+	msg, err := GetMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Owner != "" && msg.Owner != number {
+		return nil, ErrNotFound
+	}
+	if msg.Owner == "" && msg.To != number {
+		return nil, ErrNotFound
+	}
+	return msg, nil
+}
+
+// Lists the messages scheduled to a number and by them for their contacts,
+// {"number", "password"}
+func listMessages(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	c := GetConn()
+	defer c.Close()
+	msgs, err := scheduledMessages(c, data["number"], true, MAX_LISTED_MESSAGES)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list messages", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, ERR_S+"getting your messages.", http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"messages": msgs}, http.StatusOK)
+}
+
+// Cancels a scheduled message, {"number", "password", "id"}
+func cancelMessage(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	_, err := userMessage(data["number"], data["id"])
+	if err == nil {
+		err = CancelMessage(data["id"])
+	}
+	if err == ErrNotFound {
+		WriteJSONError(w, "No scheduled message with that ID.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not cancel message", Fields{"message_id": data["id"], "error": err})
+		WriteJSONError(w, ERR_S+"cancelling the message.", http.StatusInternalServerError)
+		return
+	}
+	LoggerFrom(r.Context()).Info("message cancelled", Fields{"message_id": data["id"]})
+}
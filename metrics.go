@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"sync/atomic"
+)
+
+// Counters exported at /metrics on the worker port
+var (
+	dispatchLoops  int64
+	messagesSent   int64
+	messagesFailed int64
+)
+
+// Writes metrics in the Prometheus text format
+func metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "textremind_dispatch_loops_total", "counter", "Dispatcher loops completed.", atomic.LoadInt64(&dispatchLoops))
+	writeMetric(w, "textremind_messages_sent_total", "counter", "Scheduled messages sent.", atomic.LoadInt64(&messagesSent))
+	writeMetric(w, "textremind_messages_failed_total", "counter", "Attempts to send scheduled messages which failed.", atomic.LoadInt64(&messagesFailed))
+	if last := atomic.LoadInt64(&dispatchLastLoop); last != 0 {
+		writeMetric(w, "textremind_dispatch_last_loop_timestamp_seconds", "gauge", "When the dispatcher last completed a loop.", last/1e9)
+	}
+
+	circuitOpen := int64(0)
+	if HTTP_CLIENT.Breaker != nil && HTTP_CLIENT.Breaker.State() != BREAKER_STATE_NAMES[BREAKER_CLOSED] {
+		circuitOpen = 1
+	}
+	writeMetric(w, "textremind_twilio_circuit_open", "gauge", "Whether sending to Twilio is paused by the circuit breaker.", circuitOpen)
+
+	if c, err := DialRedis(); err == nil {
+		defer c.Close()
+		if n, err := redis.Int64(c.Do("ZCARD", "messages")); err == nil {
+			writeMetric(w, "textremind_messages_scheduled", "gauge", "Messages waiting to be dispatched.", n)
+		}
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
@@ -3,10 +3,16 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	uuid "github.com/nu7hatch/gouuid"
 	"net/http"
+	"regexp"
 	"strconv"
+	"time"
 )
 
+// Incoming request IDs are only trusted if they look like one
+var REQUEST_ID_RE = regexp.MustCompile(`^[A-Za-z0-9\-_.]{1,64}$`)
+
 func HTTPSRedirect(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("https://textremind.net%s", r.RequestURI), http.StatusMovedPermanently)
 }
@@ -17,7 +23,7 @@ func CorsMiddleware(fn func(http.ResponseWriter, *http.Request)) http.HandlerFun
 		if r.Method == "OPTIONS" {
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
 			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(60*60*6))
-			w.Header().Set("Access-Control-Allow-Headers", "CONTENT-TYPE, ACCEPT")
+			w.Header().Set("Access-Control-Allow-Headers", "CONTENT-TYPE, ACCEPT, AUTHORIZATION, X-REQUEST-ID, IDEMPOTENCY-KEY")
 			// FIXME: for some reason, the `Access-Control-Request-Headers` never seems to exist in requests
 			// if v, ok := r.Header["Access-Control-Request-Headers"]; ok {
 			//  w.Header().Set("Access-Control-Allow-Headers", v[0])
@@ -25,10 +31,47 @@ func CorsMiddleware(fn func(http.ResponseWriter, *http.Request)) http.HandlerFun
 			return
 		}
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Idempotent-Replayed")
 		fn(w, r)
 	}
 }
 
+// Records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Assigns each request an ID (reusing a valid `X-Request-ID` header), echoes
+// it in the response, and attaches a logger carrying it to the request context
+func RequestIDMiddleware(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !REQUEST_ID_RE.MatchString(id) {
+			uid, _ := uuid.NewV4()
+			id = uid.String()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		log := logger.With(Fields{"request_id": id})
+		r = r.WithContext(WithLogger(r.Context(), log))
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		fn(rec, r)
+		log.Info("request handled", Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rec.code,
+			"duration_ms": time.Since(start).Seconds() * 1000,
+		})
+	}
+}
+
 // Decodes JSON from request, passes decoded data to handler
 func DecodeJSONMiddleware(fn func(http.ResponseWriter, *http.Request, map[string]string)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -48,7 +91,7 @@ func decodeJSON(w http.ResponseWriter, r *http.Request) (map[string]string, erro
 	dec := json.NewDecoder(r.Body)
 	data := make(map[string]string)
 	if err := dec.Decode(&data); err != nil {
-		errlogger.Println(err)
+		LoggerFrom(r.Context()).Warn("could not decode request body", Fields{"error": err})
 		WriteJSONError(w, DECODE_ERR_S, http.StatusBadRequest)
 		return nil, err
 	}
@@ -63,7 +106,7 @@ func WriteJSON(w http.ResponseWriter, data map[string]interface{}, code int) err
 	enc := json.NewEncoder(w)
 	w.WriteHeader(code)
 	if err := enc.Encode(&data); err != nil {
-		errlogger.Println(err)
+		logger.Error("could not encode response", Fields{"error": err})
 		return err
 	}
 	return nil
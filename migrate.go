@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// A change to how data is stored, applied once by `textremind migrate`
+type migration struct {
+	Version     int
+	Description string
+	Run         func(c redis.Conn) error
+}
+
+// Applied in order, append new migrations to the end
+var MIGRATIONS = []migration{
+	{1, "index scheduled messages by recipient", indexMessagesByRecipient},
+	{2, "index scheduled messages to contacts by owner", indexMessagesByOwner},
+}
+
+// Get the version of the last migration applied to storage
+func SchemaVersion() (int, error) {
+	c := GetConn()
+	defer c.Close()
+	v, err := redis.Int(c.Do("GET", "schema_version"))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return v, err
+}
+
+// Get migrations which haven't been applied yet
+func PendingMigrations() ([]migration, error) {
+	version, err := SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]migration, 0)
+	for _, m := range MIGRATIONS {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Apply pending migrations in order, recording each as it completes.
+// Calls applied after each migration.
+func Migrate(applied func(migration)) error {
+	pending, err := PendingMigrations()
+	if err != nil {
+		return err
+	}
+	c := GetConn()
+	defer c.Close()
+	for _, m := range pending {
+		if err := m.Run(c); err != nil {
+			return err
+		}
+		if _, err := c.Do("SET", "schema_version", m.Version); err != nil {
+			return err
+		}
+		applied(m)
+	}
+	return nil
+}
+
+// Messages scheduled before user_messages:<number> existed aren't in it
+func indexMessagesByRecipient(c redis.Conn) error {
+	ids, err := redis.Strings(c.Do("ZRANGE", "messages", 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		to, err := redis.String(c.Do("HGET", id, "to"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := c.Do("SADD", userMessagesKey(to), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Messages to contacts scheduled before owner_messages:<owner> existed aren't in it
+func indexMessagesByOwner(c redis.Conn) error {
+	ids, err := redis.Strings(c.Do("ZRANGE", "messages", 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		owner, err := redis.String(c.Do("HGET", id, "owner"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := c.Do("SADD", ownerMessagesKey(owner), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
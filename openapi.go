@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/scascketta/textremind/sms"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const OPENAPI_VERSION = "3.0.3"
+
+// How a route's request fields are sent, the content type of its body or
+// "query" for query parameters
+const (
+	IN_JSON       = "application/json"
+	IN_MULTIPART  = "multipart/form-data"
+	IN_URLENCODED = "application/x-www-form-urlencoded"
+	IN_QUERY      = "query"
+)
+
+// Parameters in a route's path, like {id}
+var PATH_PARAM_RE = regexp.MustCompile(`\{(\w+)\}`)
+
+// A documented route. Handlers read requests as objects of strings, so
+// Fields is just their names, separated by spaces: required ones end in "*"
+// and "var.*" allows any fields starting "var.". Response maps the fields of
+// a successful JSON response to a value of the type written, optional ones
+// end in "?". Routes with a nil Response and no Produces have an empty body.
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// API key scope the route accepts instead of a password, if any
+	Scope  string
+	In     string
+	Fields string
+	// Status of a successful response, 200 if zero
+	Status   int
+	Response map[string]interface{}
+	// Content type of a successful response which isn't JSON
+	Produces string
+	// Responses other than Error for some status codes
+	Other map[int]map[string]interface{}
+}
+
+var healthResponse = map[string]interface{}{"status": "", "checks": map[string]checkResult{}}
+
+var API_ROUTES = []apiRoute{
+	{Method: "POST", Path: "/schedule", Summary: "Schedule a message to yourself, or to a group with number and group", Scope: SCOPE_MESSAGES_WRITE, In: IN_JSON,
+		Fields:   "to number group password time* body template var.* media channel destination urgent ack nag_minutes max_nags escalation max_segments",
+		Response: map[string]interface{}{"id": "", "sms?": sms.Info{}, "skipped?": []string{}, "warning?": "", "deferred_until?": int64(0), "deferred?": map[string]int64{}}},
+	{Method: "POST", Path: "/schedule/bulk", Summary: "Schedule messages from an uploaded CSV or JSON file", Scope: SCOPE_MESSAGES_WRITE, In: IN_MULTIPART,
+		Fields:   "number* password file* dry_run",
+		Response: map[string]interface{}{"messages": 0, "ids?": []string{}, "dry_run": false},
+		Other:    map[int]map[string]interface{}{http.StatusBadRequest: {"message": "", "errors?": []BulkRowError{}, "dry_run?": false}}},
+	{Method: "POST", Path: "/messages/list", Summary: "List the messages scheduled to you and by you for your contacts, soonest first", Scope: SCOPE_MESSAGES_READ, In: IN_JSON,
+		Fields: "number* password", Response: map[string]interface{}{"messages": []*Message{}}},
+	{Method: "POST", Path: "/messages/cancel", Summary: "Cancel a scheduled message", Scope: SCOPE_MESSAGES_WRITE, In: IN_JSON,
+		Fields: "number* password id*"},
+	{Method: "POST", Path: "/message_status", Summary: "Get a message and its delivery status", Scope: SCOPE_MESSAGES_READ, In: IN_JSON,
+		Fields: "number* password id*", Response: map[string]interface{}{"message": &Message{}, "escalation_log?": []EscalationEvent{}}},
+	{Method: "POST", Path: "/group_message_status", Summary: "Get a group message and the message to each member", Scope: SCOPE_MESSAGES_READ, In: IN_JSON,
+		Fields: "number* password id*", Response: map[string]interface{}{"message": &Broadcast{}}},
+
+	{Method: "GET", Path: "/check", Summary: "Check if a number is verified", In: IN_QUERY,
+		Fields: "number*", Response: map[string]interface{}{"verified": false}},
+	{Method: "POST", Path: "/send_verification", Summary: "Text a verification code to a number", In: IN_JSON,
+		Fields: "number*"},
+	{Method: "GET", Path: "/check_verification", Summary: "Check a verification code", In: IN_QUERY,
+		Fields: "number* code*", Response: map[string]interface{}{"valid": false}},
+	{Method: "POST", Path: "/set_password", Summary: "Set the password of a verified number", In: IN_JSON,
+		Fields: "number* password*"},
+	{Method: "POST", Path: "/set_timezone", Summary: "Set your time zone", In: IN_JSON,
+		Fields: "number* password* timezone*"},
+	{Method: "POST", Path: "/set_quiet_hours", Summary: "Set or clear your quiet hours", In: IN_JSON,
+		Fields: "number* password* start end", Response: map[string]interface{}{"quiet_hours": &QuietHours{}}},
+
+	{Method: "POST", Path: "/templates/save", Summary: "Save a message template", In: IN_JSON,
+		Fields: "number* password* name* body*"},
+	{Method: "POST", Path: "/templates/list", Summary: "List your templates", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"templates": []Template{}}},
+	{Method: "POST", Path: "/templates/delete", Summary: "Delete a template", In: IN_JSON,
+		Fields: "number* password* name*"},
+
+	{Method: "POST", Path: "/contacts/add", Summary: "Invite a contact to receive your reminders", In: IN_JSON,
+		Fields: "number* password* contact* name", Response: map[string]interface{}{"contact": &Contact{}, "invited": false}},
+	{Method: "POST", Path: "/contacts/list", Summary: "List your contacts and groups", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"contacts": []*Contact{}, "groups": map[string][]string{}}},
+	{Method: "POST", Path: "/contacts/remove", Summary: "Remove a contact", In: IN_JSON,
+		Fields: "number* password* contact*"},
+	{Method: "POST", Path: "/groups/save", Summary: "Save a group of contacts, members separated by commas", In: IN_JSON,
+		Fields: "number* password* name* members*"},
+	{Method: "POST", Path: "/groups/delete", Summary: "Delete a group", In: IN_JSON,
+		Fields: "number* password* name*"},
+
+	{Method: "POST", Path: "/api_keys/create", Summary: "Make an API key, which is only returned here", In: IN_JSON,
+		Fields: "number* password* name* scopes*", Response: map[string]interface{}{"api_key": &APIKey{}, "key": ""}},
+	{Method: "POST", Path: "/api_keys/list", Summary: "List your API keys", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"api_keys": []*APIKey{}}},
+	{Method: "POST", Path: "/api_keys/revoke", Summary: "Revoke an API key", In: IN_JSON,
+		Fields: "number* password* id*"},
+
+	{Method: "POST", Path: "/destinations/add", Summary: "Add an email address or webhook URL to deliver reminders to", In: IN_JSON,
+		Fields: "number* password* channel* address*", Response: map[string]interface{}{"destination": &Destination{}}},
+	{Method: "POST", Path: "/destinations/verify", Summary: "Verify an email address with the code sent to it", In: IN_JSON,
+		Fields: "number* password* channel* address* code*", Response: map[string]interface{}{"valid": false}},
+	{Method: "POST", Path: "/destinations/list", Summary: "List your destinations", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"destinations": []*Destination{}}},
+	{Method: "POST", Path: "/destinations/remove", Summary: "Remove a destination", In: IN_JSON,
+		Fields: "number* password* channel* address*"},
+
+	{Method: "POST", Path: "/media/upload", Summary: "Upload an image to attach to messages", In: IN_MULTIPART,
+		Fields: "number* password* file*", Response: map[string]interface{}{"media": &Media{}}},
+	{Method: "GET", Path: "/media/{id}", Summary: "Get an uploaded image", Produces: "image/*"},
+
+	{Method: "POST", Path: "/calendars/import", Summary: "Import reminders from an uploaded iCalendar file", In: IN_MULTIPART,
+		Fields: "number* password* file* id", Response: map[string]interface{}{"calendar": &Calendar{}, "sync": &CalendarSync{}}},
+	{Method: "POST", Path: "/calendars/subscribe", Summary: "Import reminders from a calendar URL, fetched again regularly", In: IN_JSON,
+		Fields: "number* password* url*", Response: map[string]interface{}{"calendar": &Calendar{}, "sync": &CalendarSync{}}},
+	{Method: "POST", Path: "/calendars/list", Summary: "List your calendars", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"calendars": []*Calendar{}}},
+	{Method: "POST", Path: "/calendars/delete", Summary: "Delete a calendar and cancel its reminders", In: IN_JSON,
+		Fields: "number* password* id*"},
+
+	{Method: "POST", Path: "/feed/url", Summary: "Get the secret URL of your reminder feed", In: IN_JSON,
+		Fields: "number* password* reset", Response: map[string]interface{}{"url": ""}},
+	{Method: "POST", Path: "/feed/revoke", Summary: "Stop your reminder feed URL working", In: IN_JSON,
+		Fields: "number* password*"},
+	{Method: "GET", Path: "/feed/{token}.ics", Summary: "Get your scheduled reminders as an iCalendar feed", Produces: "text/calendar"},
+
+	{Method: "POST", Path: "/webhooks/subscribe", Summary: "Subscribe a URL to message lifecycle events", In: IN_JSON,
+		Fields: "number* password* url* events", Response: map[string]interface{}{"subscription": &Subscription{}}},
+	{Method: "POST", Path: "/webhooks/list", Summary: "List your webhook subscriptions", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"subscriptions": []*Subscription{}}},
+	{Method: "POST", Path: "/webhooks/unsubscribe", Summary: "Remove a webhook subscription", In: IN_JSON,
+		Fields: "number* password* id*"},
+	{Method: "POST", Path: "/webhooks/deliveries", Summary: "List the latest event deliveries", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"deliveries": []*Delivery{}}},
+	{Method: "POST", Path: "/webhooks/replay", Summary: "Send an event delivery again", In: IN_JSON,
+		Fields: "number* password* id*", Response: map[string]interface{}{"delivery": &Delivery{}}},
+
+	{Method: "POST", Path: "/escalations/save", Summary: "Save an escalation policy", In: IN_JSON,
+		Fields: "number* password* name* steps*", Response: map[string]interface{}{"steps": []EscalationStep{}}},
+	{Method: "POST", Path: "/escalations/list", Summary: "List your escalation policies", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"escalations": map[string][]EscalationStep{}}},
+	{Method: "POST", Path: "/escalations/delete", Summary: "Delete an escalation policy", In: IN_JSON,
+		Fields: "number* password* name*"},
+
+	{Method: "POST", Path: "/fallback/set", Summary: "Set how reminders Twilio rejects are delivered instead", In: IN_JSON,
+		Fields: "number* password* channel* destination timeout_minutes", Response: map[string]interface{}{"fallback": &FallbackRule{}}},
+	{Method: "POST", Path: "/fallback/get", Summary: "Get your fallback rule", In: IN_JSON,
+		Fields: "number* password*", Response: map[string]interface{}{"fallback": &FallbackRule{}}},
+	{Method: "POST", Path: "/fallback/clear", Summary: "Clear your fallback rule", In: IN_JSON,
+		Fields: "number* password*"},
+
+	{Method: "POST", Path: "/sms/inbound", Summary: "Twilio's webhook for texts to TWILIO_NUMBER", In: IN_URLENCODED,
+		Fields: "From* Body*", Produces: "text/xml"},
+	{Method: "POST", Path: "/sms/status", Summary: "Twilio's status callback for sent messages", In: IN_URLENCODED,
+		Fields: "MessageStatus* ErrorCode", Status: http.StatusNoContent},
+
+	{Method: "GET", Path: "/healthz", Summary: "Check the process is serving and the dispatcher isn't stuck",
+		Response: healthResponse, Other: map[int]map[string]interface{}{http.StatusServiceUnavailable: healthResponse}},
+	{Method: "GET", Path: "/readyz", Summary: "Check storage and the SMS provider are available",
+		Response: healthResponse, Other: map[int]map[string]interface{}{http.StatusServiceUnavailable: healthResponse}},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics", Produces: "text/plain"},
+	{Method: "GET", Path: "/openapi.json", Summary: "This document",
+		Response: map[string]interface{}{"openapi": "", "info": map[string]interface{}{}, "servers": []map[string]string{}, "paths": map[string]interface{}{}, "components": map[string]interface{}{}}},
+}
+
+// Schemas for types which encode themselves, by type name
+var OPENAPI_SCHEMAS = map[string]map[string]interface{}{
+	"QuietHours": {
+		"type":                 "object",
+		"description":          "Times as HH:MM in the user's time zone",
+		"properties":           map[string]interface{}{"start": map[string]interface{}{"type": "string"}, "end": map[string]interface{}{"type": "string"}},
+		"required":             []interface{}{"start", "end"},
+		"additionalProperties": false,
+	},
+}
+
+var jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// Builds schemas from Go types the way encoding/json encodes them. Structs
+// become components, nil pointers, slices and maps are null.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+// Components are named after their type, with the package for types from
+// other packages, e.g. SMSInfo
+func schemaName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	if pkg == "" || pkg == "main" || strings.HasSuffix(pkg, "/textremind") {
+		return t.Name()
+	}
+	return strings.ToUpper(pkg[strings.LastIndex(pkg, "/")+1:]) + t.Name()
+}
+
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	if _, ok := schema["$ref"]; ok {
+		return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+	}
+	schema["nullable"] = true
+	return schema
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(b.schema(t.Elem()))
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nullable(map[string]interface{}{"type": "string", "format": "byte"})
+		}
+		return nullable(map[string]interface{}{"type": "array", "items": b.schema(t.Elem())})
+	case reflect.Map:
+		return nullable(map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())})
+	case reflect.Struct:
+		return b.component(t)
+	}
+	panic(fmt.Sprintf("openapi: can't describe %s", t))
+}
+
+// A reference to the schema for struct t, adding it to the components
+func (b *schemaBuilder) component(t reflect.Type) map[string]interface{} {
+	name := schemaName(t)
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	if _, ok := b.components[name]; ok {
+		return ref
+	}
+	if schema, ok := OPENAPI_SCHEMAS[name]; ok {
+		b.components[name] = schema
+		return ref
+	}
+	if t.Implements(jsonMarshaler) || reflect.PtrTo(t).Implements(jsonMarshaler) {
+		panic(fmt.Sprintf("openapi: %s encodes itself, add it to OPENAPI_SCHEMAS", t))
+	}
+	// placeholder for recursive types
+	b.components[name] = map[string]interface{}{}
+	props := make(map[string]interface{})
+	required := make([]interface{}, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := f.Name
+		if tag[0] != "" {
+			name = tag[0]
+		}
+		props[name] = b.schema(f.Type)
+		if !stringIn("omitempty", tag[1:]) {
+			required = append(required, name)
+		}
+	}
+	b.components[name] = map[string]interface{}{"type": "object", "properties": props, "required": required, "additionalProperties": false}
+	return ref
+}
+
+// Schema for an object whose fields are described like apiRoute.Response
+func (b *schemaBuilder) object(fields map[string]interface{}) map[string]interface{} {
+	props := make(map[string]interface{})
+	required := make([]interface{}, 0)
+	for name, v := range fields {
+		if strings.HasSuffix(name, "?") {
+			name = strings.TrimSuffix(name, "?")
+		} else {
+			required = append(required, name)
+		}
+		props[name] = b.schema(reflect.TypeOf(v))
+	}
+	sort.Slice(required, func(i, j int) bool { return required[i].(string) < required[j].(string) })
+	return map[string]interface{}{"type": "object", "properties": props, "required": required, "additionalProperties": false}
+}
+
+// Schema for the fields a route reads, like the map[string]string its
+// handler decodes
+func routeFields(fields string) (map[string]interface{}, []interface{}, bool) {
+	props := make(map[string]interface{})
+	required := make([]interface{}, 0)
+	vars := false
+	for _, name := range strings.Fields(fields) {
+		switch {
+		case name == "var.*":
+			vars = true
+			continue
+		case strings.HasSuffix(name, "*"):
+			name = strings.TrimSuffix(name, "*")
+			required = append(required, name)
+		}
+		schema := map[string]interface{}{"type": "string"}
+		if name == "file" {
+			schema["format"] = "binary"
+		}
+		props[name] = schema
+	}
+	return props, required, vars
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func (b *schemaBuilder) operation(route apiRoute) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary":     route.Summary,
+		"operationId": strings.Trim(strings.NewReplacer("/", "_", "{", "", "}", "", ".", "_").Replace(route.Path), "_"),
+		"tags":        []interface{}{strings.SplitN(strings.Trim(route.Path, "/"), "/", 2)[0]},
+	}
+
+	params := make([]interface{}, 0)
+	for _, m := range PATH_PARAM_RE.FindAllStringSubmatch(route.Path, -1) {
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+	props, required, vars := routeFields(route.Fields)
+	switch route.In {
+	case IN_QUERY:
+		for _, name := range sortedKeys(props) {
+			params = append(params, map[string]interface{}{"name": name, "in": "query", "required": stringIn(name, toStrings(required)), "schema": props[name]})
+		}
+	case IN_JSON, IN_MULTIPART, IN_URLENCODED:
+		schema := map[string]interface{}{"type": "object", "properties": props, "required": required, "additionalProperties": false}
+		if vars {
+			schema["additionalProperties"] = map[string]interface{}{"type": "string"}
+			schema["description"] = "Template variables are sent as var.<name>"
+		}
+		content := map[string]interface{}{route.In: map[string]interface{}{"schema": schema}}
+		op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if route.Scope != "" {
+		op["security"] = []interface{}{map[string]interface{}{}, map[string]interface{}{"apiKey": []interface{}{}}}
+		op["x-scope"] = route.Scope
+		op["description"] = "Send password, or an API key with the " + route.Scope + " scope."
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	switch {
+	case route.Produces != "":
+		success["content"] = map[string]interface{}{route.Produces: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	case route.Response != nil:
+		success["content"] = jsonContent(b.object(route.Response))
+	}
+	responses := map[string]interface{}{
+		fmt.Sprint(status): success,
+		"default":          map[string]interface{}{"description": "Error", "content": jsonContent(map[string]interface{}{"$ref": "#/components/schemas/Error"})},
+	}
+	for code, fields := range route.Other {
+		responses[fmt.Sprint(code)] = map[string]interface{}{"description": http.StatusText(code), "content": jsonContent(b.object(fields))}
+	}
+	op["responses"] = responses
+	return op
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toStrings(list []interface{}) []string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i], _ = v.(string)
+	}
+	return s
+}
+
+// The OpenAPI document for API_ROUTES, served from baseURL. It's built of
+// maps and slices as if decoded from JSON, so it can be checked with
+// ValidateSchema directly.
+func OpenAPISpec(baseURL string) map[string]interface{} {
+	b := &schemaBuilder{components: map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type":                 "object",
+			"properties":           map[string]interface{}{"message": map[string]interface{}{"type": "string"}},
+			"required":             []interface{}{"message"},
+			"additionalProperties": false,
+		},
+	}}
+	paths := make(map[string]interface{})
+	for _, route := range API_ROUTES {
+		item, ok := paths[route.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = b.operation(route)
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":       "TextRemind",
+			"version":     "1",
+			"description": "Schedule SMS reminders. Requests are authenticated with the user's number and password, or an API key as `Authorization: Bearer <key>` where a route allows it.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": baseURL}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas":         b.components,
+			"securitySchemes": map[string]interface{}{"apiKey": map[string]interface{}{"type": "http", "scheme": "bearer"}},
+		},
+	}
+}
+
+// Checks a value decoded from JSON against schema, resolving references to
+// spec's components. The error names the first field which doesn't match.
+func ValidateSchema(spec, schema map[string]interface{}, v interface{}) error {
+	return validateSchema(spec, schema, v, "$")
+}
+
+func validateSchema(spec, schema map[string]interface{}, v interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		components, _ := spec["components"].(map[string]interface{})
+		schemas, _ := components["schemas"].(map[string]interface{})
+		s, ok := schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: no schema %s", path, ref)
+		}
+		return validateSchema(spec, s, v, path)
+	}
+	if v == nil {
+		if schema["nullable"] == true || len(schema) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%s: is null", path)
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			if err := validateSchema(spec, s.(map[string]interface{}), v, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	typ, _ := schema["type"].(string)
+	ok := true
+	switch typ {
+	case "string":
+		_, ok = v.(string)
+	case "boolean":
+		_, ok = v.(bool)
+	case "number":
+		_, ok = v.(float64)
+	case "integer":
+		n, isNumber := v.(float64)
+		ok = isNumber && n == math.Trunc(n)
+	case "array":
+		items, isArray := v.([]interface{})
+		if !isArray {
+			return fmt.Errorf("%s: is not an array", path)
+		}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			if err := validateSchema(spec, itemSchema, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, isObject := v.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("%s: is not an object", path)
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: is missing %q", path, name)
+			}
+		}
+		for _, name := range sortedKeys(obj) {
+			s, ok := props[name].(map[string]interface{})
+			if !ok {
+				switch extra := schema["additionalProperties"].(type) {
+				case bool:
+					if !extra {
+						return fmt.Errorf("%s: has undocumented field %q", path, name)
+					}
+					continue
+				case map[string]interface{}:
+					s = extra
+				default:
+					continue
+				}
+			}
+			if err := validateSchema(spec, s, obj[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%s: should be %s", path, typ)
+	}
+	return nil
+}
+
+// Serves the OpenAPI document for the API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, OpenAPISpec(publicURL(r)), http.StatusOK)
+}
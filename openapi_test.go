@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	app := NewTestApp(t)
+	code, spec := app.Get("/openapi.json", nil)
+	if code != http.StatusOK || spec["openapi"] != OPENAPI_VERSION {
+		t.Fatalf("got status %d, %v", code, spec["openapi"])
+	}
+	if servers := spec["servers"].([]interface{}); servers[0].(map[string]interface{})["url"] != app.Server.URL {
+		t.Errorf("unexpected servers %v", servers)
+	}
+
+	// every reference resolves
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				if err := ValidateSchema(spec, v, nil); err != nil && strings.Contains(err.Error(), "no schema") {
+					t.Errorf("%s: %s doesn't resolve", path, ref)
+				}
+			}
+			for k, child := range v {
+				walk(path+"."+k, child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(path, child)
+			}
+		}
+	}
+	walk("$", spec)
+
+	// every documented route is served by a handler rather than the static
+	// files, and its errors match the document
+	ids := make(map[string]bool)
+	for _, route := range API_ROUTES {
+		op := spec["paths"].(map[string]interface{})[route.Path].(map[string]interface{})[strings.ToLower(route.Method)].(map[string]interface{})
+		id := op["operationId"].(string)
+		if ids[id] || op["summary"] == "" {
+			t.Errorf("%s: duplicate operationId %q or no summary", route.Path, id)
+		}
+		ids[id] = true
+		if route.In != IN_JSON {
+			continue
+		}
+		if code, res := app.PostJSON(route.Path, map[string]string{"number": "5550000000"}); code == http.StatusNotFound && res["message"] == nil {
+			t.Errorf("%s isn't routed", route.Path)
+		}
+	}
+	if code, res := app.Get("/check", url.Values{"number": {"5550000000"}}); code != http.StatusOK || res["verified"] != false {
+		t.Errorf("check: got status %d, %v", code, res)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	spec := OpenAPISpec("http://example.com")
+	schema := map[string]interface{}{"$ref": "#/components/schemas/Message"}
+	decode := func(s string) interface{} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	valid := `{"id": "abc", "to": "5558675309", "body": "Call mum", "time": 1420113600, "scheduled": true, "status": "scheduled", "vars": {"name": "mum"}, "fallback": null}`
+	if err := ValidateSchema(spec, schema, decode(valid)); err != nil {
+		t.Errorf("valid message rejected: %v", err)
+	}
+	for _, c := range []struct{ json, err string }{
+		{`{"id": "abc", "to": "5558675309", "body": "Call mum", "scheduled": true, "status": "scheduled"}`, `$: is missing "time"`},
+		{strings.Replace(valid, `"id"`, `"uuid"`, 1), `$: is missing "id"`},
+		{strings.Replace(valid, `"vars"`, `"variables"`, 1), `$: has undocumented field "variables"`},
+		{strings.Replace(valid, `1420113600`, `1420113600.5`, 1), `$.time: should be integer`},
+		{strings.Replace(valid, `"mum"}`, `3}`, 1), `$.vars.name: should be string`},
+		{strings.Replace(valid, `"Call mum"`, `null`, 1), `$.body: is null`},
+		{`[]`, `$: is not an object`},
+	} {
+		if err := ValidateSchema(spec, schema, decode(c.json)); err == nil || err.Error() != c.err {
+			t.Errorf("%s: got error %v, want %s", c.json, err, c.err)
+		}
+	}
+
+	list := spec["paths"].(map[string]interface{})["/messages/list"].(map[string]interface{})["post"].(map[string]interface{})
+	res := list["responses"].(map[string]interface{})["200"].(map[string]interface{})["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	if err := ValidateSchema(spec, res, decode(`{"messages": [`+valid+`, {"id": 1}]}`)); err == nil || !strings.HasPrefix(err.Error(), "$.messages[1]: ") {
+		t.Errorf("invalid message in list: got error %v", err)
+	}
+}
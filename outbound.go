@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// Lets calendar and webhook URLs reach this machine and private
+	// networks, for development with local servers
+	ALLOW_PRIVATE_URLS bool = os.Getenv("TEXTREMIND_ALLOW_PRIVATE_URLS") == "true"
+
+	ErrPrivateAddress = errors.New("address is not on the public internet")
+
+	// Ranges which aren't public but aren't covered by net.IP's methods
+	NON_PUBLIC_NETS = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96")
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+// Whether ip is on the public internet: not loopback, private, link-local,
+// multicast or otherwise reserved
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range NON_PUBLIC_NETS {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a URL's host is plainly not public: localhost or an address which
+// isn't. Other names are checked when connecting, see checkPublicAddress.
+func isPrivateHost(host string) bool {
+	if ALLOW_PRIVATE_URLS {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return !isPublicIP(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// Refuses connections to addresses which aren't public. It's called with
+// the resolved address of every connection, including redirects, so host
+// names resolving to private addresses are caught too.
+func checkPublicAddress(network, address string, _ syscall.RawConn) error {
+	if ALLOW_PRIVATE_URLS {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+// HTTP client for URLs given by users, which only connects to public
+// addresses. Proxies from the environment aren't used, as the proxy would
+// make the connection instead.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: checkPublicAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := isPublicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestPublicClientRefusesPrivateAddresses(t *testing.T) {
+	NewTestApp(t)
+	ALLOW_PRIVATE_URLS = false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := newPublicClient(time.Second)
+	if _, err := client.Get(server.URL); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("expected ErrPrivateAddress, got %v", err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "169.254.169.254", "[::1]"} {
+		if _, err := normalizeAddress(CHANNEL_WEBHOOK, "http://"+host+"/hook"); err != ErrInvalidDestination {
+			t.Errorf("webhook to %s: expected ErrInvalidDestination, got %v", host, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidQuietHours = errors.New("invalid quiet hours")
+
+// A daily window, in a user's time zone, when their messages aren't sent
+// unless they're urgent. Times are minutes after midnight; if End is before
+// Start the window spans midnight, e.g. 22:00 to 07:00.
+type QuietHours struct {
+	Start int
+	End   int
+}
+
+// Parses quiet hours from "HH:MM" start and end times
+func ParseQuietHours(start, end string) (*QuietHours, error) {
+	q := &QuietHours{}
+	var err error
+	if q.Start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if q.End, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if q.Start == q.End {
+		return nil, ErrInvalidQuietHours
+	}
+	return q, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrInvalidQuietHours
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// Stored as "HH:MM-HH:MM"
+func (q *QuietHours) String() string {
+	return formatClock(q.Start) + "-" + formatClock(q.End)
+}
+
+func (q *QuietHours) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"start":%q,"end":%q}`, formatClock(q.Start), formatClock(q.End))), nil
+}
+
+// If t is inside the window in loc, returns when the window ends, otherwise
+// the zero time
+func (q *QuietHours) Until(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	m := t.Hour()*60 + t.Minute()
+	inside := q.Start <= m && m < q.End
+	if q.End < q.Start {
+		inside = m >= q.Start || m < q.End
+	}
+	if !inside {
+		return time.Time{}
+	}
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.End/60, q.End%60, 0, 0, loc)
+	if !end.After(t) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, q.End/60, q.End%60, 0, 0, loc)
+	}
+	return end
+}
+
+// Get a user's quiet hours, or nil if they don't have any
+func GetQuietHours(number string) (*QuietHours, error) {
+	c := GetConn()
+	defer c.Close()
+	return getQuietHours(c, number)
+}
+
+func getQuietHours(c redis.Conn, number string) (*QuietHours, error) {
+	s, err := redis.String(c.Do("HGET", number, "quiet_hours"))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseStoredQuietHours(s), nil
+}
+
+// Parses quiet hours stored by SetQuietHours, nil if there are none
+func parseStoredQuietHours(s string) *QuietHours {
+	if len(s) != len("00:00-00:00") {
+		return nil
+	}
+	q, _ := ParseQuietHours(s[:5], s[6:])
+	return q
+}
+
+// Sets a user's quiet hours, or clears them if q is nil
+func SetQuietHours(number string, q *QuietHours) error {
+	c := GetConn()
+	defer c.Close()
+	var err error
+	if q == nil {
+		_, err = c.Do("HDEL", number, "quiet_hours")
+	} else {
+		_, err = c.Do("HSET", number, "quiet_hours", q.String())
+	}
+	return err
+}
+
+// When a message due at t must wait until, for the quiet hours of the user
+// it's for, or the zero time if it can be sent now. Messages to contacts
+// follow the contact's quiet hours in their time zone if they have an
+// account, otherwise their sender's.
+func quietUntil(c redis.Conn, msg *Message, t time.Time) (time.Time, error) {
+	if msg.Urgent {
+		return time.Time{}, nil
+	}
+	number, err := settingsUser(c, msg.To, msg.Owner)
+	if err != nil {
+		return time.Time{}, err
+	}
+	q, err := getQuietHours(c, number)
+	if err != nil || q == nil {
+		return time.Time{}, err
+	}
+	return q.Until(t, userLocation(c, number)), nil
+}
+
+// Reschedules a message for when quiet hours end, keeping when it was
+// first due
+func deferMessage(c redis.Conn, msg *Message, until time.Time) error {
+	c.Send("MULTI")
+	c.Send("ZADD", "messages", until.Unix(), msg.ID)
+	c.Send("HSETNX", msg.ID, "deferred_from", msg.Time)
+	c.Send("HSET", msg.ID, "time", until.Unix())
+	_, err := c.Do("EXEC")
+	return err
+}
+
+// Warning for a message scheduled for unix time at to each of recipients, if
+// it isn't urgent and dispatch will hold it for quiet hours, see quietUntil.
+// owner is who scheduled it, empty for users' messages to themselves. Also
+// returns when the last recipient's quiet hours end and when each held
+// recipient's do.
+func quietHoursWarning(owner string, recipients []string, at string, urgent bool) (string, int64, map[string]int64, error) {
+	t, err := strconv.ParseInt(at, 10, 64)
+	if err != nil || urgent {
+		return "", 0, nil, nil
+	}
+	c := GetConn()
+	defer c.Close()
+	var last time.Time
+	deferred := make(map[string]int64)
+	for _, to := range recipients {
+		until, err := quietUntil(c, &Message{To: to, Owner: owner}, time.Unix(t, 0))
+		if err != nil {
+			return "", 0, nil, err
+		}
+		if until.IsZero() {
+			continue
+		}
+		deferred[to] = until.Unix()
+		if until.After(last) {
+			last = until
+		}
+	}
+	if len(deferred) == 0 {
+		return "", 0, nil, nil
+	}
+
+	if owner == "" {
+		loc := userLocation(c, recipients[0])
+		msg := fmt.Sprintf("This time is in your quiet hours, so the message will be sent at %s unless it's marked urgent.", last.In(loc).Format("3:04 PM Mon Jan 2"))
+		return msg, last.Unix(), deferred, nil
+	}
+	loc := userLocation(c, owner)
+	msg := fmt.Sprintf("This time is in the quiet hours of %d of the recipients, so their messages will be held until as late as %s unless it's marked urgent.", len(deferred), last.In(loc).Format("3:04 PM Mon Jan 2"))
+	return msg, last.Unix(), deferred, nil
+}
+
+// Adds a quiet hours warning to a /schedule response, see quietHoursWarning.
+// Group messages also list when each held recipient's message will be sent.
+func addQuietHoursWarning(r *http.Request, res map[string]interface{}, owner string, recipients []string, data map[string]string) {
+	warning, until, deferred, err := quietHoursWarning(owner, recipients, data["time"], data["urgent"] == "true")
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not check quiet hours", Fields{"number": data["number"], "error": err})
+		return
+	}
+	if warning != "" {
+		res["warning"], res["deferred_until"] = warning, until
+		if owner != "" {
+			res["deferred"] = deferred
+		}
+	}
+}
+
+// Sets the user's quiet hours, {"number", "password", "start", "end"} with
+// times as "HH:MM" in their time zone. Empty times clear them.
+func setQuietHours(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	var q *QuietHours
+	if data["start"] != "" || data["end"] != "" {
+		var err error
+		if q, err = ParseQuietHours(data["start"], data["end"]); err != nil {
+			WriteJSONError(w, "Quiet hours need different start and end times, as HH:MM.", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := SetQuietHours(data["number"], q); err != nil {
+		LoggerFrom(r.Context()).Error("could not set quiet hours", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, ERR_S+"setting your quiet hours.", http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"quiet_hours": q}, http.StatusOK)
+}
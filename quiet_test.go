@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursUntil(t *testing.T) {
+	chicago, _ := time.LoadLocation("America/Chicago")
+	overnight, _ := ParseQuietHours("22:00", "07:00")
+	lunch, _ := ParseQuietHours("12:00", "13:30")
+	cases := []struct {
+		q     *QuietHours
+		at    time.Time
+		until time.Time
+	}{
+		{overnight, time.Date(2015, 1, 1, 21, 59, 0, 0, chicago), time.Time{}},
+		{overnight, time.Date(2015, 1, 1, 22, 0, 0, 0, chicago), time.Date(2015, 1, 2, 7, 0, 0, 0, chicago)},
+		{overnight, time.Date(2015, 1, 2, 3, 0, 0, 0, chicago), time.Date(2015, 1, 2, 7, 0, 0, 0, chicago)},
+		{overnight, time.Date(2015, 1, 2, 7, 0, 0, 0, chicago), time.Time{}},
+		{lunch, time.Date(2015, 1, 1, 13, 0, 0, 0, chicago), time.Date(2015, 1, 1, 13, 30, 0, 0, chicago)},
+		{lunch, time.Date(2015, 1, 1, 23, 0, 0, 0, chicago), time.Time{}},
+		// in UTC it's 04:00, but it's 22:00 for the user
+		{overnight, time.Date(2015, 1, 2, 4, 0, 0, 0, time.UTC), time.Date(2015, 1, 2, 7, 0, 0, 0, chicago)},
+		// the night the clocks go forward is an hour shorter
+		{overnight, time.Date(2015, 3, 8, 1, 0, 0, 0, chicago), time.Date(2015, 3, 8, 7, 0, 0, 0, chicago)},
+	}
+	for _, c := range cases {
+		if got := c.q.Until(c.at, chicago); !got.Equal(c.until) {
+			t.Errorf("%s at %s: got %s, expected %s", c.q, c.at, got, c.until)
+		}
+	}
+
+	for _, bad := range [][2]string{{"22:00", "22:00"}, {"10pm", "07:00"}, {"22:00", "24:00"}, {"", "07:00"}} {
+		if _, err := ParseQuietHours(bad[0], bad[1]); err != ErrInvalidQuietHours {
+			t.Errorf("%v: expected ErrInvalidQuietHours, got %v", bad, err)
+		}
+	}
+}
+
+func TestQuietHoursDeferDispatch(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	app.PostJSON("/set_timezone", map[string]string{"number": number, "password": password, "timezone": "America/Chicago"})
+	if code, res := app.PostJSON("/set_quiet_hours", map[string]string{"number": number, "password": password, "start": "22:00", "end": "07:00"}); code != http.StatusOK {
+		t.Fatalf("set quiet hours: got status %d, %v", code, res)
+	}
+	sent := len(app.Twilio.Messages())
+
+	// it's 6am in Chicago
+	now := app.Clock.Now().Unix()
+	at := strconv.FormatInt(now, 10)
+	_, res := app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": "Water the plants"})
+	wakeUp := time.Date(2015, 1, 1, 13, 0, 0, 0, time.UTC).Unix()
+	if res["warning"] == nil || res["deferred_until"] != float64(wakeUp) {
+		t.Errorf("expected a quiet hours warning, got %v", res)
+	}
+	_, res = app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": "Smoke alarm", "urgent": "true"})
+	if res["warning"] != nil {
+		t.Errorf("urgent message warned about quiet hours: %v", res)
+	}
+
+	app.Dispatch()
+	msgs := app.Twilio.Messages()[sent:]
+	if len(msgs) != 1 || msgs[0].Body != "Smoke alarm" {
+		t.Fatalf("expected only the urgent message during quiet hours, got %+v", msgs)
+	}
+	deferred, err := ListMessages(0)
+	if err != nil || len(deferred) != 1 {
+		t.Fatalf("expected one deferred message, got %v, %v", deferred, err)
+	}
+	if deferred[0].Time != wakeUp || deferred[0].DeferredFrom != now {
+		t.Errorf("message not deferred until quiet hours end: %+v", deferred[0])
+	}
+
+	app.Advance(time.Hour)
+	app.Dispatch()
+	msgs = app.Twilio.Messages()[sent:]
+	if len(msgs) != 2 || msgs[1].Body != "Water the plants" {
+		t.Errorf("deferred message not sent when quiet hours ended, got %+v", msgs)
+	}
+
+	app.PostJSON("/set_quiet_hours", map[string]string{"number": number, "password": password})
+	if q, _ := GetQuietHours(number); q != nil {
+		t.Errorf("quiet hours not cleared: %s", q)
+	}
+}
+
+func TestQuietHoursOfContacts(t *testing.T) {
+	app := NewTestApp(t)
+	owner, contact, password := "5558675309", "5551230001", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	app.PostJSON("/contacts/add", map[string]string{"number": owner, "password": password, "contact": contact, "name": "alice"})
+	app.ReceiveSMS("+1"+contact, "YES")
+	app.PostJSON("/groups/save", map[string]string{"number": owner, "password": password, "name": "team", "members": contact})
+	schedule := func(body string) map[string]interface{} {
+		at := strconv.FormatInt(app.Clock.Now().Unix(), 10)
+		code, res := app.PostJSON("/schedule", map[string]string{"number": owner, "password": password, "group": "team", "time": at, "body": body})
+		if code != http.StatusOK {
+			t.Fatalf("schedule group message: got status %d, %v", code, res)
+		}
+		app.Dispatch()
+		return res
+	}
+	// when the contact's message is held until, from the response's warning
+	deferredUntil := func(res map[string]interface{}) interface{} {
+		deferred, _ := res["deferred"].(map[string]interface{})
+		if res["warning"] == nil || deferred[contact] != res["deferred_until"] {
+			return nil
+		}
+		return deferred[contact]
+	}
+	sentTo := func(body string) bool {
+		for _, m := range app.Twilio.Messages() {
+			if m.Body == body {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the sender's quiet hours apply to contacts without an account
+	SetQuietHours(owner, &QuietHours{Start: 11 * 60, End: 13 * 60})
+	if until := deferredUntil(schedule("first")); until != float64(time.Date(2015, 1, 1, 13, 0, 0, 0, time.UTC).Unix()) {
+		t.Errorf("expected a warning for the sender's quiet hours, deferred until %v", until)
+	}
+	if sentTo("first") {
+		t.Error("message sent during the sender's quiet hours to a contact without an account")
+	}
+
+	// it's 6am in Chicago, in the contact's quiet hours but not the sender's
+	SetQuietHours(owner, nil)
+	verifyNumber(t, app, contact, password)
+	app.PostJSON("/set_timezone", map[string]string{"number": contact, "password": password, "timezone": "America/Chicago"})
+	app.PostJSON("/set_quiet_hours", map[string]string{"number": contact, "password": password, "start": "22:00", "end": "07:00"})
+	if until := deferredUntil(schedule("second")); until != float64(time.Date(2015, 1, 1, 13, 0, 0, 0, time.UTC).Unix()) {
+		t.Errorf("expected a warning for the contact's quiet hours, deferred until %v", until)
+	}
+	if sentTo("second") {
+		t.Error("message sent during the contact's quiet hours")
+	}
+	app.Advance(time.Hour)
+	app.Dispatch()
+	if !sentTo("second") {
+		t.Error("message not sent when the contact's quiet hours ended")
+	}
+}
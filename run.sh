@@ -1,3 +1,3 @@
 #!/usr/bin/env bash
 
-go run server.go dispatch.go middleware.go twilio.go verify.go
+go run $(ls *.go | grep -v _test.go) "$@"
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"log"
+	"github.com/scascketta/textremind/sms"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
+	// Process modes, see serve
+	MODE_ALL    = "all"
+	MODE_API    = "api"
+	MODE_WORKER = "worker"
+
+	LOCKED_S = "This account is locked."
+
 	ERR_S                = "Something went wrong while "
 	SCHEDULE_MSG_ERR_S   = ERR_S + "scheduling the message."
 	VERIFY_ERR_S         = ERR_S + "checking if phone number is verified."
@@ -20,39 +29,151 @@ const (
 	SET_PASSWORD_ERR_S   = ERR_S + "setting password."
 	CHECK_PASSWORD_ERR_S = ERR_S + "checking password."
 	DECODE_ERR_S         = ERR_S + "decoding request body."
+	TEMPLATE_ERR_S       = ERR_S + "updating templates."
 )
 
 var (
-	dbglogger *log.Logger = log.New(os.Stdout, "[DBG] ", log.LstdFlags|log.Lshortfile)
-	errlogger *log.Logger = log.New(os.Stderr, "[ERR] ", log.LstdFlags|log.Lshortfile)
+	logger *Logger = NewLogger(os.Stderr, ParseLevel(os.Getenv("TEXTREMIND_LOG_LEVEL")))
 
 	ENV_VARS    []string = []string{"TWILIO_ACCOUNT_SID", "TWILIO_AUTH_TOKEN", "TWILIO_NUMBER", "TEXTREMIND_ENV", "TEXTREMIND_ADDR", "TEXTREMIND_PORT"}
-	HTTP_CLIENT *Client  = &Client{URL: TWILIO_URL, HTTPClient: &http.Client{}}
+	HTTP_CLIENT *Client  = NewClient(TWILIO_URL)
 	ENV         string   = os.Getenv("TEXTREMIND_ENV")
 	SERVER_ADDR string   = os.Getenv("TEXTREMIND_ADDR")
 	SERVER_PORT string   = os.Getenv("TEXTREMIND_PORT")
+	REDIS_ADDR  string   = envOr("TEXTREMIND_REDIS_ADDR", ":6379")
+	MODES       []string = []string{MODE_ALL, MODE_API, MODE_WORKER}
+	// Where a worker serves health checks and metrics
+	WORKER_ADDR string = envOr("TEXTREMIND_WORKER_ADDR", ":9091")
+
+	// Required when not using a fake Twilio server in development
+	TWILIO_ENV_VARS []string = []string{"TWILIO_ACCOUNT_SID", "TWILIO_AUTH_TOKEN", "TWILIO_NUMBER"}
+	// Only required when running the HTTP server
+	SERVER_ENV_VARS []string = []string{"TEXTREMIND_ADDR", "TEXTREMIND_PORT"}
 )
 
 func main() {
-	checkRequiredEnvVars(ENV_VARS)
+	os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Runs the HTTP API, the dispatcher, or both depending on mode, for
+// `textremind serve`. Only one process should run the dispatcher, API
+// processes can be scaled out.
+func serve(mode string) {
+	if !stringIn(mode, MODES) {
+		logger.Fatal("unknown mode", Fields{"mode": mode, "modes": strings.Join(MODES, ",")})
+	}
+	checkRequiredEnvVars(requiredEnvVars(mode != MODE_WORKER))
+	logger.Info("starting", Fields{"mode": mode})
 
 	// Seed PRNG for generating verification codes
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	// Scheduled messages are dispatched in a new goroutine
-	go DispatchMessages()
+	if mode == MODE_WORKER {
+		go startWorkerServer(WORKER_ADDR)
+		DispatchMessages()
+		return
+	}
+	if mode == MODE_ALL {
+		// Scheduled messages are dispatched in a new goroutine
+		go DispatchMessages()
+		if os.Getenv("TEXTREMIND_WORKER_ADDR") != "" {
+			go startWorkerServer(WORKER_ADDR)
+		}
+	}
 
-	http.HandleFunc("/schedule", CorsMiddleware(DecodeJSONMiddleware(schedule)))
-	http.HandleFunc("/check", CorsMiddleware(check))
-	http.HandleFunc("/send_verification", CorsMiddleware(DecodeJSONMiddleware(sendVerification)))
-	http.HandleFunc("/check_verification", CorsMiddleware(checkVerification))
-	http.HandleFunc("/set_password", CorsMiddleware(DecodeJSONMiddleware(setPassword)))
-	http.Handle("/", http.FileServer(http.Dir("static/")))
+	http.Handle("/", newRouter())
 
 	startServer()
 }
 
-func checkRequiredEnvVars(env_vars []string) {
+// Serves the dispatcher's health checks and metrics on their own port
+func startWorkerServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/metrics", metrics)
+	logger.Info("worker HTTP server listening", Fields{"addr": addr})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Fatal("problem starting worker HTTP server", Fields{"error": err})
+	}
+}
+
+// Registers the app's handlers on a new mux
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schedule", RequestIDMiddleware(CorsMiddleware(APIKeyMiddleware(SCOPE_MESSAGES_WRITE, DecodeJSONMiddleware(schedule)))))
+	mux.HandleFunc("/schedule/bulk", RequestIDMiddleware(CorsMiddleware(APIKeyMiddleware(SCOPE_MESSAGES_WRITE, scheduleBulkUpload))))
+	mux.HandleFunc("/check", RequestIDMiddleware(CorsMiddleware(check)))
+	mux.HandleFunc("/send_verification", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(sendVerification))))
+	mux.HandleFunc("/check_verification", RequestIDMiddleware(CorsMiddleware(checkVerification)))
+	mux.HandleFunc("/set_password", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(setPassword))))
+	mux.HandleFunc("/templates/save", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(saveTemplate))))
+	mux.HandleFunc("/templates/list", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listTemplates))))
+	mux.HandleFunc("/templates/delete", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(deleteTemplate))))
+	mux.HandleFunc("/set_timezone", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(setTimezone))))
+	mux.HandleFunc("/set_quiet_hours", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(setQuietHours))))
+	mux.HandleFunc("/contacts/add", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(addContact))))
+	mux.HandleFunc("/contacts/list", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listContacts))))
+	mux.HandleFunc("/contacts/remove", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(removeContact))))
+	mux.HandleFunc("/groups/save", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(saveGroup))))
+	mux.HandleFunc("/groups/delete", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(deleteGroup))))
+	mux.HandleFunc("/group_message_status", RequestIDMiddleware(CorsMiddleware(APIKeyMiddleware(SCOPE_MESSAGES_READ, DecodeJSONMiddleware(groupMessageStatus)))))
+	mux.HandleFunc("/api_keys/create", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(createAPIKey))))
+	mux.HandleFunc("/api_keys/list", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listAPIKeys))))
+	mux.HandleFunc("/api_keys/revoke", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(revokeAPIKey))))
+	mux.HandleFunc("/destinations/add", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(addDestination))))
+	mux.HandleFunc("/destinations/verify", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(verifyDestination))))
+	mux.HandleFunc("/destinations/list", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listDestinations))))
+	mux.HandleFunc("/destinations/remove", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(removeDestination))))
+	mux.HandleFunc("/media/upload", RequestIDMiddleware(CorsMiddleware(uploadMedia)))
+	mux.HandleFunc("/media/", serveMedia)
+	mux.HandleFunc("/calendars/import", RequestIDMiddleware(CorsMiddleware(importCalendar)))
+	mux.HandleFunc("/calendars/subscribe", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(subscribeCalendar))))
+	mux.HandleFunc("/calendars/list", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listCalendars))))
+	mux.HandleFunc("/calendars/delete", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(deleteCalendar))))
+	mux.HandleFunc("/feed/url", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(feedURL))))
+	mux.HandleFunc("/feed/revoke", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(revokeFeedURL))))
+	mux.HandleFunc("/feed/", RequestIDMiddleware(serveFeed))
+	mux.HandleFunc("/webhooks/subscribe", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(subscribeEvents))))
+	mux.HandleFunc("/webhooks/list", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listEventSubscriptions))))
+	mux.HandleFunc("/webhooks/unsubscribe", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(unsubscribeEvents))))
+	mux.HandleFunc("/webhooks/deliveries", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listDeliveries))))
+	mux.HandleFunc("/webhooks/replay", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(replayDelivery))))
+	mux.HandleFunc("/escalations/save", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(saveEscalation))))
+	mux.HandleFunc("/escalations/list", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(listEscalations))))
+	mux.HandleFunc("/escalations/delete", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(deleteEscalation))))
+	mux.HandleFunc("/messages/list", RequestIDMiddleware(CorsMiddleware(APIKeyMiddleware(SCOPE_MESSAGES_READ, DecodeJSONMiddleware(listMessages)))))
+	mux.HandleFunc("/messages/cancel", RequestIDMiddleware(CorsMiddleware(APIKeyMiddleware(SCOPE_MESSAGES_WRITE, DecodeJSONMiddleware(cancelMessage)))))
+	mux.HandleFunc("/message_status", RequestIDMiddleware(CorsMiddleware(APIKeyMiddleware(SCOPE_MESSAGES_READ, DecodeJSONMiddleware(messageStatus)))))
+	mux.HandleFunc("/fallback/set", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(setFallback))))
+	mux.HandleFunc("/fallback/get", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(getFallbackRule))))
+	mux.HandleFunc("/fallback/clear", RequestIDMiddleware(CorsMiddleware(DecodeJSONMiddleware(clearFallback))))
+	mux.HandleFunc("/sms/inbound", RequestIDMiddleware(inboundSMS))
+	mux.HandleFunc("/sms/status", RequestIDMiddleware(smsStatus))
+	mux.HandleFunc("/openapi.json", RequestIDMiddleware(CorsMiddleware(serveOpenAPI)))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.Handle("/", http.FileServer(http.Dir("static/")))
+	return mux
+}
+
+// Environment variables needed by a command. Twilio credentials aren't
+// needed in development when sending to a fake Twilio server, see
+// `textremind fake-twilio`, and only the HTTP server needs an address.
+func requiredEnvVars(serving bool) []string {
+	fakeTwilio := ENV == "DEV" && os.Getenv("TWILIO_API_BASE") != ""
+	required := make([]string, 0, len(ENV_VARS))
+	for _, ev := range ENV_VARS {
+		if (fakeTwilio && stringIn(ev, TWILIO_ENV_VARS)) || (!serving && stringIn(ev, SERVER_ENV_VARS)) {
+			continue
+		}
+		required = append(required, ev)
+	}
+	return required
+}
+
+// Returns the environment variables in env_vars which are unset
+func missingEnvVars(env_vars []string) []string {
 	missing := make([]string, 0)
 
 	for _, ev := range env_vars {
@@ -60,55 +181,254 @@ func checkRequiredEnvVars(env_vars []string) {
 			missing = append(missing, ev)
 		}
 	}
+	return missing
+}
 
+func checkRequiredEnvVars(env_vars []string) {
+	missing := missingEnvVars(env_vars)
 	if len(missing) > 0 {
-		missing_msg := strings.Join(missing, "\n")
-		errlogger.Fatalf("The following environment variables are missing:\n%s", missing_msg)
+		logger.Fatal("required environment variables are missing", Fields{"missing": strings.Join(missing, ",")})
 	}
 }
 
 func startServer() {
 	if ENV == "DEV" {
-		dbglogger.Printf("HTTP server listening on %s:%s\n", SERVER_ADDR, SERVER_PORT)
+		logger.Info("HTTP server listening", Fields{"addr": SERVER_ADDR + ":" + SERVER_PORT})
 		err := http.ListenAndServe(SERVER_ADDR+":"+SERVER_PORT, nil)
 		if err != nil {
-			errlogger.Fatal("Problem starting HTTP server:", err)
+			logger.Fatal("problem starting HTTP server", Fields{"error": err})
 		}
 	} else {
 
 		// Start HTTPS and HTTP server, HTTP server redirects to HTTPS server.
 		go func() {
-			dbglogger.Printf("HTTPS server listening on %s:443\n", SERVER_ADDR)
+			logger.Info("HTTPS server listening", Fields{"addr": SERVER_ADDR + ":443"})
 			err := http.ListenAndServeTLS(SERVER_ADDR+":443", "textremind.net.cert", "textremind.net.key", nil)
 			if err != nil {
-				errlogger.Fatal("Problem starting HTTPS server:", err)
+				logger.Fatal("problem starting HTTPS server", Fields{"error": err})
 			}
 		}()
 
-		dbglogger.Printf("HTTP server listening on %s:80\n", SERVER_ADDR)
+		logger.Info("HTTP server listening", Fields{"addr": SERVER_ADDR + ":80"})
 		if err := http.ListenAndServe(SERVER_ADDR+":80", http.HandlerFunc(HTTPSRedirect)); err != nil {
-			errlogger.Fatal("Problem starting HTTP server:", err)
+			logger.Fatal("problem starting HTTP server", Fields{"error": err})
 		}
 	}
 }
 
-// Handle requests to schedule messages
+// Handle requests to schedule messages. If "template" names one of the
+// user's templates it's used instead of "body", with variables given as
+// "var.<name>" keys. If "group" is given the message goes to each of the
+// group's confirmed members, see scheduleGroup. "channel" and "destination"
+// choose how it's delivered, see messageChannel. Responds with an SMS's
+// encoding and number of segments, see sms.Analyze, and a warning if the
+// time is in the user's quiet hours and "urgent" isn't "true". With "ack"
+// the reminder is re-sent until the user replies, see messageAck, and with
+// "escalation" it's also sent to the policy's contacts, see escalate.
+// Idempotency keys are only claimed once the user is authenticated.
 func schedule(w http.ResponseWriter, r *http.Request, data map[string]string) {
-	matches, err := CheckPassword(data["to"], []byte(data["password"]))
+	number := data["to"]
+	if data["group"] != "" {
+		number = data["number"]
+	}
+	if !authenticate(w, r, number, data["password"]) {
+		return
+	}
+	if data["group"] != "" {
+		IdempotencyMiddleware(scheduleGroup)(w, r, data)
+	} else {
+		IdempotencyMiddleware(scheduleOwn)(w, r, data)
+	}
+}
+
+// Schedules a message to the authenticated user, see schedule
+func scheduleOwn(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	channel, ok := messageChannel(w, r, data["to"], data)
+	if !ok {
+		return
+	}
+	content, info, ok := messageContent(w, r, data["to"], data)
+	if !ok {
+		return
+	}
+	if data["escalation"] != "" {
+		data["ack"] = "true"
+	}
+	ack, ok := messageAck(w, data)
+	if !ok {
+		return
+	}
+	escalation, ok := messageEscalation(w, r, data["to"], data)
+	if !ok {
+		return
+	}
+	fields := append(append(append(channel, content...), ack...), escalation...)
+	id, err := scheduleMessage(r.Context(), data["to"], data["time"], fields...)
 	if err != nil {
-		errlogger.Println(err)
+		LoggerFrom(r.Context()).Error("could not schedule message", Fields{"to": data["to"], "error": err})
 		WriteJSONError(w, SCHEDULE_MSG_ERR_S, http.StatusInternalServerError)
 		return
 	}
-	if !matches {
-		WriteJSONError(w, "Password doesn't match.", http.StatusBadRequest)
-		return
+	res := map[string]interface{}{"id": id}
+	if info.Encoding != "" {
+		res["sms"] = info
+	}
+	addQuietHoursWarning(r, res, "", []string{data["to"]}, data)
+	WriteJSON(w, res, http.StatusOK)
+}
+
+// Gets the stored fields for the content of a message scheduled by owner:
+// its body, or one of owner's templates with variables, and images from
+// "media", a comma separated list of IDs from uploadMedia. Also returns how
+// it will be sent. Writes an error and returns false if the request is invalid or the
+// message is longer than "max_segments" or MAX_SEGMENTS.
+func messageContent(w http.ResponseWriter, r *http.Request, owner string, data map[string]string) ([]interface{}, sms.Info, bool) {
+	maxSegments := MAX_SEGMENTS
+	if n, err := strconv.Atoi(data["max_segments"]); err == nil && n > 0 && n < maxSegments {
+		maxSegments = n
+	}
+	media, err := parseMediaIDs(owner, data["media"])
+	if err != nil {
+		WriteJSONError(w, "Images can't be attached: "+err.Error()+".", http.StatusBadRequest)
+		return nil, sms.Info{}, false
+	}
+	isSMS := data["channel"] == "" || data["channel"] == CHANNEL_SMS
+	if len(media) > 0 && !isSMS {
+		WriteJSONError(w, "Images can only be sent by SMS.", http.StatusBadRequest)
+		return nil, sms.Info{}, false
+	}
+	check := func(body string) (sms.Info, error) {
+		switch {
+		case !isSMS:
+			return sms.Info{}, checkChannelBody(body)
+		case len(media) > 0:
+			return checkMMS(body)
+		}
+		return checkSegments(body, maxSegments)
+	}
+	var fields []interface{}
+	if len(media) > 0 {
+		fields = []interface{}{"media", strings.Join(media, ",")}
+	}
+	if data["urgent"] == "true" {
+		fields = append(fields, "urgent", "1")
+	}
+
+	if data["template"] == "" {
+		body := data["body"]
+		if TRANSLITERATE {
+			body = sms.Transliterate(body)
+		}
+		info, err := check(body)
+		if err != nil {
+			WriteJSONError(w, err.Error(), http.StatusBadRequest)
+			return nil, info, false
+		}
+		return append(fields, "body", body), info, true
 	}
 
-	err = ScheduleMessage(data["body"], data["to"], data["time"])
+	t, err := GetTemplate(owner, data["template"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No template with that name.", http.StatusBadRequest)
+		return nil, sms.Info{}, false
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not get template", Fields{"number": owner, "error": err})
+		WriteJSONError(w, SCHEDULE_MSG_ERR_S, http.StatusInternalServerError)
+		return nil, sms.Info{}, false
+	}
+
+	vars := make(map[string]string)
+	for k, v := range data {
+		if strings.HasPrefix(k, "var.") {
+			vars[strings.TrimPrefix(k, "var.")] = v
+		}
+	}
+	at, err := strconv.ParseInt(data["time"], 10, 64)
+	if err != nil {
+		WriteJSONError(w, "Time is not valid.", http.StatusBadRequest)
+		return nil, sms.Info{}, false
+	}
+	// catch missing variables and check the length now rather than when it's
+	// sent, though dates and times may render a little longer or shorter
+	preview, err := RenderTemplate(t.Body, vars, time.Unix(at, 0), UserLocation(owner))
+	if err != nil {
+		WriteJSONError(w, "Template can't be rendered: "+err.Error(), http.StatusBadRequest)
+		return nil, sms.Info{}, false
+	}
+	if TRANSLITERATE {
+		preview = sms.Transliterate(preview)
+	}
+	info, err := check(preview)
 	if err != nil {
-		errlogger.Println(err)
+		WriteJSONError(w, err.Error(), http.StatusBadRequest)
+		return nil, info, false
+	}
+	tfields, err := templateFields(t.Body, vars)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not encode template variables", Fields{"error": err})
 		WriteJSONError(w, SCHEDULE_MSG_ERR_S, http.StatusInternalServerError)
+		return nil, sms.Info{}, false
+	}
+	return append(fields, tfields...), info, true
+}
+
+// Creates or replaces a template, {"number", "password", "name", "body"}
+func saveTemplate(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := SaveTemplate(data["number"], Template{Name: data["name"], Body: data["body"]})
+	switch {
+	case err == ErrTooManyTemplates:
+		WriteJSONError(w, fmt.Sprintf("You can't have more than %d templates.", MAX_TEMPLATES), http.StatusBadRequest)
+	case err == ErrInvalidTemplate:
+		WriteJSONError(w, fmt.Sprintf("Templates need a name of at most %d characters and a body of at most %d.", MAX_TEMPLATE_NAME_LEN, MAX_TEMPLATE_LEN), http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidTemplate):
+		WriteJSONError(w, "Template is not valid: "+err.Error(), http.StatusBadRequest)
+	case err != nil:
+		LoggerFrom(r.Context()).Error("could not save template", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, TEMPLATE_ERR_S, http.StatusInternalServerError)
+	}
+}
+
+// Lists templates, {"number", "password"}
+func listTemplates(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	templates, err := ListTemplates(data["number"])
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not list templates", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, TEMPLATE_ERR_S, http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]interface{}{"templates": templates}, http.StatusOK)
+}
+
+// Deletes a template, {"number", "password", "name"}
+func deleteTemplate(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	err := DeleteTemplate(data["number"], data["name"])
+	if err == ErrNotFound {
+		WriteJSONError(w, "No template with that name.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not delete template", Fields{"number": data["number"], "error": err})
+		WriteJSONError(w, TEMPLATE_ERR_S, http.StatusInternalServerError)
+	}
+}
+
+// Sets the user's time zone, {"number", "password", "timezone"}
+func setTimezone(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if !authenticate(w, r, data["number"], data["password"]) {
+		return
+	}
+	if err := SetUserTimezone(data["number"], data["timezone"]); err != nil {
+		WriteJSONError(w, "Time zone is not valid.", http.StatusBadRequest)
 	}
 }
 
@@ -118,7 +438,7 @@ func check(w http.ResponseWriter, r *http.Request) {
 
 	verified, err := CheckNumberVerified(number)
 	if err != nil {
-		errlogger.Println(err)
+		LoggerFrom(r.Context()).Error("could not check if number is verified", Fields{"number": number, "error": err})
 		WriteJSONError(w, VERIFY_ERR_S, http.StatusInternalServerError)
 		return
 	}
@@ -127,16 +447,24 @@ func check(w http.ResponseWriter, r *http.Request) {
 }
 
 func sendVerification(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	log := LoggerFrom(r.Context())
+	if rejectLocked(w, r, data["number"]) {
+		return
+	}
 	code, err := MakeVerificationCode(data["number"])
+	if err == ErrVerifyTooSoon {
+		WriteJSONError(w, "Please wait a minute before requesting another verification code.", http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
-		errlogger.Println(err)
+		log.Error("could not make verification code", Fields{"number": data["number"], "error": err})
 		WriteJSONError(w, SEND_VERIFY_ERR_S, http.StatusInternalServerError)
 		return
 	}
 
-	err = SendTwilioMessage(HTTP_CLIENT, data["number"], fmt.Sprintf("Your verification code for TextRemind is %s.", code))
+	err = SendTwilioMessage(r.Context(), HTTP_CLIENT, data["number"], fmt.Sprintf("Your verification code for TextRemind is %s.", code))
 	if err != nil {
-		errlogger.Println(err)
+		log.Error("could not send verification code", Fields{"number": data["number"], "error": err})
 		WriteJSONError(w, SEND_VERIFY_ERR_S, http.StatusInternalServerError)
 	}
 }
@@ -147,8 +475,12 @@ func checkVerification(w http.ResponseWriter, r *http.Request) {
 	number := v.Get("number")
 
 	valid, err := CheckVerificationCode(code, number)
+	if err == ErrVerifyLocked {
+		WriteJSONError(w, "Too many wrong verification codes, please wait a few minutes and try again.", http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
-		errlogger.Println(err)
+		LoggerFrom(r.Context()).Error("could not check verification code", Fields{"number": number, "error": err})
 		WriteJSONError(w, CHECK_VERIFY_ERR_S, http.StatusInternalServerError)
 		return
 	}
@@ -161,11 +493,14 @@ func checkVerification(w http.ResponseWriter, r *http.Request) {
 }
 
 func setPassword(w http.ResponseWriter, r *http.Request, data map[string]string) {
+	if rejectLocked(w, r, data["number"]) {
+		return
+	}
 	only_number_verified, err := CheckOnlyNumberVerified(data["number"])
 	if only_number_verified {
 		err = SetPassword(data["number"], []byte(data["password"]))
 		if err != nil {
-			errlogger.Println(err)
+			LoggerFrom(r.Context()).Error("could not set password", Fields{"number": data["number"], "error": err})
 			WriteJSONError(w, SET_PASSWORD_ERR_S, http.StatusInternalServerError)
 		}
 		MarkNumberVerified(data["number"])
@@ -174,11 +509,81 @@ func setPassword(w http.ResponseWriter, r *http.Request, data map[string]string)
 	}
 }
 
+// Returns the value of environment variable name, or def if it's unset
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func stringIn(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Get connection to local redis server
+func DialRedis() (redis.Conn, error) {
+	return redis.DialTimeout("tcp", REDIS_ADDR, 5*time.Second, 5*time.Second, 5*time.Second)
+}
+
+// Checks number's password, or the API key the request was made with, see
+// APIKeyMiddleware. Writes an error and returns false if it doesn't match or
+// the account is locked.
+func authenticate(w http.ResponseWriter, r *http.Request, number, password string) bool {
+	if key, ok := APIKeyFrom(r.Context()); ok {
+		if key.Number != number {
+			WriteJSONError(w, "API key is for a different number.", http.StatusForbidden)
+			return false
+		}
+		return !rejectLocked(w, r, number)
+	}
+	if bearerToken(r) != "" {
+		WriteJSONError(w, "API keys can't be used for this request.", http.StatusForbidden)
+		return false
+	}
+	if rejectLocked(w, r, number) {
+		return false
+	}
+	matches, err := CheckPassword(number, []byte(password))
+	if err != nil && err != redis.ErrNil {
+		LoggerFrom(r.Context()).Error("could not check password", Fields{"number": number, "error": err})
+		WriteJSONError(w, CHECK_PASSWORD_ERR_S, http.StatusInternalServerError)
+		return false
+	}
+	if !matches {
+		WriteJSONError(w, "Password doesn't match.", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Writes an error and returns true if number's account is locked
+func rejectLocked(w http.ResponseWriter, r *http.Request, number string) bool {
+	locked, err := IsUserLocked(number)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("could not check if user is locked", Fields{"number": number, "error": err})
+		WriteJSONError(w, ERR_S+"checking the account.", http.StatusInternalServerError)
+		return true
+	}
+	if locked {
+		WriteJSONError(w, LOCKED_S, http.StatusForbidden)
+	}
+	return locked
+}
+
+// Get connection to storage, replaced by MemoryRedis.Conn in tests
+var GetConn func() redis.Conn = getRedisConn
+
 // Get connection to local redis server or exit
-func GetConn() redis.Conn {
-	c, err := redis.Dial("tcp", ":6379")
+func getRedisConn() redis.Conn {
+	c, err := DialRedis()
 	if err != nil {
-		errlogger.Fatal("Error connecting to redis server: ", err)
+		logger.Fatal("error connecting to redis server", Fields{"error": err})
 	}
 	return c
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"github.com/scascketta/textremind/sms"
+	"os"
+	"strconv"
+)
+
+var (
+	// Maximum segments a scheduled message may be split into, requests can
+	// lower it with "max_segments"
+	MAX_SEGMENTS int = envInt("TEXTREMIND_MAX_SEGMENTS", 3)
+	// Whether to replace characters like smart quotes which would make a
+	// message UCS-2 with GSM-7 lookalikes
+	TRANSLITERATE bool = os.Getenv("TEXTREMIND_TRANSLITERATE") != "false"
+)
+
+// Checks body fits in maxSegments, with an error explaining why not
+func checkSegments(body string, maxSegments int) (sms.Info, error) {
+	info := sms.Analyze(body)
+	if info.Segments <= maxSegments {
+		return info, nil
+	}
+	msg := fmt.Sprintf("Message is too long: it would be sent as %d texts, the limit is %d.", info.Segments, maxSegments)
+	if info.Encoding == sms.ENCODING_UCS2 {
+		msg += fmt.Sprintf(" It contains characters such as emoji which limit each text to %d characters.", sms.UCS2_SINGLE)
+	}
+	return info, fmt.Errorf("%s", msg)
+}
+
+// Gets an integer environment variable, or def if it's unset or invalid
+func envInt(name string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+// Package sms works out how a text message will be encoded and split into
+// segments when it's sent.
+package sms
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+// SMS encodings. Messages are sent as GSM-7 if every character is in the
+// GSM 03.38 alphabet, otherwise the whole message is sent as UCS-2.
+const (
+	ENCODING_GSM7 = "GSM-7"
+	ENCODING_UCS2 = "UCS-2"
+)
+
+// Characters per segment. Messages longer than one segment are split and
+// each part loses room to the header used to reassemble them.
+const (
+	GSM7_SINGLE    = 160
+	GSM7_MULTIPART = 153
+	UCS2_SINGLE    = 70
+	UCS2_MULTIPART = 67
+)
+
+var (
+	GSM7_BASIC = toSet("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+	// Sent as an escape followed by the character, so they take two septets
+	GSM7_EXTENDED = toSet("\f^{}\\[~]|€")
+
+	TRANSLITERATIONS = strings.NewReplacer(
+		"‘", "'", "’", "'", "‚", "'", "‛", "'", "′", "'",
+		"“", "\"", "”", "\"", "„", "\"", "‟", "\"", "″", "\"",
+		"–", "-", "—", "-", "‒", "-", "−", "-", "‐", "-",
+		"…", "...", "\u00a0", " ", "\u202f", " ", "\u200b", "",
+		"•", "-", "\t", " ",
+	)
+)
+
+// How a message will be sent
+type Info struct {
+	Encoding string `json:"encoding"`
+	// In GSM-7 septets or UCS-2 code units, extended GSM-7 characters and
+	// characters outside the BMP count twice
+	Length   int `json:"length"`
+	Segments int `json:"segments"`
+	// Sent with media, which isn't split into segments
+	MMS bool `json:"mms,omitempty"`
+}
+
+func toSet(chars string) map[rune]bool {
+	set := make(map[rune]bool)
+	for _, r := range chars {
+		set[r] = true
+	}
+	return set
+}
+
+// Whether s can be sent as GSM-7
+func IsGSM7(s string) bool {
+	for _, r := range s {
+		if !GSM7_BASIC[r] && !GSM7_EXTENDED[r] {
+			return false
+		}
+	}
+	return true
+}
+
+// Replaces common characters outside GSM-7 with lookalikes which aren't
+func Transliterate(s string) string {
+	return TRANSLITERATIONS.Replace(s)
+}
+
+// Works out the encoding and number of segments s will be sent as
+func Analyze(s string) Info {
+	// the size of each character, which can't be split across segments
+	sizes := make([]int, 0, len(s))
+	info := Info{Encoding: ENCODING_GSM7}
+	single, multipart := GSM7_SINGLE, GSM7_MULTIPART
+	if IsGSM7(s) {
+		for _, r := range s {
+			if GSM7_EXTENDED[r] {
+				sizes = append(sizes, 2)
+			} else {
+				sizes = append(sizes, 1)
+			}
+		}
+	} else {
+		info.Encoding = ENCODING_UCS2
+		single, multipart = UCS2_SINGLE, UCS2_MULTIPART
+		for _, r := range s {
+			sizes = append(sizes, len(utf16.Encode([]rune{r})))
+		}
+	}
+
+	for _, n := range sizes {
+		info.Length += n
+	}
+	if info.Length == 0 {
+		return info
+	}
+	if info.Length <= single {
+		info.Segments = 1
+		return info
+	}
+	used := 0
+	info.Segments = 1
+	for _, n := range sizes {
+		if used+n > multipart {
+			info.Segments++
+			used = 0
+		}
+		used += n
+	}
+	return info
+}
@@ -0,0 +1,48 @@
+package sms
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	for _, c := range []struct {
+		body     string
+		encoding string
+		length   int
+		segments int
+	}{
+		{"", ENCODING_GSM7, 0, 0},
+		{"Take out the trash", ENCODING_GSM7, 18, 1},
+		{strings.Repeat("a", 160), ENCODING_GSM7, 160, 1},
+		{strings.Repeat("a", 161), ENCODING_GSM7, 161, 2},
+		{strings.Repeat("a", 306), ENCODING_GSM7, 306, 2},
+		{strings.Repeat("a", 307), ENCODING_GSM7, 307, 3},
+		// extended characters take two septets and aren't split
+		{strings.Repeat("€", 80), ENCODING_GSM7, 160, 1},
+		{strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), ENCODING_GSM7, 306, 3},
+		{"Café à 5€", ENCODING_GSM7, 10, 1},
+		{"Lunch 🍕", ENCODING_UCS2, 8, 1},
+		{strings.Repeat("ş", 70), ENCODING_UCS2, 70, 1},
+		{strings.Repeat("ş", 71), ENCODING_UCS2, 71, 2},
+		// surrogate pairs aren't split
+		{strings.Repeat("ş", 66) + "🍕" + strings.Repeat("ş", 66), ENCODING_UCS2, 134, 3},
+		{strings.Repeat("🍕", 67), ENCODING_UCS2, 134, 3},
+	} {
+		info := Analyze(c.body)
+		if info.Encoding != c.encoding || info.Length != c.length || info.Segments != c.segments {
+			t.Errorf("Analyze(%q) = %+v, want %s, length %d, %d segments", c.body, info, c.encoding, c.length, c.segments)
+		}
+	}
+}
+
+func TestTransliterate(t *testing.T) {
+	in := "“Don’t forget” — it’s at 5…"
+	out := Transliterate(in)
+	if want := "\"Don't forget\" - it's at 5..."; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if !IsGSM7(out) {
+		t.Errorf("%q is not GSM-7", out)
+	}
+}
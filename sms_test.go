@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/scascketta/textremind/sms"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleSegmentLimit(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	at := strconv.FormatInt(app.Clock.Now().Add(time.Hour).Unix(), 10)
+	schedule := func(body, maxSegments string) (int, map[string]interface{}) {
+		return app.PostJSON("/schedule", map[string]string{"to": number, "password": password, "time": at, "body": body, "max_segments": maxSegments})
+	}
+
+	code, res := schedule("It’s time", "")
+	info, _ := res["sms"].(map[string]interface{})
+	if code != http.StatusOK || info["encoding"] != sms.ENCODING_GSM7 || info["segments"] != 1.0 {
+		t.Errorf("smart quote: got status %d, %v", code, res)
+	}
+
+	emoji := strings.Repeat("🎉", 80)
+	if code, res := schedule(emoji, ""); code != http.StatusOK || res["sms"].(map[string]interface{})["segments"] != 3.0 {
+		t.Errorf("3 segment message: got status %d, %v", code, res)
+	}
+	if code, res := schedule(emoji, "2"); code != http.StatusBadRequest || !strings.Contains(res["message"].(string), "emoji") {
+		t.Errorf("message over max_segments: got status %d, %v", code, res)
+	}
+	if code, _ := schedule(strings.Repeat(emoji, 2), "10"); code != http.StatusBadRequest {
+		t.Errorf("max_segments raised the limit: got status %d", code)
+	}
+
+	app.Advance(time.Hour)
+	app.Dispatch()
+	sent := false
+	for _, m := range app.Twilio.Messages() {
+		sent = sent || m.Body == "It's time"
+	}
+	if !sent {
+		t.Errorf("expected transliterated message to be sent, got %+v", app.Twilio.Messages())
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// users' time zones must load where the system has no zoneinfo
+	_ "time/tzdata"
+)
+
+var ErrNotFound = errors.New("not found")
+
+var ErrContentGone = errors.New("message content has been removed since it was dispatched")
+
+// A scheduled message, stored as a hash keyed by ID and a member of the
+// `messages` zset scored by delivery time
+type Message struct {
+	ID   string `json:"id"`
+	To   string `json:"to"`
+	Body string `json:"body"`
+	Time int64  `json:"time"`
+	// If set, Body is empty and the message is rendered from Template and
+	// Vars when dispatched, see RenderTemplate
+	Template string            `json:"template,omitempty"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	// IDs of attached images, see SaveMedia
+	Media []string `json:"media,omitempty"`
+	// How it's delivered, SMS if empty. Email and webhook messages go to
+	// Destination, see AddDestination.
+	Channel     string `json:"channel,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// Latest status reported by Twilio, e.g. "delivered"
+	Delivery string           `json:"delivery,omitempty"`
+	Fallback *FallbackOutcome `json:"fallback,omitempty"`
+	// Urgent messages are sent during quiet hours, others wait until they
+	// end and keep the time they were first due in DeferredFrom
+	Urgent       bool  `json:"urgent,omitempty"`
+	DeferredFrom int64 `json:"deferred_from,omitempty"`
+	// Set on reminders which need a reply, see awaitAck. They're re-sent
+	// every NagMinutes, at most MaxNags times, until acknowledged.
+	Ack          string `json:"ack,omitempty"`
+	NagMinutes   int    `json:"nag_minutes,omitempty"`
+	MaxNags      int    `json:"max_nags,omitempty"`
+	Sends        int    `json:"sends,omitempty"`
+	AckedAt      int64  `json:"acked_at,omitempty"`
+	AckedBy      string `json:"acked_by,omitempty"`
+	SnoozedUntil int64  `json:"snoozed_until,omitempty"`
+	// Contacts sent the reminder in turn while it's unacknowledged, and the
+	// index of the next step, see escalate
+	Escalation     []EscalationStep `json:"escalation,omitempty"`
+	EscalationStep int              `json:"escalation_step,omitempty"`
+	// ID of the calendar the message was imported from
+	Calendar string `json:"calendar,omitempty"`
+
+	// Whether the message is waiting to be dispatched
+	Scheduled bool   `json:"scheduled"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	SentAt    int64  `json:"sent_at,omitempty"`
+	// Set on messages sent to a contact: the sender, and for group messages
+	// the ID shared by the messages to each member
+	Owner     string `json:"owner,omitempty"`
+	Broadcast string `json:"broadcast,omitempty"`
+}
+
+// Message statuses
+const (
+	STATUS_SCHEDULED = "scheduled"
+	STATUS_RETRYING  = "retrying"
+	STATUS_SENT      = "sent"
+	// rejected by the provider, not retried
+	STATUS_FAILED = "failed"
+	// group message not sent because the member is no longer confirmed
+	STATUS_SKIPPED = "skipped"
+)
+
+// How long a sent message's status is kept
+const MESSAGE_RETENTION = 7 * 24 * time.Hour
+
+// Someone who has verified, or is verifying, their number
+type User struct {
+	Number string `json:"number"`
+	// Number verified and password set
+	Verified bool `json:"verified"`
+	// Number verified but password not yet set
+	OnlyNumberVerified bool `json:"only_number_verified"`
+	PasswordSet        bool `json:"password_set"`
+	Locked             bool `json:"locked"`
+	ScheduledMessages  int  `json:"scheduled_messages"`
+	// IANA time zone name, empty for UTC
+	Timezone   string      `json:"timezone,omitempty"`
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+}
+
+// Key of the set of IDs of messages scheduled for a number
+func userMessagesKey(number string) string {
+	return "user_messages:" + number
+}
+
+// Key of the set of IDs of messages a user has scheduled for their contacts
+func ownerMessagesKey(owner string) string {
+	return "owner_messages:" + owner
+}
+
+// Whether number has an account. Messages and calendars of users who have
+// been deleted are skipped.
+func userExists(c redis.Conn, number string) (bool, error) {
+	return redis.Bool(c.Do("EXISTS", number))
+}
+
+// Get a scheduled or recently sent message, or ErrNotFound
+func GetMessage(id string) (*Message, error) {
+	c := GetConn()
+	defer c.Close()
+	return getMessage(c, id)
+}
+
+func getMessage(c redis.Conn, id string) (*Message, error) {
+	score, err := redis.String(c.Do("ZSCORE", "messages", id))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	scheduled := err == nil
+	values, err := redis.Strings(c.Do("HGETALL", id))
+	if err != nil {
+		return nil, err
+	}
+	if !scheduled && len(values) == 0 {
+		return nil, ErrNotFound
+	}
+
+	msg := &Message{ID: id, Scheduled: scheduled, Status: STATUS_SCHEDULED}
+	if scheduled {
+		at, _ := strconv.ParseFloat(score, 64)
+		msg.Time = int64(at)
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		switch values[i] {
+		case "time":
+			if !scheduled {
+				msg.Time, _ = strconv.ParseInt(values[i+1], 10, 64)
+			}
+		case "status":
+			msg.Status = values[i+1]
+		case "attempts":
+			msg.Attempts, _ = strconv.Atoi(values[i+1])
+		case "last_error":
+			msg.LastError = values[i+1]
+		case "sent_at":
+			msg.SentAt, _ = strconv.ParseInt(values[i+1], 10, 64)
+		case "owner":
+			msg.Owner = values[i+1]
+		case "broadcast":
+			msg.Broadcast = values[i+1]
+		case "to":
+			msg.To = values[i+1]
+		case "body":
+			msg.Body = values[i+1]
+		case "template":
+			msg.Template = values[i+1]
+		case "media":
+			msg.Media = strings.Split(values[i+1], ",")
+		case "channel":
+			msg.Channel = values[i+1]
+		case "destination":
+			msg.Destination = values[i+1]
+		case "delivery":
+			msg.Delivery = values[i+1]
+		case "urgent":
+			msg.Urgent = values[i+1] == "1"
+		case "deferred_from":
+			msg.DeferredFrom, _ = strconv.ParseInt(values[i+1], 10, 64)
+		case "ack":
+			msg.Ack = values[i+1]
+		case "nag_minutes":
+			msg.NagMinutes, _ = strconv.Atoi(values[i+1])
+		case "max_nags":
+			msg.MaxNags, _ = strconv.Atoi(values[i+1])
+		case "sends":
+			msg.Sends, _ = strconv.Atoi(values[i+1])
+		case "acked_at":
+			msg.AckedAt, _ = strconv.ParseInt(values[i+1], 10, 64)
+		case "calendar":
+			msg.Calendar = values[i+1]
+		case "acked_by":
+			msg.AckedBy = values[i+1]
+		case "escalation":
+			if err := json.Unmarshal([]byte(values[i+1]), &msg.Escalation); err != nil {
+				return nil, err
+			}
+		case "escalation_step":
+			msg.EscalationStep, _ = strconv.Atoi(values[i+1])
+		case "snoozed_until":
+			msg.SnoozedUntil, _ = strconv.ParseInt(values[i+1], 10, 64)
+		case "fallback":
+			msg.Fallback = &FallbackOutcome{}
+			if err := json.Unmarshal([]byte(values[i+1]), msg.Fallback); err != nil {
+				return nil, err
+			}
+		case "vars":
+			if err := json.Unmarshal([]byte(values[i+1]), &msg.Vars); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return msg, nil
+}
+
+// List scheduled messages in delivery order. If before is positive, only
+// messages due before it are listed.
+func ListMessages(before int64) ([]*Message, error) {
+	c := GetConn()
+	defer c.Close()
+
+	max := "+inf"
+	if before > 0 {
+		max = "(" + strconv.FormatInt(before, 10)
+	}
+	ids, err := redis.Strings(c.Do("ZRANGEBYSCORE", "messages", "-inf", max))
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		msg, err := getMessage(c, id)
+		if err == ErrNotFound || (err == nil && !msg.Scheduled) {
+			// dispatched since listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Unschedule and delete a message, or ErrNotFound
+func CancelMessage(id string) error {
+	c := GetConn()
+	defer c.Close()
+
+	msg, err := getMessage(c, id)
+	if err != nil {
+		return err
+	}
+	if !msg.Scheduled {
+		return ErrNotFound
+	}
+	c.Send("MULTI")
+	queueCancel(c, msg)
+	if _, err = c.Do("EXEC"); err != nil {
+		return err
+	}
+	return cancelled(c, msg)
+}
+
+// Sends the commands unscheduling and deleting a scheduled message, to be
+// run in a transaction followed by cancelled
+func queueCancel(c redis.Conn, msg *Message) {
+	c.Send("ZREM", "messages", msg.ID)
+	c.Send("DEL", msg.ID)
+	c.Send("SREM", userMessagesKey(msg.To), msg.ID)
+	if msg.Owner != "" {
+		c.Send("SREM", ownerMessagesKey(msg.Owner), msg.ID)
+	}
+}
+
+// Sends the cancelled event for a message removed by queueCancel and
+// releases its media
+func cancelled(c redis.Conn, msg *Message) error {
+	msg.Scheduled = false
+	if err := emitEvent(c, EVENT_CANCELLED, msg, CLOCK.Now()); err != nil {
+		logger.Error("could not queue event", Fields{"event": EVENT_CANCELLED, "message_id": msg.ID, "error": err})
+	}
+	return releaseMedia(c, msg.Media, CLOCK.Now())
+}
+
+// Reschedule a message for delivery at unix time at, or ErrNotFound. Returns
+// ErrContentGone for failed messages whose body was removed when they finished.
+func RequeueMessage(id string, at int64) error {
+	c := GetConn()
+	defer c.Close()
+
+	msg, err := getMessage(c, id)
+	if err != nil {
+		return err
+	}
+	if msg.Status == STATUS_SENT {
+		return ErrNotFound
+	}
+	if msg.Body == "" && msg.Template == "" {
+		return ErrContentGone
+	}
+	c.Send("MULTI")
+	// finished messages expire after MESSAGE_RETENTION
+	c.Send("PERSIST", id)
+	c.Send("HDEL", id, "last_error", "attempts")
+	c.Send("ZADD", "messages", at, id)
+	c.Send("HMSET", id, "time", at, "status", STATUS_SCHEDULED)
+	c.Send("SADD", userMessagesKey(msg.To), id)
+	if msg.Owner != "" {
+		c.Send("SADD", ownerMessagesKey(msg.Owner), id)
+	}
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Get a user by number, or ErrNotFound if nothing is known about them
+func GetUser(number string) (*User, error) {
+	c := GetConn()
+	defer c.Close()
+
+	c.Send("MULTI")
+	c.Send("EXISTS", number)
+	c.Send("SISMEMBER", "verified", number)
+	c.Send("SISMEMBER", "only_number_verified", number)
+	c.Send("HEXISTS", number, "password")
+	c.Send("HEXISTS", number, "locked")
+	c.Send("SCARD", userMessagesKey(number))
+	c.Send("HGET", number, "timezone")
+	c.Send("HGET", number, "quiet_hours")
+	replies, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	var exists, verified, onlyNumberVerified, passwordSet, locked bool
+	var scheduled int
+	var timezone, quiet string
+	if _, err := redis.Scan(replies, &exists, &verified, &onlyNumberVerified, &passwordSet, &locked, &scheduled, &timezone, &quiet); err != nil {
+		return nil, err
+	}
+	if !exists && !verified && !onlyNumberVerified && scheduled == 0 {
+		return nil, ErrNotFound
+	}
+	return &User{
+		Number:             number,
+		Verified:           verified,
+		OnlyNumberVerified: onlyNumberVerified && !verified,
+		PasswordSet:        passwordSet,
+		Locked:             locked,
+		ScheduledMessages:  scheduled,
+		Timezone:           timezone,
+		QuietHours:         parseStoredQuietHours(quiet),
+	}, nil
+}
+
+// List users who have verified their number, sorted by number
+func ListUsers() ([]*User, error) {
+	c := GetConn()
+	verified, err := redis.Strings(c.Do("SMEMBERS", "verified"))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	onlyNumberVerified, err := redis.Strings(c.Do("SMEMBERS", "only_number_verified"))
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := append(verified, onlyNumberVerified...)
+	sort.Strings(numbers)
+	users := make([]*User, 0, len(numbers))
+	for i, number := range numbers {
+		if i > 0 && numbers[i-1] == number {
+			continue
+		}
+		user, err := GetUser(number)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// Locked users can't schedule messages, verify their number or set a password
+func SetUserLocked(number string, locked bool) error {
+	if _, err := GetUser(number); err != nil {
+		return err
+	}
+	c := GetConn()
+	defer c.Close()
+	var err error
+	if locked {
+		_, err = c.Do("HSET", number, "locked", "1")
+	} else {
+		_, err = c.Do("HDEL", number, "locked")
+	}
+	return err
+}
+
+func IsUserLocked(number string) (bool, error) {
+	c := GetConn()
+	defer c.Close()
+	return redis.Bool(c.Do("HEXISTS", number, "locked"))
+}
+
+// Delete everything stored about a user: their scheduled messages, including
+// those to contacts, contacts and groups, templates, destinations,
+// escalation and fallback rules, calendars, webhook subscriptions, feed and
+// API keys
+func DeleteUser(number string) error {
+	if _, err := GetUser(number); err != nil {
+		return err
+	}
+	c := GetConn()
+	defer c.Close()
+
+	for _, revoke := range []func(redis.Conn, string) error{revokeFeed, revokeAPIKeys, deleteCalendars, deleteContacts, deleteSubscriptions} {
+		if err := revoke(c, number); err != nil {
+			return err
+		}
+	}
+	msgs := make([]*Message, 0)
+	for _, key := range []string{userMessagesKey(number), ownerMessagesKey(number)} {
+		ids, err := redis.Strings(c.Do("SMEMBERS", key))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			msg, err := getMessage(c, id)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	c.Send("MULTI")
+	for _, msg := range msgs {
+		c.Send("ZREM", "messages", msg.ID)
+		c.Send("DEL", msg.ID, escalationLogKey(msg.ID))
+		c.Send("SREM", userMessagesKey(msg.To), msg.ID)
+		if msg.Broadcast != "" {
+			c.Send("DEL", broadcastKey(msg.Broadcast), broadcastMessagesKey(msg.Broadcast))
+		}
+	}
+	c.Send("DEL", userMessagesKey(number), ownerMessagesKey(number), templatesKey(number), destinationsKey(number), escalationsKey(number), unattachedMediaKey(number), number)
+	c.Send("SREM", "verified", number)
+	c.Send("SREM", "only_number_verified", number)
+	if _, err := c.Do("EXEC"); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := releaseMedia(c, msg.Media, CLOCK.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set a user's time zone to an IANA name such as "America/Chicago"
+func SetUserTimezone(number, timezone string) error {
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return err
+	}
+	c := GetConn()
+	defer c.Close()
+	_, err := c.Do("HSET", number, "timezone", timezone)
+	return err
+}
+
+// Get a user's time zone, UTC if they haven't set one
+func UserLocation(number string) *time.Location {
+	c := GetConn()
+	defer c.Close()
+	return userLocation(c, number)
+}
+
+func userLocation(c redis.Conn, number string) *time.Location {
+	name, err := redis.String(c.Do("HGET", number, "timezone"))
+	if err != nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// The user whose time zone and quiet hours apply to messages owner schedules
+// for to: to if they have an account, otherwise owner. owner is empty for
+// messages users schedule for themselves.
+func settingsUser(c redis.Conn, to, owner string) (string, error) {
+	if owner == "" || owner == to {
+		return to, nil
+	}
+	exists, err := userExists(c, to)
+	if err != nil || exists {
+		return to, err
+	}
+	return owner, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Limits on a user's templates
+const (
+	MAX_TEMPLATES         = 50
+	MAX_TEMPLATE_NAME_LEN = 64
+	MAX_TEMPLATE_LEN      = 1600
+)
+
+var (
+	ErrTooManyTemplates = errors.New("too many templates")
+	ErrInvalidTemplate  = errors.New("invalid template")
+	ErrTemplateTooLong  = errors.New("rendered template is too long")
+	// A scheduled message's template failed to render, which won't change
+	// by trying again
+	ErrRenderFailed = errors.New("could not render template")
+)
+
+// A named message body with variables, e.g. "Standup in {{.minutes}} min".
+// Besides variables given when scheduling, templates can use .Now (a
+// time.Time), .Date, .Time and .Weekday, all in the recipient's time zone,
+// or the sender's for contacts without an account.
+// Only text and fields like {{.name}} or {{.Now.Year}} are allowed, no
+// functions, pipelines or control structures.
+type Template struct {
+	Name string `json:"name"`
+	Body string `json:"body"`
+}
+
+// Key of the hash of a user's templates, by name
+func templatesKey(number string) string {
+	return "templates:" + number
+}
+
+func parseTemplate(name, body string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range t.Tree.Root.Nodes {
+		if !allowedTemplateNode(node) {
+			return nil, fmt.Errorf("only variables like {{.name}} are allowed, not %s", node)
+		}
+	}
+	return t, nil
+}
+
+// Whether node is text or a single field with no arguments
+func allowedTemplateNode(node parse.Node) bool {
+	switch node := node.(type) {
+	case *parse.TextNode:
+		return true
+	case *parse.ActionNode:
+		pipe := node.Pipe
+		if len(pipe.Decl) != 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+			return false
+		}
+		_, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode)
+		return ok
+	}
+	return false
+}
+
+// Writer which fails once more than max bytes are written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, ErrTemplateTooLong
+	}
+	return b.Buffer.Write(p)
+}
+
+// Renders a template body with vars and the computed values at now in loc.
+// Returns an error wrapping ErrTemplateTooLong if the result is longer than
+// MAX_TEMPLATE_LEN.
+func RenderTemplate(body string, vars map[string]string, now time.Time, loc *time.Location) (string, error) {
+	t, err := parseTemplate("message", body)
+	if err != nil {
+		return "", err
+	}
+	now = now.In(loc)
+	data := map[string]interface{}{
+		"Now":     now,
+		"Date":    now.Format("Mon Jan 2"),
+		"Time":    now.Format("3:04 PM"),
+		"Weekday": now.Weekday().String(),
+	}
+	for k, v := range vars {
+		data[k] = v
+	}
+	buf := &limitedBuffer{max: MAX_TEMPLATE_LEN}
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Creates or replaces a user's template
+func SaveTemplate(number string, t Template) error {
+	if t.Name == "" || len(t.Name) > MAX_TEMPLATE_NAME_LEN || t.Body == "" || len(t.Body) > MAX_TEMPLATE_LEN {
+		return ErrInvalidTemplate
+	}
+	if _, err := parseTemplate(t.Name, t.Body); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTemplate, err)
+	}
+
+	c := GetConn()
+	defer c.Close()
+	exists, err := redis.Bool(c.Do("HEXISTS", templatesKey(number), t.Name))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		n, err := redis.Int(c.Do("HLEN", templatesKey(number)))
+		if err != nil {
+			return err
+		}
+		if n >= MAX_TEMPLATES {
+			return ErrTooManyTemplates
+		}
+	}
+	_, err = c.Do("HSET", templatesKey(number), t.Name, t.Body)
+	return err
+}
+
+// Get a user's template by name, or ErrNotFound
+func GetTemplate(number, name string) (*Template, error) {
+	c := GetConn()
+	defer c.Close()
+	body, err := redis.String(c.Do("HGET", templatesKey(number), name))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Template{Name: name, Body: body}, nil
+}
+
+// List a user's templates sorted by name
+func ListTemplates(number string) ([]Template, error) {
+	c := GetConn()
+	defer c.Close()
+	values, err := redis.Strings(c.Do("HGETALL", templatesKey(number)))
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]Template, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		templates = append(templates, Template{Name: values[i], Body: values[i+1]})
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// Delete a user's template, or ErrNotFound
+func DeleteTemplate(number, name string) error {
+	c := GetConn()
+	defer c.Close()
+	n, err := redis.Int(c.Do("HDEL", templatesKey(number), name))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	loc, _ := time.LoadLocation("America/Chicago")
+	now := time.Date(2015, 3, 2, 3, 30, 0, 0, time.UTC) // still Sunday in Chicago
+	out, err := RenderTemplate("Standup in {{.minutes}} min ({{.Weekday}} {{.Time}})", map[string]string{"minutes": "5"}, now, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Standup in 5 min (Sunday 9:30 PM)"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+
+	if _, err := RenderTemplate("Join at {{.link}}", nil, now, loc); err == nil {
+		t.Error("missing variable did not cause an error")
+	}
+	if _, err := RenderTemplate("{{.x}}", map[string]string{"x": strings.Repeat("a", MAX_TEMPLATE_LEN+1)}, now, loc); !errors.Is(err, ErrTemplateTooLong) {
+		t.Errorf("expected ErrTemplateTooLong, got %v", err)
+	}
+}
+
+func TestSaveTemplateOnlyAllowsFields(t *testing.T) {
+	NewTestApp(t)
+	for _, body := range []string{
+		"{{range 1000000000}}spam{{end}}",
+		"{{if .x}}y{{end}}",
+		"{{printf \"%s\" .x}}",
+		"{{.x | html}}",
+		"{{$y := .x}}",
+		"{{.Now.Format \"Jan 2\"}}",
+	} {
+		if err := SaveTemplate("5558675309", Template{Name: "t", Body: body}); !errors.Is(err, ErrInvalidTemplate) {
+			t.Errorf("%q: expected ErrInvalidTemplate, got %v", body, err)
+		}
+	}
+	if err := SaveTemplate("5558675309", Template{Name: "t", Body: "In {{.minutes}} min, {{.Now.Year}}"}); err != nil {
+		t.Errorf("fields rejected: %v", err)
+	}
+}
+
+func TestScheduleFromTemplate(t *testing.T) {
+	app := NewTestApp(t)
+	number, password := "5558675309", "correct horse battery"
+	verifyNumber(t, app, number, password)
+	auth := func(data map[string]string) map[string]string {
+		data["number"], data["password"] = number, password
+		return data
+	}
+
+	if code, _ := app.PostJSON("/templates/save", auth(map[string]string{"name": "standup", "body": "Standup in {{.minutes"})); code != http.StatusBadRequest {
+		t.Errorf("invalid template saved: got status %d", code)
+	}
+	if code, _ := app.PostJSON("/templates/save", auth(map[string]string{"name": "standup", "body": "Standup in {{.minutes}} min, {{.Date}}"})); code != http.StatusOK {
+		t.Fatalf("save template: got status %d", code)
+	}
+	_, res := app.PostJSON("/templates/list", auth(map[string]string{}))
+	if templates, _ := res["templates"].([]interface{}); len(templates) != 1 {
+		t.Errorf("expected 1 template, got %v", res)
+	}
+	if code, _ := app.PostJSON("/set_timezone", auth(map[string]string{"timezone": "Asia/Tokyo"})); code != http.StatusOK {
+		t.Fatalf("set timezone: got status %d", code)
+	}
+
+	at := strconv.FormatInt(app.Clock.Now().Add(12*time.Hour).Unix(), 10)
+	schedule := map[string]string{"to": number, "password": password, "template": "standup", "time": at}
+	if code, _ := app.PostJSON("/schedule", schedule); code != http.StatusBadRequest {
+		t.Errorf("schedule without template variable: got status %d", code)
+	}
+	schedule["var.minutes"] = "5"
+	if code, _ := app.PostJSON("/schedule", schedule); code != http.StatusOK {
+		t.Fatalf("schedule from template: got status %d", code)
+	}
+
+	// editing or deleting the template doesn't change scheduled messages
+	app.PostJSON("/templates/delete", auth(map[string]string{"name": "standup"}))
+	app.Advance(12 * time.Hour)
+	app.Dispatch()
+	msgs := app.Twilio.Messages()
+	if got, want := msgs[len(msgs)-1].Body, "Standup in 5 min, Fri Jan 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTemplateInContactsTimezone(t *testing.T) {
+	app := NewTestApp(t)
+	owner, contact, password := "5558675309", "5551230001", "correct horse battery"
+	verifyNumber(t, app, owner, password)
+	app.PostJSON("/set_timezone", map[string]string{"number": owner, "password": password, "timezone": "Asia/Tokyo"})
+	app.PostJSON("/contacts/add", map[string]string{"number": owner, "password": password, "contact": contact, "name": "alice"})
+	app.ReceiveSMS("+1"+contact, "YES")
+	app.PostJSON("/groups/save", map[string]string{"number": owner, "password": password, "name": "team", "members": contact})
+	app.PostJSON("/templates/save", map[string]string{"number": owner, "password": password, "name": "now", "body": "It's {{.Time}}"})
+	schedule := map[string]string{"number": owner, "password": password, "group": "team", "template": "now", "time": strconv.FormatInt(app.Clock.Now().Unix(), 10)}
+
+	// contacts without an account get the sender's time zone
+	app.PostJSON("/schedule", schedule)
+	app.Dispatch()
+	verifyNumber(t, app, contact, password)
+	app.PostJSON("/set_timezone", map[string]string{"number": contact, "password": password, "timezone": "America/Chicago"})
+	app.PostJSON("/schedule", schedule)
+	app.Dispatch()
+
+	got := make([]string, 0)
+	for _, m := range app.Twilio.Messages() {
+		if m.To == contact && strings.HasPrefix(m.Body, "It's") {
+			got = append(got, m.Body)
+		}
+	}
+	if want := []string{"It's 9:00 PM", "It's 6:00 AM"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The app's HTTP handlers running against in-memory storage and fake
+// Twilio and SMTP servers, with a clock the test controls.
+type TestApp struct {
+	T      *testing.T
+	DB     *MemoryRedis
+	Twilio *FakeTwilio
+	SMTP   *FakeSMTP
+	Server *httptest.Server
+	Clock  *FakeClock
+}
+
+// Starts a TestApp, global storage and provider settings are restored when
+// the test finishes. Tests using it must not run in parallel.
+func NewTestApp(t *testing.T) *TestApp {
+	app := &TestApp{
+		T:      t,
+		DB:     NewMemoryRedis(),
+		Twilio: NewFakeTwilio("fake-auth-token", FakeConfig{}),
+		Clock:  NewFakeClock(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)),
+	}
+	twilioServer := httptest.NewServer(app.Twilio)
+	smtp, err := NewFakeSMTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.SMTP = smtp
+
+	oldGetConn, oldClient, oldNumber, oldToken, oldLogger, oldClock, oldMediaDir, oldSMTP, oldAllowPrivate := GetConn, HTTP_CLIENT, TWILIO_NUMBER, TWILIO_AUTH_TOKEN, logger, CLOCK, MEDIA_DIR, SMTP_ADDR, ALLOW_PRIVATE_URLS
+	CLOCK = app.Clock
+	// webhooks and calendars are served by httptest servers on loopback
+	ALLOW_PRIVATE_URLS = true
+	MEDIA_DIR = t.TempDir()
+	SMTP_ADDR = smtp.Addr()
+	GetConn = app.DB.Conn
+	HTTP_CLIENT = &Client{URL: twilioServer.URL + "/2010-04-01/Accounts/ACfake/Messages.json", HTTPClient: &http.Client{}}
+	TWILIO_NUMBER = "+15005550006"
+	TWILIO_AUTH_TOKEN = app.Twilio.AuthToken
+	logger = NewLogger(ioutil.Discard, ERROR)
+
+	app.Server = httptest.NewServer(openAPIValidator(t, newRouter()))
+	t.Cleanup(func() {
+		app.Server.Close()
+		twilioServer.Close()
+		smtp.Close()
+		GetConn, HTTP_CLIENT, TWILIO_NUMBER, TWILIO_AUTH_TOKEN, logger, CLOCK, MEDIA_DIR, SMTP_ADDR, ALLOW_PRIVATE_URLS = oldGetConn, oldClient, oldNumber, oldToken, oldLogger, oldClock, oldMediaDir, oldSMTP, oldAllowPrivate
+	})
+	return app
+}
+
+// Moves the app's clock forward
+func (a *TestApp) Advance(d time.Duration) {
+	a.Clock.Advance(d)
+}
+
+// Runs one pass of the dispatcher at the app's current time
+func (a *TestApp) Dispatch() {
+	c := GetConn()
+	defer c.Close()
+	if err := dispatchDue(c, a.Clock.Now()); err != nil {
+		a.T.Fatal(err)
+	}
+	for _, j := range DISPATCH_JOBS {
+		j.runNow(a.Clock.Now())
+	}
+}
+
+// POSTs data as JSON, returns the status code and decoded response
+func (a *TestApp) PostJSON(path string, data map[string]string) (int, map[string]interface{}) {
+	b, _ := json.Marshal(data)
+	res, err := http.Post(a.Server.URL+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		a.T.Fatal(err)
+	}
+	return a.decode(res)
+}
+
+// GETs path with query q, returns the status code and decoded response
+func (a *TestApp) Get(path string, q url.Values) (int, map[string]interface{}) {
+	res, err := http.Get(a.Server.URL + path + "?" + q.Encode())
+	if err != nil {
+		a.T.Fatal(err)
+	}
+	return a.decode(res)
+}
+
+// Texts body to the app from number, signed like Twilio's webhook. Returns
+// the status code and the reply, if any.
+func (a *TestApp) ReceiveSMS(from, body string) (int, string) {
+	params := url.Values{"From": {from}, "To": {TWILIO_NUMBER}, "Body": {body}}
+	target := a.Server.URL + "/sms/inbound"
+	req, _ := http.NewRequest("POST", target, strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", TwilioSignature(a.Twilio.AuthToken, target, params))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.T.Fatal(err)
+	}
+	defer res.Body.Close()
+	var reply twiML
+	xml.NewDecoder(res.Body).Decode(&reply)
+	return res.StatusCode, reply.Message
+}
+
+func (a *TestApp) decode(res *http.Response) (int, map[string]interface{}) {
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	data := make(map[string]interface{})
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &data); err != nil {
+			a.T.Fatalf("couldn't decode response %q: %s", body, err)
+		}
+	}
+	return res.StatusCode, data
+}
+
+// Checks requests to and responses from next against the OpenAPI document,
+// reporting differences as errors in t. Paths which aren't documented may
+// only serve static files.
+func openAPIValidator(t *testing.T, next http.Handler) http.Handler {
+	spec := OpenAPISpec("")
+	paths := spec["paths"].(map[string]interface{})
+	type pattern struct {
+		re    *regexp.Regexp
+		route apiRoute
+	}
+	patterns := make([]pattern, 0, len(API_ROUTES))
+	for _, route := range API_ROUTES {
+		re := PATH_PARAM_RE.ReplaceAllString(route.Path, "[^/]+")
+		patterns = append(patterns, pattern{regexp.MustCompile("^" + strings.Replace(re, ".", `\.`, -1) + "$"), route})
+	}
+	get := func(m interface{}, keys ...string) interface{} {
+		for _, k := range keys {
+			mm, _ := m.(map[string]interface{})
+			m = mm[k]
+		}
+		return m
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var route *apiRoute
+		for i := range patterns {
+			// fixed paths win over ones with parameters
+			if patterns[i].re.MatchString(r.URL.Path) && (route == nil || patterns[i].route.Path == r.URL.Path) {
+				route = &patterns[i].route
+			}
+		}
+		where := r.Method + " " + r.URL.Path
+		var op interface{}
+		if route != nil {
+			op = get(paths, route.Path, strings.ToLower(route.Method))
+		}
+
+		// checked once the response is known, as tests leave out required
+		// fields on purpose to check they're rejected
+		var requestErr error
+		switch {
+		case route == nil:
+		case route.In == IN_JSON:
+			b, _ := ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+			var data map[string]interface{}
+			schema, _ := get(op, "requestBody", "content", IN_JSON, "schema").(map[string]interface{})
+			if json.Unmarshal(b, &data) == nil {
+				requestErr = ValidateSchema(spec, schema, data)
+			}
+		case route.In == IN_QUERY:
+			documented := make(map[string]bool)
+			params, _ := get(op, "parameters").([]interface{})
+			for _, p := range params {
+				documented[get(p, "name").(string)] = true
+			}
+			for name := range r.URL.Query() {
+				if !documented[name] {
+					t.Errorf("%s: query parameter %q isn't in the OpenAPI document", where, name)
+				}
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+
+		contentType := rec.Header().Get("Content-Type")
+		isJSON := strings.HasPrefix(contentType, "application/json")
+		ok := rec.Code >= 200 && rec.Code <= 299
+		rejected := rec.Code >= 400 && rec.Code <= 499
+		if requestErr != nil && !(rejected && strings.Contains(requestErr.Error(), "is missing")) {
+			t.Errorf("%s: request doesn't match the OpenAPI document: %v", where, requestErr)
+		}
+		if route == nil {
+			if isJSON {
+				t.Errorf("%s isn't in the OpenAPI document", where)
+			}
+			return
+		}
+		if ok && r.Method != route.Method {
+			t.Errorf("%s: only %s is in the OpenAPI document", where, route.Method)
+		}
+		res := get(op, "responses", strconv.Itoa(rec.Code))
+		if res == nil {
+			res = get(op, "responses", "default")
+			if ok {
+				t.Errorf("%s: status %d isn't in the OpenAPI document", where, rec.Code)
+			}
+		}
+		content, _ := get(res, "content").(map[string]interface{})
+		switch {
+		case isJSON:
+			schema, _ := get(content, IN_JSON, "schema").(map[string]interface{})
+			var body interface{}
+			if schema == nil {
+				t.Errorf("%s: %d JSON response isn't in the OpenAPI document", where, rec.Code)
+			} else if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Errorf("%s: response isn't JSON: %v", where, err)
+			} else if err := ValidateSchema(spec, schema, body); err != nil {
+				t.Errorf("%s: %d response doesn't match the OpenAPI document: %v", where, rec.Code, err)
+			}
+		case ok && rec.Body.Len() == 0:
+			if len(content) > 0 {
+				t.Errorf("%s: empty response, the OpenAPI document has %v", where, content)
+			}
+		case ok:
+			documented := false
+			for t := range content {
+				documented = documented || strings.HasPrefix(contentType, strings.TrimSuffix(t, "*"))
+			}
+			if !documented {
+				t.Errorf("%s: %s response isn't in the OpenAPI document", where, contentType)
+			}
+		}
+	})
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Makes a random hex string from n bytes of crypto/rand, for secrets and
+// unguessable IDs such as API keys, feed tokens and media IDs
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("could not read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
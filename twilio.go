@@ -1,24 +1,80 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"github.com/garyburd/redigo/redis"
 	uuid "github.com/nu7hatch/gouuid"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// Twilio error codes we handle specially.
+// See: https://www.twilio.com/docs/api/errors
+const (
+	TWILIO_ERR_AUTH           = 20003
+	TWILIO_ERR_TOO_MANY       = 20429
+	TWILIO_ERR_INVALID_NUMBER = 21211
+	TWILIO_ERR_NOT_MOBILE     = 21614
+	TWILIO_ERR_UNSUBSCRIBED   = 21610
+	TWILIO_ERR_QUEUE_OVERFLOW = 30001
 )
 
 var (
-	TWILIO_ACCOUNT_SID string = os.Getenv("TWILIO_ACCOUNT_SID")
-	TWILIO_AUTH_TOKEN  string = os.Getenv("TWILIO_AUTH_TOKEN")
-	TWILIO_NUMBER      string = os.Getenv("TWILIO_NUMBER")
-	TWILIO_URL         string = fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", TWILIO_ACCOUNT_SID)
+	TWILIO_ACCOUNT_SID string = twilioEnv("TWILIO_ACCOUNT_SID", "ACfake")
+	TWILIO_AUTH_TOKEN  string = twilioEnv("TWILIO_AUTH_TOKEN", "fake-auth-token")
+	TWILIO_NUMBER      string = twilioEnv("TWILIO_NUMBER", "+15005550006")
+	// Overridden in development to point at `textremind fake-twilio`
+	TWILIO_API_BASE string = envOr("TWILIO_API_BASE", "https://api.twilio.com")
+	TWILIO_URL      string = fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", TWILIO_API_BASE, TWILIO_ACCOUNT_SID)
 )
 
+// Gets a Twilio setting from the environment. In development against a fake
+// Twilio server, unset settings fall back to fake values.
+func twilioEnv(name, fake string) string {
+	if os.Getenv("TEXTREMIND_ENV") == "DEV" && os.Getenv("TWILIO_API_BASE") != "" {
+		return envOr(name, fake)
+	}
+	return os.Getenv(name)
+}
+
 // Schedule a message to be sent to msg.To at msg.Time
-func ScheduleMessage(body, to, time string) error {
+func ScheduleMessage(ctx context.Context, body, to, time string) error {
+	_, err := scheduleMessage(ctx, to, time, "body", body)
+	return err
+}
+
+// Schedule a message rendered from a template body with vars when it's sent
+func ScheduleTemplateMessage(ctx context.Context, tmpl string, vars map[string]string, to, time string) (string, error) {
+	fields, err := templateFields(tmpl, vars)
+	if err != nil {
+		return "", err
+	}
+	return scheduleMessage(ctx, to, time, fields...)
+}
+
+// Stored fields of a message rendered from template body tmpl
+func templateFields(tmpl string, vars map[string]string) ([]interface{}, error) {
+	encoded, err := json.Marshal(vars)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{"template", tmpl, "vars", string(encoded)}, nil
+}
+
+// Stores a message to to with the given hash fields and schedules it for
+// time, returns its ID
+func scheduleMessage(ctx context.Context, to, time string, fields ...interface{}) (string, error) {
 	uid, _ := uuid.NewV4()
 	id := uid.String()
 
@@ -26,30 +82,206 @@ func ScheduleMessage(body, to, time string) error {
 	defer c.Close()
 
 	c.Send("MULTI")
-	c.Send("ZADD", "messages", time, id)
-	c.Send("HSET", id, "body", body)
-	c.Send("HSET", id, "to", to)
+	queueMessage(c, id, to, time, fields...)
 	_, err := c.Do("EXEC")
 	if err != nil {
-		return nil
+		return "", err
+	}
+	LoggerFrom(ctx).Info("message scheduled", Fields{"message_id": id, "to": to, "time": time})
+	emitMessageEvents(ctx, c, EVENT_SCHEDULED, id)
+	return id, nil
+}
+
+// Sends the commands storing a scheduled message, to be run in a transaction
+func queueMessage(c redis.Conn, id, to, time string, fields ...interface{}) {
+	c.Send("ZADD", "messages", time, id)
+	c.Send("HMSET", append([]interface{}{id, "to", to, "time", time, "status", STATUS_SCHEDULED}, fields...)...)
+	c.Send("SADD", userMessagesKey(to), id)
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "media":
+			attachMedia(c, strings.Split(fields[i+1].(string), ","))
+		case "owner":
+			c.Send("SADD", ownerMessagesKey(fields[i+1].(string)), id)
+		}
 	}
-	dbglogger.Printf("Message scheduled successfully for delivery at: %s", time)
-	return nil
 }
 
 type Client struct {
 	URL        string
 	HTTPClient *http.Client
+	// Timeout for each attempt, zero means only HTTPClient's timeout applies
+	Timeout time.Duration
+	// Number of extra attempts made after a retryable failure
+	MaxRetries int
+	// Base delay between attempts, doubled for each retry and jittered
+	Backoff time.Duration
+	// Optional, stops sending while the provider is down
+	Breaker *CircuitBreaker
+}
+
+// Returns a Client for url with production timeouts, retries and circuit breaker
+func NewClient(url string) *Client {
+	return &Client{
+		URL:        url,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		Timeout:    10 * time.Second,
+		MaxRetries: 3,
+		Backoff:    500 * time.Millisecond,
+		Breaker:    NewCircuitBreaker(5, time.Minute),
+	}
+}
+
+// Error response from the Twilio API
+type TwilioError struct {
+	StatusCode int    `json:"status"`
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	MoreInfo   string `json:"more_info"`
+	// Raw response body
+	Body       string `json:"-"`
+	retryAfter time.Duration
+}
+
+func (e *TwilioError) Error() string {
+	return fmt.Sprintf("SendTwilioMessage received statuscode %d, body: %s", e.StatusCode, e.Body)
+}
+
+// Whether the request may succeed if tried again later
+func (e *TwilioError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500 || e.Code == TWILIO_ERR_QUEUE_OVERFLOW
+}
+
+// Whether err is a Twilio error which will never succeed if retried, for
+// example an invalid or unsubscribed recipient
+func IsPermanentTwilioError(err error) bool {
+	var terr *TwilioError
+	return errors.As(err, &terr) && !terr.Retryable()
+}
+
+// Whether err is a Twilio error with the given error code
+func IsTwilioErrorCode(err error, code int) bool {
+	var terr *TwilioError
+	return errors.As(err, &terr) && terr.Code == code
+}
+
+// Parses an unsuccessful response into a *TwilioError
+func parseTwilioError(res *http.Response) *TwilioError {
+	body, _ := ioutil.ReadAll(res.Body)
+	terr := &TwilioError{}
+	// Not every error body is JSON (e.g. from proxies), the code is optional
+	json.Unmarshal(body, terr)
+	terr.StatusCode = res.StatusCode
+	terr.Body = string(body)
+	if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		terr.retryAfter = time.Duration(secs) * time.Second
+	}
+	return terr
 }
 
-// Send a SMS using Twilio to phone number to, and given body.
-func SendTwilioMessage(c *Client, to, body string) error {
+// Send a SMS using Twilio to phone number to, and given body, or a MMS if
+// there are mediaURLs for Twilio to fetch. Retryable failures (network
+// errors, 429 and 5xx responses) are retried with backoff.
+func SendTwilioMessage(ctx context.Context, c *Client, to, body string, mediaURLs ...string) error {
+	return sendTwilioMessage(ctx, c, to, body, "", mediaURLs)
+}
+
+// Like SendTwilioMessage, Twilio POSTs delivery updates to statusCallback if it's set
+func sendTwilioMessage(ctx context.Context, c *Client, to, body, statusCallback string, mediaURLs []string) error {
 	q := url.Values{}
 	q.Set("From", TWILIO_NUMBER)
 	q.Set("To", to)
 	q.Set("Body", body)
+	for _, u := range mediaURLs {
+		q.Add("MediaUrl", u)
+	}
+	if statusCallback != "" {
+		q.Set("StatusCallback", statusCallback)
+	}
+
+	return c.send(ctx, c.URL, q, to)
+}
+
+// Call phone number to using Twilio and read body aloud, retrying like
+// SendTwilioMessage
+func MakeTwilioCall(ctx context.Context, c *Client, to, body string) error {
+	b, err := xml.Marshal(twiMLSay{Say: body})
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("From", TWILIO_NUMBER)
+	q.Set("To", to)
+	q.Set("Twiml", string(b))
+
+	return c.send(ctx, c.callsURL(), q, to)
+}
+
+type twiMLSay struct {
+	XMLName xml.Name `xml:"Response"`
+	Say     string   `xml:"Say"`
+}
+
+// The Calls API URL of c's account, which is beside the Messages API
+func (c *Client) callsURL() string {
+	return strings.TrimSuffix(c.URL, "Messages.json") + "Calls.json"
+}
+
+// POSTs form values q to endpoint, retrying as configured
+func (c *Client) send(ctx context.Context, endpoint string, q url.Values, to string) error {
+	log := LoggerFrom(ctx)
+
+	var err error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := c.backoff(attempt, err)
+			log.Warn("retrying twilio request", Fields{"attempt": attempt, "delay_ms": delay.Seconds() * 1000, "error": err})
+			select {
+			case <-CLOCK.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
 
-	req, _ := http.NewRequest("POST", c.URL, strings.NewReader(q.Encode()))
+		if c.Breaker != nil {
+			if berr := c.Breaker.Allow(); berr != nil {
+				return berr
+			}
+		}
+		err = c.attempt(ctx, endpoint, q)
+		retryable := isRetryable(err)
+		if c.Breaker != nil {
+			if ctx.Err() != nil {
+				// a cancelled call tells us nothing about the provider
+				c.Breaker.Release()
+			} else {
+				// permanent errors mean the provider is up, so they don't trip the breaker
+				c.Breaker.Record(!retryable)
+			}
+		}
+		if err == nil {
+			log.Info("twilio request sent", Fields{"to": to, "endpoint": path.Base(endpoint), "attempts": attempt + 1, "body_length": len(q.Get("Body"))})
+			return nil
+		}
+		if !retryable || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Makes a single request, bounded by c.Timeout
+func (c *Client) attempt(ctx context.Context, endpoint string, q url.Values) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(q.Encode()))
+	if err != nil {
+		return err
+	}
 	req.SetBasicAuth(TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
@@ -60,10 +292,31 @@ func SendTwilioMessage(c *Client, to, body string) error {
 	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		errmsg, _ := ioutil.ReadAll(res.Body)
-		return fmt.Errorf("SendTwilioMessage received statuscode %d, body: %s", res.StatusCode, errmsg)
-	} else {
-		dbglogger.Printf("Twilio msg sent, body: %s\n", body)
+		return parseTwilioError(res)
 	}
 	return nil
 }
+
+// Delay before the given retry attempt: exponential backoff with equal
+// jitter, or the provider's Retry-After if it asked for longer
+func (c *Client) backoff(attempt int, err error) time.Duration {
+	max := c.Backoff << uint(attempt-1)
+	delay := max/2 + time.Duration(rand.Int63n(int64(max/2)+1))
+	var terr *TwilioError
+	if errors.As(err, &terr) && terr.retryAfter > delay {
+		delay = terr.retryAfter
+	}
+	return delay
+}
+
+// Network errors and timeouts are retryable, as are some Twilio errors
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var terr *TwilioError
+	if errors.As(err, &terr) {
+		return terr.Retryable()
+	}
+	return true
+}
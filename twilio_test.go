@@ -1,13 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestEnvVars(t *testing.T) {
-	checkRequiredEnvVars(ENV_VARS)
+	for _, ev := range ENV_VARS {
+		t.Setenv(ev, "set")
+	}
+	if missing := missingEnvVars(ENV_VARS); len(missing) != 0 {
+		t.Errorf("expected no missing env vars, got %v", missing)
+	}
+
+	t.Setenv("TWILIO_NUMBER", "")
+	if missing := missingEnvVars(ENV_VARS); len(missing) != 1 || missing[0] != "TWILIO_NUMBER" {
+		t.Errorf("expected TWILIO_NUMBER to be missing, got %v", missing)
+	}
 }
 
 func TestBadRequest(t *testing.T) {
@@ -15,7 +28,7 @@ func TestBadRequest(t *testing.T) {
 	rb := `{"code": 20003, "detail": "Your AccountSid or AuthToken was incorrect.", "message": "Authentication Error - No credentials provided", "more_info": "https://www.twilio.com/docs/errors/20003", "status": 401}`
 	c, server := MockClient(sc, []byte(rb), map[string]string{"Content-Type": "application/json"})
 	defer server.Close()
-	err := SendTwilioMessage(c, "5558675309", "asdf")
+	err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf")
 
 	if err != nil && err.Error() != fmt.Sprintf("SendTwilioMessage received statuscode %d, body: %s", sc, rb) {
 		t.Error(err)
@@ -27,7 +40,7 @@ func TestInternalError(t *testing.T) {
 	sc := 500
 	c, server := MockClient(sc, []byte(rb), map[string]string{"Content-Type": "application/json"})
 	defer server.Close()
-	err := SendTwilioMessage(c, "5558675309", "asdf")
+	err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf")
 
 	if err != nil && err.Error() != fmt.Sprintf("SendTwilioMessage received statuscode %d, body: %s", sc, rb) {
 		t.Error(err)
@@ -39,7 +52,7 @@ func TestOK(t *testing.T) {
 	sc := 200
 	c, server := MockClient(sc, []byte(rb), map[string]string{"Content-Type": "application/json"})
 	defer server.Close()
-	err := SendTwilioMessage(c, "5558675309", "asdf")
+	err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf")
 
 	if err != nil {
 		t.Error(err)
@@ -67,8 +80,127 @@ func TestRequestDetails(t *testing.T) {
 		w.WriteHeader(200)
 	})
 	defer server.Close()
-	err := SendTwilioMessage(c, "5558675309", "asdf")
+	err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf")
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestRetryThenSuccess(t *testing.T) {
+	attempts := 0
+	c, server := MockClientHandler(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer server.Close()
+	c.MaxRetries = 3
+	c.Backoff = time.Millisecond
+
+	if err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf"); err != nil {
+		t.Error(err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestPermanentErrorNotRetried(t *testing.T) {
+	attempts := 0
+	rb := `{"code": 21211, "message": "The 'To' number 5558675309 is not a valid phone number.", "status": 400}`
+	c, server := MockClientHandler(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(rb))
+	})
+	defer server.Close()
+	c.MaxRetries = 3
+	c.Backoff = time.Millisecond
+
+	err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf")
+	if !IsTwilioErrorCode(err, TWILIO_ERR_INVALID_NUMBER) || !IsPermanentTwilioError(err) {
+		t.Errorf("expected permanent invalid number error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c, server := MockClientHandler(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	defer server.Close()
+	c.Timeout = 10 * time.Millisecond
+
+	if err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	attempts := 0
+	c, server := MockClientHandler(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer server.Close()
+	c.Breaker = NewCircuitBreaker(2, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		SendTwilioMessage(context.Background(), c, "5558675309", "asdf")
+	}
+	if err := SendTwilioMessage(context.Background(), c, "5558675309", "asdf"); err != ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts before breaker opened, got %d", attempts)
+	}
+}
+
+func TestCircuitBreakerCooldownUsesClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+	oldClock := CLOCK
+	CLOCK = clock
+	defer func() { CLOCK = oldClock }()
+
+	b := NewCircuitBreaker(1, time.Minute)
+	b.Record(false)
+	if err := b.Allow(); err != ErrCircuitOpen {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	clock.Advance(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Errorf("trial call not allowed after cooldown: %v", err)
+	}
+}
+
+func TestCancelledTrialDoesNotCloseBreaker(t *testing.T) {
+	clock := NewFakeClock(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+	oldClock := CLOCK
+	CLOCK = clock
+	defer func() { CLOCK = oldClock }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, server := MockClientHandler(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer server.Close()
+	c.Breaker = NewCircuitBreaker(1, time.Minute)
+	c.Breaker.Record(false)
+	clock.Advance(time.Minute)
+
+	if err := SendTwilioMessage(ctx, c, "5558675309", "asdf"); err == nil {
+		t.Fatal("expected cancelled request to fail")
+	}
+	if state := c.Breaker.State(); state != "open" {
+		t.Errorf("expected breaker to stay open after a cancelled trial, got %s", state)
+	}
+	if err := c.Breaker.Allow(); err != nil {
+		t.Errorf("expected the next call to be let through as the trial, got %v", err)
+	}
+}
@@ -2,13 +2,33 @@ package main
 
 import (
 	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/subtle"
+	"errors"
 	"github.com/garyburd/redigo/redis"
 	"math/rand"
 	"strconv"
+	"time"
+)
+
+const (
+	// How long a verification code can be used for
+	VERIFY_CODE_TTL = 10 * time.Minute
+	// Minimum time between sending verification codes to a number
+	VERIFY_RESEND_INTERVAL = time.Minute
+	// Wrong codes allowed for a number in VERIFY_FAILURE_WINDOW before checks
+	// are refused until the window has passed
+	MAX_VERIFY_FAILURES   = 5
+	VERIFY_FAILURE_WINDOW = 15 * time.Minute
+)
+
+var (
+	ErrVerifyTooSoon = errors.New("verification code requested too soon after the last one")
+	ErrVerifyLocked  = errors.New("too many wrong verification codes")
 )
 
 func SetPassword(number string, password []byte) error {
 	c := GetConn()
+	defer c.Close()
 	hashed, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
 	if err != nil {
 		return err
@@ -19,6 +39,7 @@ func SetPassword(number string, password []byte) error {
 
 func CheckPassword(number string, password []byte) (bool, error) {
 	c := GetConn()
+	defer c.Close()
 	hashed, err := redis.String(c.Do("HGET", number, "password"))
 	if err != nil {
 		return false, err
@@ -28,33 +49,94 @@ func CheckPassword(number string, password []byte) (bool, error) {
 	return matches, nil
 }
 
+// Makes a new verification code for number, valid for VERIFY_CODE_TTL.
+// Returns ErrVerifyTooSoon if a code was made in the last VERIFY_RESEND_INTERVAL.
 func MakeVerificationCode(number string) (string, error) {
+	c := GetConn()
+	defer c.Close()
+
+	now := CLOCK.Now()
+	sent, err := redis.Int64(c.Do("HGET", number, "code_sent"))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if err == nil && now.Before(time.Unix(sent, 0).Add(VERIFY_RESEND_INTERVAL)) {
+		return "", ErrVerifyTooSoon
+	}
+
+	code := randomCode()
+	_, err = c.Do("HMSET", number, "code", code, "code_sent", now.Unix(), "code_expires", now.Add(VERIFY_CODE_TTL).Unix())
+	return code, err
+}
+
+// Makes a six digit verification code
+func randomCode() string {
 	code := ""
 	for i := 0; i < 6; i++ {
 		code += strconv.Itoa(rand.Intn(10))
 	}
-	c := GetConn()
-	_, err := c.Do("HSET", number, "code", code)
-	return code, err
+	return code
 }
 
+// Checks code against the unexpired code made for number. A code can only be
+// used once. Returns ErrVerifyLocked once MAX_VERIFY_FAILURES wrong codes have
+// been tried in VERIFY_FAILURE_WINDOW.
 func CheckVerificationCode(code, number string) (bool, error) {
 	c := GetConn()
+	defer c.Close()
 	actual_code, err := redis.String(c.Do("HGET", number, "code"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// count the check before comparing so concurrent guesses can't get past
+	// the limit, a correct code clears the count below
+	now := CLOCK.Now()
+	since, err := redis.Int64(c.Do("HGET", number, "code_failures_since"))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+	if err == redis.ErrNil || !now.Before(time.Unix(since, 0).Add(VERIFY_FAILURE_WINDOW)) {
+		if _, err := c.Do("HMSET", number, "code_failures", 0, "code_failures_since", now.Unix()); err != nil {
+			return false, err
+		}
+	}
+	failures, err := redis.Int(c.Do("HINCRBY", number, "code_failures", 1))
 	if err != nil {
 		return false, err
 	}
-	return actual_code == code, nil
+	if failures > MAX_VERIFY_FAILURES {
+		return false, ErrVerifyLocked
+	}
+
+	// codes made before expiry was tracked have no expiry and are still accepted
+	expires, err := redis.Int64(c.Do("HGET", number, "code_expires"))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+	if err == nil && !now.Before(time.Unix(expires, 0)) {
+		return false, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(actual_code)) != 1 {
+		return false, nil
+	}
+	_, err = c.Do("HDEL", number, "code", "code_expires", "code_failures", "code_failures_since")
+	return err == nil, err
 }
 
 func MarkOnlyNumberVerified(number string) error {
 	c := GetConn()
+	defer c.Close()
 	_, err := c.Do("SADD", "only_number_verified", number)
 	return err
 }
 
 func MarkNumberVerified(number string) error {
 	c := GetConn()
+	defer c.Close()
 	_, err := c.Do("SADD", "verified", number)
 	return err
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/scascketta/textremind/webhook"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	WEBHOOK_TIMEOUT = 10 * time.Second
+	// Most of a webhook response which is read
+	MAX_WEBHOOK_RESPONSE = 64 << 10
+)
+
+var WEBHOOK_CLIENT = newPublicClient(WEBHOOK_TIMEOUT)
+
+// POSTs payload as JSON to url signed with secret. Returns the start of the
+// response body, or an error if it wasn't a 2xx.
+func PostWebhook(ctx context.Context, url, secret string, payload interface{}) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	now := CLOCK.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TextRemind-Webhook")
+	req.Header.Set(webhook.TIMESTAMP_HEADER, strconv.FormatInt(now, 10))
+	req.Header.Set(webhook.SIGNATURE_HEADER, webhook.Sign(secret, now, body))
+
+	res, err := WEBHOOK_CLIENT.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, MAX_WEBHOOK_RESPONSE))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return b, &WebhookError{StatusCode: res.StatusCode}
+	}
+	return b, nil
+}
+
+// A webhook's response which wasn't a 2xx
+type WebhookError struct {
+	StatusCode int
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("webhook responded with statuscode %d", e.StatusCode)
+}
+
+// Client errors mean the webhook will never accept the request, e.g. 410 Gone,
+// except timeouts and rate limiting
+func (e *WebhookError) Permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
@@ -0,0 +1,50 @@
+// Package webhook signs the webhooks TextRemind sends, and checks them for
+// services receiving them.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers every webhook is sent with
+const (
+	SIGNATURE_HEADER = "X-TextRemind-Signature"
+	TIMESTAMP_HEADER = "X-TextRemind-Timestamp"
+)
+
+var (
+	ErrInvalidSignature = errors.New("webhook signature is not valid")
+	ErrOldTimestamp     = errors.New("webhook timestamp is too old")
+)
+
+// Signature of a webhook sent at timestamp, the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the destination's secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the signature of a webhook received at now with body, and that it
+// was sent within tolerance, so captured webhooks can't be replayed later
+func Verify(r *http.Request, secret string, body []byte, now time.Time, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(r.Header.Get(TIMESTAMP_HEADER), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(r.Header.Get(SIGNATURE_HEADER)), []byte(Sign(secret, ts, body))) {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return ErrOldTimestamp
+	}
+	return nil
+}
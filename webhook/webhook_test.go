@@ -0,0 +1,37 @@
+package webhook
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"type":"message.sent"}`)
+	signed := func(secret string, at time.Time) *http.Request {
+		r, _ := http.NewRequest("POST", "http://example.com/hook", nil)
+		r.Header.Set(TIMESTAMP_HEADER, strconv.FormatInt(at.Unix(), 10))
+		r.Header.Set(SIGNATURE_HEADER, Sign(secret, at.Unix(), body))
+		return r
+	}
+
+	if err := Verify(signed("s3cret", now), "s3cret", body, now.Add(time.Minute), 5*time.Minute); err != nil {
+		t.Errorf("valid webhook rejected: %v", err)
+	}
+	if err := Verify(signed("other", now), "s3cret", body, now, 5*time.Minute); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature for the wrong secret, got %v", err)
+	}
+	if err := Verify(signed("s3cret", now), "s3cret", []byte(`{}`), now, 5*time.Minute); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature for a changed body, got %v", err)
+	}
+	if err := Verify(signed("s3cret", now.Add(-time.Hour)), "s3cret", body, now, 5*time.Minute); err != ErrOldTimestamp {
+		t.Errorf("expected ErrOldTimestamp, got %v", err)
+	}
+	r := signed("s3cret", now)
+	r.Header.Del(TIMESTAMP_HEADER)
+	if err := Verify(r, "s3cret", body, now, 5*time.Minute); err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature without a timestamp, got %v", err)
+	}
+}